@@ -15,3 +15,35 @@ func ShelfFor(wareID api.WareID) fs.RelPath {
 		chunk1, chunk2, wareID.Hash,
 	))
 }
+
+/*
+	Return the dir in the content store which holds deduplicated file bodies
+	with the given content hash.
+
+	The content store is shared by shelves of all pack types, since the
+	content hashes of individual files do not depend on the pack format.
+	The hash is given encoded as the hash of a WareID is, algorithm prefix
+	and all, so bodies hashed with different algorithms never share a dir.
+	Entries within the dir are named by `ContentVariant`.
+*/
+func ContentFor(contentHash string) fs.RelPath {
+	chunk1, chunk2, _ := whutil.ChunkifyHash(api.WareID{Hash: contentHash})
+	return fs.MustRelPath(fmt.Sprintf("content/%s/%s/%s",
+		chunk1, chunk2, contentHash,
+	))
+}
+
+/*
+	Return the name of an entry in a `ContentFor` dir.
+
+	Hardlinked entries share their inode with every shelf that links them,
+	so the attributes stored on the inode (ownership, permissions, and mtime)
+	are part of their name; reflinked entries share only data blocks, and so
+	a single entry serves every variation of attributes.
+*/
+func ContentVariant(fmeta fs.Metadata, shareInode bool) string {
+	if !shareInode {
+		return "data"
+	}
+	return fmt.Sprintf("%d-%d-%o-%d", fmeta.Uid, fmeta.Gid, fmeta.Perms, fmeta.Mtime.UnixNano())
+}
@@ -0,0 +1,26 @@
+package cache
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/rio/fs"
+)
+
+func TestShelfFor(t *testing.T) {
+	Convey("Shelves should be sharded by the hash's base58 digest", t, func() {
+		for _, tr := range []struct {
+			hash  string
+			shelf string
+		}{
+			{"8Ld5Wp7XvAnGLqmAeDtGjHbHHkF4", "tar/fileset/8Ld/5Wp/8Ld5Wp7XvAnGLqmAeDtGjHbHHkF4"},
+			{"sha256-8Ld5Wp7XvAnGLqmAeDtGjHbHHkF4", "tar/fileset/8Ld/5Wp/sha256-8Ld5Wp7XvAnGLqmAeDtGjHbHHkF4"},
+			{"blake3-G4fq2bCn9X1z", "tar/fileset/G4f/q2b/blake3-G4fq2bCn9X1z"},
+			{"blake3-G4", "tar/fileset/G4-/---/blake3-G4"},
+		} {
+			So(ShelfFor(api.WareID{Type: "tar", Hash: tr.hash}), ShouldResemble, fs.MustRelPath(tr.shelf))
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/polydawn/go-timeless-api/rio"
+	. "github.com/warpfork/go-errcat"
+
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/lib/treewalk"
+)
+
+/*
+	Summarizes the disk usage of the filesets in a cache.
+
+	LogicalBytes is the sum of the sizes of every file in every shelf, as if
+	each were a plain copy.  PhysicalBytes counts each inode once, anywhere in
+	the cache (shelves, content store, and anything else), so the difference
+	between the two is what hardlink deduplication saved.
+
+	Data blocks shared by reflinks are invisible from here: reflinked files
+	have distinct inodes, and are counted in full.
+*/
+type Stats struct {
+	Shelves       int   `refmt:"shelves"`
+	Files         int   `refmt:"files"`
+	LogicalBytes  int64 `refmt:"logicalBytes"`
+	PhysicalBytes int64 `refmt:"physicalBytes"`
+}
+
+/*
+	Walk the cache rooted at the given filesystem and total its usage.
+
+	Temp dirs of unpacks still in progress are skipped.
+	A cache which doesn't exist yet is simply empty.
+*/
+func GetStats(cacheFs fs.FS) (stats Stats, err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	type inode struct{ dev, ino uint64 }
+	seen := map[inode]struct{}{}
+	preVisit := func(filenode *fs.FilewalkNode) error {
+		if filenode.Err != nil {
+			return filenode.Err
+		}
+		segs := strings.Split(filenode.Info.Name.String(), "/")[1:]
+		if len(segs) > 0 && strings.HasPrefix(segs[0], ".tmp.") {
+			return treewalk.SkipNode
+		}
+		inShelf := len(segs) >= 5 && segs[1] == "fileset"
+		switch filenode.Info.Type {
+		case fs.Type_Dir:
+			if inShelf && len(segs) == 5 {
+				stats.Shelves++
+			}
+			return nil
+		case fs.Type_File:
+			// pass
+		default:
+			return nil
+		}
+		if inShelf {
+			stats.Files++
+			stats.LogicalBytes += filenode.Info.Size
+		}
+		fi, err := os.Lstat(cacheFs.BasePath().Join(filenode.Info.Name).String())
+		if err != nil {
+			return err
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			key := inode{uint64(st.Dev), uint64(st.Ino)}
+			if _, ok := seen[key]; ok {
+				return nil
+			}
+			seen[key] = struct{}{}
+		}
+		stats.PhysicalBytes += filenode.Info.Size
+		return nil
+	}
+	err = fs.Walk(cacheFs, preVisit, nil)
+	switch Category(err) {
+	case nil:
+		return stats, nil
+	case fs.ErrNotExists:
+		if _, err2 := cacheFs.LStat(fs.RelPath{}); Category(err2) == fs.ErrNotExists {
+			return Stats{}, nil
+		}
+		fallthrough
+	default:
+		return stats, Errorf(rio.ErrLocalCacheProblem, "error reading cache: %s", err)
+	}
+}
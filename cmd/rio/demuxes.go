@@ -6,15 +6,16 @@ import (
 	"github.com/polydawn/go-timeless-api/rio"
 	"github.com/polydawn/rio/transmat/git"
 	tartrans "github.com/polydawn/rio/transmat/tar"
+	"github.com/polydawn/rio/transmat/util"
 	ziptrans "github.com/polydawn/rio/transmat/zip"
 )
 
-func demuxPackTool(packType string) (rio.PackFunc, error) {
+func demuxPackTool(packType string) (util.PackRecordsFunc, error) {
 	switch packType {
 	case "tar":
-		return tartrans.Pack, nil
+		return tartrans.PackRecords, nil
 	case "zip":
-		return ziptrans.Pack, nil
+		return ziptrans.PackRecords, nil
 	default:
 		return nil, Errorf(rio.ErrUsage, "unsupported packtype %q", packType)
 	}
@@ -33,12 +34,12 @@ func demuxUnpackTool(packType string) (rio.UnpackFunc, error) {
 	}
 }
 
-func demuxScanTool(packType string) (rio.ScanFunc, error) {
+func demuxScanTool(packType string) (util.ScanRecordsFunc, error) {
 	switch packType {
 	case "tar":
-		return tartrans.Scan, nil
+		return tartrans.ScanRecords, nil
 	case "zip":
-		return ziptrans.Scan, nil
+		return ziptrans.ScanRecords, nil
 	default:
 		return nil, Errorf(rio.ErrUsage, "unsupported packtype %q", packType)
 	}
@@ -54,3 +55,51 @@ func demuxMirrorTool(packType string) (rio.MirrorFunc, error) {
 		return nil, Errorf(rio.ErrUsage, "unsupported packtype %q", packType)
 	}
 }
+
+func demuxWalkTool(packType string) (util.WalkFunc, error) {
+	switch packType {
+	case "tar":
+		return tartrans.Walk, nil
+	case "zip":
+		return ziptrans.Walk, nil
+	default:
+		return nil, Errorf(rio.ErrUsage, "unsupported packtype %q", packType)
+	}
+}
+
+func demuxConvertTool(packType string) (util.ConvertFunc, error) {
+	switch packType {
+	case "tar":
+		return tartrans.Convert, nil
+	case "zip":
+		return ziptrans.Convert, nil
+	default:
+		return nil, Errorf(rio.ErrUsage, "unsupported packtype %q", packType)
+	}
+}
+
+func demuxListTool(packType string) (util.ListFunc, error) {
+	switch packType {
+	case "tar":
+		return tartrans.List, nil
+	case "git":
+		return git.List, nil
+	case "zip":
+		return ziptrans.List, nil
+	default:
+		return nil, Errorf(rio.ErrUsage, "unsupported packtype %q", packType)
+	}
+}
+
+func demuxCatTool(packType string) (util.CatFunc, error) {
+	switch packType {
+	case "tar":
+		return tartrans.Cat, nil
+	case "git":
+		return git.Cat, nil
+	case "zip":
+		return ziptrans.Cat, nil
+	default:
+		return nil, Errorf(rio.ErrUsage, "unsupported packtype %q", packType)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/polydawn/refmt/obj/atlas"
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+)
+
+/*
+	Returns the WareID if the arg is one of a pack type we can list.
+	Anything else in a diff is taken to be a local path.
+*/
+func diffWareArg(arg string) (api.WareID, bool) {
+	wareID, err := api.ParseWareID(arg)
+	if err != nil {
+		return api.WareID{}, false
+	}
+	if _, err := demuxListTool(string(wareID.Type)); err != nil {
+		return api.WareID{}, false
+	}
+	return wareID, true
+}
+
+/*
+	Returns the records of one side of a diff: either a ware, which is
+	listed (and verified), or a local path, which is scanned as if packed
+	into the given pack type with the given filters.
+*/
+func diffSide(
+	ctx context.Context,
+	arg string,
+	packType api.PackType,
+	filt api.FilesetPackFilter,
+	warehouses []api.WarehouseLocation,
+	mon rio.Monitor,
+) (fshash.Bucket, error) {
+	if wareID, ok := diffWareArg(arg); ok {
+		listFunc, _ := demuxListTool(string(wareID.Type))
+		return listFunc(ctx, wareID, warehouses, mon)
+	}
+	if mon.Chan != nil {
+		close(mon.Chan)
+	}
+	if _, err := os.Lstat(arg); err != nil {
+		return nil, Errorf(rio.ErrUsage, "%q is neither a ware ID nor an existing path", arg)
+	}
+	bucket, _, err := scanPath(ctx, arg, packType, filt)
+	return bucket, err
+}
+
+/*
+	Returns the records of a local path as they would be if it were packed
+	into the given pack type with the given filters, and the WareID it
+	would have.
+
+	(The pack type can matter: e.g. tar only keeps mtimes to the second.)
+*/
+func scanPath(ctx context.Context, path string, packType api.PackType, filt api.FilesetPackFilter) (fshash.Bucket, api.WareID, error) {
+	packFunc, err := demuxPackTool(string(packType))
+	if err != nil {
+		return nil, api.WareID{}, err
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return nil, api.WareID{}, Recategorize(rio.ErrUsage, err)
+	}
+	wareID, bucket, err := packFunc(ctx, packType, path, filt, "", rio.Monitor{})
+	if err != nil {
+		return nil, api.WareID{}, err
+	}
+	return bucket, wareID, nil
+}
+
+func diffBuckets(prev, next fshash.Bucket) (changes []fshash.Change, err error) {
+	defer func() {
+		// Both buckets were already hashed, so this shouldn't happen; but just in case.
+		if rec := recover(); rec != nil {
+			if e, ok := rec.(fshash.ErrInvalidFilesystem); ok {
+				err = Errorf(rio.ErrWareCorrupt, "%s", e)
+				return
+			}
+			panic(rec)
+		}
+	}()
+	return fshash.Diff(prev, next), nil
+}
+
+// diffEntry is one line of `rio diff` output.
+type diffEntry struct {
+	Name   string   `refmt:"name"`
+	Change string   `refmt:"change"`
+	Fields []string `refmt:"fields,omitempty"`
+	Old    *lsEntry `refmt:"old,omitempty"`
+	New    *lsEntry `refmt:"new,omitempty"`
+}
+
+var diffEntryAtlas = atlas.MustBuild(
+	atlas.BuildEntry(diffEntry{}).StructMap().Autogenerate().Complete(),
+	atlas.BuildEntry(lsEntry{}).StructMap().Autogenerate().Complete(),
+)
+
+/*
+	Emits a record for each change, in path order.
+	In dumb format, each is a line as by describeChange.
+*/
+func emitDiff(oc *outputController, changes []fshash.Change) {
+	for _, change := range changes {
+		entry := diffEntry{
+			Change: string(change.Kind),
+			Fields: change.Fields,
+		}
+		if change.Old != nil {
+			prev := toLsEntry(*change.Old)
+			entry.Old = &prev
+			entry.Name = prev.Name
+		}
+		if change.New != nil {
+			next := toLsEntry(*change.New)
+			entry.New = &next
+			entry.Name = next.Name
+		}
+		oc.EmitRecord(describeChange(change), &entry, diffEntryAtlas)
+	}
+}
+
+/*
+	Returns a line describing the change, of the form
+
+		+ <name>
+		- <name>
+		~ <name> (<field>, <field>, ...)
+
+	for additions, removals, and modifications respectively.
+*/
+func describeChange(change fshash.Change) string {
+	switch change.Kind {
+	case fshash.Change_Added:
+		return "+ " + change.New.Name
+	case fshash.Change_Removed:
+		return "- " + change.Old.Name
+	case fshash.Change_Modified:
+		return fmt.Sprintf("~ %s (%s)", change.New.Name, strings.Join(change.Fields, ", "))
+	default:
+		panic("unreachable")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+
+	"github.com/alecthomas/units"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/polydawn/rio/transmat/mixins/limits"
+)
+
+// limitsRequest holds the `--limit-*` flags common to unpack and scan.
+type limitsRequest struct {
+	TotalSize units.Base2Bytes
+	Entries   int64
+	FileSize  units.Base2Bytes
+	Depth     int
+	Ratio     float64
+}
+
+func (req *limitsRequest) flags(cmd *kingpin.CmdClause) {
+	cmd.Flag("limit-total-size", "Fail if the ware's files add up to more than this (e.g. '10GiB').").
+		BytesVar(&req.TotalSize)
+	cmd.Flag("limit-entries", "Fail if the ware has more than this many entries.").
+		Int64Var(&req.Entries)
+	cmd.Flag("limit-file-size", "Fail if any file in the ware is bigger than this (e.g. '1GiB').").
+		BytesVar(&req.FileSize)
+	cmd.Flag("limit-depth", "Fail if any path in the ware is more than this many dirs deep.").
+		IntVar(&req.Depth)
+	cmd.Flag("limit-ratio", "Fail if the ware's files add up to more than this many times the size of the ware itself (after the first MiB).  Catches decompression bombs.").
+		Float64Var(&req.Ratio)
+}
+
+// Returns a context carrying the limits, if any were asked for.
+func (req limitsRequest) prepare(ctx context.Context) context.Context {
+	l := limits.Limits{
+		MaxTotalSize: int64(req.TotalSize),
+		MaxEntries:   req.Entries,
+		MaxFileSize:  int64(req.FileSize),
+		MaxDepth:     req.Depth,
+		MaxRatio:     req.Ratio,
+	}
+	if l == (limits.Limits{}) {
+		return ctx
+	}
+	return limits.WithLimits(ctx, l)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/polydawn/refmt/misc"
+	"github.com/polydawn/refmt/obj/atlas"
+	. "github.com/warpfork/go-errcat"
+
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/lib/treewalk"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+)
+
+// lsEntry is one line of `rio ls` output.
+type lsEntry struct {
+	Name        string `refmt:"name"`
+	Type        string `refmt:"type"`
+	Perms       string `refmt:"perms"`
+	Uid         int64  `refmt:"uid"`
+	Gid         int64  `refmt:"gid"`
+	Size        int64  `refmt:"size"`
+	Devmajor    int64  `refmt:"devmajor,omitempty"`
+	Devminor    int64  `refmt:"devminor,omitempty"`
+	Mtime       string `refmt:"mtime"`
+	Linkname    string `refmt:"linkname,omitempty"`
+	ContentHash string `refmt:"contentHash,omitempty"`
+}
+
+var lsEntryAtlas = atlas.MustBuild(
+	atlas.BuildEntry(lsEntry{}).StructMap().Autogenerate().Complete(),
+)
+
+/*
+	Emits a record for each entry in the bucket, in path order.
+
+	In dumb format, each is a line of the form
+
+		<type> <perms> <uid>:<gid> <size> <mtime> <contentHash> <name>[ -> <linkname>]
+
+	where devices show "major,minor" in place of size, and entries without
+	content show "-" in place of the hash.
+*/
+func emitListing(oc *outputController, bucket fshash.Bucket) (err error) {
+	defer func() {
+		// The bucket was already hashed, so this shouldn't happen; but just in case.
+		if rec := recover(); rec != nil {
+			if e, ok := rec.(fshash.ErrInvalidFilesystem); ok {
+				err = Errorf(rio.ErrWareCorrupt, "%s", e)
+				return
+			}
+			panic(rec)
+		}
+	}()
+	return treewalk.Walk(bucket.Iterator(), func(node treewalk.Node) error {
+		record := node.(fshash.RecordIterator).Record()
+		entry := toLsEntry(record)
+		size := strconv.FormatInt(entry.Size, 10)
+		if record.Metadata.Type == fs.Type_Device || record.Metadata.Type == fs.Type_CharDevice {
+			size = fmt.Sprintf("%d,%d", entry.Devmajor, entry.Devminor)
+		}
+		hash := entry.ContentHash
+		if hash == "" {
+			hash = "-"
+		}
+		line := fmt.Sprintf("%c %s %d:%d %s %s %s %s",
+			record.Metadata.Type, entry.Perms, entry.Uid, entry.Gid, size, entry.Mtime, hash, entry.Name)
+		if entry.Linkname != "" {
+			line += " -> " + entry.Linkname
+		}
+		oc.EmitRecord(line, &entry, lsEntryAtlas)
+		return nil
+	}, nil)
+}
+
+func toLsEntry(record fshash.Record) lsEntry {
+	fmeta := record.Metadata
+	entry := lsEntry{
+		Name:     record.Name,
+		Type:     fmeta.Type.String(),
+		Perms:    fmt.Sprintf("%04o", fmeta.Perms),
+		Uid:      int64(fmeta.Uid),
+		Gid:      int64(fmeta.Gid),
+		Size:     fmeta.Size,
+		Devmajor: fmeta.Devmajor,
+		Devminor: fmeta.Devminor,
+		Mtime:    fmeta.Mtime.UTC().Format(time.RFC3339Nano),
+		Linkname: fmeta.Linkname,
+	}
+	if record.ContentHash != nil {
+		entry.ContentHash = misc.Base58Encode(record.ContentHash)
+	}
+	return entry
+}
@@ -7,18 +7,29 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/polydawn/refmt"
 	"github.com/polydawn/refmt/json"
+	"github.com/polydawn/refmt/obj/atlas"
 	. "github.com/warpfork/go-errcat"
 	"gopkg.in/alecthomas/kingpin.v2"
 
 	api "github.com/polydawn/go-timeless-api"
 	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/cache"
+	"github.com/polydawn/rio/config"
 	"github.com/polydawn/rio/fs"
 	"github.com/polydawn/rio/fs/osfs"
 	"github.com/polydawn/rio/fsOp"
+	"github.com/polydawn/rio/transmat/mixins/filters"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+	"github.com/polydawn/rio/transmat/mixins/limits"
+	"github.com/polydawn/rio/transmat/mixins/statcache"
+	tartrans "github.com/polydawn/rio/transmat/tar"
+	"github.com/polydawn/rio/transmat/util"
+	ziptrans "github.com/polydawn/rio/transmat/zip"
 )
 
 func main() {
@@ -54,7 +65,26 @@ const (
 func Main(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
 	bhv := Parse(ctx, args, stdin, stdout, stderr)
 	err := bhv.action()
-	return rio.ExitCodeForError(err)
+	if err == nil {
+		return 0
+	}
+	return exitCodeForCategory(Category(err))
+}
+
+// Exit codes for rio's own error categories, which the API's table doesn't have.
+//  They carry on from the end of the API's numbering.
+var exitCodes = map[rio.ErrorCategory]int{
+	limits.ErrLimitExceeded: 14,
+}
+
+// Translates an errcat category into an exit code: rio's own, or else the API's.
+func exitCodeForCategory(category interface{}) int {
+	if c, ok := category.(rio.ErrorCategory); ok {
+		if code, ok := exitCodes[c]; ok {
+			return code
+		}
+	}
+	return rio.ExitCodeForCategory(category)
 }
 
 func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) behavior {
@@ -68,7 +98,7 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 	// Output control helper.
 	//  Declared early because we reference it in action thunks;
 	//  however its format field may not end up set until much lower in the file.
-	oc := &outputController{"", stdout, stderr, nil, sync.WaitGroup{}}
+	oc := &outputController{"", stdout, stderr, sync.WaitGroup{}}
 
 	// Args struct defs and flag declarations.
 	bhvs := map[string]*behavior{}
@@ -84,8 +114,18 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 		args := struct {
 			PackType                string // Pack type
 			Path                    string // Pack target path, abs or rel
-			Filter                  string // Filters for pack
-			TargetWarehouseLocation string // Warehouse address to push to
+			Filter                  string   // Filters for pack
+			Include                 []string // Path patterns to pack (if given, all else is left out)
+			Exclude                 []string // Path patterns to leave out of the pack
+			UidMap                  []string // Uid remappings, "containerID:hostID:size"
+			GidMap                  []string // Gid remappings, "containerID:hostID:size"
+			TargetWarehouseLocation string   // Warehouse address to push to
+			Hash                    string   // Hash algorithm
+			StatCache               bool     // Use the stat cache
+			TarFormat               string   // Tar header format
+			Sparse                  bool     // Pack sparse files as such
+			ZipMethod               string   // Zip compression method
+			Manifest                manifestRequest
 		}{}
 		cmd.Arg("pack", "Pack type").
 			Required().
@@ -93,10 +133,37 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 		cmd.Arg("path", "Target path").
 			Required().
 			StringVar(&args.Path)
-		cmd.Flag("target", "Warehouse in which to place the ware").
+		cmd.Flag("target", "Warehouse in which to place the ware.  '-' writes the ware to stdout (and then all other output goes to stderr).").
 			StringVar(&args.TargetWarehouseLocation)
 		cmd.Flag("filters", "Configure filters for file properties, such as mtime, uid, gid, etc.  By default many of these attribute will be flattened.").
 			StringVar(&args.Filter)
+		cmd.Flag("include", "Glob pattern of paths to pack; if given, files not matching any include (nor in a dir matching one) are left out, as are dirs left with none of them in.  May be repeated.").
+			StringsVar(&args.Include)
+		cmd.Flag("exclude", "Glob pattern of paths to leave out of the pack, in the same syntax as a '.rioignore' file.  May be repeated.").
+			StringsVar(&args.Exclude)
+		cmd.Flag("uidmap", "Map host uids back to ware uids, as 'containerID:hostID:size' (like /etc/subuid).  May be repeated.  Uids not covered are rejected.").
+			StringsVar(&args.UidMap)
+		cmd.Flag("gidmap", "Map host gids back to ware gids, as 'containerID:hostID:size' (like /etc/subgid).  May be repeated.  Gids not covered are rejected.").
+			StringsVar(&args.GidMap)
+		cmd.Flag("hash", "Hash algorithm for the WareID.  Any but the default is named in the WareID, so unpacking detects it.").
+			Default(string(fshash.DefaultAlgorithm)).
+			EnumVar(&args.Hash, algorithmNames()...)
+		cmd.Flag("stat-cache", "Remember the hashes of files by their stat info (under $RIO_BASE), and skip rehashing unchanged files.  Cached hashes are only used with no --target; when writing a ware, every file is still read and hashed.").
+			BoolVar(&args.StatCache)
+		cmd.Flag("tar-format", "Tar header format (tar only).  'auto' uses USTAR where it can, and PAX where it must; 'ustar' is strict, and rejects anything USTAR can't hold (long paths, large uids, xattrs).  Doesn't change the WareID.").
+			Default(string(tartrans.Format_Auto)).
+			EnumVar(&args.TarFormat, tarFormatNames()...)
+		cmd.Flag("sparse", "Pack files with holes as sparse entries (tar only; 'auto' or 'pax' formats).  Doesn't change the WareID, but the tar's bytes then depend on where the filesystem has holes.").
+			BoolVar(&args.Sparse)
+		cmd.Flag("zip-method", "Compression method for files (zip only).  'store' doesn't compress: best for contents that are compressed already.  Doesn't change the WareID.").
+			Default(string(ziptrans.Method_Deflate)).
+			EnumVar(&args.ZipMethod, zipMethodNames()...)
+		cmd.Flag("manifest", "Also write a manifest to this file: every path, with the metadata and content hash the WareID commits to.").
+			StringVar(&args.Manifest.Path)
+		cmd.Flag("manifest-format", "Format of the manifest.").
+			Default(manifestFormat_Json).
+			EnumVar(&args.Manifest.Format,
+				manifestFormat_Json, manifestFormat_Cbor)
 		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
 			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
 
@@ -113,7 +180,30 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 				return Recategorize(rio.ErrUsage, err)
 			}
 			filt = filt.Apply(api.FilesetPackFilter_Conservative)
-			resultWareID, err := packFunc(
+			pathFilt, err := filters.NewPathFilter(args.Include, args.Exclude)
+			if err != nil {
+				return err
+			}
+			idmap, err := filters.ParseIDMap(args.UidMap, args.GidMap)
+			if err != nil {
+				return err
+			}
+			ctx := filters.WithIDMap(filters.WithPathFilter(ctx, pathFilt), idmap)
+			ctx = fshash.WithAlgorithm(ctx, fshash.Algorithm(args.Hash))
+			if args.StatCache {
+				ctx = statcache.WithStatCache(ctx, config.GetStatCachePath())
+			}
+			ctx = tartrans.WithFormat(ctx, tartrans.Format(args.TarFormat))
+			if args.Sparse {
+				ctx = tartrans.WithSparse(ctx)
+			}
+			ctx = ziptrans.WithMethod(ctx, ziptrans.Method(args.ZipMethod))
+			if api.WarehouseLocation(args.TargetWarehouseLocation) == util.StdioWarehouse {
+				// The ware gets stdout to itself; everything else moves over.
+				ctx = util.WithStdio(ctx, nil, stdout)
+				oc.stdout = stderr
+			}
+			resultWareID, records, err := packFunc(
 				ctx,
 				api.PackType(args.PackType),
 				path,
@@ -124,6 +214,12 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			if err != nil {
 				return err
 			}
+			if records != nil {
+				defer records.Close()
+			}
+			if err := args.Manifest.write(resultWareID, records); err != nil {
+				return err
+			}
 			oc.EmitResult(resultWareID, nil)
 			return nil
 		}}
@@ -135,7 +231,11 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			Path                     string   // Unpack target path, may be abs or rel
 			Filter                   string   // Filters for unpack
 			PlacementMode            string   // Placement mode enum
+			Subpath                  string   // Subtree of the ware to unpack, if not all of it
+			UidMap                   []string // Uid remappings, "containerID:hostID:size"
+			GidMap                   []string // Gid remappings, "containerID:hostID:size"
 			SourcesWarehouseLocation []string // Warehouse address to fetch from
+			Limits                   limitsRequest
 		}{}
 		cmd.Arg("ware", "Ware ID").
 			Required().
@@ -146,10 +246,17 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 		cmd.Flag("placer", "Placement mode to use [copy, direct, mount, none]").
 			EnumVar(&args.PlacementMode,
 				string(rio.Placement_Copy), string(rio.Placement_Direct), string(rio.Placement_Mount), string(rio.Placement_None))
-		cmd.Flag("source", "Warehouses from which to fetch the ware").
+		cmd.Flag("source", "Warehouses from which to fetch the ware.  '-' reads the ware from stdin.").
 			StringsVar(&args.SourcesWarehouseLocation)
 		cmd.Flag("filters", "Configure filters for file properties, such as mtime, uid, gid, etc.  By default all of these will be kept, except any use of setuid, setgid, and device modes will be rejected.").
 			StringVar(&args.Filter)
+		cmd.Flag("subpath", "Unpack only this path within the ware (a dir, file, or other), placing it at the target path.  The whole ware is still verified.").
+			StringVar(&args.Subpath)
+		cmd.Flag("uidmap", "Map ware uids to host uids, as 'containerID:hostID:size' (like /etc/subuid).  May be repeated.  Uids not covered are rejected.").
+			StringsVar(&args.UidMap)
+		cmd.Flag("gidmap", "Map ware gids to host gids, as 'containerID:hostID:size' (like /etc/subgid).  May be repeated.  Gids not covered are rejected.").
+			StringsVar(&args.GidMap)
+		args.Limits.flags(cmd)
 		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
 			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
 
@@ -170,10 +277,27 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 				return Recategorize(rio.ErrUsage, err)
 			}
 			filt = filt.Apply(api.FilesetUnpackFilter_LowPriv)
+			idmap, err := filters.ParseIDMap(args.UidMap, args.GidMap)
+			if err != nil {
+				return err
+			}
+			subpath := fs.MustRelPath("./" + strings.TrimLeft(args.Subpath, "/"))
+			if subpath.GoesUp() {
+				return Errorf(rio.ErrUsage, "subpath %q must not leave the ware", args.Subpath)
+			}
 			err = fsOp.RemoveDirContent(osfs.New(fs.MustAbsolutePath(path)), fs.RelPath{})
 			if err != nil {
 				return Recategorize(rio.ErrInoperablePath, err)
 			}
+			if subpath != (fs.RelPath{}) {
+				// The subtree might not be a dir, so clear the way entirely.
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					return Recategorize(rio.ErrInoperablePath, err)
+				}
+			}
+			ctx := filters.WithIDMap(filters.WithUnpackSubpath(ctx, subpath), idmap)
+			ctx = util.WithStdio(ctx, stdin, nil)
+			ctx = args.Limits.prepare(ctx)
 			resultWareID, err := unpackFunc(
 				ctx,
 				wareID,
@@ -194,16 +318,35 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 		cmd := app.Command("scan", "Scan some existing data stream see if it's a known packed format, and compute its WareID if so.  (Mostly used for importing tars from the interweb.)")
 		args := struct {
 			PackType                string // Pack type
-			Filter                  string // Filters as if unpacking
-			SourceWarehouseLocation string // Warehouse address of data to scan
+			Filter                  string   // Filters as if unpacking
+			UidMap                  []string // Uid remappings as if unpacking
+			GidMap                  []string // Gid remappings as if unpacking
+			SourceWarehouseLocation string   // Warehouse address of data to scan
+			Hash                    string   // Hash algorithm
+			Manifest                manifestRequest
+			Limits                  limitsRequest
 		}{}
 		cmd.Arg("pack", "Pack type").
 			Required().
 			StringVar(&args.PackType)
-		cmd.Flag("source", "Address to of the data to scan.").
+		cmd.Flag("source", "Address to of the data to scan.  '-' scans stdin.").
 			StringVar(&args.SourceWarehouseLocation)
 		cmd.Flag("filters", "Configure filters for file properties, such as mtime, uid, gid, etc.").
 			StringVar(&args.Filter)
+		cmd.Flag("uidmap", "Map ware uids as if unpacking, as 'containerID:hostID:size'.  May be repeated.").
+			StringsVar(&args.UidMap)
+		cmd.Flag("gidmap", "Map ware gids as if unpacking, as 'containerID:hostID:size'.  May be repeated.").
+			StringsVar(&args.GidMap)
+		cmd.Flag("hash", "Hash algorithm for the WareID.  Any but the default is named in the WareID, so unpacking detects it.").
+			Default(string(fshash.DefaultAlgorithm)).
+			EnumVar(&args.Hash, algorithmNames()...)
+		cmd.Flag("manifest", "Also write a manifest to this file: every path, with the metadata and content hash the WareID commits to.").
+			StringVar(&args.Manifest.Path)
+		cmd.Flag("manifest-format", "Format of the manifest.").
+			Default(manifestFormat_Json).
+			EnumVar(&args.Manifest.Format,
+				manifestFormat_Json, manifestFormat_Cbor)
+		args.Limits.flags(cmd)
 		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
 			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
 
@@ -216,7 +359,14 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 				return Recategorize(rio.ErrUsage, err)
 			}
 			filt = filt.Apply(api.FilesetUnpackFilter_Conservative)
-			resultWareID, err := scanFunc(
+			idmap, err := filters.ParseIDMap(args.UidMap, args.GidMap)
+			if err != nil {
+				return err
+			}
+			ctx := fshash.WithAlgorithm(filters.WithIDMap(ctx, idmap), fshash.Algorithm(args.Hash))
+			ctx = util.WithStdio(ctx, stdin, nil)
+			ctx = args.Limits.prepare(ctx)
+			resultWareID, records, err := scanFunc(
 				ctx,
 				api.PackType(args.PackType),
 				filt,
@@ -227,6 +377,12 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			if err != nil {
 				return err
 			}
+			if records != nil {
+				defer records.Close()
+			}
+			if err := args.Manifest.write(resultWareID, records); err != nil {
+				return err
+			}
 			oc.EmitResult(resultWareID, nil)
 			return nil
 		}}
@@ -270,6 +426,349 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			return nil
 		}}
 	}
+	{
+		cmd := app.Command("convert", "Repack a ware into another pack type, streaming it from one to the other.  The fileset is the same, so the WareID keeps its hash; the whole ware is verified.")
+		args := struct {
+			WareID                   string   // WareID to convert
+			PackType                 string   // Pack type to convert to
+			TargetWarehouseLocation  string   // Warehouse to place the converted ware in
+			SourceWarehouseLocations []string // Warehouses we can fetch from
+		}{}
+		cmd.Arg("ware", "Ware ID").
+			Required().
+			StringVar(&args.WareID)
+		cmd.Flag("to", "Pack type to convert to").
+			Required().
+			StringVar(&args.PackType)
+		cmd.Flag("target", "Warehouse in which to place the converted ware.  '-' writes the ware to stdout (and then all other output goes to stderr).").
+			StringVar(&args.TargetWarehouseLocation)
+		cmd.Flag("source", "Warehouses from which to fetch the ware.  '-' reads the ware from stdin.").
+			StringsVar(&args.SourceWarehouseLocations)
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			wareID, err := api.ParseWareID(args.WareID)
+			if err != nil {
+				return err
+			}
+			walkFunc, err := demuxWalkTool(string(wareID.Type))
+			if err != nil {
+				return err
+			}
+			convertFunc, err := demuxConvertTool(args.PackType)
+			if err != nil {
+				return err
+			}
+			ctx := util.WithStdio(ctx, stdin, nil)
+			if api.WarehouseLocation(args.TargetWarehouseLocation) == util.StdioWarehouse {
+				// The ware gets stdout to itself; everything else moves over.
+				ctx = util.WithStdio(ctx, stdin, stdout)
+				oc.stdout = stderr
+			}
+			resultWareID, err := convertFunc(
+				ctx,
+				wareID,
+				walkFunc,
+				convertWarehouseSlice(args.SourceWarehouseLocations),
+				api.WarehouseLocation(args.TargetWarehouseLocation),
+				oc.WireMonitor(ctx, rio.Monitor{}),
+			)
+			if err != nil {
+				return err
+			}
+			oc.EmitResult(resultWareID, nil)
+			return nil
+		}}
+	}
+	{
+		cmd := app.Command("ls", "List the contents of a Ware, without unpacking it.  The whole ware is still fetched and verified.")
+		args := struct {
+			WareID                   string   // Ware id string "<kind>:<hash>"
+			SourcesWarehouseLocation []string // Warehouse address to fetch from
+		}{}
+		cmd.Arg("ware", "Ware ID").
+			Required().
+			StringVar(&args.WareID)
+		cmd.Flag("source", "Warehouses from which to fetch the ware").
+			StringsVar(&args.SourcesWarehouseLocation)
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			wareID, err := api.ParseWareID(args.WareID)
+			if err != nil {
+				return err
+			}
+			listFunc, err := demuxListTool(string(wareID.Type))
+			if err != nil {
+				return err
+			}
+			bucket, err := listFunc(
+				ctx,
+				wareID,
+				convertWarehouseSlice(args.SourcesWarehouseLocation),
+				oc.WireMonitor(ctx, rio.Monitor{}),
+			)
+			if err != nil {
+				return err
+			}
+			defer bucket.Close()
+			if err := emitListing(oc, bucket); err != nil {
+				return err
+			}
+			oc.EmitResult(wareID, nil)
+			return nil
+		}}
+	}
+	{
+		cmd := app.Command("cat", "Write the contents of a single file in a Ware to stdout, without unpacking the rest.")
+		args := struct {
+			WareID                   string   // Ware id string "<kind>:<hash>"
+			Path                     string   // Path of the file within the ware
+			NoVerify                 bool     // Skip verifying the whole ware
+			SourcesWarehouseLocation []string // Warehouse address to fetch from
+		}{}
+		cmd.Arg("ware", "Ware ID").
+			Required().
+			StringVar(&args.WareID)
+		cmd.Arg("path", "Path of the file within the ware").
+			Required().
+			StringVar(&args.Path)
+		cmd.Flag("source", "Warehouses from which to fetch the ware").
+			StringsVar(&args.SourcesWarehouseLocation)
+		cmd.Flag("no-verify", "Write the file as soon as it's found, without reading and verifying the rest of the ware.  Faster, but a corrupt ware may yield a corrupt file.").
+			BoolVar(&args.NoVerify)
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			wareID, err := api.ParseWareID(args.WareID)
+			if err != nil {
+				return err
+			}
+			catFunc, err := demuxCatTool(string(wareID.Type))
+			if err != nil {
+				return err
+			}
+			path := fs.MustRelPath("./" + strings.TrimLeft(args.Path, "/"))
+			if path.GoesUp() {
+				return Errorf(rio.ErrUsage, "path %q must not leave the ware", args.Path)
+			}
+			// No monitor: stdout is for the file body alone.
+			return catFunc(
+				ctx,
+				wareID,
+				path,
+				!args.NoVerify,
+				oc.stdout,
+				convertWarehouseSlice(args.SourcesWarehouseLocation),
+				rio.Monitor{},
+			)
+		}}
+	}
+	{
+		cmd := app.Command("diff", "Compare the contents of two Wares, or of a Ware and a local path, and report added, removed, and modified entries.")
+		args := struct {
+			Old                      string   // Ware id string "<kind>:<hash>", or a path
+			New                      string   // Ware id string "<kind>:<hash>", or a path
+			Filter                   string   // Filters for scanning paths, as if packing
+			SourcesWarehouseLocation []string // Warehouse address to fetch from
+		}{}
+		cmd.Arg("old", "Ware ID or local path").
+			Required().
+			StringVar(&args.Old)
+		cmd.Arg("new", "Ware ID or local path").
+			Required().
+			StringVar(&args.New)
+		cmd.Flag("source", "Warehouses from which to fetch the wares").
+			StringsVar(&args.SourcesWarehouseLocation)
+		cmd.Flag("filters", "Configure filters for file properties of local paths, as if packing them.  The defaults are the same as for pack.").
+			StringVar(&args.Filter)
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			filt, err := api.ParseFilesetPackFilter(args.Filter)
+			if err != nil {
+				return Recategorize(rio.ErrUsage, err)
+			}
+			filt = filt.Apply(api.FilesetPackFilter_Conservative)
+			warehouses := convertWarehouseSlice(args.SourcesWarehouseLocation)
+			// Local paths are scanned as if packed like the ware they're compared to,
+			//  with the same hash algorithm (or file contents would never compare equal).
+			//  (Git wares can't be packed, but their records are like tar's.)
+			packType := api.PackType("tar")
+			var alg fshash.Algorithm
+			for _, arg := range []string{args.New, args.Old} {
+				wareID, ok := diffWareArg(arg)
+				if !ok || wareID.Type == "git" {
+					continue
+				}
+				packType = wareID.Type
+				wareAlg, err := fshash.AlgorithmOfWareHash(wareID.Hash)
+				if err != nil {
+					return Errorf(rio.ErrUsage, "%s", err)
+				}
+				if alg != "" && wareAlg != alg {
+					return Errorf(rio.ErrUsage, "cannot diff wares hashed with different algorithms (%s and %s)", alg, wareAlg)
+				}
+				alg = wareAlg
+			}
+			if alg != "" {
+				ctx = fshash.WithAlgorithm(ctx, alg)
+			}
+			prev, err := diffSide(ctx, args.Old, packType, filt, warehouses, oc.WireMonitor(ctx, rio.Monitor{}))
+			if err != nil {
+				return err
+			}
+			defer prev.Close()
+			next, err := diffSide(ctx, args.New, packType, filt, warehouses, oc.WireMonitor(ctx, rio.Monitor{}))
+			if err != nil {
+				return err
+			}
+			defer next.Close()
+			changes, err := diffBuckets(prev, next)
+			if err != nil {
+				return err
+			}
+			emitDiff(oc, changes)
+			return nil
+		}}
+	}
+	{
+		cmd := app.Command("verify", "Check that a local path still matches a Ware, as if packing it.")
+		args := struct {
+			WareID                   string   // Ware id string "<kind>:<hash>"
+			Path                     string   // Path to check, may be abs or rel
+			Filter                   string   // Filters as if packing
+			SourcesWarehouseLocation []string // Warehouse address to fetch from, to list differences
+			StatCache                bool     // Use the stat cache
+		}{}
+		cmd.Arg("ware", "Ware ID").
+			Required().
+			StringVar(&args.WareID)
+		cmd.Arg("path", "Path to check").
+			Required().
+			StringVar(&args.Path)
+		cmd.Flag("source", "Warehouses from which to fetch the ware, if it doesn't match, to list the differences").
+			StringsVar(&args.SourcesWarehouseLocation)
+		cmd.Flag("filters", "Configure filters for file properties, as if packing.  The defaults are the same as for pack.").
+			StringVar(&args.Filter)
+		cmd.Flag("stat-cache", "Remember the hashes of files by their stat info (under $RIO_BASE), and skip rehashing unchanged files.").
+			BoolVar(&args.StatCache)
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			wareID, err := api.ParseWareID(args.WareID)
+			if err != nil {
+				return err
+			}
+			filt, err := api.ParseFilesetPackFilter(args.Filter)
+			if err != nil {
+				return Recategorize(rio.ErrUsage, err)
+			}
+			filt = filt.Apply(api.FilesetPackFilter_Conservative)
+			if args.StatCache {
+				ctx = statcache.WithStatCache(ctx, config.GetStatCachePath())
+			}
+			err = verifyPath(
+				ctx,
+				wareID,
+				args.Path,
+				filt,
+				convertWarehouseSlice(args.SourcesWarehouseLocation),
+				oc.WireMonitor(ctx, rio.Monitor{}),
+			)
+			if err != nil {
+				return err
+			}
+			oc.EmitResult(wareID, nil)
+			return nil
+		}}
+	}
+	{
+		cmd := app.Command("prove", "Write a proof that a path is included in a Ware, which can be checked with only the WareID.  The whole ware is still fetched and verified.")
+		args := struct {
+			WareID                   string   // Ware id string "<kind>:<hash>"
+			Path                     string   // Path of the file or dir within the ware
+			SourcesWarehouseLocation []string // Warehouse address to fetch from
+		}{}
+		cmd.Arg("ware", "Ware ID").
+			Required().
+			StringVar(&args.WareID)
+		cmd.Arg("path", "Path of the file or dir within the ware").
+			Required().
+			StringVar(&args.Path)
+		cmd.Flag("source", "Warehouses from which to fetch the ware").
+			StringsVar(&args.SourcesWarehouseLocation)
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			wareID, err := api.ParseWareID(args.WareID)
+			if err != nil {
+				return err
+			}
+			path := fs.MustRelPath("./" + strings.TrimLeft(args.Path, "/"))
+			if path.GoesUp() {
+				return Errorf(rio.ErrUsage, "path %q must not leave the ware", args.Path)
+			}
+			return proveWare(
+				ctx,
+				wareID,
+				path,
+				convertWarehouseSlice(args.SourcesWarehouseLocation),
+				oc.stdout,
+			)
+		}}
+	}
+	{
+		cmd := app.Command("check-proof", "Check a proof, as written by 'rio prove', that a path is included in a Ware.")
+		args := struct {
+			WareID    string // Ware id string "<kind>:<hash>"
+			ProofPath string // Path of the proof file
+		}{}
+		cmd.Arg("ware", "Ware ID").
+			Required().
+			StringVar(&args.WareID)
+		cmd.Arg("proof", "Path of the proof file").
+			Required().
+			StringVar(&args.ProofPath)
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			wareID, err := api.ParseWareID(args.WareID)
+			if err != nil {
+				return err
+			}
+			entry, err := checkProof(wareID, args.ProofPath)
+			if err != nil {
+				return err
+			}
+			oc.EmitRecord(entry.Name, &entry, fshash.ManifestAtlas)
+			oc.EmitResult(wareID, nil)
+			return nil
+		}}
+	}
+	{
+		cmd := app.Command("cache", "Inspect the local fileset cache.")
+		{
+			cmd := cmd.Command("stats", "Report the size of the fileset cache, both as plain copies and as actually stored after content deduplication.")
+			args := struct{}{}
+			bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+				defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+				stats, err := cache.GetStats(osfs.New(config.GetCacheBasePath()))
+				if err != nil {
+					return err
+				}
+				oc.EmitRecord(
+					fmt.Sprintf("shelves: %d\nfiles: %d\nlogical bytes: %d\nphysical bytes: %d",
+						stats.Shelves, stats.Files, stats.LogicalBytes, stats.PhysicalBytes),
+					&stats, atlas.MustBuild(
+						atlas.BuildEntry(cache.Stats{}).StructMap().Autogenerate().Complete(),
+					),
+				)
+				return nil
+			}}
+		}
+	}
 	// Okay now let's be clear: actually all of these behaviors should, end of day,
 	//  actually send their errors through our output control.
 	//  We still also return it, both so you can write tests around this
@@ -308,8 +807,7 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 type outputController struct {
 	format         format
 	stdout, stderr io.Writer
-	monChan        chan rio.Event // set up when calling WireMonitor
-	monWg          sync.WaitGroup
+	monWg          sync.WaitGroup // one for each monitor wired, until its chan is closed.
 }
 
 func (oc *outputController) EmitResult(wareID api.WareID, err error) {
@@ -336,17 +834,37 @@ func (oc *outputController) EmitResult(wareID api.WareID, err error) {
 	}
 }
 
+// EmitRecord is for commands whose output is something other than a WareID.
+//  In dumb format the given text is printed as-is; in json format, the
+//  object is marshalled with the given atlas.
+func (oc *outputController) EmitRecord(dumb string, obj interface{}, atl atlas.Atlas) {
+	oc.monWg.Wait()
+	switch oc.format {
+	case "", format_Dumb:
+		fmt.Fprintln(oc.stdout, dumb)
+	case format_Json:
+		marshaller := refmt.NewMarshallerAtlased(json.EncodeOptions{}, oc.stdout, atl)
+		if err := marshaller.Marshal(obj); err != nil {
+			panic(err)
+		}
+		oc.stdout.Write([]byte{'\n'})
+	default:
+		panic(fmt.Errorf("rio: invalid format %s", oc.format))
+	}
+}
+
+// WireMonitor may be called more than once (e.g. for each side of a diff); each gets its own chan.
 func (oc *outputController) WireMonitor(ctx context.Context, m rio.Monitor) rio.Monitor {
-	oc.monChan = make(chan rio.Event)
+	monChan := make(chan rio.Event)
 	oc.monWg.Add(1)
-	m.Chan = oc.monChan
+	m.Chan = monChan
 	switch oc.format {
 	case "", format_Dumb:
 		go func() {
 			defer oc.monWg.Done()
 			for {
 				select {
-				case evt, ok := <-oc.monChan:
+				case evt, ok := <-monChan:
 					if !ok {
 						return
 					}
@@ -369,7 +887,7 @@ func (oc *outputController) WireMonitor(ctx context.Context, m rio.Monitor) rio.
 			defer oc.monWg.Done()
 			for {
 				select {
-				case evt, ok := <-oc.monChan:
+				case evt, ok := <-monChan:
 					if !ok {
 						return
 					}
@@ -389,6 +907,30 @@ func (oc *outputController) WireMonitor(ctx context.Context, m rio.Monitor) rio.
 	return m
 }
 
+func algorithmNames() []string {
+	names := make([]string, len(fshash.Algorithms))
+	for i, alg := range fshash.Algorithms {
+		names[i] = string(alg)
+	}
+	return names
+}
+
+func tarFormatNames() []string {
+	names := make([]string, len(tartrans.Formats))
+	for i, f := range tartrans.Formats {
+		names[i] = string(f)
+	}
+	return names
+}
+
+func zipMethodNames() []string {
+	names := make([]string, len(ziptrans.Methods))
+	for i, m := range ziptrans.Methods {
+		names[i] = string(m)
+	}
+	return names
+}
+
 func convertWarehouseSlice(slice []string) []api.WarehouseLocation {
 	result := make([]api.WarehouseLocation, len(slice))
 	for idx, item := range slice {
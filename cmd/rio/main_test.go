@@ -5,10 +5,14 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/cbor"
+	"github.com/polydawn/refmt/json"
 	. "github.com/smartystreets/goconvey/convey"
 
 	"github.com/polydawn/go-timeless-api/rio"
@@ -16,6 +20,8 @@ import (
 	"github.com/polydawn/rio/fs/osfs"
 	"github.com/polydawn/rio/fsOp"
 	"github.com/polydawn/rio/testutil"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+	"github.com/polydawn/rio/transmat/mixins/limits"
 )
 
 func stdBuffers() (stdin, stdout, stderr *bytes.Buffer) {
@@ -153,6 +159,259 @@ func TestTarFixtureUnpack(t *testing.T) {
 	)
 }
 
+func TestVerify(t *testing.T) {
+	Convey("rio verify: checking a path against a ware", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			ctx := context.Background()
+			srcPath := tmpDir.Join(fs.MustRelPath("src")).String()
+			So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("src"), 0755), ShouldBeNil)
+			So(ioutil.WriteFile(srcPath+"/a", []byte("zyx"), 0644), ShouldBeNil)
+			warehouse := fmt.Sprintf("file://%s/ware.tar", tmpDir)
+
+			stdin, stdout, stderr := stdBuffers()
+			exitCode := Main(ctx, []string{"rio", "pack", "tar", srcPath, "--target=" + warehouse}, stdin, stdout, stderr)
+			So(exitCode, ShouldEqual, 0)
+			wareID := lastLine(string(stdout.Bytes()))
+
+			Convey("an unchanged path should pass", func() {
+				stdin, stdout, stderr := stdBuffers()
+				exitCode := Main(ctx, []string{"rio", "verify", wareID, srcPath}, stdin, stdout, stderr)
+				So(exitCode, ShouldEqual, 0)
+				So(lastLine(string(stdout.Bytes())), ShouldEqual, wareID)
+			})
+			Convey("a changed path should fail, listing differences if it can", func() {
+				So(ioutil.WriteFile(srcPath+"/a", []byte("qwe"), 0644), ShouldBeNil)
+				So(ioutil.WriteFile(srcPath+"/b", []byte("new"), 0644), ShouldBeNil)
+
+				stdin, stdout, stderr := stdBuffers()
+				exitCode := Main(ctx, []string{"rio", "verify", wareID, srcPath}, stdin, stdout, stderr)
+				So(exitCode, ShouldEqual, rio.ExitCodeForCategory(rio.ErrWareHashMismatch))
+				So(string(stderr.Bytes()), ShouldContainSubstring, "give sources")
+
+				stdin, stdout, stderr = stdBuffers()
+				exitCode = Main(ctx, []string{"rio", "verify", wareID, srcPath, "--source=" + warehouse}, stdin, stdout, stderr)
+				So(exitCode, ShouldEqual, rio.ExitCodeForCategory(rio.ErrWareHashMismatch))
+				So(string(stderr.Bytes()), ShouldContainSubstring, "differences:\n  ~ ./a (content)\n  + ./b\n")
+			})
+			Convey("a ware made with another hash algorithm should be checked with that one", func() {
+				warehouse := fmt.Sprintf("file://%s/ware256.tar", tmpDir)
+				stdin, stdout, stderr := stdBuffers()
+				exitCode := Main(ctx, []string{"rio", "pack", "tar", srcPath, "--hash=sha256", "--target=" + warehouse}, stdin, stdout, stderr)
+				So(exitCode, ShouldEqual, 0)
+				wareID256 := lastLine(string(stdout.Bytes()))
+				So(wareID256, ShouldStartWith, "tar:sha256-")
+
+				stdin, stdout, stderr = stdBuffers()
+				exitCode = Main(ctx, []string{"rio", "verify", wareID256, srcPath}, stdin, stdout, stderr)
+				So(exitCode, ShouldEqual, 0)
+
+				So(ioutil.WriteFile(srcPath+"/a", []byte("qwe"), 0644), ShouldBeNil)
+				stdin, stdout, stderr = stdBuffers()
+				exitCode = Main(ctx, []string{"rio", "verify", wareID256, srcPath, "--source=" + warehouse}, stdin, stdout, stderr)
+				So(exitCode, ShouldEqual, rio.ExitCodeForCategory(rio.ErrWareHashMismatch))
+				So(string(stderr.Bytes()), ShouldContainSubstring, "differences:\n  ~ ./a (content)\n")
+			})
+		})
+	})
+}
+
+func TestStdio(t *testing.T) {
+	Convey("rio pack to stdout, and scan and unpack from stdin", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			ctx := context.Background()
+			srcPath := tmpDir.Join(fs.MustRelPath("src")).String()
+			So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("src"), 0755), ShouldBeNil)
+			So(ioutil.WriteFile(srcPath+"/a", []byte("zyx"), 0644), ShouldBeNil)
+
+			stdin, stdout, stderr := stdBuffers()
+			exitCode := Main(ctx, []string{"rio", "pack", "tar", srcPath, "--target=-"}, stdin, stdout, stderr)
+			So(exitCode, ShouldEqual, 0)
+			wareID := lastLine(string(stderr.Bytes()))
+			So(wareID, ShouldStartWith, "tar:")
+			ware := stdout.Bytes()
+
+			stdin, stdout, stderr = stdBuffers()
+			exitCode = Main(ctx, []string{"rio", "pack", "tar", srcPath}, stdin, stdout, stderr)
+			So(exitCode, ShouldEqual, 0)
+			So(lastLine(string(stdout.Bytes())), ShouldEqual, wareID)
+
+			Convey("the ware should scan from stdin", func() {
+				stdin, stdout, stderr := stdBuffers()
+				stdin.Write(ware)
+				exitCode := Main(ctx, []string{"rio", "scan", "tar", "--source=-"}, stdin, stdout, stderr)
+				So(exitCode, ShouldEqual, 0)
+				So(lastLine(string(stdout.Bytes())), ShouldEqual, wareID)
+			})
+			Convey("the ware should unpack from stdin", func() {
+				dstPath := tmpDir.String() + "/dst"
+				stdin, stdout, stderr := stdBuffers()
+				stdin.Write(ware)
+				exitCode := Main(ctx, []string{"rio", "unpack", wareID, dstPath, "--source=-", "--placer=direct"}, stdin, stdout, stderr)
+				So(exitCode, ShouldEqual, 0)
+				So(string(stderr.Bytes()), ShouldContainSubstring, `opened from warehouse "-"`)
+				body, err := ioutil.ReadFile(dstPath + "/a")
+				So(err, ShouldBeNil)
+				So(string(body), ShouldEqual, "zyx")
+			})
+			Convey("a ware from stdin that's not the one asked for should be rejected", func() {
+				stdin, stdout, stderr := stdBuffers()
+				stdin.Write(ware)
+				exitCode := Main(ctx, []string{"rio", "unpack", "tar:notreallyit", tmpDir.String() + "/dst", "--source=-", "--placer=direct"}, stdin, stdout, stderr)
+				So(exitCode, ShouldEqual, rio.ExitCodeForCategory(rio.ErrWareHashMismatch))
+			})
+			Convey("a ware over a limit should fail with the limit's own exit code, not a filter's", func() {
+				stdin, stdout, stderr := stdBuffers()
+				stdin.Write(ware)
+				exitCode := Main(ctx, []string{"rio", "scan", "tar", "--source=-", "--limit-entries=1"}, stdin, stdout, stderr)
+				So(exitCode, ShouldEqual, exitCodeForCategory(limits.ErrLimitExceeded))
+				So(exitCode, ShouldNotEqual, rio.ExitCodeForCategory(rio.ErrFilterRejection))
+			})
+		})
+	})
+}
+
+func TestConvert(t *testing.T) {
+	Convey("rio convert: repacking a ware into another pack type", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			ctx := context.Background()
+			srcPath := tmpDir.Join(fs.MustRelPath("src")).String()
+			So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("src"), 0755), ShouldBeNil)
+			So(ioutil.WriteFile(srcPath+"/a", []byte("zyx"), 0644), ShouldBeNil)
+			So(os.Symlink("a", srcPath+"/b"), ShouldBeNil)
+			tarWarehouse := fmt.Sprintf("file://%s/ware.tgz", tmpDir)
+			zipWarehouse := fmt.Sprintf("file://%s/ware.zip", tmpDir)
+
+			stdin, stdout, stderr := stdBuffers()
+			exitCode := Main(ctx, []string{"rio", "pack", "tar", srcPath, "--target=" + tarWarehouse}, stdin, stdout, stderr)
+			So(exitCode, ShouldEqual, 0)
+			tarWareID := lastLine(string(stdout.Bytes()))
+
+			Convey("tar to zip should keep the hash, and match packing the zip directly", func() {
+				stdin, stdout, stderr := stdBuffers()
+				exitCode := Main(ctx, []string{"rio", "convert", tarWareID, "--to=zip", "--source=" + tarWarehouse, "--target=" + zipWarehouse}, stdin, stdout, stderr)
+				So(exitCode, ShouldEqual, 0)
+				zipWareID := lastLine(string(stdout.Bytes()))
+				So(zipWareID, ShouldEqual, "zip:"+strings.TrimPrefix(tarWareID, "tar:"))
+
+				stdin, stdout, stderr = stdBuffers()
+				exitCode = Main(ctx, []string{"rio", "pack", "zip", srcPath, "--target=" + zipWarehouse + ".direct"}, stdin, stdout, stderr)
+				So(exitCode, ShouldEqual, 0)
+				So(lastLine(string(stdout.Bytes())), ShouldEqual, zipWareID)
+				converted, err := ioutil.ReadFile(tmpDir.String() + "/ware.zip")
+				So(err, ShouldBeNil)
+				direct, err := ioutil.ReadFile(tmpDir.String() + "/ware.zip.direct")
+				So(err, ShouldBeNil)
+				So(bytes.Equal(converted, direct), ShouldBeTrue)
+
+				Convey("and back to tar should give the original bytes", func() {
+					stdin, stdout, stderr := stdBuffers()
+					exitCode := Main(ctx, []string{"rio", "convert", zipWareID, "--to=tar", "--source=" + zipWarehouse, "--target=-"}, stdin, stdout, stderr)
+					So(exitCode, ShouldEqual, 0)
+					So(lastLine(string(stderr.Bytes())), ShouldEqual, tarWareID)
+					original, err := ioutil.ReadFile(tmpDir.String() + "/ware.tgz")
+					So(err, ShouldBeNil)
+					So(bytes.Equal(stdout.Bytes(), original), ShouldBeTrue)
+				})
+			})
+			Convey("an unknown pack type should be rejected", func() {
+				stdin, stdout, stderr := stdBuffers()
+				exitCode := Main(ctx, []string{"rio", "convert", tarWareID, "--to=rar", "--source=" + tarWarehouse}, stdin, stdout, stderr)
+				So(exitCode, ShouldEqual, rio.ExitCodeForCategory(rio.ErrUsage))
+			})
+		})
+	})
+}
+
+func TestManifest(t *testing.T) {
+	Convey("rio pack and scan with a manifest", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			ctx := context.Background()
+			srcPath := tmpDir.Join(fs.MustRelPath("src")).String()
+			So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("src"), 0755), ShouldBeNil)
+			So(ioutil.WriteFile(srcPath+"/a", []byte("zyx"), 0644), ShouldBeNil)
+			warehouse := fmt.Sprintf("file://%s/ware.tar", tmpDir)
+			readManifest := func(path string, opts refmt.DecodeOptions) fshash.Manifest {
+				body, err := ioutil.ReadFile(path)
+				So(err, ShouldBeNil)
+				var manifest fshash.Manifest
+				So(refmt.UnmarshalAtlased(opts, body, &manifest, fshash.ManifestAtlas), ShouldBeNil)
+				return manifest
+			}
+
+			stdin, stdout, stderr := stdBuffers()
+			exitCode := Main(ctx, []string{"rio", "pack", "tar", srcPath, "--target=" + warehouse, "--manifest=" + tmpDir.String() + "/pack.json"}, stdin, stdout, stderr)
+			So(exitCode, ShouldEqual, 0)
+			wareID := lastLine(string(stdout.Bytes()))
+
+			packManifest := readManifest(tmpDir.String()+"/pack.json", json.DecodeOptions{})
+			So(packManifest.WareID, ShouldEqual, wareID)
+			So(packManifest.Entries, ShouldHaveLength, 2)
+			So(packManifest.Entries[0].Name, ShouldEqual, ".")
+			So(packManifest.Entries[0].Type, ShouldEqual, "d")
+			So(packManifest.Entries[0].ContentHash, ShouldEqual, "")
+			So(packManifest.Entries[1].Name, ShouldEqual, "./a")
+			So(packManifest.Entries[1].Perms, ShouldEqual, 0644)
+			So(packManifest.Entries[1].ContentHash, ShouldNotEqual, "")
+
+			Convey("scanning the ware should give the same manifest", func() {
+				stdin, stdout, stderr := stdBuffers()
+				exitCode := Main(ctx, []string{"rio", "scan", "tar", "--source=" + warehouse, "--manifest=" + tmpDir.String() + "/scan.cbor", "--manifest-format=cbor"}, stdin, stdout, stderr)
+				So(exitCode, ShouldEqual, 0)
+				So(lastLine(string(stdout.Bytes())), ShouldEqual, wareID)
+				So(readManifest(tmpDir.String()+"/scan.cbor", cbor.DecodeOptions{}), ShouldResemble, packManifest)
+			})
+		})
+	})
+}
+
+func TestProve(t *testing.T) {
+	Convey("rio prove and check-proof", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			ctx := context.Background()
+			srcPath := tmpDir.Join(fs.MustRelPath("src")).String()
+			So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("src"), 0755), ShouldBeNil)
+			So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("src/d"), 0755), ShouldBeNil)
+			So(ioutil.WriteFile(srcPath+"/a", []byte("zyx"), 0644), ShouldBeNil)
+			So(ioutil.WriteFile(srcPath+"/d/b", []byte("wvu"), 0644), ShouldBeNil)
+			warehouse := fmt.Sprintf("file://%s/ware.tar", tmpDir)
+			proofPath := tmpDir.String() + "/proof.json"
+
+			stdin, stdout, stderr := stdBuffers()
+			exitCode := Main(ctx, []string{"rio", "pack", "tar", srcPath, "--target=" + warehouse}, stdin, stdout, stderr)
+			So(exitCode, ShouldEqual, 0)
+			wareID := lastLine(string(stdout.Bytes()))
+
+			stdin, stdout, stderr = stdBuffers()
+			exitCode = Main(ctx, []string{"rio", "prove", wareID, "d/b", "--source=" + warehouse}, stdin, stdout, stderr)
+			So(exitCode, ShouldEqual, 0)
+			So(ioutil.WriteFile(proofPath, stdout.Bytes(), 0644), ShouldBeNil)
+
+			Convey("the proof should check against the ware", func() {
+				stdin, stdout, stderr := stdBuffers()
+				exitCode := Main(ctx, []string{"rio", "check-proof", wareID, proofPath}, stdin, stdout, stderr)
+				So(exitCode, ShouldEqual, 0)
+				So(string(stdout.Bytes()), ShouldEqual, "./d/b\n"+wareID+"\n")
+			})
+			Convey("the proof should not check against another ware", func() {
+				So(ioutil.WriteFile(srcPath+"/a", []byte("qwe"), 0644), ShouldBeNil)
+				stdin, stdout, stderr := stdBuffers()
+				exitCode := Main(ctx, []string{"rio", "pack", "tar", srcPath}, stdin, stdout, stderr)
+				So(exitCode, ShouldEqual, 0)
+				otherWareID := lastLine(string(stdout.Bytes()))
+
+				stdin, stdout, stderr = stdBuffers()
+				exitCode = Main(ctx, []string{"rio", "check-proof", otherWareID, proofPath}, stdin, stdout, stderr)
+				So(exitCode, ShouldEqual, rio.ExitCodeForCategory(rio.ErrWareHashMismatch))
+			})
+			Convey("paths not in the ware should have no proof", func() {
+				stdin, stdout, stderr := stdBuffers()
+				exitCode := Main(ctx, []string{"rio", "prove", wareID, "d/nope", "--source=" + warehouse}, stdin, stdout, stderr)
+				So(exitCode, ShouldEqual, rio.ExitCodeForCategory(rio.ErrUsage))
+			})
+		})
+	})
+}
+
 func lastLine(str string) string {
 	str = strings.TrimRight(str, "\n")
 	ss := strings.Split(str, "\n")
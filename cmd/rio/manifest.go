@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/cbor"
+	"github.com/polydawn/refmt/json"
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+)
+
+const (
+	manifestFormat_Json = "json"
+	manifestFormat_Cbor = "cbor"
+)
+
+// manifestRequest holds the `--manifest` flags common to pack and scan.
+type manifestRequest struct {
+	Path   string
+	Format string
+}
+
+/*
+	If a manifest was asked for, writes it, of the records the WareID is
+	the hash of.  Otherwise, does nothing.
+*/
+func (req manifestRequest) write(wareID api.WareID, bucket fshash.Bucket) error {
+	if req.Path == "" {
+		return nil
+	}
+	return writeManifest(req.Path, req.Format, wareID, bucket)
+}
+
+/*
+	Writes the manifest of the bucket (which must be the records hashed
+	to get the wareID) to a file at the given path, in json or cbor.
+*/
+func writeManifest(path string, format string, wareID api.WareID, bucket fshash.Bucket) (err error) {
+	if bucket == nil {
+		return Errorf(rio.ErrUsage, "cannot write a manifest for %s wares", wareID.Type)
+	}
+	defer func() {
+		// The bucket was already hashed, so this shouldn't happen; but just in case.
+		if rec := recover(); rec != nil {
+			if e, ok := rec.(fshash.ErrInvalidFilesystem); ok {
+				err = Errorf(rio.ErrWareCorrupt, "%s", e)
+				return
+			}
+			panic(rec)
+		}
+	}()
+	manifest := fshash.BuildManifest(wareID.String(), bucket)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return Errorf(rio.ErrInoperablePath, "cannot write manifest: %s", err)
+	}
+	defer f.Close()
+	var opts refmt.EncodeOptions
+	switch format {
+	case manifestFormat_Json:
+		opts = json.EncodeOptions{Line: []byte{'\n'}, Indent: []byte{'\t'}}
+	case manifestFormat_Cbor:
+		opts = cbor.EncodeOptions{}
+	default:
+		panic("unreachable; kingpin enum")
+	}
+	if err := refmt.NewMarshallerAtlased(opts, f, fshash.ManifestAtlas).Marshal(manifest); err != nil {
+		return Errorf(rio.ErrInoperablePath, "cannot write manifest: %s", err)
+	}
+	if format == manifestFormat_Json {
+		if _, err := f.Write([]byte{'\n'}); err != nil {
+			return Errorf(rio.ErrInoperablePath, "cannot write manifest: %s", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return Errorf(rio.ErrInoperablePath, "cannot write manifest: %s", err)
+	}
+	return nil
+}
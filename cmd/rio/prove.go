@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/json"
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+)
+
+/*
+	Lists the ware (verifying it) and writes a proof that the path is
+	included in it, as json.
+*/
+func proveWare(
+	ctx context.Context,
+	wareID api.WareID,
+	path fs.RelPath,
+	warehouses []api.WarehouseLocation,
+	w io.Writer,
+) (err error) {
+	if wareID.Type == "git" {
+		return Errorf(rio.ErrUsage, "cannot prove paths in a git ware: its hash is of a commit, not a fileset")
+	}
+	alg, err := fshash.AlgorithmOfWareHash(wareID.Hash)
+	if err != nil {
+		return Errorf(rio.ErrUsage, "%s", err)
+	}
+	listFunc, err := demuxListTool(string(wareID.Type))
+	if err != nil {
+		return err
+	}
+	// No monitor: stdout is for the proof alone.
+	bucket, err := listFunc(ctx, wareID, warehouses, rio.Monitor{})
+	if err != nil {
+		return err
+	}
+	defer bucket.Close()
+	defer func() {
+		// The bucket was already hashed, so this shouldn't happen; but just in case.
+		if rec := recover(); rec != nil {
+			if e, ok := rec.(fshash.ErrInvalidFilesystem); ok {
+				err = Errorf(rio.ErrWareCorrupt, "%s", e)
+				return
+			}
+			panic(rec)
+		}
+	}()
+	proof, err := fshash.Prove(bucket, path, alg.New)
+	if err != nil {
+		return Errorf(rio.ErrUsage, "cannot prove path in ware %q: %s", wareID, err)
+	}
+	if err := refmt.NewMarshallerAtlased(json.EncodeOptions{Line: []byte{'\n'}, Indent: []byte{'\t'}}, w, fshash.ProofAtlas).Marshal(proof); err != nil {
+		return Errorf(rio.ErrInoperablePath, "cannot write proof: %s", err)
+	}
+	if _, err := w.Write([]byte{'\n'}); err != nil {
+		return Errorf(rio.ErrInoperablePath, "cannot write proof: %s", err)
+	}
+	return nil
+}
+
+/*
+	Checks a proof file (as written by proveWare) against the ware,
+	and returns the entry it proves is included.
+
+	Needs no warehouse: the proof carries all the hashes it needs.
+*/
+func checkProof(wareID api.WareID, proofPath string) (fshash.ManifestEntry, error) {
+	if wareID.Type == "git" {
+		return fshash.ManifestEntry{}, Errorf(rio.ErrUsage, "cannot check proofs against a git ware: its hash is of a commit, not a fileset")
+	}
+	alg, err := fshash.AlgorithmOfWareHash(wareID.Hash)
+	if err != nil {
+		return fshash.ManifestEntry{}, Errorf(rio.ErrUsage, "%s", err)
+	}
+	body, err := ioutil.ReadFile(proofPath)
+	if err != nil {
+		return fshash.ManifestEntry{}, Errorf(rio.ErrUsage, "cannot read proof: %s", err)
+	}
+	var proof fshash.Proof
+	if err := refmt.NewUnmarshallerAtlased(json.DecodeOptions{}, bytes.NewReader(body), fshash.ProofAtlas).Unmarshal(&proof); err != nil {
+		return fshash.ManifestEntry{}, Errorf(rio.ErrUsage, "cannot parse proof: %s", err)
+	}
+	root, err := proof.Root(alg.New)
+	if err != nil {
+		return fshash.ManifestEntry{}, Errorf(rio.ErrUsage, "%s", err)
+	}
+	actualWareID := api.WareID{Type: wareID.Type, Hash: alg.WareHash(root)}
+	if actualWareID != wareID {
+		return fshash.ManifestEntry{}, ErrorDetailed(
+			rio.ErrWareHashMismatch,
+			fmt.Sprintf("proof mismatch: proof of %q is for %q, not %q", proof.Entry.Name, actualWareID, wareID),
+			map[string]string{
+				"expected": wareID.String(),
+				"actual":   actualWareID.String(),
+			},
+		)
+	}
+	return proof.Entry, nil
+}
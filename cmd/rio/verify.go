@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+)
+
+// How many differing entries a verify failure lists, at most.
+const verifyMaxListed = 10
+
+/*
+	Checks that the local path, scanned as if packed with the given filters,
+	has the given WareID.
+
+	On mismatch, returns an ErrWareHashMismatch; if the ware can be listed
+	from the given warehouses, the error also lists the first entries which
+	differ from it.
+*/
+func verifyPath(
+	ctx context.Context,
+	wareID api.WareID,
+	path string,
+	filt api.FilesetPackFilter,
+	warehouses []api.WarehouseLocation,
+	mon rio.Monitor,
+) error {
+	// The monitor is only used if we list the ware; until then, we must close it.
+	monHandedOff := false
+	defer func() {
+		if !monHandedOff && mon.Chan != nil {
+			close(mon.Chan)
+		}
+	}()
+
+	if wareID.Type == "git" {
+		return Errorf(rio.ErrUsage, "cannot verify a path against a git ware: its hash is of a commit, not a fileset")
+	}
+	if _, err := os.Lstat(path); err != nil {
+		return Errorf(rio.ErrUsage, "cannot verify path %q: %s", path, err)
+	}
+	alg, err := fshash.AlgorithmOfWareHash(wareID.Hash)
+	if err != nil {
+		return Errorf(rio.ErrUsage, "%s", err)
+	}
+	ctx = fshash.WithAlgorithm(ctx, alg)
+	bucket, actualWareID, err := scanPath(ctx, path, wareID.Type, filt)
+	if err != nil {
+		return err
+	}
+	defer bucket.Close()
+	if actualWareID == wareID {
+		return nil
+	}
+
+	// Mismatch.  See if we can say where.
+	msg := fmt.Sprintf("hash mismatch: path %q is %q, not %q", path, actualWareID, wareID)
+	if len(warehouses) == 0 {
+		msg += " (give sources for the ware to list the differences)"
+	} else {
+		monHandedOff = true
+		msg += listDifferences(ctx, wareID, bucket, warehouses, mon)
+	}
+	return ErrorDetailed(
+		rio.ErrWareHashMismatch,
+		msg,
+		map[string]string{
+			"expected": wareID.String(),
+			"actual":   actualWareID.String(),
+		},
+	)
+}
+
+// Returns text to append to a mismatch message, listing the first differences
+//  between the ware and the bucket; or saying why it can't.
+func listDifferences(
+	ctx context.Context,
+	wareID api.WareID,
+	bucket fshash.Bucket,
+	warehouses []api.WarehouseLocation,
+	mon rio.Monitor,
+) string {
+	listFunc, err := demuxListTool(string(wareID.Type))
+	if err != nil {
+		panic("unreachable; verify only accepts listable pack types")
+	}
+	expected, err := listFunc(ctx, wareID, warehouses, mon)
+	if err != nil {
+		return fmt.Sprintf(" (could not list the ware to find the differences: %s)", err)
+	}
+	defer expected.Close()
+	changes, err := diffBuckets(expected, bucket)
+	if err != nil {
+		return fmt.Sprintf(" (could not list the ware to find the differences: %s)", err)
+	}
+	var lines []string
+	for i, change := range changes {
+		if i == verifyMaxListed {
+			lines = append(lines, fmt.Sprintf("  ... and %d more", len(changes)-i))
+			break
+		}
+		lines = append(lines, "  "+describeChange(change))
+	}
+	return "; differences:\n" + strings.Join(lines, "\n")
+}
@@ -54,6 +54,25 @@ func GetMountWorkPath() fs.AbsolutePath {
 	return fs.MustAbsolutePath(pth)
 }
 
+/*
+	Return the path where stat caches are kept, for speeding up repeated packs
+	of the same paths.
+
+	The default value is `"$RIO_BASE/statcache"`;
+	this can be overriden by the `RIO_STATCACHE` environment variable.
+*/
+func GetStatCachePath() fs.AbsolutePath {
+	pth := os.Getenv("RIO_STATCACHE")
+	if pth == "" {
+		return GetRioBasePath().Join(fs.MustRelPath("statcache"))
+	}
+	pth, err := filepath.Abs(pth)
+	if err != nil {
+		panic(err)
+	}
+	return fs.MustAbsolutePath(pth)
+}
+
 /*
 	Return the home-base path prefix that is the default root for all other Rio paths.
 
@@ -71,3 +90,29 @@ func GetRioBasePath() fs.AbsolutePath {
 	}
 	return fs.MustAbsolutePath(pth)
 }
+
+type CacheDedupMode string
+
+const (
+	CacheDedup_None     CacheDedupMode = "none"
+	CacheDedup_Hardlink CacheDedupMode = "hardlink"
+	CacheDedup_Reflink  CacheDedupMode = "reflink"
+)
+
+/*
+	Return the mode in which fileset cache shelves should share file content
+	with each other.
+
+	The default value is `"none"` (every shelf is a full copy);
+	this can be overriden by the `RIO_CACHE_DEDUP` environment variable,
+	which may be set to `"hardlink"` or `"reflink"`.
+	Unrecognized values are treated as `"none"`.
+*/
+func GetCacheDedupMode() CacheDedupMode {
+	switch mode := CacheDedupMode(os.Getenv("RIO_CACHE_DEDUP")); mode {
+	case CacheDedup_Hardlink, CacheDedup_Reflink:
+		return mode
+	default:
+		return CacheDedup_None
+	}
+}
@@ -40,7 +40,8 @@ const (
 		Note that any function returning ErrBreakout is, by nature, doing so in a
 		best-effort sense: if there are concurrent modifcations to the operational
 		area of the filesystem by any other processes, it is *impossible* to
-		avoid a TOCTOU violation.
+		avoid a TOCTOU violation -- unless the filesystem does every op relative
+		to an open dir, refusing symlinks, as the one from osfs.NewConfined does.
 	*/
 	ErrBreakout ErrorCategory = "fs-breakout"
 )
@@ -0,0 +1,325 @@
+/*
+	faultfs wraps another filesystem, and makes it fail on cue: on the Nth
+	call of an op, on paths matching a pattern, or once some number of
+	bytes have been written to (or read from) its files.
+
+	It's for testing error handling.  Injected errors come back the way
+	osfs would return the same error from the OS: normalized into fs error
+	categories by the FS's ops, and raw from the files' ops, as from an
+	os.File.  So e.g. a write failing with ENOSPC reaches PlaceFile raw,
+	just as it would off a real disk.
+*/
+package faultfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/polydawn/rio/fs"
+)
+
+/*
+	A Fault says which calls fail, and how.
+	Every condition given must match; zero values match anything.
+*/
+type Fault struct {
+	// The name of the op: a method of fs.FS ("OpenFile", "Mkdir", ...),
+	// or "Read", "Write", or "Close" for the files it opened.
+	// ReadAt and WriteAt count as Read and Write.
+	Op string
+
+	// A pattern (as for path.Match) for the path of the op, in the form
+	// RelPath.String gives: e.g. "./etc/*".  Files' ops have the path
+	// they were opened with.
+	Path string
+
+	// If nonzero, only the Nth call (counting from 1) matching the above
+	// fails; otherwise, every one does.
+	Nth int
+
+	// If nonzero, only Read and Write can match, and this many bytes
+	// (across every call matching the above) go through before they fail.
+	// The call that crosses the limit goes through in part.  Nth is ignored.
+	AfterBytes int64
+
+	// The error, as the OS would give it: e.g. syscall.ENOSPC.
+	// If nil: Write is made short, and Read ends early (with io.EOF),
+	// without other errors; and anything else fails with EIO.
+	Err error
+}
+
+/*
+	Wraps the given filesystem, injecting the faults given.  If a call
+	matches several, the first listed wins.
+
+	The faults are counted per FS; wrap afresh to start them over.
+*/
+func New(afs fs.FS, faults ...Fault) *FS {
+	ffs := &FS{inner: afs}
+	for _, f := range faults {
+		ffs.faults = append(ffs.faults, &fault{Fault: f})
+	}
+	return ffs
+}
+
+type FS struct {
+	inner  fs.FS
+	mu     sync.Mutex
+	faults []*fault
+}
+
+var _ fs.FS = &FS{}
+
+type fault struct {
+	Fault
+	calls int   // how many calls have matched.
+	bytes int64 // how many bytes have gone through, if counting them.
+}
+
+func (f *fault) matches(op string, p fs.RelPath) bool {
+	if f.Op != "" && f.Op != op {
+		return false
+	}
+	if f.Path != "" {
+		if ok, _ := path.Match(f.Path, p.String()); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+	Counts a call, of an op moving n bytes (or none, for all but Read
+	and Write), against every fault; and returns how many of those bytes
+	may go through, and the fault tripped, if any.
+*/
+func (afs *FS) trip(op string, p fs.RelPath, n int) (int, *fault) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	var tripped *fault
+	allowed := n
+	for _, f := range afs.faults {
+		if !f.matches(op, p) {
+			continue
+		}
+		if f.AfterBytes != 0 {
+			if remaining := f.AfterBytes - f.bytes; (op == "Read" || op == "Write") && int64(allowed) > remaining {
+				allowed = int(remaining)
+				if tripped == nil {
+					tripped = f
+				}
+			}
+			continue
+		}
+		f.calls++
+		if (f.Nth == 0 || f.calls == f.Nth) && tripped == nil {
+			tripped, allowed = f, 0
+		}
+	}
+	afs.count(op, p, int64(allowed))
+	return allowed, tripped
+}
+
+// Counts bytes against every fault counting them.  Must hold the lock.
+func (afs *FS) count(op string, p fs.RelPath, n int64) {
+	if op != "Read" && op != "Write" {
+		return
+	}
+	for _, f := range afs.faults {
+		if f.AfterBytes != 0 && f.matches(op, p) {
+			f.bytes += n
+		}
+	}
+}
+
+// Takes back bytes counted by trip, which didn't go through after all.
+func (afs *FS) refund(op string, p fs.RelPath, n int) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	afs.count(op, p, -int64(n))
+}
+
+// Checks an FS op for faults, returning the error as osfs would.
+func (afs *FS) check(op string, p fs.RelPath) error {
+	_, f := afs.trip(op, p, 0)
+	if f == nil {
+		return nil
+	}
+	err := f.Err
+	if err == nil {
+		err = syscall.EIO
+	}
+	return fs.NormalizeIOError(&os.PathError{Op: strings.ToLower(op), Path: p.String(), Err: err})
+}
+
+func (afs *FS) BasePath() fs.AbsolutePath {
+	return afs.inner.BasePath()
+}
+
+func (afs *FS) OpenFile(path fs.RelPath, flag int, perms fs.Perms) (fs.File, error) {
+	if err := afs.check("OpenFile", path); err != nil {
+		return nil, err
+	}
+	f, err := afs.inner.OpenFile(path, flag, perms)
+	if err != nil {
+		return nil, err
+	}
+	return &file{File: f, afs: afs, name: path}, nil
+}
+
+func (afs *FS) Mkdir(path fs.RelPath, perms fs.Perms) error {
+	if err := afs.check("Mkdir", path); err != nil {
+		return err
+	}
+	return afs.inner.Mkdir(path, perms)
+}
+
+func (afs *FS) Mklink(path fs.RelPath, target string) error {
+	if err := afs.check("Mklink", path); err != nil {
+		return err
+	}
+	return afs.inner.Mklink(path, target)
+}
+
+func (afs *FS) Mkfifo(path fs.RelPath, perms fs.Perms) error {
+	if err := afs.check("Mkfifo", path); err != nil {
+		return err
+	}
+	return afs.inner.Mkfifo(path, perms)
+}
+
+func (afs *FS) MkdevBlock(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
+	if err := afs.check("MkdevBlock", path); err != nil {
+		return err
+	}
+	return afs.inner.MkdevBlock(path, major, minor, perms)
+}
+
+func (afs *FS) MkdevChar(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
+	if err := afs.check("MkdevChar", path); err != nil {
+		return err
+	}
+	return afs.inner.MkdevChar(path, major, minor, perms)
+}
+
+func (afs *FS) Lchown(path fs.RelPath, uid uint32, gid uint32) error {
+	if err := afs.check("Lchown", path); err != nil {
+		return err
+	}
+	return afs.inner.Lchown(path, uid, gid)
+}
+
+func (afs *FS) Chmod(path fs.RelPath, perms fs.Perms) error {
+	if err := afs.check("Chmod", path); err != nil {
+		return err
+	}
+	return afs.inner.Chmod(path, perms)
+}
+
+func (afs *FS) SetTimesLNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
+	if err := afs.check("SetTimesLNano", path); err != nil {
+		return err
+	}
+	return afs.inner.SetTimesLNano(path, mtime, atime)
+}
+
+func (afs *FS) SetTimesNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
+	if err := afs.check("SetTimesNano", path); err != nil {
+		return err
+	}
+	return afs.inner.SetTimesNano(path, mtime, atime)
+}
+
+func (afs *FS) Stat(path fs.RelPath) (*fs.Metadata, error) {
+	if err := afs.check("Stat", path); err != nil {
+		return nil, err
+	}
+	return afs.inner.Stat(path)
+}
+
+func (afs *FS) LStat(path fs.RelPath) (*fs.Metadata, error) {
+	if err := afs.check("LStat", path); err != nil {
+		return nil, err
+	}
+	return afs.inner.LStat(path)
+}
+
+func (afs *FS) ReadDirNames(path fs.RelPath) ([]string, error) {
+	if err := afs.check("ReadDirNames", path); err != nil {
+		return nil, err
+	}
+	return afs.inner.ReadDirNames(path)
+}
+
+func (afs *FS) Readlink(path fs.RelPath) (string, bool, error) {
+	if err := afs.check("Readlink", path); err != nil {
+		return "", false, err
+	}
+	return afs.inner.Readlink(path)
+}
+
+func (afs *FS) ResolveLink(symlink string, startingAt fs.RelPath) (fs.RelPath, error) {
+	if err := afs.check("ResolveLink", startingAt); err != nil {
+		return startingAt, err
+	}
+	return afs.inner.ResolveLink(symlink, startingAt)
+}
+
+// An open file.  Seeks go straight through; all else can be made to fail.
+type file struct {
+	fs.File
+	afs  *FS
+	name fs.RelPath
+}
+
+func (f *file) Read(bs []byte) (int, error) {
+	return f.do("Read", bs, f.File.Read)
+}
+
+func (f *file) ReadAt(bs []byte, off int64) (int, error) {
+	return f.do("Read", bs, func(bs []byte) (int, error) { return f.File.ReadAt(bs, off) })
+}
+
+func (f *file) Write(bs []byte) (int, error) {
+	return f.do("Write", bs, f.File.Write)
+}
+
+func (f *file) WriteAt(bs []byte, off int64) (int, error) {
+	return f.do("Write", bs, func(bs []byte) (int, error) { return f.File.WriteAt(bs, off) })
+}
+
+// Does a read or write of as much as the faults allow; then fails it, if one tripped.
+func (f *file) do(op string, bs []byte, fn func([]byte) (int, error)) (int, error) {
+	allowed, flt := f.afs.trip(op, f.name, len(bs))
+	n, err := fn(bs[:allowed])
+	if n < allowed {
+		f.afs.refund(op, f.name, allowed-n)
+	}
+	switch {
+	case err != nil || n < allowed || flt == nil:
+		return n, err
+	case flt.Err != nil:
+		return n, &os.PathError{Op: strings.ToLower(op), Path: f.name.String(), Err: flt.Err}
+	case op == "Read":
+		return n, io.EOF
+	default:
+		return n, nil // a short write.
+	}
+}
+
+func (f *file) Close() error {
+	if _, flt := f.afs.trip("Close", f.name, 0); flt != nil {
+		f.File.Close() // it's closed regardless, as an os.File would be.
+		err := flt.Err
+		if err == nil {
+			err = syscall.EIO
+		}
+		return &os.PathError{Op: "close", Path: f.name.String(), Err: err}
+	}
+	return f.File.Close()
+}
@@ -0,0 +1,126 @@
+package faultfs
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/memfs"
+	"github.com/polydawn/rio/fs/tests"
+)
+
+func TestAll(t *testing.T) {
+	Convey("faultfs (with no faults) spec compliance tests", t, func() {
+		afs := New(memfs.New())
+
+		tests.CheckBaseLstat(afs)
+		tests.CheckMkdirLstatRoundtrip(afs)
+		tests.CheckDeepMkdirError(afs)
+		tests.CheckMklinkLstatRoundtrip(afs)
+		tests.CheckSymlinks(afs)
+		tests.CheckPerniciousSymlinks(afs)
+		tests.CheckOpsTraversingSymlinks(afs)
+	})
+}
+
+func TestFaults(t *testing.T) {
+	Convey("faultfs", t, func() {
+		inner := memfs.New()
+		write := func(afs fs.FS, name string, chunks ...string) (int, error) {
+			f, err := afs.OpenFile(fs.MustRelPath(name), os.O_CREATE|os.O_WRONLY, 0644)
+			So(err, ShouldBeNil)
+			defer f.Close()
+			total := 0
+			for _, chunk := range chunks {
+				n, err := f.Write([]byte(chunk))
+				total += n
+				if err != nil || n < len(chunk) {
+					return total, err
+				}
+			}
+			return total, nil
+		}
+
+		Convey("ops fail with the error categories osfs would give", func() {
+			for errno, category := range map[error]fs.ErrorCategory{
+				syscall.ENOENT:  fs.ErrNotExists,
+				syscall.EEXIST:  fs.ErrAlreadyExists,
+				syscall.ENOTDIR: fs.ErrNotDir,
+				syscall.EACCES:  fs.ErrPermission,
+				syscall.EPERM:   fs.ErrPermission,
+				syscall.ENOSPC:  fs.ErrMisc,
+				nil:             fs.ErrMisc,
+			} {
+				afs := New(inner, Fault{Op: "Mkdir", Err: errno})
+				So(Category(afs.Mkdir(fs.MustRelPath("d"), 0755)), ShouldEqual, category)
+			}
+			Convey("and without doing anything", func() {
+				_, err := inner.LStat(fs.MustRelPath("d"))
+				So(Category(err), ShouldEqual, fs.ErrNotExists)
+			})
+		})
+		Convey("only the Nth call should fail, if asked", func() {
+			afs := New(inner, Fault{Op: "Mkdir", Nth: 2, Err: syscall.EACCES})
+			So(afs.Mkdir(fs.MustRelPath("a"), 0755), ShouldBeNil)
+			So(Category(afs.Mkdir(fs.MustRelPath("b"), 0755)), ShouldEqual, fs.ErrPermission)
+			So(afs.Mkdir(fs.MustRelPath("c"), 0755), ShouldBeNil)
+		})
+		Convey("only paths matching the pattern should fail", func() {
+			afs := New(inner, Fault{Path: "./a/*", Err: syscall.EACCES})
+			So(afs.Mkdir(fs.MustRelPath("a"), 0755), ShouldBeNil)
+			So(Category(afs.Mkdir(fs.MustRelPath("a/b"), 0755)), ShouldEqual, fs.ErrPermission)
+			_, err := afs.LStat(fs.MustRelPath("a/b"))
+			So(Category(err), ShouldEqual, fs.ErrPermission)
+			_, err = afs.LStat(fs.MustRelPath("a"))
+			So(err, ShouldBeNil)
+		})
+		Convey("writes should fail after so many bytes", func() {
+			Convey("short, with no error given", func() {
+				afs := New(inner, Fault{Op: "Write", AfterBytes: 5})
+				n, err := write(afs, "f", "abc", "defg", "h")
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 5)
+				n, err = write(afs, "g", "ijk")
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 0)
+				body, _ := ioutil.ReadAll(shouldOpen(inner, "f"))
+				So(string(body), ShouldEqual, "abcde")
+			})
+			Convey("with the error given, raw, as an os.File's would be", func() {
+				afs := New(inner, Fault{Op: "Write", Path: "./f", AfterBytes: 5, Err: syscall.ENOSPC})
+				n, err := write(afs, "f", "abc", "defg")
+				So(n, ShouldEqual, 5)
+				So(err, ShouldHaveSameTypeAs, &os.PathError{})
+				So(err.(*os.PathError).Err, ShouldEqual, syscall.ENOSPC)
+				n, err = write(afs, "g", "abc", "defg")
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 7)
+			})
+		})
+		Convey("reads should end early after so many bytes", func() {
+			_, err := write(inner, "f", "abcdefgh")
+			So(err, ShouldBeNil)
+			afs := New(inner, Fault{Op: "Read", AfterBytes: 3})
+			body, err := ioutil.ReadAll(shouldOpen(afs, "f"))
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, "abc")
+		})
+		Convey("closes should fail, if asked", func() {
+			afs := New(inner, Fault{Op: "Close", Err: syscall.EIO})
+			f, err := afs.OpenFile(fs.MustRelPath("f"), os.O_CREATE|os.O_WRONLY, 0644)
+			So(err, ShouldBeNil)
+			So(f.Close(), ShouldNotBeNil)
+		})
+	})
+}
+
+func shouldOpen(afs fs.FS, name string) fs.File {
+	f, err := afs.OpenFile(fs.MustRelPath(name), os.O_RDONLY, 0)
+	So(err, ShouldBeNil)
+	return f
+}
@@ -0,0 +1,398 @@
+/*
+	memfs is a filesystem entirely in memory: files, dirs, symlinks, fifos,
+	and devices, with their perms, ownership, and mtimes.
+
+	It behaves as osfs does (down to error categories), as if run by
+	root: there are no permission checks, and chown always works.  Symlinks
+	are resolved the same way, as if the FS root were the real root.  New
+	files are owned by the uid and gid of the process, as they'd be on disk.
+
+	This makes it handy for unpacking a ware just to look at it, and for
+	tests which would rather not need a tmpdir (or root).
+*/
+package memfs
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+
+	"github.com/polydawn/rio/fs"
+)
+
+var (
+	myUid = uint32(os.Getuid())
+	myGid = uint32(os.Getgid())
+)
+
+/*
+	Returns a new, empty filesystem: just a root dir.
+	Its BasePath is "/", since it has none.
+*/
+func New() *FS {
+	return &FS{root: newNode(fs.Type_Dir, 0755)}
+}
+
+type FS struct {
+	mu   sync.Mutex // guards every node, and every file's contents.
+	root *node
+}
+
+var _ fs.FS = &FS{}
+
+type node struct {
+	fs.Metadata                  // Name isn't kept up to date; Size is only set when stat'd.
+	body        []byte           // if file: the contents.
+	children    map[string]*node // if dir: the entries.
+}
+
+func newNode(t fs.Type, perms fs.Perms) *node {
+	n := &node{Metadata: fs.Metadata{
+		Type:  t,
+		Perms: perms & 07777,
+		Uid:   myUid,
+		Gid:   myGid,
+		Mtime: time.Now(),
+	}}
+	if t == fs.Type_Dir {
+		n.children = map[string]*node{}
+	}
+	return n
+}
+
+func (afs *FS) BasePath() fs.AbsolutePath {
+	return fs.AbsolutePath{}
+}
+
+func (afs *FS) OpenFile(path fs.RelPath, flag int, perms fs.Perms) (fs.File, error) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	rpath, err := afs.resolve(path, false)
+	if err != nil {
+		return nil, err
+	}
+	// Follow a symlink in the last segment, as the OS would;
+	//  unless it's an exclusive create, which the OS would refuse.
+	if n, err := afs.get(rpath); err == nil && n.Type == fs.Type_Symlink && flag&os.O_EXCL == 0 {
+		rpath, err = afs.resolveLink(n.Linkname, rpath, map[fs.RelPath]struct{}{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	n, err := afs.get(rpath)
+	switch {
+	case Category(err) == fs.ErrNotExists && flag&os.O_CREATE != 0:
+		n = newNode(fs.Type_File, perms)
+		if err := afs.put(rpath, n); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, Errorf(fs.ErrAlreadyExists, "open %s: file exists", rpath)
+	case n.Type != fs.Type_File:
+		return nil, Errorf(fs.ErrMisc, "open %s: not a regular file (a %s)", rpath, n.Type)
+	case flag&os.O_TRUNC != 0:
+		n.body = nil
+		n.Mtime = time.Now()
+	}
+	return &file{afs: afs, n: n, name: rpath, flag: flag}, nil
+}
+
+func (afs *FS) Mkdir(path fs.RelPath, perms fs.Perms) error {
+	return afs.make(path, newNode(fs.Type_Dir, perms))
+}
+
+func (afs *FS) Mklink(path fs.RelPath, target string) error {
+	n := newNode(fs.Type_Symlink, 0777)
+	n.Linkname = target
+	return afs.make(path, n)
+}
+
+func (afs *FS) Mkfifo(path fs.RelPath, perms fs.Perms) error {
+	return afs.make(path, newNode(fs.Type_NamedPipe, perms))
+}
+
+func (afs *FS) MkdevBlock(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
+	n := newNode(fs.Type_Device, perms)
+	n.Devmajor, n.Devminor = major, minor
+	return afs.make(path, n)
+}
+
+func (afs *FS) MkdevChar(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
+	n := newNode(fs.Type_CharDevice, perms)
+	n.Devmajor, n.Devminor = major, minor
+	return afs.make(path, n)
+}
+
+func (afs *FS) make(path fs.RelPath, n *node) error {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	rpath, err := afs.resolve(path, false)
+	if err != nil {
+		return err
+	}
+	if rpath == (fs.RelPath{}) {
+		return Errorf(fs.ErrAlreadyExists, "mkdir %s: file exists", rpath)
+	}
+	return afs.put(rpath, n)
+}
+
+func (afs *FS) Lchown(path fs.RelPath, uid uint32, gid uint32) error {
+	return afs.update(path, false, func(n *node) {
+		n.Uid, n.Gid = uid, gid
+	})
+}
+
+func (afs *FS) Chmod(path fs.RelPath, perms fs.Perms) error {
+	return afs.update(path, true, func(n *node) {
+		n.Perms = perms & 07777
+	})
+}
+
+func (afs *FS) SetTimesLNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
+	return afs.update(path, false, func(n *node) {
+		n.Mtime = mtime
+	})
+}
+
+func (afs *FS) SetTimesNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
+	return afs.update(path, true, func(n *node) {
+		n.Mtime = mtime
+	})
+}
+
+func (afs *FS) update(path fs.RelPath, resolveLast bool, fn func(*node)) error {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	rpath, err := afs.resolve(path, resolveLast)
+	if err != nil {
+		return err
+	}
+	n, err := afs.get(rpath)
+	if err != nil {
+		return err
+	}
+	fn(n)
+	return nil
+}
+
+func (afs *FS) Stat(path fs.RelPath) (*fs.Metadata, error) {
+	return afs.stat(path, true)
+}
+
+func (afs *FS) LStat(path fs.RelPath) (*fs.Metadata, error) {
+	return afs.stat(path, false)
+}
+
+func (afs *FS) stat(path fs.RelPath, resolveLast bool) (*fs.Metadata, error) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	rpath, err := afs.resolve(path, resolveLast)
+	if err != nil {
+		return nil, err
+	}
+	n, err := afs.get(rpath)
+	if err != nil {
+		return nil, err
+	}
+	fmeta := n.Metadata
+	fmeta.Name = path
+	if n.Type == fs.Type_File {
+		fmeta.Size = int64(len(n.body))
+	}
+	return &fmeta, nil
+}
+
+func (afs *FS) ReadDirNames(path fs.RelPath) ([]string, error) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	rpath, err := afs.resolve(path, true)
+	if err != nil {
+		return nil, err
+	}
+	n, err := afs.get(rpath)
+	if err != nil {
+		return nil, err
+	}
+	if n.Type != fs.Type_Dir {
+		return nil, Errorf(fs.ErrNotDir, "readdirent %s: not a directory", rpath)
+	}
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (afs *FS) Readlink(path fs.RelPath) (string, bool, error) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	rpath, err := afs.resolve(path, false)
+	if err != nil {
+		return "", false, err
+	}
+	return afs.readlink(rpath)
+}
+
+func (afs *FS) ResolveLink(symlink string, startingAt fs.RelPath) (fs.RelPath, error) {
+	if startingAt.GoesUp() {
+		return startingAt, Errorf(fs.ErrBreakout, "fs: invalid path %q: must not depart basepath", startingAt)
+	}
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	return afs.resolveLink(symlink, startingAt, map[fs.RelPath]struct{}{})
+}
+
+/*
+	Returns the path an op on the given path would act on, following
+	symlinks just as the ops do (in the last segment too, if resolveLast).
+
+	This is for filesystems built atop a memfs which keep more about each
+	file than it does, and need to know which file a path lands on.
+*/
+func (afs *FS) Resolve(path fs.RelPath, resolveLast bool) (fs.RelPath, error) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	return afs.resolve(path, resolveLast)
+}
+
+// Returns the node at the path, which must already be resolved:
+//  no segment is followed if it's a symlink.
+func (afs *FS) get(rpath fs.RelPath) (*node, error) {
+	n := afs.root
+	if rpath == (fs.RelPath{}) {
+		return n, nil
+	}
+	for _, segment := range strings.Split(rpath.String(), "/")[1:] {
+		if n.Type != fs.Type_Dir {
+			return nil, Errorf(fs.ErrNotDir, "lstat %s: not a directory", rpath)
+		}
+		child, ok := n.children[segment]
+		if !ok {
+			return nil, Errorf(fs.ErrNotExists, "lstat %s: no such file or directory", rpath)
+		}
+		n = child
+	}
+	return n, nil
+}
+
+// Puts a new node at the path (which must already be resolved, and mustn't exist).
+func (afs *FS) put(rpath fs.RelPath, n *node) error {
+	parent, err := afs.get(rpath.Dir())
+	if err != nil {
+		return err
+	}
+	if parent.Type != fs.Type_Dir {
+		return Errorf(fs.ErrNotDir, "%s: not a directory", rpath.Dir())
+	}
+	if _, exists := parent.children[rpath.Last()]; exists {
+		return Errorf(fs.ErrAlreadyExists, "%s: file exists", rpath)
+	}
+	parent.children[rpath.Last()] = n
+	parent.Mtime = time.Now()
+	return nil
+}
+
+func (afs *FS) readlink(rpath fs.RelPath) (string, bool, error) {
+	n, err := afs.get(rpath)
+	if err != nil {
+		return "", false, err
+	}
+	if n.Type != fs.Type_Symlink {
+		return "", false, nil
+	}
+	return n.Linkname, true, nil
+}
+
+/*
+	Resolves a path, following symlinks in every segment but the last
+	(and the last too, if resolveLast), just as osfs does.
+
+	A path which doesn't exist isn't an error here (unless a segment before
+	the last is missing); the op on the resolved path will say so.
+*/
+func (afs *FS) resolve(path fs.RelPath, resolveLast bool) (fs.RelPath, error) {
+	if path.GoesUp() {
+		return path, Errorf(fs.ErrBreakout, "fs: invalid path %q: must not depart basepath", path)
+	}
+	if path == (fs.RelPath{}) {
+		return path, nil
+	}
+	segments := strings.Split(path.String(), "/")[1:]
+	iLast := len(segments) - 1
+	resolved := fs.RelPath{}
+	for i, segment := range segments {
+		resolved = resolved.Join(fs.MustRelPath(segment))
+		if i == iLast && !resolveLast {
+			return resolved, nil
+		}
+		target, isLink, err := afs.readlink(resolved)
+		if err != nil {
+			if i == iLast && Category(err) == fs.ErrNotExists {
+				return resolved, nil
+			}
+			return resolved, err
+		}
+		if isLink {
+			resolved, err = afs.resolveLink(target, resolved, map[fs.RelPath]struct{}{})
+			if err != nil {
+				return resolved, err
+			}
+		}
+	}
+	return resolved, nil
+}
+
+func (afs *FS) resolveLink(symlink string, startingAt fs.RelPath, seen map[fs.RelPath]struct{}) (fs.RelPath, error) {
+	if _, isSeen := seen[startingAt]; isSeen {
+		return startingAt, Errorf(fs.ErrRecursion, "cyclic symlinks detected from %q", startingAt)
+	}
+	seen[startingAt] = struct{}{}
+	segments := strings.Split(symlink, "/")
+	path := startingAt
+	if segments[0] == "" { // rooted
+		path = fs.RelPath{}
+		segments = segments[1:]
+	} else {
+		path = startingAt.Dir() // drop the link node itself
+	}
+	iLast := len(segments) - 1
+	for i, s := range segments {
+		// Identity segments can simply be skipped.
+		if s == "" || s == "." {
+			continue
+		}
+		// Excessive up segements aren't an error; they simply no-op when already at root.
+		if s == ".." {
+			path = path.Dir()
+			continue
+		}
+		// Okay, join the segment and peek at it.
+		path = path.Join(fs.MustRelPath(s))
+		// Bail on cycles before considering recursion!
+		if path == startingAt {
+			return startingAt, Errorf(fs.ErrRecursion, "cyclic symlinks detected from %q", startingAt)
+		}
+		// Check if this is a symlink; if so we must recurse on it.
+		morelink, isLink, err := afs.readlink(path)
+		if err != nil {
+			if i == iLast && Category(err) == fs.ErrNotExists {
+				return path, nil
+			}
+			return startingAt, err
+		}
+		if isLink {
+			path, err = afs.resolveLink(morelink, path, seen)
+			if err != nil {
+				return startingAt, err
+			}
+		}
+	}
+	return path, nil
+}
@@ -0,0 +1,139 @@
+package memfs
+
+import (
+	"io"
+	"os"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+
+	"github.com/polydawn/rio/fs"
+)
+
+var _ fs.File = &file{}
+
+// An open file.  Like an os.File, it has its own offset, and its writes
+//  land in the node, for all to see, straight away.
+type file struct {
+	afs    *FS
+	n      *node
+	name   fs.RelPath
+	flag   int
+	off    int64
+	closed bool
+}
+
+func (f *file) Close() error {
+	f.afs.mu.Lock()
+	defer f.afs.mu.Unlock()
+	if f.closed {
+		return Errorf(fs.ErrMisc, "close %s: %s", f.name, os.ErrClosed)
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *file) Read(bs []byte) (int, error) {
+	f.afs.mu.Lock()
+	defer f.afs.mu.Unlock()
+	n, err := f.readAt(bs, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *file) ReadAt(bs []byte, off int64) (int, error) {
+	f.afs.mu.Lock()
+	defer f.afs.mu.Unlock()
+	n, err := f.readAt(bs, off)
+	if err == nil && n < len(bs) {
+		err = io.EOF // ReadAt doesn't get to return short without saying why.
+	}
+	return n, err
+}
+
+func (f *file) readAt(bs []byte, off int64) (int, error) {
+	if err := f.check("read", os.O_WRONLY); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, Errorf(fs.ErrMisc, "read %s: negative offset", f.name)
+	}
+	if off >= int64(len(f.n.body)) {
+		return 0, io.EOF
+	}
+	return copy(bs, f.n.body[off:]), nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.afs.mu.Lock()
+	defer f.afs.mu.Unlock()
+	if f.closed {
+		return 0, Errorf(fs.ErrMisc, "seek %s: %s", f.name, os.ErrClosed)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.n.body))
+	}
+	if offset < 0 {
+		return 0, Errorf(fs.ErrMisc, "seek %s: invalid argument", f.name)
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *file) Write(bs []byte) (int, error) {
+	f.afs.mu.Lock()
+	defer f.afs.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.off = int64(len(f.n.body))
+	}
+	n, err := f.writeAt(bs, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *file) WriteAt(bs []byte, off int64) (int, error) {
+	f.afs.mu.Lock()
+	defer f.afs.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		return 0, Errorf(fs.ErrMisc, "write %s: invalid use of WriteAt on file opened with O_APPEND", f.name)
+	}
+	return f.writeAt(bs, off)
+}
+
+func (f *file) writeAt(bs []byte, off int64) (int, error) {
+	if err := f.check("write", os.O_RDONLY); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, Errorf(fs.ErrMisc, "write %s: negative offset", f.name)
+	}
+	if size, end := int64(len(f.n.body)), off+int64(len(bs)); end > size {
+		if end > int64(cap(f.n.body)) {
+			body := make([]byte, size, end*2)
+			copy(body, f.n.body)
+			f.n.body = body
+		}
+		f.n.body = f.n.body[:end]
+		hole := f.n.body[size:] // a write past the end leaves a hole of zeros.
+		for i := range hole {
+			hole[i] = 0
+		}
+	}
+	copy(f.n.body[off:], bs)
+	f.n.Mtime = time.Now()
+	return len(bs), nil
+}
+
+// Errors if the file's closed, or was opened with the given access mode (which forbids the op).
+func (f *file) check(op string, forbidden int) error {
+	switch {
+	case f.closed:
+		return Errorf(fs.ErrMisc, "%s %s: %s", op, f.name, os.ErrClosed)
+	case f.flag&(os.O_RDONLY|os.O_WRONLY|os.O_RDWR) == forbidden:
+		return Errorf(fs.ErrMisc, "%s %s: bad file descriptor", op, f.name)
+	}
+	return nil
+}
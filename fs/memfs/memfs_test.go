@@ -0,0 +1,137 @@
+package memfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/tests"
+)
+
+func TestAll(t *testing.T) {
+	Convey("memfs spec compliance tests", t, func() {
+		afs := New()
+
+		tests.CheckBaseLstat(afs)
+		tests.CheckMkdirLstatRoundtrip(afs)
+		tests.CheckDeepMkdirError(afs)
+		tests.CheckMklinkLstatRoundtrip(afs)
+		tests.CheckSymlinks(afs)
+		tests.CheckPerniciousSymlinks(afs)
+		tests.CheckOpsTraversingSymlinks(afs)
+	})
+}
+
+func TestMemfs(t *testing.T) {
+	Convey("memfs", t, func() {
+		afs := New()
+
+		Convey("files hold what's written to them, with their attributes", func() {
+			f, err := afs.OpenFile(fs.MustRelPath("f"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+			So(err, ShouldBeNil)
+			_, err = f.Write([]byte("hello"))
+			So(err, ShouldBeNil)
+			_, err = f.WriteAt([]byte("!"), 7)
+			So(err, ShouldBeNil)
+			_, err = f.Read(make([]byte, 1))
+			So(err, ShouldNotBeNil) // opened write-only.
+			So(f.Close(), ShouldBeNil)
+
+			mtime := time.Date(2004, 10, 14, 4, 3, 2, 1, time.UTC)
+			So(afs.Lchown(fs.MustRelPath("f"), 1234, 5678), ShouldBeNil)
+			So(afs.SetTimesNano(fs.MustRelPath("f"), mtime, fs.DefaultTime), ShouldBeNil)
+			fmeta, err := afs.LStat(fs.MustRelPath("f"))
+			So(err, ShouldBeNil)
+			So(*fmeta, ShouldResemble, fs.Metadata{
+				Name:  fs.MustRelPath("f"),
+				Type:  fs.Type_File,
+				Perms: 0640,
+				Uid:   1234,
+				Gid:   5678,
+				Size:  8,
+				Mtime: mtime,
+			})
+
+			f, err = afs.OpenFile(fs.MustRelPath("f"), os.O_RDONLY, 0)
+			So(err, ShouldBeNil)
+			body, err := ioutil.ReadAll(f)
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, "hello\x00\x00!")
+			_, err = f.Seek(-3, io.SeekEnd)
+			So(err, ShouldBeNil)
+			body, err = ioutil.ReadAll(f)
+			So(string(body), ShouldEqual, "\x00\x00!")
+			So(f.Close(), ShouldBeNil)
+
+			Convey("and can't be made twice, exclusively", func() {
+				_, err := afs.OpenFile(fs.MustRelPath("f"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+				So(Category(err), ShouldEqual, fs.ErrAlreadyExists)
+			})
+			Convey("and can be truncated", func() {
+				f, err := afs.OpenFile(fs.MustRelPath("f"), os.O_TRUNC|os.O_WRONLY, 0)
+				So(err, ShouldBeNil)
+				So(f.Close(), ShouldBeNil)
+				fmeta, err := afs.LStat(fs.MustRelPath("f"))
+				So(err, ShouldBeNil)
+				So(fmeta.Size, ShouldEqual, 0)
+			})
+			Convey("but aren't dirs", func() {
+				So(Category(afs.Mkdir(fs.MustRelPath("f/d"), 0755)), ShouldEqual, fs.ErrNotDir)
+				_, err := afs.ReadDirNames(fs.MustRelPath("f"))
+				So(Category(err), ShouldEqual, fs.ErrNotDir)
+			})
+		})
+		Convey("devices and fifos keep their numbers and perms", func() {
+			So(afs.MkdevChar(fs.MustRelPath("null"), 1, 3, 0666), ShouldBeNil)
+			So(afs.MkdevBlock(fs.MustRelPath("sda"), 8, 0, 0660), ShouldBeNil)
+			So(afs.Mkfifo(fs.MustRelPath("pipe"), 0600), ShouldBeNil)
+			fmeta, err := afs.LStat(fs.MustRelPath("null"))
+			So(err, ShouldBeNil)
+			So(fmeta.Type, ShouldEqual, fs.Type_CharDevice)
+			So([]int64{fmeta.Devmajor, fmeta.Devminor}, ShouldResemble, []int64{1, 3})
+			fmeta, err = afs.LStat(fs.MustRelPath("sda"))
+			So(err, ShouldBeNil)
+			So(fmeta.Type, ShouldEqual, fs.Type_Device)
+			So(fmeta.Perms, ShouldEqual, fs.Perms(0660))
+			fmeta, err = afs.LStat(fs.MustRelPath("pipe"))
+			So(err, ShouldBeNil)
+			So(fmeta.Type, ShouldEqual, fs.Type_NamedPipe)
+
+			names, err := afs.ReadDirNames(fs.RelPath{})
+			So(err, ShouldBeNil)
+			So(names, ShouldResemble, []string{"null", "pipe", "sda"})
+		})
+		Convey("symlinks are followed by Stat and Chmod, and not by LStat, Lchown, or Readlink", func() {
+			So(afs.Mkdir(fs.MustRelPath("d"), 0755), ShouldBeNil)
+			So(afs.Mklink(fs.MustRelPath("l"), "/d"), ShouldBeNil)
+			So(afs.Chmod(fs.MustRelPath("l"), 0700), ShouldBeNil)
+			So(afs.Lchown(fs.MustRelPath("l"), 1, 1), ShouldBeNil)
+			fmeta, err := afs.Stat(fs.MustRelPath("l"))
+			So(err, ShouldBeNil)
+			So(fmeta.Type, ShouldEqual, fs.Type_Dir)
+			So(fmeta.Perms, ShouldEqual, fs.Perms(0700))
+			So(fmeta.Uid, ShouldEqual, myUid)
+			fmeta, err = afs.LStat(fs.MustRelPath("l"))
+			So(err, ShouldBeNil)
+			So(fmeta.Type, ShouldEqual, fs.Type_Symlink)
+			So(fmeta.Linkname, ShouldEqual, "/d")
+			So(fmeta.Uid, ShouldEqual, 1)
+			target, isLink, err := afs.Readlink(fs.MustRelPath("l"))
+			So(err, ShouldBeNil)
+			So(isLink, ShouldBeTrue)
+			So(target, ShouldEqual, "/d")
+			_, isLink, err = afs.Readlink(fs.MustRelPath("d"))
+			So(err, ShouldBeNil)
+			So(isLink, ShouldBeFalse)
+		})
+		Convey("paths out of the FS are refused", func() {
+			So(Category(afs.Mkdir(fs.MustRelPath("../d"), 0755)), ShouldEqual, fs.ErrBreakout)
+		})
+	})
+}
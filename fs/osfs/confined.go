@@ -0,0 +1,14 @@
+package osfs
+
+import (
+	"github.com/polydawn/rio/fs"
+)
+
+/*
+	ConfinedFS is the FS from NewConfined.  It may hold a dirfd of the base
+	path open; Close releases it.
+*/
+type ConfinedFS interface {
+	fs.FS
+	Close() error
+}
@@ -0,0 +1,465 @@
+//go:build linux
+// +build linux
+
+package osfs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	. "github.com/warpfork/go-errcat"
+	"golang.org/x/sys/unix"
+
+	"github.com/polydawn/rio/fs"
+)
+
+/*
+	NewConfined returns an FS which behaves like New's -- symlinks are still
+	resolved as if the base path were the root -- but which stays beneath
+	the base path even while other processes are modifying it concurrently.
+
+	Every operation is done relative to a dirfd of the base path, and the
+	path it's done on is opened with openat2's RESOLVE_BENEATH and
+	RESOLVE_NO_SYMLINKS: so if a symlink is swapped in after we resolved the
+	path, the operation fails with ErrBreakout rather than following it.
+	On kernels without openat2 (before 5.6, or where seccomp hides it), the
+	path is instead walked one segment at a time with O_NOFOLLOW, which is
+	slower but just as strict.
+
+	The base path itself is trusted: ops on it (the empty path) are done
+	by its full path, so it needn't exist yet, nor even be a dir.
+	Chmod relies on /proc being mounted.
+
+	Close it when done, to release the base path's dirfd.
+*/
+func NewConfined(basePath fs.AbsolutePath) ConfinedFS {
+	return &confinedFS{basePath: basePath}
+}
+
+type confinedFS struct {
+	basePath fs.AbsolutePath
+
+	mu   sync.Mutex
+	base *os.File // The base path's dir, opened on first use; closed by Close.
+}
+
+func (afs *confinedFS) BasePath() fs.AbsolutePath {
+	return afs.basePath
+}
+
+/*
+	Releases the base path's dirfd, if it's been opened.
+	Using the FS after this opens it again.
+*/
+func (afs *confinedFS) Close() error {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	if afs.base == nil {
+		return nil
+	}
+	err := afs.base.Close()
+	afs.base = nil
+	return err
+}
+
+func (afs *confinedFS) OpenFile(path fs.RelPath, flag int, perms fs.Perms) (fs.File, error) {
+	rpath, err := afs.resolve(path, false)
+	if err != nil {
+		return nil, err
+	}
+	// Follow a symlink in the last segment (within the base), as the OS would;
+	//  unless it's an exclusive create, which the OS would refuse.
+	if flag&os.O_EXCL == 0 {
+		if target, isLink, _ := afs.readlinkRel(rpath); isLink {
+			rpath, err = resolveLink(afs, target, rpath, map[fs.RelPath]struct{}{})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	fd, err := afs.open(rpath, flag, uint32(perms&07777))
+	if err != nil {
+		return nil, afs.pathError("open", rpath, err)
+	}
+	return os.NewFile(uintptr(fd), afs.basePath.Join(rpath).String()), nil
+}
+
+func (afs *confinedFS) Mkdir(path fs.RelPath, perms fs.Perms) error {
+	return afs.at("mkdir", path, false, func(dirfd int, name string) error {
+		return unix.Mkdirat(dirfd, name, uint32(perms&07777))
+	})
+}
+
+func (afs *confinedFS) Mklink(path fs.RelPath, target string) error {
+	return afs.at("symlink", path, false, func(dirfd int, name string) error {
+		return unix.Symlinkat(target, dirfd, name)
+	})
+}
+
+func (afs *confinedFS) Mkfifo(path fs.RelPath, perms fs.Perms) error {
+	return afs.at("mkfifo", path, false, func(dirfd int, name string) error {
+		return unix.Mknodat(dirfd, name, uint32(perms&07777)|unix.S_IFIFO, 0)
+	})
+}
+
+func (afs *confinedFS) MkdevBlock(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
+	return afs.at("mknod", path, false, func(dirfd int, name string) error {
+		return unix.Mknodat(dirfd, name, uint32(perms&07777)|unix.S_IFBLK, int(devModesJoin(major, minor)))
+	})
+}
+
+func (afs *confinedFS) MkdevChar(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
+	return afs.at("mknod", path, false, func(dirfd int, name string) error {
+		return unix.Mknodat(dirfd, name, uint32(perms&07777)|unix.S_IFCHR, int(devModesJoin(major, minor)))
+	})
+}
+
+func (afs *confinedFS) Lchown(path fs.RelPath, uid uint32, gid uint32) error {
+	return afs.at("lchown", path, false, func(dirfd int, name string) error {
+		return unix.Fchownat(dirfd, name, int(uid), int(gid), unix.AT_SYMLINK_NOFOLLOW)
+	})
+}
+
+func (afs *confinedFS) Chmod(path fs.RelPath, perms fs.Perms) error {
+	rpath, err := afs.resolve(path, true)
+	if err != nil {
+		return err
+	}
+	if rpath == (fs.RelPath{}) {
+		return fs.NormalizeIOError(os.Chmod(afs.basePath.String(), permsToOs(perms)))
+	}
+	// There's no fchmod of an O_PATH fd, nor a chmodat that won't follow
+	//  a symlink; going through the fd's magic link in proc is how libc
+	//   gets a race-free lchmod too.  (If it's a symlink, this fails.)
+	fd, err := afs.open(rpath, unix.O_PATH|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return afs.pathError("chmod", rpath, err)
+	}
+	defer unix.Close(fd)
+	err = unix.Chmod(fmt.Sprintf("/proc/self/fd/%d", fd), uint32(perms&07777))
+	return afs.pathError("chmod", rpath, err)
+}
+
+func (afs *confinedFS) SetTimesLNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
+	return afs.at("utimes", path, false, func(dirfd int, name string) error {
+		return unix.UtimesNanoAt(dirfd, name, []unix.Timespec{
+			unix.NsecToTimespec(atime.UnixNano()),
+			unix.NsecToTimespec(mtime.UnixNano()),
+		}, unix.AT_SYMLINK_NOFOLLOW)
+	})
+}
+
+func (afs *confinedFS) SetTimesNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
+	// Having resolved the whole path ourselves, there's no link left to follow.
+	return afs.at("utimes", path, true, func(dirfd int, name string) error {
+		return unix.UtimesNanoAt(dirfd, name, []unix.Timespec{
+			unix.NsecToTimespec(atime.UnixNano()),
+			unix.NsecToTimespec(mtime.UnixNano()),
+		}, unix.AT_SYMLINK_NOFOLLOW)
+	})
+}
+
+func (afs *confinedFS) Stat(path fs.RelPath) (*fs.Metadata, error) {
+	rpath, err := afs.resolve(path, true)
+	if err != nil {
+		return nil, err
+	}
+	return afs.lstat(path, rpath)
+}
+
+func (afs *confinedFS) LStat(path fs.RelPath) (*fs.Metadata, error) {
+	rpath, err := afs.resolve(path, false)
+	if err != nil {
+		return nil, err
+	}
+	return afs.lstat(path, rpath)
+}
+
+func (afs *confinedFS) lstat(path fs.RelPath, rpath fs.RelPath) (*fs.Metadata, error) {
+	fd, err := afs.open(rpath, unix.O_PATH|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, afs.pathError("lstat", rpath, err)
+	}
+	f := os.NewFile(uintptr(fd), afs.basePath.Join(rpath).String())
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fs.NormalizeIOError(err)
+	}
+	return convertFileinfo(path, fi, func() (string, error) {
+		target, err := readlinkat(fd, "")
+		return target, afs.pathError("readlink", rpath, err)
+	})
+}
+
+func (afs *confinedFS) ReadDirNames(path fs.RelPath) ([]string, error) {
+	rpath, err := afs.resolve(path, true)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := afs.open(rpath, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, afs.pathError("open", rpath, err)
+	}
+	f := os.NewFile(uintptr(fd), afs.basePath.Join(rpath).String())
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return names, fs.NormalizeIOError(err)
+	}
+	return names, nil
+}
+
+func (afs *confinedFS) Readlink(path fs.RelPath) (string, bool, error) {
+	var target string
+	var isLink bool
+	err := afs.at("readlink", path, false, func(dirfd int, name string) (err error) {
+		target, err = readlinkat(dirfd, name)
+		switch err {
+		case nil:
+			isLink = true
+		case unix.EINVAL: // not a symlink.
+			err = nil
+		}
+		return err
+	})
+	return target, isLink, err
+}
+
+func (afs *confinedFS) readlinkRel(path fs.RelPath) (string, bool, error) {
+	dirfd, err := afs.open(path.Dir(), unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return "", false, &os.PathError{Op: "readlink", Path: afs.basePath.Join(path).String(), Err: err}
+	}
+	defer unix.Close(dirfd)
+	target, err := readlinkat(dirfd, path.Last())
+	switch err {
+	case nil:
+		return target, true, nil
+	case unix.EINVAL: // not a symlink.
+		return "", false, nil
+	default:
+		return "", false, &os.PathError{Op: "readlink", Path: afs.basePath.Join(path).String(), Err: err}
+	}
+}
+
+func (afs *confinedFS) ResolveLink(symlink string, startingAt fs.RelPath) (fs.RelPath, error) {
+	if startingAt.GoesUp() {
+		return startingAt, Errorf(fs.ErrBreakout, "fs: invalid path %q: must not depart basepath", startingAt)
+	}
+	return resolveLink(afs, symlink, startingAt, map[fs.RelPath]struct{}{})
+}
+
+// Resolves a path, within the confines of the basepath, just as osFS does.
+func (afs *confinedFS) resolve(path fs.RelPath, resolveLast bool) (fs.RelPath, error) {
+	if path.GoesUp() {
+		return fs.RelPath{}, Errorf(fs.ErrBreakout, "fs: invalid path %q: must not depart basepath", path)
+	}
+	return realpath(afs, path, resolveLast)
+}
+
+/*
+	Resolves the path, then calls fn with a dirfd of the dir it's in, and
+	the name of its last segment -- for one of the `*at` syscalls.
+
+	For the base path itself, fn gets AT_FDCWD and the base's full path.
+*/
+func (afs *confinedFS) at(op string, path fs.RelPath, resolveLast bool, fn func(dirfd int, name string) error) error {
+	rpath, err := afs.resolve(path, resolveLast)
+	if err != nil {
+		return err
+	}
+	if rpath == (fs.RelPath{}) {
+		return afs.pathError(op, rpath, fn(unix.AT_FDCWD, afs.basePath.String()))
+	}
+	dirfd, err := afs.open(rpath.Dir(), unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return afs.pathError(op, rpath, err)
+	}
+	defer unix.Close(dirfd)
+	return afs.pathError(op, rpath, fn(dirfd, rpath.Last()))
+}
+
+// Returns the base path's dirfd, opening it if this is the first time it exists.
+func (afs *confinedFS) baseFd() (int, error) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	if afs.base == nil {
+		f, err := os.OpenFile(afs.basePath.String(), os.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return -1, err.(*os.PathError).Err
+		}
+		afs.base = f
+	}
+	return int(afs.base.Fd()), nil
+}
+
+/*
+	Opens the path beneath the base, without following any symlinks: the
+	path should already be resolved.  If a symlink is met, the error is
+	ELOOP; unless it's the last segment and the flags include both O_PATH
+	and O_NOFOLLOW, in which case the symlink itself is opened.
+
+	Errors are returned raw, as they come from the OS.
+*/
+func (afs *confinedFS) open(path fs.RelPath, flag int, mode uint32) (int, error) {
+	flag |= unix.O_CLOEXEC
+	if path == (fs.RelPath{}) {
+		return unix.Open(afs.basePath.String(), flag, mode) // it may even be a file.
+	}
+	dirfd, err := afs.baseFd()
+	if err != nil {
+		return -1, err
+	}
+	if flag&(unix.O_CREAT|unix.O_TMPFILE) == 0 {
+		mode = 0 // openat2 rejects a mode it won't use.
+	}
+	if useOpenat2() {
+		for {
+			fd, err := openat2(dirfd, path.String(), flag, mode, resolveBeneath|resolveNoSymlinks)
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			return fd, err
+		}
+	}
+	return openWalking(dirfd, path, flag, mode)
+}
+
+/*
+	Does what openat2 with RESOLVE_BENEATH|RESOLVE_NO_SYMLINKS does, with
+	plain openat: opening each segment in turn, relative to the last, with
+	O_NOFOLLOW, and checking it's a dir before going on.
+	(Paths are already clean -- no "." or ".." segments -- so that's all.)
+*/
+func openWalking(dirfd int, path fs.RelPath, flag int, mode uint32) (int, error) {
+	fd, err := unix.Dup(dirfd)
+	if err != nil {
+		return -1, err
+	}
+	segments := strings.Split(path.String(), "/")[1:]
+	if len(segments) == 0 {
+		segments = []string{"."}
+	}
+	last := len(segments) - 1
+	for _, segment := range segments[:last] {
+		next, err := openatNoFollow(fd, segment, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		unix.Close(fd)
+		if err != nil {
+			return -1, err
+		}
+		fd = next
+	}
+	defer unix.Close(fd)
+	return openatNoFollow(fd, segments[last], flag, mode)
+}
+
+// Opens the name in the dir, failing with ELOOP if it's a symlink
+//  (unless the flags include O_PATH|O_NOFOLLOW, asking for the symlink itself).
+func openatNoFollow(dirfd int, name string, flag int, mode uint32) (int, error) {
+	if flag&unix.O_PATH == 0 {
+		return unix.Openat(dirfd, name, flag|unix.O_NOFOLLOW, mode) // ELOOP for symlinks by itself.
+	}
+	fd, err := unix.Openat(dirfd, name, (flag|unix.O_NOFOLLOW)&^unix.O_DIRECTORY, mode)
+	if err != nil {
+		return -1, err
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	switch {
+	case st.Mode&unix.S_IFMT == unix.S_IFLNK && flag&unix.O_NOFOLLOW == 0:
+		unix.Close(fd)
+		return -1, unix.ELOOP
+	case st.Mode&unix.S_IFMT != unix.S_IFDIR && flag&unix.O_DIRECTORY != 0:
+		unix.Close(fd)
+		return -1, unix.ENOTDIR
+	}
+	return fd, nil
+}
+
+// Normalizes an error from the OS, from an op on the (resolved) path.
+//  ELOOP and EXDEV are what openat2 says if the path has (or escapes via)
+//   a symlink; we resolved the path before, so it must have just changed.
+func (afs *confinedFS) pathError(op string, path fs.RelPath, err error) error {
+	switch err {
+	case nil:
+		return nil
+	case unix.ELOOP, unix.EXDEV:
+		return ErrorDetailed(
+			fs.ErrBreakout,
+			fmt.Sprintf("breakout error: refusing to traverse symlink while trying to %s %q in %q", op, path, afs.basePath),
+			map[string]string{
+				"opArea": afs.basePath.String(),
+				"opPath": path.String(),
+			},
+		)
+	}
+	return fs.NormalizeIOError(&os.PathError{Op: op, Path: afs.basePath.Join(path).String(), Err: err})
+}
+
+func readlinkat(dirfd int, name string) (string, error) {
+	for n := 128; ; n *= 2 {
+		buf := make([]byte, n)
+		m, err := unix.Readlinkat(dirfd, name, buf)
+		if err != nil {
+			return "", err
+		}
+		if m < n {
+			return string(buf[:m]), nil
+		}
+	}
+}
+
+// These are not yet available in our version of x/sys.
+//  The syscall number is the same on every arch (but mips, where it's
+//   offset, and so an unsupported number: which just means the fallback).
+const (
+	sysOpenat2        = 437
+	resolveNoSymlinks = 0x04
+	resolveBeneath    = 0x08
+)
+
+type openHow struct {
+	flags   uint64
+	mode    uint64
+	resolve uint64
+}
+
+func openat2(dirfd int, path string, flag int, mode uint32, resolve uint64) (int, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+	how := openHow{uint64(flag), uint64(mode), resolve}
+	fd, _, errno := syscall.Syscall6(sysOpenat2, uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&how)), unsafe.Sizeof(how), 0, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// Reports whether openat2 works here; checked once.  (A var, so tests can turn it off.)
+var useOpenat2 = func() bool {
+	openat2Once.Do(func() {
+		fd, err := openat2(unix.AT_FDCWD, "/", unix.O_PATH|unix.O_CLOEXEC, 0, 0)
+		if err != nil {
+			return
+		}
+		unix.Close(fd)
+		openat2Works = true
+	})
+	return openat2Works
+}
+
+var (
+	openat2Once  sync.Once
+	openat2Works bool
+)
@@ -0,0 +1,110 @@
+package osfs
+
+import (
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+	"golang.org/x/sys/unix"
+
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/tests"
+	"github.com/polydawn/rio/testutil"
+)
+
+func TestConfined(t *testing.T) {
+	for _, mode := range []struct {
+		name    string
+		openat2 bool
+	}{
+		{"with openat2", true},
+		{"walking with openat", false},
+	} {
+		Convey("confined osfs, "+mode.name, t, func() {
+			if mode.openat2 && !useOpenat2() {
+				SkipSo("openat2 is not available here")
+				return
+			}
+			defer func(orig func() bool) { useOpenat2 = orig }(useOpenat2)
+			useOpenat2 = func() bool { return mode.openat2 }
+
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				tfs := New(tmpDir)
+				boxPath := fs.MustRelPath("sandbox")
+				tfs.Mkdir(boxPath, 0755)
+				afs := NewConfined(tmpDir.Join(boxPath))
+				defer afs.Close()
+
+				Convey("spec compliance", func() {
+					tests.CheckBaseLstat(afs)
+					tests.CheckMkdirLstatRoundtrip(afs)
+					tests.CheckDeepMkdirError(afs)
+					tests.CheckMklinkLstatRoundtrip(afs)
+					tests.CheckSymlinks(afs)
+					tests.CheckPerniciousSymlinks(afs)
+					tests.CheckOpsTraversingSymlinks(afs)
+				})
+
+				Convey("a symlink out of the base, met where a resolved path was expected, is refused", func() {
+					So(tfs.Mkdir(fs.MustRelPath("outside"), 0755), ShouldBeNil)
+					So(afs.Mklink(fs.MustRelPath("evil"), tmpDir.Join(fs.MustRelPath("outside")).String()), ShouldBeNil)
+
+					// As if "evil" had been swapped in just after we resolved "evil/x".
+					cfs := afs.(*confinedFS)
+					_, err := cfs.open(fs.MustRelPath("evil/x"), os.O_CREATE|os.O_WRONLY, 0644)
+					So(err, ShouldEqual, unix.ELOOP)
+					So(Category(cfs.pathError("open", fs.MustRelPath("evil/x"), err)), ShouldEqual, fs.ErrBreakout)
+					_, err = cfs.open(fs.MustRelPath("evil"), os.O_RDONLY, 0)
+					So(err, ShouldEqual, unix.ELOOP)
+					_, err = cfs.open(fs.MustRelPath("evil"), unix.O_PATH|unix.O_DIRECTORY, 0)
+					So(err, ShouldEqual, unix.ELOOP)
+					_, err = os.Lstat(tmpDir.Join(fs.MustRelPath("outside/x")).String())
+					So(os.IsNotExist(err), ShouldBeTrue)
+
+					Convey("while the symlink itself can still be looked at", func() {
+						fmeta, err := afs.LStat(fs.MustRelPath("evil"))
+						So(err, ShouldBeNil)
+						So(fmeta.Type, ShouldEqual, fs.Type_Symlink)
+						So(fmeta.Linkname, ShouldEqual, tmpDir.Join(fs.MustRelPath("outside")).String())
+					})
+					Convey("and ops through it are resolved within the base, as ever", func() {
+						f, err := afs.OpenFile(fs.MustRelPath("evil/x"), os.O_CREATE|os.O_WRONLY, 0644)
+						So(err, ShouldNotBeNil) // the link's target, taken within the base, doesn't exist.
+						So(f, ShouldBeNil)
+						So(afs.Chmod(fs.MustRelPath("evil"), 0700), ShouldNotBeNil)
+						stat, err := tfs.Stat(fs.MustRelPath("outside"))
+						So(err, ShouldBeNil)
+						So(stat.Perms, ShouldEqual, fs.Perms(0755))
+					})
+				})
+
+				Convey("the base may be made by the FS itself", func() {
+					bfs := NewConfined(tmpDir.Join(fs.MustRelPath("later")))
+					defer bfs.Close()
+					_, err := bfs.LStat(fs.RelPath{})
+					So(Category(err), ShouldEqual, fs.ErrNotExists)
+					So(bfs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+					So(bfs.Mkdir(fs.MustRelPath("d"), 0750), ShouldBeNil)
+					So(bfs.Chmod(fs.MustRelPath("d"), 0705), ShouldBeNil)
+					fmeta, err := bfs.LStat(fs.MustRelPath("d"))
+					So(err, ShouldBeNil)
+					So(fmeta.Type, ShouldEqual, fs.Type_Dir)
+					So(fmeta.Perms, ShouldEqual, fs.Perms(0705))
+				})
+
+				Convey("closing releases the base's dirfd, and the FS may still be used after", func() {
+					So(afs.Mkdir(fs.MustRelPath("d"), 0755), ShouldBeNil)
+					So(afs.Mkdir(fs.MustRelPath("d/e"), 0755), ShouldBeNil)
+					cfs := afs.(*confinedFS)
+					So(cfs.base, ShouldNotBeNil)
+					So(afs.Close(), ShouldBeNil)
+					So(cfs.base, ShouldBeNil)
+					So(afs.Close(), ShouldBeNil)
+					_, err := afs.LStat(fs.MustRelPath("d/e"))
+					So(err, ShouldBeNil)
+				})
+			})
+		})
+	}
+}
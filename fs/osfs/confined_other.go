@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package osfs
+
+import (
+	"github.com/polydawn/rio/fs"
+)
+
+/*
+	NewConfined returns an FS which stays beneath the base path even while
+	other processes are modifying it concurrently -- on linux.
+
+	Elsewhere, it's just New: confinement is only best-effort.
+*/
+func NewConfined(basePath fs.AbsolutePath) ConfinedFS {
+	return unconfinedFS{New(basePath)}
+}
+
+type unconfinedFS struct {
+	fs.FS
+}
+
+func (unconfinedFS) Close() error {
+	return nil
+}
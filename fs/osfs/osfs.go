@@ -125,6 +125,15 @@ func (afs *osFS) LStat(path fs.RelPath) (*fs.Metadata, error) {
 }
 
 func (afs *osFS) convertFileinfo(path fs.RelPath, fi os.FileInfo) (*fs.Metadata, error) {
+	return convertFileinfo(path, fi, func() (string, error) {
+		target, _, err := afs.readlink(afs.basePath.Join(path).String())
+		return target, err
+	})
+}
+
+// Converts the fileinfo to our metadata.
+//  The readlink func is only called if the file is a symlink.
+func convertFileinfo(path fs.RelPath, fi os.FileInfo, readlink func() (string, error)) (*fs.Metadata, error) {
 	// Copy over the easy 1-to-1 parts.
 	fmeta := &fs.Metadata{
 		Name:  path,
@@ -142,7 +151,7 @@ func (afs *osFS) convertFileinfo(path fs.RelPath, fi os.FileInfo) (*fs.Metadata,
 		fmeta.Type = fs.Type_Symlink
 		// If it's a symlink, get that info.
 		//  It's an extra syscall, but we almost always want it.
-		if target, _, err := afs.readlink(afs.basePath.Join(path).String()); err == nil {
+		if target, err := readlink(); err == nil {
 			fmeta.Linkname = target
 		} else {
 			return nil, err
@@ -218,6 +227,9 @@ func (afs *osFS) Readlink(path fs.RelPath) (string, bool, error) {
 	err = fs.NormalizeIOError(err)
 	return target, isLink, err
 }
+func (afs *osFS) readlinkRel(path fs.RelPath) (string, bool, error) {
+	return afs.readlink(afs.BasePath().Join(path).String())
+}
 func (afs *osFS) readlink(path string) (string, bool, error) {
 	target, err := os.Readlink(path)
 	switch {
@@ -241,10 +253,17 @@ func (afs *osFS) realpath(path fs.RelPath, resolveLast bool) (string, error) {
 	if path.GoesUp() {
 		return "", Errorf(fs.ErrBreakout, "fs: invalid path %q: must not depart basepath", path)
 	}
-	path, err := afs._realpath(path, resolveLast)
+	path, err := realpath(afs, path, resolveLast)
 	return afs.BasePath().Join(path).String(), err
 }
-func (afs *osFS) _realpath(path fs.RelPath, resolveLast bool) (fs.RelPath, error) {
+
+// The parts of an FS that path resolution needs.
+//  readlinkRel returns errors as they come from the OS, not yet normalized.
+type linkReader interface {
+	readlinkRel(path fs.RelPath) (target string, isSymlink bool, err error)
+}
+
+func realpath(afs linkReader, path fs.RelPath, resolveLast bool) (fs.RelPath, error) {
 	segments := strings.Split(path.String(), "/")[1:]
 	iLast := len(segments) - 1
 	resolved := fs.RelPath{}
@@ -253,12 +272,12 @@ func (afs *osFS) _realpath(path fs.RelPath, resolveLast bool) (fs.RelPath, error
 		if i == iLast && !resolveLast {
 			return resolved, nil
 		}
-		morelink, isLink, err := afs.readlink(afs.BasePath().Join(resolved).String())
+		morelink, isLink, err := afs.readlinkRel(resolved)
 		if err != nil {
 			return resolved, fs.NormalizeIOError(err)
 		}
 		if isLink {
-			resolved, err = afs.resolveLink(morelink, resolved, map[fs.RelPath]struct{}{})
+			resolved, err = resolveLink(afs, morelink, resolved, map[fs.RelPath]struct{}{})
 			if err != nil {
 				return resolved, fs.NormalizeIOError(err) // maybe cat and nil
 			}
@@ -271,9 +290,9 @@ func (afs *osFS) ResolveLink(symlink string, startingAt fs.RelPath) (fs.RelPath,
 	if startingAt.GoesUp() {
 		return startingAt, Errorf(fs.ErrBreakout, "fs: invalid path %q: must not depart basepath", startingAt)
 	}
-	return afs.resolveLink(symlink, startingAt, map[fs.RelPath]struct{}{})
+	return resolveLink(afs, symlink, startingAt, map[fs.RelPath]struct{}{})
 }
-func (afs *osFS) resolveLink(symlink string, startingAt fs.RelPath, seen map[fs.RelPath]struct{}) (fs.RelPath, error) {
+func resolveLink(afs linkReader, symlink string, startingAt fs.RelPath, seen map[fs.RelPath]struct{}) (fs.RelPath, error) {
 	if _, isSeen := seen[startingAt]; isSeen {
 		return startingAt, Errorf(fs.ErrRecursion, "cyclic symlinks detected from %q", startingAt)
 	}
@@ -303,7 +322,7 @@ func (afs *osFS) resolveLink(symlink string, startingAt fs.RelPath, seen map[fs.
 			return startingAt, Errorf(fs.ErrRecursion, "cyclic symlinks detected from %q", startingAt)
 		}
 		// Check if this is a symlink; if so we must recurse on it.
-		morelink, isLink, err := afs.readlink(afs.BasePath().Join(path).String())
+		morelink, isLink, err := afs.readlinkRel(path)
 		if err != nil {
 			if i == iLast && os.IsNotExist(err) {
 				return path, nil
@@ -311,7 +330,7 @@ func (afs *osFS) resolveLink(symlink string, startingAt fs.RelPath, seen map[fs.
 			return startingAt, fs.NormalizeIOError(err)
 		}
 		if isLink {
-			path, err = afs.resolveLink(morelink, path, seen)
+			path, err = resolveLink(afs, morelink, path, seen)
 			if err != nil {
 				return startingAt, err
 			}
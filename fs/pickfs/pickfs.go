@@ -0,0 +1,120 @@
+/*
+	pickfs is a filesystem which discards everything written to it, except
+	the body of one named file, which is copied out to a writer.
+
+	This is how getting a single file out of a ware works: the unpacker
+	proceeds exactly as usual -- reading and hashing every entry -- and
+	we just keep the part we wanted.
+*/
+package pickfs
+
+import (
+	"io"
+
+	. "github.com/warpfork/go-errcat"
+
+	"github.com/polydawn/rio/fs"
+	nilFS "github.com/polydawn/rio/fs/nilfs"
+)
+
+type FS struct {
+	fs.FS               // the discard; everything we don't override goes here.
+	path     fs.RelPath // the path to pick.
+	w        io.Writer  // where the body of the picked file goes.
+	whenDone func()     // called once the picked path has been placed; may be nil.
+	found    fs.Type
+}
+
+var _ fs.FS = &FS{}
+
+/*
+	Returns a filesystem which copies the body of the file placed at `path`
+	to `w`, and discards everything else.
+
+	If `whenDone` is non-nil, it's called as soon as something has been
+	placed at the path (e.g. so the caller may stop early).
+*/
+func New(path fs.RelPath, w io.Writer, whenDone func()) *FS {
+	return &FS{
+		FS:       nilFS.New(),
+		path:     path,
+		w:        w,
+		whenDone: whenDone,
+	}
+}
+
+/*
+	Returns the type of what was placed at the path:
+	fs.Type_Invalid if nothing was.
+*/
+func (pfs *FS) Found() fs.Type {
+	return pfs.found
+}
+
+func (pfs *FS) saw(path fs.RelPath, t fs.Type) {
+	if path != pfs.path {
+		return
+	}
+	pfs.found = t
+	if t != fs.Type_File && pfs.whenDone != nil {
+		pfs.whenDone()
+	}
+}
+
+func (pfs *FS) OpenFile(path fs.RelPath, flag int, perms fs.Perms) (fs.File, error) {
+	f, err := pfs.FS.OpenFile(path, flag, perms)
+	if err != nil || path != pfs.path {
+		return f, err
+	}
+	pfs.saw(path, fs.Type_File)
+	return pickedFile{pfs}, nil
+}
+
+func (pfs *FS) Mkdir(path fs.RelPath, perms fs.Perms) error {
+	pfs.saw(path, fs.Type_Dir)
+	return pfs.FS.Mkdir(path, perms)
+}
+
+func (pfs *FS) Mklink(path fs.RelPath, target string) error {
+	pfs.saw(path, fs.Type_Symlink)
+	return pfs.FS.Mklink(path, target)
+}
+
+func (pfs *FS) Mkfifo(path fs.RelPath, perms fs.Perms) error {
+	pfs.saw(path, fs.Type_NamedPipe)
+	return pfs.FS.Mkfifo(path, perms)
+}
+
+func (pfs *FS) MkdevBlock(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
+	pfs.saw(path, fs.Type_Device)
+	return pfs.FS.MkdevBlock(path, major, minor, perms)
+}
+
+func (pfs *FS) MkdevChar(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
+	pfs.saw(path, fs.Type_CharDevice)
+	return pfs.FS.MkdevChar(path, major, minor, perms)
+}
+
+// pickedFile is write-only: the body goes to the writer, and that's all.
+type pickedFile struct {
+	pfs *FS
+}
+
+func (f pickedFile) Close() error {
+	if f.pfs.whenDone != nil {
+		f.pfs.whenDone()
+	}
+	return nil
+}
+func (f pickedFile) Write(bs []byte) (int, error) {
+	n, err := f.pfs.w.Write(bs)
+	if err != nil {
+		return n, Errorf(fs.ErrMisc, "pickfs: %s", err)
+	}
+	return n, nil
+}
+func (pickedFile) Read([]byte) (int, error)           { return 0, Errorf(fs.ErrMisc, "pickfs: file is write-only") }
+func (pickedFile) ReadAt([]byte, int64) (int, error)  { return 0, Errorf(fs.ErrMisc, "pickfs: file is write-only") }
+func (pickedFile) Seek(int64, int) (int64, error)     { return 0, Errorf(fs.ErrMisc, "pickfs: file is not seekable") }
+func (pickedFile) WriteAt([]byte, int64) (int, error) { return 0, Errorf(fs.ErrMisc, "pickfs: file is not seekable") }
+
@@ -0,0 +1,233 @@
+/*
+	subtreefs wraps a filesystem so that only one subtree of the paths
+	written to it land anywhere, and they land rebased to the root.
+
+	This is how unpacking part of a ware works: the unpacker proceeds exactly
+	as usual -- reading and hashing every entry, so the whole ware is still
+	verified -- while operations on any path outside the subtree are silently
+	discarded (file bodies are drained and dropped).
+*/
+package subtreefs
+
+import (
+	"strings"
+	"time"
+
+	"github.com/polydawn/rio/fs"
+	nilFS "github.com/polydawn/rio/fs/nilfs"
+)
+
+type FS struct {
+	afs     fs.FS      // the real filesystem, rooted at the unpack target.
+	subpath fs.RelPath // the subtree to keep, in the terms of the paths we're given.
+	dest    fs.RelPath // where the subtree's root lands in afs.
+	none    bool       // if true, nothing we're given lands; used for nested trees outside the subtree.
+	discard fs.FS
+	reached *bool // shared with any FS made by Sub.
+}
+
+var _ fs.FS = &FS{}
+
+/*
+	Returns a filesystem which maps `subpath` (and everything beneath it)
+	to the root of `afs`, and discards everything else.
+*/
+func New(afs fs.FS, subpath fs.RelPath) *FS {
+	return &FS{
+		afs:     afs,
+		subpath: subpath,
+		discard: nilFS.New(),
+		reached: new(bool),
+	}
+}
+
+/*
+	Reports whether anything at all was written within the subtree
+	(by this FS, or any made from it by Sub).
+	If not, the subtree must not have existed.
+*/
+func (sfs *FS) Reached() bool {
+	return *sfs.reached
+}
+
+/*
+	Returns a filesystem for unpacking a nested tree (such as a git submodule)
+	which is found at `name`, with the same subtree selection applied.
+*/
+func (sfs *FS) Sub(name fs.RelPath) *FS {
+	sub := *sfs
+	switch {
+	case sfs.none:
+		// pass; still nothing.
+	case isWithin(name, sfs.subpath):
+		sub.dest = sfs.dest.Join(rebase(name, sfs.subpath))
+		sub.subpath = fs.RelPath{}
+	case isWithin(sfs.subpath, name):
+		sub.subpath = rebase(sfs.subpath, name)
+	default:
+		sub.none = true
+	}
+	return &sub
+}
+
+func isWithin(path, root fs.RelPath) bool {
+	if root == (fs.RelPath{}) || path == root {
+		return true
+	}
+	return strings.HasPrefix(path.String(), root.String()+"/")
+}
+
+func rebase(path, root fs.RelPath) fs.RelPath {
+	if path == root {
+		return fs.RelPath{}
+	}
+	if root == (fs.RelPath{}) {
+		return path
+	}
+	return fs.MustRelPath(strings.TrimPrefix(path.String(), root.String()+"/"))
+}
+
+// Returns the path in afs, or false if the path should be discarded.
+func (sfs *FS) resolve(path fs.RelPath) (fs.RelPath, bool) {
+	if sfs.none || path.GoesUp() || !isWithin(path, sfs.subpath) {
+		return path, false
+	}
+	return sfs.dest.Join(rebase(path, sfs.subpath)), true
+}
+
+// Like resolve, but also records that we've reached the subtree.
+func (sfs *FS) resolveWrite(path fs.RelPath) (fs.RelPath, bool) {
+	p, ok := sfs.resolve(path)
+	if ok {
+		*sfs.reached = true
+	}
+	return p, ok
+}
+
+func (sfs *FS) BasePath() fs.AbsolutePath {
+	return sfs.afs.BasePath().Join(sfs.dest)
+}
+
+func (sfs *FS) OpenFile(path fs.RelPath, flag int, perms fs.Perms) (fs.File, error) {
+	if p, ok := sfs.resolveWrite(path); ok {
+		return sfs.afs.OpenFile(p, flag, perms)
+	}
+	return sfs.discard.OpenFile(path, flag, perms)
+}
+
+func (sfs *FS) Mkdir(path fs.RelPath, perms fs.Perms) error {
+	if p, ok := sfs.resolveWrite(path); ok {
+		return sfs.afs.Mkdir(p, perms)
+	}
+	return sfs.discard.Mkdir(path, perms)
+}
+
+func (sfs *FS) Mklink(path fs.RelPath, target string) error {
+	if p, ok := sfs.resolveWrite(path); ok {
+		return sfs.afs.Mklink(p, target)
+	}
+	return sfs.discard.Mklink(path, target)
+}
+
+func (sfs *FS) Mkfifo(path fs.RelPath, perms fs.Perms) error {
+	if p, ok := sfs.resolveWrite(path); ok {
+		return sfs.afs.Mkfifo(p, perms)
+	}
+	return sfs.discard.Mkfifo(path, perms)
+}
+
+func (sfs *FS) MkdevBlock(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
+	if p, ok := sfs.resolveWrite(path); ok {
+		return sfs.afs.MkdevBlock(p, major, minor, perms)
+	}
+	return sfs.discard.MkdevBlock(path, major, minor, perms)
+}
+
+func (sfs *FS) MkdevChar(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
+	if p, ok := sfs.resolveWrite(path); ok {
+		return sfs.afs.MkdevChar(p, major, minor, perms)
+	}
+	return sfs.discard.MkdevChar(path, major, minor, perms)
+}
+
+func (sfs *FS) Lchown(path fs.RelPath, uid uint32, gid uint32) error {
+	if p, ok := sfs.resolve(path); ok {
+		return sfs.afs.Lchown(p, uid, gid)
+	}
+	return sfs.discard.Lchown(path, uid, gid)
+}
+
+func (sfs *FS) Chmod(path fs.RelPath, perms fs.Perms) error {
+	if p, ok := sfs.resolve(path); ok {
+		return sfs.afs.Chmod(p, perms)
+	}
+	return sfs.discard.Chmod(path, perms)
+}
+
+func (sfs *FS) SetTimesLNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
+	if p, ok := sfs.resolve(path); ok {
+		return sfs.afs.SetTimesLNano(p, mtime, atime)
+	}
+	return sfs.discard.SetTimesLNano(path, mtime, atime)
+}
+
+func (sfs *FS) SetTimesNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
+	if p, ok := sfs.resolve(path); ok {
+		return sfs.afs.SetTimesNano(p, mtime, atime)
+	}
+	return sfs.discard.SetTimesNano(path, mtime, atime)
+}
+
+func (sfs *FS) Stat(path fs.RelPath) (*fs.Metadata, error) {
+	if p, ok := sfs.resolve(path); ok {
+		return sfs.unresolveMeta(path)(sfs.afs.Stat(p))
+	}
+	return sfs.discard.Stat(path)
+}
+
+func (sfs *FS) LStat(path fs.RelPath) (*fs.Metadata, error) {
+	if p, ok := sfs.resolve(path); ok {
+		return sfs.unresolveMeta(path)(sfs.afs.LStat(p))
+	}
+	return sfs.discard.LStat(path)
+}
+
+// Metadata from afs is named in afs terms; put the name back to ours.
+func (sfs *FS) unresolveMeta(path fs.RelPath) func(*fs.Metadata, error) (*fs.Metadata, error) {
+	return func(fmeta *fs.Metadata, err error) (*fs.Metadata, error) {
+		if fmeta != nil {
+			fmeta.Name = path
+		}
+		return fmeta, err
+	}
+}
+
+func (sfs *FS) ReadDirNames(path fs.RelPath) ([]string, error) {
+	if p, ok := sfs.resolve(path); ok {
+		return sfs.afs.ReadDirNames(p)
+	}
+	return sfs.discard.ReadDirNames(path)
+}
+
+func (sfs *FS) Readlink(path fs.RelPath) (string, bool, error) {
+	if p, ok := sfs.resolve(path); ok {
+		return sfs.afs.Readlink(p)
+	}
+	return sfs.discard.Readlink(path)
+}
+
+/*
+	Resolves links within the subtree as the underlying filesystem would,
+	confined to the subtree's destination; the result is in our own terms.
+*/
+func (sfs *FS) ResolveLink(symlink string, startingAt fs.RelPath) (fs.RelPath, error) {
+	p, ok := sfs.resolve(startingAt)
+	if !ok {
+		return sfs.discard.ResolveLink(symlink, startingAt)
+	}
+	resolved, err := sfs.afs.ResolveLink(symlink, p)
+	if err != nil || !isWithin(resolved, sfs.dest) {
+		return resolved, err
+	}
+	return sfs.subpath.Join(rebase(resolved, sfs.dest)), nil
+}
@@ -27,8 +27,10 @@ type WalkFunc func(filenode *FilewalkNode) error
 
 	Symlinks are not followed.
 
-	The traversal order of siblings is *not* guaranteed, and is *not* necessarily
-	stable.
+	Siblings are visited in order, sorted by name (bytewise), so the whole
+	traversal is stable: the same tree always walks the same way, however
+	the underlying filesystem happens to list it.  Pack relies on this to
+	produce the same archive bytes every time.
 
 	Caveat: calling `node.NextChild()` during your walk results in undefined behavior.
 */
@@ -62,7 +64,7 @@ type FilewalkNode struct {
 	Info *Metadata
 	Err  error
 
-	children []*FilewalkNode // note we didn't sort this
+	children []*FilewalkNode // sorted by name.
 	itrIndex int             // next child offset
 }
 
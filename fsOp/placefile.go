@@ -15,6 +15,19 @@ var (
 	myGid = uint32(os.Getgid())
 )
 
+/*
+	Placer is implemented by filesystems which would rather be handed each
+	file whole -- metadata and body together -- than have it built up one
+	op at a time.  PlaceFile defers entirely to them: none of its checks
+	or other ops are applied.
+
+	The body (only for files; nil otherwise) must be read to the end
+	before returning.
+*/
+type Placer interface {
+	PlaceFile(fmeta fs.Metadata, body io.Reader) error
+}
+
 /*
 	Places a file on the filesystem.
 	Replicates all attributes described in the metadata.
@@ -34,6 +47,8 @@ var (
 	Please note that like all filesystem operations within a lightyear of
 	symlinks, all validations are best-effort, but are only capable of
 	correctness in the absense of concurrent modifications inside `destBasePath`.
+	(The FS from osfs.NewConfined closes that gap: with it, a symlink
+	swapped in concurrently makes the ops fail with ErrBreakout.)
 
 	Device files *will* be created, with their maj/min numbers.
 	This may be considered a security concern; you should whitelist inputs
@@ -58,6 +73,11 @@ var (
 	because it is not the unpack command's job to maintain a CAS filesystem.)
 */
 func PlaceFile(afs fs.FS, fmeta fs.Metadata, body io.Reader, skipChown bool) error {
+	// Filesystems which take whole files get them whole, and that's all.
+	if placer, ok := afs.(Placer); ok {
+		return placer.PlaceFile(fmeta, body)
+	}
+
 	// First, no part of the path may be a symlink.
 	for path := fmeta.Name; ; path = path.Dir() {
 		if path == (fs.RelPath{}) {
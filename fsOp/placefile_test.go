@@ -3,11 +3,14 @@ package fsOp
 import (
 	"bytes"
 	"io/ioutil"
+	"syscall"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
 
 	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/faultfs"
 	"github.com/polydawn/rio/fs/osfs"
 	"github.com/polydawn/rio/testutil"
 )
@@ -45,6 +48,30 @@ func TestPlaceFile(t *testing.T) {
 					So(fsErr.Error(), ShouldContainSubstring, "no such")
 				})
 			})
+			Convey("Placements should fail with the filesystem's errors, by category", func() {
+				file := fs.Metadata{Name: fs.MustRelPath("thing"), Type: fs.Type_File, Perms: 0644, Uid: 4000}
+				dir := fs.Metadata{Name: fs.MustRelPath("dir"), Type: fs.Type_Dir, Perms: 0755}
+				for _, tr := range []struct {
+					title    string
+					fmeta    fs.Metadata
+					fault    faultfs.Fault
+					category fs.ErrorCategory
+				}{
+					{"a short write", file, faultfs.Fault{Op: "Write", AfterBytes: 2}, fs.ErrShortWrite},
+					{"a failing write", file, faultfs.Fault{Op: "Write", Err: syscall.EIO}, fs.ErrMisc},
+					{"a file that may not be made", file, faultfs.Fault{Op: "OpenFile", Err: syscall.EACCES}, fs.ErrPermission},
+					{"a file that may not be owned", file, faultfs.Fault{Op: "Lchown", Err: syscall.EPERM}, fs.ErrPermission},
+					{"a dir in a non-dir", dir, faultfs.Fault{Op: "Mkdir", Err: syscall.ENOTDIR}, fs.ErrNotDir},
+					{"a path that may not be checked for symlinks", dir, faultfs.Fault{Op: "Readlink", Err: syscall.EACCES}, fs.ErrPermission},
+					{"times that may not be set", dir, faultfs.Fault{Op: "SetTimesNano", Err: syscall.EPERM}, fs.ErrPermission},
+				} {
+					Convey(tr.title, func() {
+						afs := faultfs.New(osfs.New(tmpDir), tr.fault)
+						fsErr := PlaceFile(afs, tr.fmeta, bytes.NewBuffer([]byte("abc\n")), false)
+						So(Category(fsErr), ShouldEqual, tr.category)
+					})
+				}
+			})
 			Convey("Simple dir placements should work", func() {
 				// TODO
 			})
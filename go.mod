@@ -3,12 +3,15 @@ module github.com/polydawn/rio
 go 1.18
 
 require (
+	github.com/alecthomas/units v0.0.0-20211218093645-b94a6e3cc137
+	github.com/klauspost/compress v1.17.2
 	github.com/polydawn/go-timeless-api v0.0.0-20220821201550-b93919e12c56
 	github.com/polydawn/refmt v0.0.0-20201211092308-30ac6d18308e
 	github.com/smartystreets/goconvey v1.7.2
 	github.com/syndtr/gocapability v0.0.0-20200815063812-42c35b437635
 	github.com/warpfork/go-errcat v0.0.0-20180917083543-335044ffc86e
 	github.com/xi2/xz v0.0.0-20171230120015-48954b6210f8
+	github.com/zeebo/blake3 v0.2.4
 	golang.org/x/sys v0.0.0-20190726091711-fc99dfbffb4e
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 	gopkg.in/src-d/go-billy.v4 v4.3.2
@@ -17,12 +20,12 @@ require (
 
 require (
 	github.com/alecthomas/template v0.0.0-20190718012654-fb15b899a751 // indirect
-	github.com/alecthomas/units v0.0.0-20211218093645-b94a6e3cc137 // indirect
 	github.com/emirpasic/gods v1.12.0 // indirect
 	github.com/gopherjs/gopherjs v0.0.0-20181017120253-0766667cb4d1 // indirect
 	github.com/jbenet/go-context v0.0.0-20150711004518-d14ea06fba99 // indirect
 	github.com/jtolds/gls v4.20.0+incompatible // indirect
 	github.com/kevinburke/ssh_config v0.0.0-20190725054713-01f96b0aa0cd // indirect
+	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
 	github.com/sergi/go-diff v1.0.0 // indirect
 	github.com/smartystreets/assertions v1.2.0 // indirect
@@ -22,6 +22,12 @@ var _ Placer = CopyPlacer
 	a read-only filesystem with this placer.
 */
 func CopyPlacer(srcPath, dstPath fs.AbsolutePath, _ bool) (Janitor, error) {
+	return copyPlacer(srcPath, dstPath, func(afs fs.FS) fs.FS { return afs })
+}
+
+// CopyPlacer, with the filesystem copies are placed into wrapped by wrapDst
+//  (so tests can inject faults).
+func copyPlacer(srcPath, dstPath fs.AbsolutePath, wrapDst func(fs.FS) fs.FS) (Janitor, error) {
 	// Determine desired type.
 	srcStat, err := rootFs.LStat(srcPath.CoerceRelative())
 	if err != nil {
@@ -57,39 +63,53 @@ func CopyPlacer(srcPath, dstPath fs.AbsolutePath, _ bool) (Janitor, error) {
 		}
 		defer body.Close()
 		fmeta.Name = dstPath.CoerceRelative()
+		if err := fsOp.PlaceFile(rootFs, *fmeta, body, false); err != nil {
+			return nil, Errorf(rio.ErrInoperablePath, "error placing with copy placer: %s", err)
+		}
 		return copyJanitor{
 			dstPath,
-		}, fsOp.PlaceFile(rootFs, *fmeta, body, false)
+		}, nil
 	case fs.Type_Symlink:
 		panic("TODO copy placer support for symlinks")
 	}
 
 	// For dirs, do a treewalk and copy.  Mtime repair required following every node.
+	//  Failures reading are the cache's problem; failures writing, the destination's.
 	srcFs := osfs.New(srcPath)
-	dstFs := osfs.New(dstPath)
+	confinedFs := osfs.NewConfined(dstPath)
+	defer confinedFs.Close()
+	dstFs := wrapDst(confinedFs)
 	preVisit := func(filenode *fs.FilewalkNode) error {
 		if filenode.Err != nil {
-			return filenode.Err
+			return Errorf(rio.ErrLocalCacheProblem, "error placing with copy placer: %s", filenode.Err)
 		}
 		fmeta, body, err := fsOp.ScanFile(srcFs, filenode.Info.Name)
 		if err != nil {
-			return err
+			return Errorf(rio.ErrLocalCacheProblem, "error placing with copy placer: %s", err)
 		}
 		if body != nil {
 			defer body.Close()
 		}
-		return fsOp.PlaceFile(dstFs, *fmeta, body, false)
+		if err := fsOp.PlaceFile(dstFs, *fmeta, body, false); err != nil {
+			return Errorf(rio.ErrInoperablePath, "error placing with copy placer: %s", err)
+		}
+		return nil
 	}
 	postVisit := func(filenode *fs.FilewalkNode) error {
 		if filenode.Info.Type == fs.Type_Dir {
 			if err := dstFs.SetTimesNano(filenode.Info.Name, filenode.Info.Mtime, fs.DefaultTime); err != nil {
-				return err
+				return Errorf(rio.ErrInoperablePath, "error placing with copy placer: %s", err)
 			}
 		}
 		return nil
 	}
 	if err := fs.Walk(srcFs, preVisit, postVisit); err != nil {
-		return nil, err
+		switch Category(err).(type) {
+		case rio.ErrorCategory:
+			return nil, err
+		default: // the walk's own errors, listing dirs, are reading.
+			return nil, Errorf(rio.ErrLocalCacheProblem, "error placing with copy placer: %s", err)
+		}
 	}
 
 	// Return a cleanup func that does a recursive delete.
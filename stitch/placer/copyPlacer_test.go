@@ -0,0 +1,40 @@
+package placer
+
+import (
+	"syscall"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/faultfs"
+	"github.com/polydawn/rio/fs/osfs"
+	. "github.com/polydawn/rio/testutil"
+	. "github.com/polydawn/rio/transmat/mixins/tests"
+)
+
+func TestCopyPlacerFaults(t *testing.T) {
+	Convey("Copy placer failing to write should say so, by category:", t, Requires(RequiresCanManageOwnership, func() {
+		WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			PlaceFixture(osfs.New(tmpDir.Join(fs.MustRelPath("src"))), FixtureGamma)
+			for _, tr := range []struct {
+				title string
+				fault faultfs.Fault
+			}{
+				{"a full disk", faultfs.Fault{Op: "Write", Path: "./etc/init/zed", Err: syscall.ENOSPC}},
+				{"a short write", faultfs.Fault{Op: "Write", AfterBytes: 5}},
+				{"a dir that may not be made", faultfs.Fault{Op: "Mkdir", Path: "./var", Err: syscall.EACCES}},
+				{"times that may not be set", faultfs.Fault{Op: "SetTimesNano", Nth: 3, Err: syscall.EPERM}},
+			} {
+				Convey(tr.title, func() {
+					_, err := copyPlacer(tmpDir.Join(fs.MustRelPath("src")), tmpDir.Join(fs.MustRelPath("dst")), func(afs fs.FS) fs.FS {
+						return faultfs.New(afs, tr.fault)
+					})
+					So(Category(err), ShouldEqual, rio.ErrInoperablePath)
+				})
+			}
+		})
+	}))
+}
@@ -0,0 +1,68 @@
+package git
+
+import (
+	"context"
+	"io"
+
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/pickfs"
+	"github.com/polydawn/rio/fs/subtreefs"
+	"github.com/polydawn/rio/transmat/mixins/filters"
+	"github.com/polydawn/rio/transmat/util"
+)
+
+var (
+	_ util.CatFunc = Cat
+)
+
+/*
+	Cat copies the body of one file in the commit's tree (or its
+	submodules) to the writer, without checking anything out.
+
+	Fetching a commit already verifies it, so `verify` makes no difference
+	here: the body is always written as it's read.
+*/
+func Cat(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to read.
+	path fs.RelPath, // The path within the ware of the file to cat.
+	verify bool, // Ignored; see above.
+	w io.Writer, // Where to write the file body.
+	warehouses []api.WarehouseLocation, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+
+	// Fetch the repo and any submodules.
+	tr, submoduleCtrls, err := fetch(ctx, wareID, warehouses, mon)
+	if err != nil {
+		return err
+	}
+
+	// Walk, to nowhere but the one file; stop as soon as we have it.
+	walkCtx, cancel := context.WithCancel(filters.WithIDMap(ctx, filters.IDMap{}))
+	defer cancel()
+	pfs := pickfs.New(path, w, cancel)
+	err = unpackOneRepo(walkCtx, tr, subtreefs.New(pfs, fs.RelPath{}), fs.RelPath{}, nil, api.FilesetUnpackFilter_Lossless, submoduleCtrls, mon)
+	switch {
+	case err == nil:
+		// pass
+	case pfs.Found() != fs.Type_Invalid && Category(err) == rio.ErrCancelled && ctx.Err() == nil:
+		// We stopped it ourselves; that's fine.
+	default:
+		return err
+	}
+	return util.CheckPicked(pfs, path, wareID)
+}
@@ -0,0 +1,60 @@
+package git
+
+import (
+	"context"
+
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	nilFS "github.com/polydawn/rio/fs/nilfs"
+	"github.com/polydawn/rio/fs/subtreefs"
+	"github.com/polydawn/rio/transmat/mixins/filters"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+	"github.com/polydawn/rio/transmat/util"
+)
+
+var (
+	_ util.ListFunc = List
+)
+
+/*
+	List returns records of every entry in the commit's tree (and its
+	submodules), without checking anything out.
+
+	Git has no native notion of a content hash for our purposes,
+	so file content is hashed as it's read, as the other transmats do.
+*/
+func List(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to list.
+	warehouses []api.WarehouseLocation, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ fshash.Bucket, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return nil, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+
+	// Fetch the repo and any submodules.
+	tr, submoduleCtrls, err := fetch(ctx, wareID, warehouses, mon)
+	if err != nil {
+		return nil, err
+	}
+
+	// Walk, to nowhere.
+	//  Fetching already checked the hash, as for unpack.
+	listing := &fshash.MemoryBucket{}
+	afs := subtreefs.New(nilFS.New(), fs.RelPath{})
+	ctx = filters.WithIDMap(ctx, filters.IDMap{})
+	if err := unpackOneRepo(ctx, tr, afs, fs.RelPath{}, listing, api.FilesetUnpackFilter_Lossless, submoduleCtrls, mon); err != nil {
+		return nil, err
+	}
+	return listing, nil
+}
@@ -2,6 +2,7 @@ package git
 
 import (
 	"context"
+	"crypto/sha512"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,10 +16,12 @@ import (
 	"github.com/polydawn/rio/config"
 	"github.com/polydawn/rio/fs"
 	"github.com/polydawn/rio/fs/osfs"
+	"github.com/polydawn/rio/fs/subtreefs"
 	"github.com/polydawn/rio/fsOp"
 	"github.com/polydawn/rio/transmat/mixins/cache"
 	"github.com/polydawn/rio/transmat/mixins/filters"
 	"github.com/polydawn/rio/transmat/mixins/fshash"
+	"github.com/polydawn/rio/transmat/util"
 	gitWarehouse "github.com/polydawn/rio/warehouse/impl/git"
 )
 
@@ -71,6 +74,42 @@ func unpack(
 	// Sanitize arguments.
 	path2 := fs.MustAbsolutePath(path)
 
+	// Fetch the repo and any submodules.
+	tr, submoduleCtrls, err := fetch(ctx, wareID, warehouses, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Construct filesystem wrapper to use for all our ops.
+	//  This also takes care of discarding all but a subtree, if that's all that's wanted.
+	subpath := filters.GetUnpackSubpath(ctx)
+	afs := subtreefs.New(osfs.New(path2), subpath)
+
+	// Walk.
+	//  Pin "mtime=now" first, so submodules agree with the main repo.
+	filt = filters.PinUnpackNow(filt)
+	if err := unpackOneRepo(ctx, tr, afs, fs.RelPath{}, nil, filt, submoduleCtrls, mon); err != nil {
+		return api.WareID{}, err
+	}
+	if !afs.Reached() {
+		return api.WareID{}, Errorf(rio.ErrUsage, "subpath %q not found in ware %q", subpath, wareID)
+	}
+
+	// That's it.  Checkout should have already checked the hash, so we just return it.
+	return wareID, nil
+}
+
+/*
+	Fetches the repo (and all its submodules) holding the given commit,
+	and returns the commit's tree, and controllers for the submodules
+	organized by their path.
+*/
+func fetch(
+	ctx context.Context,
+	wareID api.WareID,
+	warehouses []api.WarehouseLocation,
+	mon rio.Monitor,
+) (*object.Tree, map[string]*gitWarehouse.Controller, error) {
 	// Pick a warehouse and get a reader.
 	//  This is a *very* expensive operation for git.  It's less
 	//  of "pick a warehouse" and more "download the whole thing and hope we
@@ -83,13 +122,13 @@ func unpack(
 		mon,
 	)
 	if err != nil {
-		return api.WareID{}, err
+		return nil, nil, err
 	}
 
 	// Get submodule config.  Fetch them all.
 	submodules, err := whCtrl.Submodules(wareID.Hash)
 	if err != nil {
-		return api.WareID{}, err
+		return nil, nil, err
 	}
 	// We'll organize them by path now; only thing that's useful.
 	submoduleCtrls := map[string]*gitWarehouse.Controller{}
@@ -102,7 +141,7 @@ func unpack(
 			mon,
 		)
 		if err != nil {
-			return api.WareID{}, err
+			return nil, nil, err
 		}
 		submoduleCtrls[submCfg.Path] = whCtrl
 	}
@@ -114,32 +153,34 @@ func unpack(
 		panic(err)
 	}
 
-	// Construct filesystem wrapper to use for all our ops.
-	afs := osfs.New(path2)
-
-	// Walk.
-	if err := unpackOneRepo(ctx, tr, afs, true, filt, submoduleCtrls, mon); err != nil {
-		return api.WareID{}, err
-	}
-
-	// That's it.  Checkout should have already checked the hash, so we just return it.
-	return wareID, nil
+	return tr, submoduleCtrls, nil
 }
 
 func unpackOneRepo(
 	ctx context.Context,
 	tr *object.Tree,
-	afs fs.FS,
-	isRoot bool, // if true, will recurse for submodules (with this set to false).
+	afs *subtreefs.FS,
+	at fs.RelPath, // where this repo is in the ware: the root, or a submodule path (and then we won't recurse further).
+	listing *fshash.MemoryBucket, // if non-nil, a record of each entry (prefilter) is added to it.
 	filt api.FilesetUnpackFilter,
 	submoduleCtrls map[string]*gitWarehouse.Controller,
 	mon rio.Monitor,
 ) (err error) {
 	tw := object.NewTreeWalker(tr, true, nil)
 
+	// Any uid/gid remapping is applied along with the filters.
+	idmap := filters.GetIDMap(ctx)
+
 	// Make the root dir.  Git doesn't have metadata for the tree root.
 	conjuredFmeta := fshash.DefaultDirMetadata()
-	filters.ApplyUnpackFilter(filt, &conjuredFmeta)
+	if listing != nil {
+		prefilterFmeta := conjuredFmeta
+		prefilterFmeta.Name = at
+		listing.AddRecord(prefilterFmeta, nil)
+	}
+	if err := filters.ApplyUnpackFilter(filt, idmap, &conjuredFmeta); err != nil {
+		return err
+	}
 	if err := fsOp.PlaceFile(afs, conjuredFmeta, nil, false); err != nil {
 		return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 	}
@@ -203,7 +244,7 @@ func unpackOneRepo(
 			fmeta.Linkname = string(blob)
 		case filemode.Submodule:
 			// Ooowee!  Recurse time!
-			if !isRoot {
+			if at != (fs.RelPath{}) {
 				// Except of course if we're already a submodule, in which case no.
 				// Like git, we will make the empty dir, though.
 				fmeta.Type = fs.Type_Dir
@@ -219,8 +260,8 @@ func unpackOneRepo(
 			if err != nil {
 				panic(err)
 			}
-			submFs := osfs.New(afs.BasePath().Join(fmeta.Name))
-			if err := unpackOneRepo(ctx, submTr, submFs, false, filt, nil, mon); err != nil {
+			submFs := afs.Sub(fmeta.Name)
+			if err := unpackOneRepo(ctx, submTr, submFs, fmeta.Name, listing, filt, nil, mon); err != nil {
 				return err
 			}
 			continue
@@ -233,9 +274,14 @@ func unpackOneRepo(
 		}
 
 		// Apply filters.
-		//  Git can't contain either device nodes nor setid bits so there's
-		//  no need to check for the filters for any rejection errors.
-		filters.ApplyUnpackFilter(filt, &fmeta)
+		//  (Keep the prefilter metadata first, if listing.)
+		//  Git can't contain either device nodes nor setid bits, so the
+		//  only rejection possible is of ids the remapping doesn't cover.
+		prefilterFmeta := fmeta
+		prefilterFmeta.Name = at.Join(fmeta.Name)
+		if err := filters.ApplyUnpackFilter(filt, idmap, &fmeta); err != nil {
+			return err
+		}
 
 		// Place the file.
 		switch fmeta.Type {
@@ -248,14 +294,27 @@ func unpackOneRepo(
 			if err != nil {
 				return Errorf(rio.ErrWareCorrupt, "corrupt git tree: %s", err)
 			}
-			if err := fsOp.PlaceFile(afs, fmeta, reader, false); err != nil {
+			var body io.Reader = reader
+			var hashingReader *util.HashingReader
+			if listing != nil {
+				hashingReader = &util.HashingReader{reader, sha512.New384()}
+				body = hashingReader
+			}
+			if err := fsOp.PlaceFile(afs, fmeta, body, false); err != nil {
 				return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 			}
 			reader.Close()
+			if listing != nil {
+				prefilterFmeta.Size = tf.Size
+				listing.AddRecord(prefilterFmeta, hashingReader.Hasher.Sum(nil))
+			}
 		default:
 			if err := fsOp.PlaceFile(afs, fmeta, nil, false); err != nil {
 				return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 			}
+			if listing != nil {
+				listing.AddRecord(prefilterFmeta, nil)
+			}
 		}
 	}
 
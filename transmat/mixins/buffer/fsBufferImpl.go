@@ -13,11 +13,12 @@ import (
 )
 
 type tempRemover struct {
-	file string
+	file *os.File
 }
 
 func (t tempRemover) Close() error {
-	return os.Remove(t.file)
+	t.file.Close()
+	return os.Remove(t.file.Name())
 }
 
 // SectionReader buffers a ware to a locally seekable instance.
@@ -37,9 +38,69 @@ func SectionReader(
 
 	size, err := io.Copy(bufferFile, reader)
 	if err != nil {
-		_ = os.Remove(bufferFile.Name())
+		_ = tempRemover{bufferFile}.Close()
 		return nil, nil, Errorf(rio.ErrLocalCacheProblem, "error buffering %q: %s", wareID, err)
 	}
 
-	return io.NewSectionReader(bufferFile, 0, size), &tempRemover{bufferFile.Name()}, nil
+	return io.NewSectionReader(bufferFile, 0, size), &tempRemover{bufferFile}, nil
+}
+
+/*
+	Spool buffers a stream to a temp file as it's read, so it can be
+	processed in one pass -- and anything read so far read again later,
+	by offset, with ReadAt.
+
+	Reads go through to the stream it was made with, and Offset says how
+	far that is.  If buffering fails, reads fail; the read error may get
+	wrapped by whoever's reading, so Err returns the original.
+	Close removes the temp file.
+*/
+type Spool struct {
+	wareID api.WareID
+	r      io.Reader
+	file   *os.File
+	n      int64
+	err    error
+}
+
+func NewSpool(wareID api.WareID, reader io.Reader) (*Spool, error) {
+	bufferFile, err := ioutil.TempFile("", "rio-*")
+	if err != nil {
+		return nil, Errorf(rio.ErrInoperablePath, "error buffering %q: %s", wareID, err)
+	}
+	return &Spool{wareID: wareID, r: reader, file: bufferFile}, nil
+}
+
+func (s *Spool) Read(bs []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	n, err := s.r.Read(bs)
+	if n > 0 {
+		if _, err := s.file.Write(bs[:n]); err != nil {
+			s.err = Errorf(rio.ErrLocalCacheProblem, "error buffering %q: %s", s.wareID, err)
+			return 0, s.err
+		}
+		s.n += int64(n)
+	}
+	return n, err
+}
+
+func (s *Spool) ReadAt(bs []byte, off int64) (int, error) {
+	return s.file.ReadAt(bs, off)
+}
+
+// Returns how much of the stream has been read (and buffered).
+func (s *Spool) Offset() int64 {
+	return s.n
+}
+
+// Returns the error buffering, if any.
+func (s *Spool) Err() error {
+	return s.err
+}
+
+func (s *Spool) Close() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
 }
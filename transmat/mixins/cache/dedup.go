@@ -0,0 +1,172 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	cacheapi "github.com/polydawn/rio/cache"
+	"github.com/polydawn/rio/config"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fsOp"
+	"github.com/polydawn/rio/lib/guid"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+)
+
+/*
+	Rewrites the files of a freshly unpacked (not yet committed) shelf so that
+	their content is shared with the cache's content store, populating the
+	content store with any bodies it didn't have yet.
+
+	Each file is swapped out atomically, so if this returns an error partway,
+	the shelf is still correct -- it's just less deduplicated than it could be.
+	Dir mtimes are repaired on the way back up the walk, since swapping files
+	in and out of a dir bonks them.
+*/
+func (c cache) dedup(shelfFs fs.FS, mode config.CacheDedupMode, alg fshash.Algorithm) error {
+	var repairs []func()
+	preVisit := func(filenode *fs.FilewalkNode) error {
+		if filenode.Err != nil {
+			return filenode.Err
+		}
+		switch filenode.Info.Type {
+		case fs.Type_Dir:
+			repairs = append(repairs, fsOp.RepairMtime(shelfFs, filenode.Info.Name))
+			return nil
+		case fs.Type_File:
+			return c.dedupFile(shelfFs, *filenode.Info, mode, alg)
+		default:
+			return nil
+		}
+	}
+	postVisit := func(filenode *fs.FilewalkNode) error {
+		if filenode.Info.Type == fs.Type_Dir {
+			repairs[len(repairs)-1]()
+			repairs = repairs[:len(repairs)-1]
+		}
+		return nil
+	}
+	return fs.Walk(shelfFs, preVisit, postVisit)
+}
+
+func (c cache) dedupFile(shelfFs fs.FS, fmeta fs.Metadata, mode config.CacheDedupMode, alg fshash.Algorithm) error {
+	// Empty files aren't worth a content store entry.
+	if fmeta.Size == 0 {
+		return nil
+	}
+
+	// Hash the body.  This is the same content hash the fileset hashing uses,
+	//  with the algorithm the ware was hashed with.
+	//  If we can't read it (e.g. zero perms and we're not root), just skip it.
+	file, err := shelfFs.OpenFile(fmeta.Name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil
+	}
+	hasher := alg.New()
+	_, err = io.Copy(hasher, file)
+	file.Close()
+	if err != nil {
+		return fs.NormalizeIOError(err)
+	}
+
+	// Find the content store entry, and make sure its parents exist.
+	shareInode := mode == config.CacheDedup_Hardlink
+	entry := cacheapi.ContentFor(alg.WareHash(hasher.Sum(nil))).Join(fs.MustRelPath(cacheapi.ContentVariant(fmeta, shareInode)))
+	if err := fsOp.MkdirAll(c.fs, entry.Dir(), 0755); err != nil {
+		return err
+	}
+	entryPath := c.fs.BasePath().Join(entry).String()
+
+	switch mode {
+	case config.CacheDedup_Hardlink:
+		return dedupHardlink(shelfFs, fmeta, entryPath)
+	case config.CacheDedup_Reflink:
+		return dedupReflink(shelfFs, fmeta, entryPath)
+	default:
+		panic("unreachable")
+	}
+}
+
+func dedupHardlink(shelfFs fs.FS, fmeta fs.Metadata, entryPath string) error {
+	filePath := shelfFs.BasePath().Join(fmeta.Name).String()
+
+	// If there's no entry yet, this file becomes it.  First come, first served.
+	err := os.Link(filePath, entryPath)
+	switch {
+	case err == nil:
+		return nil
+	case os.IsExist(err):
+		// pass: swap ours out below.
+	case errors.Is(err, syscall.EMLINK):
+		return nil // already as shared as the filesystem will let it be.
+	default:
+		return fs.NormalizeIOError(err)
+	}
+
+	// Swap the file for a link to the existing entry.
+	//  Link to a temp name first, then rename over, so there's never a moment
+	//  where the shelf is missing the file.
+	tmpPath := shelfFs.BasePath().Join(fmeta.Name.Dir()).String() + "/.tmp.dedup." + guid.New()
+	if err := os.Link(entryPath, tmpPath); err != nil {
+		if errors.Is(err, syscall.EMLINK) {
+			return nil
+		}
+		return fs.NormalizeIOError(err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return fs.NormalizeIOError(err)
+	}
+	return nil
+}
+
+// Makes reflinks for dedupReflink.  (A var, so tests can make it fail.)
+var cloneFile = reflink
+
+func dedupReflink(shelfFs fs.FS, fmeta fs.Metadata, entryPath string) error {
+	filePath := shelfFs.BasePath().Join(fmeta.Name).String()
+
+	// If there's no entry yet, clone this file to become it.
+	//  Clone to a temp name and rename, so a racing party never sees a partial entry.
+	_, err := os.Lstat(entryPath)
+	switch {
+	case os.IsNotExist(err):
+		tmpPath := entryPath + ".tmp." + guid.New()
+		if err := cloneFile(filePath, tmpPath); err != nil {
+			return err
+		}
+		if err := os.Rename(tmpPath, entryPath); err != nil {
+			os.Remove(tmpPath)
+			return fs.NormalizeIOError(err)
+		}
+		return nil
+	case err != nil:
+		return fs.NormalizeIOError(err)
+	}
+
+	// Clone the entry to a temp name beside the file, give it the file's
+	//  attributes, and rename over.  Reflinks share data blocks only, so
+	//  the attributes are ours to set.
+	tmpName := fmeta.Name.Dir().Join(fs.MustRelPath(".tmp.dedup." + guid.New()))
+	tmpPath := shelfFs.BasePath().Join(tmpName).String()
+	if err := cloneFile(entryPath, tmpPath); err != nil {
+		return err
+	}
+	if err := func() error {
+		if err := shelfFs.Lchown(tmpName, fmeta.Uid, fmeta.Gid); err != nil {
+			return err
+		}
+		if err := shelfFs.Chmod(tmpName, fmeta.Perms); err != nil {
+			return err
+		}
+		if err := shelfFs.SetTimesNano(tmpName, fmeta.Mtime, fs.DefaultTime); err != nil {
+			return err
+		}
+		return fs.NormalizeIOError(os.Rename(tmpPath, filePath))
+	}(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
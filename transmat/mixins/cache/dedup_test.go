@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+
+	cacheapi "github.com/polydawn/rio/cache"
+	"github.com/polydawn/rio/config"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/osfs"
+	"github.com/polydawn/rio/fsOp"
+	"github.com/polydawn/rio/testutil"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+	"github.com/polydawn/rio/transmat/mixins/tests"
+)
+
+func TestDedupReflink(t *testing.T) {
+	Convey("Cache dedup with reflinks", t, testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			c := cache{fs: osfs.New(tmpDir.Join(fs.MustRelPath("cache")))}
+			So(os.Mkdir(c.fs.BasePath().String(), 0755), ShouldBeNil)
+
+			// Two shelves with the same content in "./a", with different mtimes.
+			fixtures := [][]tests.FixtureFile{tests.FixtureAlpha, tests.FixtureAlphaDiffTime}
+			shelves := make([]fs.FS, len(fixtures))
+			for i, fixture := range fixtures {
+				shelves[i] = osfs.New(tmpDir.Join(fs.MustRelPath(fmt.Sprintf("shelf%d", i))))
+				tests.PlaceFixture(shelves[i], fixture)
+			}
+			shouldMatchFixtures := func() {
+				for i, fixture := range fixtures {
+					for _, file := range fixture {
+						fmeta, reader, err := fsOp.ScanFile(shelves[i], file.Metadata.Name)
+						So(err, ShouldBeNil)
+						fmeta.Mtime = fmeta.Mtime.UTC()
+						So(*fmeta, ShouldResemble, file.Metadata)
+						if reader != nil {
+							body, _ := ioutil.ReadAll(reader)
+							reader.Close()
+							So(string(body), ShouldEqual, string(file.Body))
+						}
+					}
+					names, err := shelves[i].ReadDirNames(fs.RelPath{})
+					So(err, ShouldBeNil)
+					So(names, ShouldResemble, []string{"a"}) // no temp files left behind.
+				}
+			}
+
+			Convey("where the filesystem supports them, shelves should share one entry", func() {
+				probe := tmpDir.Join(fs.MustRelPath("probe")).String()
+				if err := reflink(shelves[0].BasePath().Join(fs.MustRelPath("a")).String(), probe); err != nil {
+					SkipConvey("(reflinks aren't supported here: "+err.Error()+")", func() {})
+					return
+				}
+				for _, shelf := range shelves {
+					So(c.dedup(shelf, config.CacheDedup_Reflink, fshash.DefaultAlgorithm), ShouldBeNil)
+				}
+				shouldMatchFixtures()
+				hasher := fshash.DefaultAlgorithm.New()
+				hasher.Write([]byte("zyx"))
+				entry := cacheapi.ContentFor(fshash.DefaultAlgorithm.WareHash(hasher.Sum(nil)))
+				names, err := c.fs.ReadDirNames(entry)
+				So(err, ShouldBeNil)
+				So(names, ShouldResemble, []string{"data"})
+			})
+			Convey("where reflinking fails, it should say so, and leave the shelves as they were", func() {
+				defer func(orig func(string, string) error) { cloneFile = orig }(cloneFile)
+				cloneFile = func(srcPath, dstPath string) error {
+					return Errorf(fs.ErrMisc, "reflinks are not supported here")
+				}
+				for _, shelf := range shelves {
+					So(c.dedup(shelf, config.CacheDedup_Reflink, fshash.DefaultAlgorithm), ShouldNotBeNil)
+				}
+				shouldMatchFixtures()
+			})
+		})
+	}))
+}
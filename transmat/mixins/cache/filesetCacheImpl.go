@@ -2,6 +2,7 @@ package cache
 
 import (
 	"context"
+	"io/ioutil"
 	"os"
 
 	. "github.com/warpfork/go-errcat"
@@ -9,11 +10,14 @@ import (
 	api "github.com/polydawn/go-timeless-api"
 	"github.com/polydawn/go-timeless-api/rio"
 	cacheapi "github.com/polydawn/rio/cache"
+	"github.com/polydawn/rio/config"
 	"github.com/polydawn/rio/fs"
 	"github.com/polydawn/rio/fs/osfs"
 	"github.com/polydawn/rio/fsOp"
 	"github.com/polydawn/rio/lib/guid"
 	"github.com/polydawn/rio/stitch/placer"
+	"github.com/polydawn/rio/transmat/mixins/filters"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
 	"github.com/polydawn/rio/transmat/mixins/log"
 )
 
@@ -51,11 +55,23 @@ func (c cache) Unpack(
 	// Zeroth thing: caches are by hash, but remember that filters can give you a
 	//  result hash which is different than the requested ware hash.
 	//  Right now we deal with this simply/stupidly: if you used filters, no cache for you.
+	//  (This includes uid/gid remapping, which alters the result just as filters do.)
+	//  With "mtime=now", the result is a new fileset every time: a shelf of it
+	//  could never be hit again, so don't make one at all; unpack directly.
+	if _, now, _ := filt.Mtime(); now {
+		return c.unpackUncached(ctx, wareID, path, filt, placementMode, warehouses, monitor)
+	}
 	resultWareID := wareID
-	if filt.Altering() {
+	if filt.Altering() || !filters.GetIDMap(ctx).IsIdentity() {
 		resultWareID = api.WareID{"-", "-"} // This value forces cache miss.
 	}
 
+	// If only a subtree is wanted, we still cache whole wares, and place the
+	//  subtree from the shelf.  (The unpack tool can also stream out just the
+	//  subtree directly, which we let it do if we weren't going to keep the
+	//  ware around anyway.)
+	subpath := filters.GetUnpackSubpath(ctx)
+
 	// First thing: Check if we already have the ware in cache and can jump to placement ASAP.
 	//  (This must be first because we're willing to read cache even in "direct" mode, but
 	//  yet *not* willing to even initialize empty cache dirs in that mode.)
@@ -66,19 +82,23 @@ func (c cache) Unpack(
 		switch placementMode {
 		case rio.Placement_Direct: // In direct mode: be direct.  Do nothing to cache.
 			return c.unpackTool(ctx, wareID, path, filt, rio.Placement_Direct, warehouses, monitor)
+		case rio.Placement_Copy: // Copying just a subtree: skip writing the rest, and stay direct.
+			if subpath != (fs.RelPath{}) {
+				return c.unpackTool(ctx, wareID, path, filt, rio.Placement_Direct, warehouses, monitor)
+			}
 		default: // Everyone else: unpack into cache.
 			// pass
 		}
-		// Unpack into the cache.
-		resultWareID, shelf, err = c.populate(ctx, wareID, filt, warehouses, monitor)
+		// Unpack into the cache.  (The whole ware, regardless of subpath.)
+		resultWareID, shelf, err = c.populate(filters.WithUnpackSubpath(ctx, fs.RelPath{}), wareID, filt, warehouses, monitor)
 		if err != nil {
 			return resultWareID, err
 		}
 		// Now place it from the cache shelf.
-		return resultWareID, c.place(ctx, placementMode, shelf, path)
+		return resultWareID, c.placeSubpath(ctx, placementMode, shelf, subpath, path, resultWareID)
 	case nil: // Cache has it!  Reaction varies.
 		log.CacheHasIt(monitor, wareID)
-		return resultWareID, c.place(ctx, placementMode, shelf, path)
+		return resultWareID, c.placeSubpath(ctx, placementMode, shelf, subpath, path, resultWareID)
 	default:
 		// Unknown errors reading cache are mostly considered game over.  Except:
 		//  Since direct mode has no responsibility to the cache, it can still go.
@@ -91,6 +111,64 @@ func (c cache) Unpack(
 	}
 }
 
+/*
+	Unpacks without touching the cache: directly into the path, whatever the
+	placement mode (there'd be nothing to share a mount of); or, if there's
+	to be no placement, into a temp dir which is removed after.
+*/
+func (c cache) unpackUncached(
+	ctx context.Context,
+	wareID api.WareID,
+	path string,
+	filt api.FilesetUnpackFilter,
+	placementMode rio.PlacementMode,
+	warehouses []api.WarehouseLocation,
+	monitor rio.Monitor,
+) (api.WareID, error) {
+	if placementMode == rio.Placement_None {
+		tmpPathStr, err := ioutil.TempDir("", "rio-unpack-")
+		if err != nil {
+			return api.WareID{}, Errorf(rio.ErrInoperablePath, "cannot make temp dir: %s", err)
+		}
+		defer os.RemoveAll(tmpPathStr)
+		path = tmpPathStr
+	}
+	return c.unpackTool(ctx, wareID, path, filt, rio.Placement_Direct, warehouses, monitor)
+}
+
+// Like place, but only the subtree at subpath within the shelf, which must exist.
+func (c cache) placeSubpath(
+	ctx context.Context,
+	placementMode rio.PlacementMode,
+	shelf fs.RelPath,
+	subpath fs.RelPath,
+	destination string,
+	wareID api.WareID,
+) error {
+	if subpath == (fs.RelPath{}) {
+		return c.place(ctx, placementMode, shelf, destination)
+	}
+	if subpath.GoesUp() {
+		return Errorf(rio.ErrUsage, "subpath %q must not leave the ware", subpath)
+	}
+	// Every segment must really be there, and every parent really a dir:
+	//  the placer will follow symlinks, and a subpath names the ware's entries literally.
+	for _, segment := range subpath.Split()[1:] {
+		fmeta, err := c.fs.LStat(shelf.Join(segment))
+		switch Category(err) {
+		case nil:
+			if segment != subpath && fmeta.Type != fs.Type_Dir {
+				return Errorf(rio.ErrUsage, "subpath %q not found in ware %q", subpath, wareID)
+			}
+		case fs.ErrNotExists, fs.ErrNotDir:
+			return Errorf(rio.ErrUsage, "subpath %q not found in ware %q", subpath, wareID)
+		default:
+			return Errorf(rio.ErrLocalCacheProblem, "error reading cache: %s", err)
+		}
+	}
+	return c.place(ctx, placementMode, shelf.Join(subpath), destination)
+}
+
 func (c cache) place(
 	ctx context.Context,
 	placementMode rio.PlacementMode,
@@ -150,6 +228,19 @@ func (c cache) populate(
 		return resultWareID, fs.RelPath{}, err
 	}
 
+	// If configured, share file content with the rest of the cache.
+	//  This is best-effort: a failure partway leaves some files as plain
+	//  copies, which is still a perfectly valid shelf, so we just warn.
+	if mode := config.GetCacheDedupMode(); mode != config.CacheDedup_None {
+		alg, err := fshash.AlgorithmOfWareHash(resultWareID.Hash)
+		if err == nil {
+			err = c.dedup(osfs.New(c.fs.BasePath().Join(tmpPath)), mode, alg)
+		}
+		if err != nil {
+			log.CacheDedupSkipped(monitor, resultWareID, err)
+		}
+	}
+
 	// Successful unpack: commit it to its shelf location.
 	//  This may also require mkdir'ing the prefix dirs of the shelf.
 	//  In case of race: accept our fate, assume the racing party acted in good faith,
@@ -0,0 +1,39 @@
+//go:build linux
+// +build linux
+
+package cache
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/polydawn/rio/fs"
+)
+
+// Not currently available in syscall.  (It's `_IOW(0x94, 9, int)`.)
+const _FICLONE = 0x40049409
+
+/*
+	Create a new file at dstPath which shares all of its data blocks with srcPath.
+
+	Errors if the filesystem doesn't support reflinks (or the paths are on
+	different filesystems); in that case dstPath is left absent.
+*/
+func reflink(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return fs.NormalizeIOError(err)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fs.NormalizeIOError(err)
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), _FICLONE, src.Fd())
+	dst.Close()
+	if errno != 0 {
+		os.Remove(dstPath)
+		return fs.NormalizeIOError(&os.PathError{Op: "ficlone", Path: dstPath, Err: errno})
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package cache
+
+import (
+	. "github.com/warpfork/go-errcat"
+
+	"github.com/polydawn/rio/fs"
+)
+
+func reflink(srcPath, dstPath string) error {
+	return Errorf(fs.ErrMisc, "reflinks are not supported on this platform")
+}
@@ -1,8 +1,10 @@
 package filters
 
 import (
+	"fmt"
 	"os"
 	"strconv"
+	"time"
 
 	api "github.com/polydawn/go-timeless-api"
 	"github.com/polydawn/go-timeless-api/rio"
@@ -31,13 +33,24 @@ var (
 	they will be ignored; you should probably check `IsComplete` on the filter
 	before calling this.  (We don't do it inside of here because you're
 	probably using this in a loop of large cardinality.)
+
+	Kept uids and gids are mapped from host ids to ware ids by the IDMap;
+	an id the map doesn't cover is rejected.
 */
-func ApplyPackFilter(ff api.FilesetPackFilter, fmeta *fs.Metadata) error {
+func ApplyPackFilter(ff api.FilesetPackFilter, idmap IDMap, fmeta *fs.Metadata) error {
 	if keep, setTo := ff.Uid(); !keep {
 		fmeta.Uid = uint32(setTo)
+	} else if id, ok := idmap.uidToContainer(fmeta.Uid); ok {
+		fmeta.Uid = id
+	} else {
+		return rejectUnmapped("uid", fmeta)
 	}
 	if keep, setTo := ff.Gid(); !keep {
 		fmeta.Gid = uint32(setTo)
+	} else if id, ok := idmap.gidToContainer(fmeta.Gid); ok {
+		fmeta.Gid = id
+	} else {
+		return rejectUnmapped("gid", fmeta)
 	}
 	if keep, setTo := ff.Mtime(); !keep {
 		fmeta.Mtime = setTo
@@ -93,20 +106,40 @@ func ApplyPackFilter(ff api.FilesetPackFilter, fmeta *fs.Metadata) error {
 	they will be ignored; you should probably check `IsComplete` on the filter
 	before calling this.  (We don't do it inside of here because you're
 	probably using this in a loop of large cardinality.)
+
+	If the filter has "mtime=now", each call reads the clock anew;
+	use `PinUnpackNow` once before a loop so the whole fileset agrees.
+
+	Uids and gids (other than "mine") are mapped from ware ids to host ids
+	by the IDMap; an id the map doesn't cover is rejected.
 */
-func ApplyUnpackFilter(ff api.FilesetUnpackFilter, fmeta *fs.Metadata) error {
+func ApplyUnpackFilter(ff api.FilesetUnpackFilter, idmap IDMap, fmeta *fs.Metadata) error {
 	if follow, mine, setTo := ff.Uid(); mine {
 		fmeta.Uid = myUid
-	} else if !follow {
-		fmeta.Uid = uint32(setTo)
+	} else {
+		if !follow {
+			fmeta.Uid = uint32(setTo)
+		}
+		id, ok := idmap.uidToHost(fmeta.Uid)
+		if !ok {
+			return rejectUnmapped("uid", fmeta)
+		}
+		fmeta.Uid = id
 	}
 	if follow, mine, setTo := ff.Gid(); mine {
 		fmeta.Gid = myGid
-	} else if !follow {
-		fmeta.Gid = uint32(setTo)
+	} else {
+		if !follow {
+			fmeta.Gid = uint32(setTo)
+		}
+		id, ok := idmap.gidToHost(fmeta.Gid)
+		if !ok {
+			return rejectUnmapped("gid", fmeta)
+		}
+		fmeta.Gid = id
 	}
 	if follow, now, setTo := ff.Mtime(); now {
-		panic("unpack filter mtime=now not yet supported")
+		fmeta.Mtime = time.Now().Truncate(time.Second)
 	} else if !follow {
 		fmeta.Mtime = setTo
 	}
@@ -144,3 +177,37 @@ func ApplyUnpackFilter(ff api.FilesetUnpackFilter, fmeta *fs.Metadata) error {
 	}
 	return nil
 }
+
+/*
+	PinUnpackNow returns a filter where "mtime=now", if set, is replaced by
+	the current time as a fixed value.  Other fields are unchanged.
+
+	Unpackers should call this once at the start of an unpack, so that every
+	file and dir gets the same mtime, including when dir mtimes are repaired
+	after their children are placed, and so that the filtered hash they
+	report describes exactly what they put on disk.
+
+	(The API's filter only has whole-second precision for fixed mtimes,
+	which is fine: so does "now" once it's been through the fileset hash.)
+*/
+func PinUnpackNow(ff api.FilesetUnpackFilter) api.FilesetUnpackFilter {
+	if _, now, _ := ff.Mtime(); !now {
+		return ff
+	}
+	return api.MustParseFilesetUnpackFilter(fmt.Sprintf("mtime=@%d", time.Now().Unix())).Apply(ff)
+}
+
+func rejectUnmapped(kind string, fmeta *fs.Metadata) error {
+	id := fmeta.Uid
+	if kind == "gid" {
+		id = fmeta.Gid
+	}
+	return errcat.ErrorDetailed(
+		rio.ErrFilterRejection,
+		"filter rejection: "+kind+" has no mapping",
+		map[string]string{
+			"path": fmeta.Name.String(),
+			kind:   strconv.FormatUint(uint64(id), 10),
+		},
+	)
+}
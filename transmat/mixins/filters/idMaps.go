@@ -0,0 +1,152 @@
+package filters
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/polydawn/go-timeless-api/rio"
+	. "github.com/warpfork/go-errcat"
+)
+
+/*
+	IDMapping maps a contiguous range of ids as seen in a ware ("container"
+	ids) to a range of ids on the host, in the manner of `/etc/subuid` or
+	`/proc/self/uid_map`: ContainerID through ContainerID+Size-1 correspond
+	to HostID through HostID+Size-1.
+*/
+type IDMapping struct {
+	ContainerID uint32
+	HostID      uint32
+	Size        uint32
+}
+
+/*
+	IDMap holds the uid and gid remapping tables applied between wares and
+	the host filesystem: ware ids are mapped to host ids when unpacking, and
+	host ids back to ware ids when packing.  So, for example, packing from
+	inside a user namespace yields the same WareID as packing as real root.
+
+	An empty table is the identity mapping; otherwise, any id not covered by
+	a table is rejected (there would be no way to pack it back up again).
+
+	Fixed ids given in filters (e.g. "uid=1000") are in ware terms, and are
+	mapped like any other; "uid=mine" is already in host terms, and isn't.
+
+	The zero value maps nothing.
+*/
+type IDMap struct {
+	Uid []IDMapping
+	Gid []IDMapping
+}
+
+/*
+	ParseIDMapping parses a mapping in the form "containerID:hostID:size".
+*/
+func ParseIDMapping(s string) (IDMapping, error) {
+	hunks := strings.Split(s, ":")
+	if len(hunks) != 3 {
+		return IDMapping{}, Errorf(rio.ErrUsage, "id mapping %q must be of the form 'containerID:hostID:size'", s)
+	}
+	var nums [3]uint32
+	for i, hunk := range hunks {
+		n, err := strconv.ParseUint(hunk, 10, 32)
+		if err != nil {
+			return IDMapping{}, Errorf(rio.ErrUsage, "id mapping %q must be of the form 'containerID:hostID:size': %s", s, err)
+		}
+		nums[i] = uint32(n)
+	}
+	m := IDMapping{nums[0], nums[1], nums[2]}
+	if m.Size == 0 {
+		return IDMapping{}, Errorf(rio.ErrUsage, "id mapping %q must have a nonzero size", s)
+	}
+	if uint64(m.ContainerID)+uint64(m.Size) > 1<<32 || uint64(m.HostID)+uint64(m.Size) > 1<<32 {
+		return IDMapping{}, Errorf(rio.ErrUsage, "id mapping %q overflows the id space", s)
+	}
+	return m, nil
+}
+
+/*
+	ParseIDMap parses uid and gid mappings (as by ParseIDMapping), and checks
+	that no two mappings in the same table overlap on either side.
+*/
+func ParseIDMap(uidMappings, gidMappings []string) (IDMap, error) {
+	var idmap IDMap
+	for _, x := range []struct {
+		name   string
+		strs   []string
+		result *[]IDMapping
+	}{
+		{"uid", uidMappings, &idmap.Uid},
+		{"gid", gidMappings, &idmap.Gid},
+	} {
+		for _, s := range x.strs {
+			m, err := ParseIDMapping(s)
+			if err != nil {
+				return IDMap{}, err
+			}
+			for _, other := range *x.result {
+				if overlaps(m.ContainerID, other.ContainerID, m.Size, other.Size) || overlaps(m.HostID, other.HostID, m.Size, other.Size) {
+					return IDMap{}, Errorf(rio.ErrUsage, "%s mappings %q and \"%d:%d:%d\" overlap", x.name, s, other.ContainerID, other.HostID, other.Size)
+				}
+			}
+			*x.result = append(*x.result, m)
+		}
+	}
+	return idmap, nil
+}
+
+func overlaps(a, b, aSize, bSize uint32) bool {
+	return uint64(a) < uint64(b)+uint64(bSize) && uint64(b) < uint64(a)+uint64(aSize)
+}
+
+/*
+	IsIdentity returns true if the map changes no ids.
+*/
+func (m IDMap) IsIdentity() bool {
+	return len(m.Uid) == 0 && len(m.Gid) == 0
+}
+
+func mapID(table []IDMapping, id uint32, toHost bool) (uint32, bool) {
+	if len(table) == 0 {
+		return id, true
+	}
+	for _, m := range table {
+		from, to := m.ContainerID, m.HostID
+		if !toHost {
+			from, to = to, from
+		}
+		if id >= from && uint64(id) < uint64(from)+uint64(m.Size) {
+			return to + (id - from), true
+		}
+	}
+	return id, false
+}
+
+func (m IDMap) uidToHost(id uint32) (uint32, bool)      { return mapID(m.Uid, id, true) }
+func (m IDMap) gidToHost(id uint32) (uint32, bool)      { return mapID(m.Gid, id, true) }
+func (m IDMap) uidToContainer(id uint32) (uint32, bool) { return mapID(m.Uid, id, false) }
+func (m IDMap) gidToContainer(id uint32) (uint32, bool) { return mapID(m.Gid, id, false) }
+
+func (m IDMapping) String() string {
+	return fmt.Sprintf("%d:%d:%d", m.ContainerID, m.HostID, m.Size)
+}
+
+type idMapCtxKey struct{}
+
+/*
+	Returns a context carrying the given IDMap, for pack and unpack funcs to
+	apply along with their filters.
+*/
+func WithIDMap(ctx context.Context, idmap IDMap) context.Context {
+	return context.WithValue(ctx, idMapCtxKey{}, idmap)
+}
+
+/*
+	Returns the IDMap carried by the context, or the zero (identity) IDMap.
+*/
+func GetIDMap(ctx context.Context) IDMap {
+	idmap, _ := ctx.Value(idMapCtxKey{}).(IDMap)
+	return idmap
+}
@@ -0,0 +1,257 @@
+package filters
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/polydawn/go-timeless-api/rio"
+	. "github.com/warpfork/go-errcat"
+
+	"github.com/polydawn/rio/fs"
+)
+
+/*
+	PathFilter selects which paths in a fileset are packed, by glob patterns.
+
+	Patterns use `path.Match` syntax.  A pattern containing a slash is matched
+	against the whole path (relative to the pack root, without a "./" prefix);
+	a pattern without one is matched against the last segment of the path, at
+	any depth.  A leading slash anchors a pattern to the root without
+	otherwise changing it; a trailing slash makes it match only dirs.
+
+	Excludes are considered in order, and the last match wins; an exclude
+	pattern beginning with "!" re-includes what earlier patterns excluded.
+	An excluded dir is skipped entirely, so nothing inside it can be
+	re-included.
+
+	If there are any includes, a path is only packed if it, or one of its
+	parent dirs, matches an include.  Other dirs are still walked (unless
+	excluded), since they may hold included content; they're packed only
+	if something in them is (see PruneDirs).
+
+	The zero value excludes nothing.
+*/
+type PathFilter struct {
+	includes []pathRule
+	excludes []pathRule
+}
+
+type pathRule struct {
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+/*
+	The name of the file in the root of a fileset which, if present, lists
+	exclude patterns for packing that fileset -- one per line, with blank
+	lines and lines beginning with "#" ignored.
+*/
+const IgnoreFileName = ".rioignore"
+
+func NewPathFilter(includes, excludes []string) (PathFilter, error) {
+	var pf PathFilter
+	for _, pattern := range includes {
+		rule, err := parsePathRule(pattern)
+		if err != nil {
+			return PathFilter{}, err
+		}
+		if rule.negate {
+			return PathFilter{}, Errorf(rio.ErrUsage, "path filter: include patterns may not be negated (%q)", pattern)
+		}
+		pf.includes = append(pf.includes, rule)
+	}
+	for _, pattern := range excludes {
+		rule, err := parsePathRule(pattern)
+		if err != nil {
+			return PathFilter{}, err
+		}
+		pf.excludes = append(pf.excludes, rule)
+	}
+	return pf, nil
+}
+
+func parsePathRule(pattern string) (rule pathRule, err error) {
+	original := pattern
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if strings.Contains(pattern, "/") {
+		rule.anchored = true
+		pattern = strings.TrimLeft(pattern, "/")
+	}
+	if pattern == "" {
+		return rule, Errorf(rio.ErrUsage, "path filter: empty pattern (%q)", original)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return rule, Errorf(rio.ErrUsage, "path filter: invalid pattern %q: %s", original, err)
+	}
+	rule.pattern = pattern
+	return rule, nil
+}
+
+func (r pathRule) matches(name string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if !r.anchored {
+		name = path.Base(name)
+	}
+	ok, _ := path.Match(r.pattern, name)
+	return ok
+}
+
+/*
+	Returns a PathFilter which also honors the ignore file in the root of
+	the given filesystem, if there is one.
+
+	The ignore file's patterns are considered before the filter's own
+	excludes, so explicitly given patterns have the last word.
+*/
+func (pf PathFilter) WithIgnoreFile(afs fs.FS) (PathFilter, error) {
+	f, err := afs.OpenFile(fs.MustRelPath(IgnoreFileName), os.O_RDONLY, 0)
+	switch Category(err) {
+	case nil:
+		defer f.Close()
+	case fs.ErrNotExists, fs.ErrNotDir:
+		return pf, nil
+	default:
+		return pf, Errorf(rio.ErrPackInvalid, "cannot read %s: %s", IgnoreFileName, err)
+	}
+	var excludes []pathRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parsePathRule(line)
+		if err != nil {
+			return pf, Errorf(rio.ErrPackInvalid, "invalid %s: %s", IgnoreFileName, err)
+		}
+		excludes = append(excludes, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return pf, Errorf(rio.ErrPackInvalid, "cannot read %s: %s", IgnoreFileName, err)
+	}
+	pf.excludes = append(excludes, pf.excludes...)
+	return pf, nil
+}
+
+/*
+	Returns true if the path should be left out of the pack.
+	The root path is never excluded.
+*/
+func (pf PathFilter) Excluded(name fs.RelPath, isDir bool) bool {
+	if name == (fs.RelPath{}) {
+		return false
+	}
+	str := strings.TrimPrefix(name.String(), "./")
+	if len(pf.includes) > 0 && !isDir && !pf.included(str, false) {
+		return true
+	}
+	excluded := false
+	for _, rule := range pf.excludes {
+		if rule.matches(str, isDir) {
+			excluded = !rule.negate
+		}
+	}
+	return excluded
+}
+
+func (pf PathFilter) included(str string, isDir bool) bool {
+	for p := str; p != "."; p, isDir = path.Dir(p), true {
+		for _, rule := range pf.includes {
+			if rule.matches(p, isDir) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+	Wraps the put func of a walk applying this filter, so that dirs walked
+	only for what they may hold -- those which, with includes given, don't
+	match one, and aren't in one which does -- are held back until something
+	in them is put, and left out if nothing is.
+
+	The walk must put parents before their children, as fs.Walk does.
+	Call this for each walk: the wrapper keeps the dirs it holds.
+*/
+func (pf PathFilter) PruneDirs(put func(*fs.Metadata, io.ReadCloser) error) func(*fs.Metadata, io.ReadCloser) error {
+	if len(pf.includes) == 0 {
+		return put
+	}
+	var held []*fs.Metadata // a chain of dirs, each in the one before.
+	return func(fmeta *fs.Metadata, body io.ReadCloser) error {
+		// Drop the held dirs this isn't in: the walk is done with them, and
+		//  nothing in them was put.
+		for len(held) > 0 && !strings.HasPrefix(fmeta.Name.String(), held[len(held)-1].Name.String()+"/") {
+			held = held[:len(held)-1]
+		}
+		str := strings.TrimPrefix(fmeta.Name.String(), "./")
+		if fmeta.Type == fs.Type_Dir && fmeta.Name != (fs.RelPath{}) && !pf.included(str, true) {
+			held = append(held, fmeta)
+			return nil
+		}
+		for _, dir := range held {
+			if err := put(dir, nil); err != nil {
+				return err
+			}
+		}
+		held = held[:0]
+		return put(fmeta, body)
+	}
+}
+
+type pathFilterCtxKey struct{}
+
+/*
+	Returns a context carrying the given PathFilter, for pack funcs to apply.
+
+	(The pack func signature is fixed by the API, and the API's filter type
+	only covers file attributes, so this is how path filters reach a pack.)
+*/
+func WithPathFilter(ctx context.Context, pf PathFilter) context.Context {
+	return context.WithValue(ctx, pathFilterCtxKey{}, pf)
+}
+
+/*
+	Returns the PathFilter carried by the context, or the zero PathFilter.
+*/
+func GetPathFilter(ctx context.Context) PathFilter {
+	pf, _ := ctx.Value(pathFilterCtxKey{}).(PathFilter)
+	return pf
+}
+
+type unpackSubpathCtxKey struct{}
+
+/*
+	Returns a context asking unpack funcs to place only the given subtree
+	of the ware, rebased to the unpack target path.  The whole ware is still
+	read and verified.
+
+	The zero RelPath (the default) means the whole ware.
+*/
+func WithUnpackSubpath(ctx context.Context, subpath fs.RelPath) context.Context {
+	return context.WithValue(ctx, unpackSubpathCtxKey{}, subpath)
+}
+
+/*
+	Returns the unpack subpath carried by the context, or the zero RelPath.
+*/
+func GetUnpackSubpath(ctx context.Context) fs.RelPath {
+	subpath, _ := ctx.Value(unpackSubpathCtxKey{}).(fs.RelPath)
+	return subpath
+}
@@ -0,0 +1,127 @@
+package fshash
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/polydawn/refmt/misc"
+	"github.com/zeebo/blake3"
+)
+
+/*
+	Algorithm names the hash function a fileset's WareID is made with:
+	it's used both for the content of each file, and for the tree over
+	them (see HashBucket).
+
+	The hash in a WareID says which algorithm made it: it's
+	"<algorithm>-<base58>" -- except for sha384, the default, which is
+	plain base58 as WareIDs have always been.  ('-' is never part of
+	base58, so the two forms can't be confused.)
+*/
+type Algorithm string
+
+const (
+	Algorithm_SHA384 Algorithm = "sha384"
+	Algorithm_SHA256 Algorithm = "sha256"
+	Algorithm_BLAKE3 Algorithm = "blake3"
+)
+
+const DefaultAlgorithm = Algorithm_SHA384
+
+// All the algorithms supported, default first.
+var Algorithms = []Algorithm{
+	Algorithm_SHA384,
+	Algorithm_SHA256,
+	Algorithm_BLAKE3,
+}
+
+func ParseAlgorithm(s string) (Algorithm, error) {
+	for _, a := range Algorithms {
+		if string(a) == s {
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported hash algorithm %q", s)
+}
+
+/*
+	Returns a new hasher of this algorithm.
+	(The method value works as the hasherFactory for HashBucket.)
+
+	Panics if the algorithm isn't one of Algorithms; use ParseAlgorithm
+	on anything that comes from outside.
+*/
+func (a Algorithm) New() hash.Hash {
+	switch a {
+	case Algorithm_SHA384:
+		return sha512.New384()
+	case Algorithm_SHA256:
+		return sha256.New()
+	case Algorithm_BLAKE3:
+		return blake3.New()
+	default:
+		panic(fmt.Errorf("unsupported hash algorithm %q", a))
+	}
+}
+
+/*
+	Encodes a root hash (as from HashBucket) as the hash of a WareID.
+*/
+func (a Algorithm) WareHash(sum []byte) string {
+	if a == DefaultAlgorithm {
+		return misc.Base58Encode(sum)
+	}
+	return string(a) + "-" + misc.Base58Encode(sum)
+}
+
+/*
+	Returns the algorithm the hash of a WareID was made with.
+	The hash itself isn't checked.
+*/
+func AlgorithmOfWareHash(wareHash string) (Algorithm, error) {
+	i := strings.IndexByte(wareHash, '-')
+	if i < 0 {
+		return DefaultAlgorithm, nil
+	}
+	a, err := ParseAlgorithm(wareHash[:i])
+	if err != nil || a == DefaultAlgorithm {
+		return "", fmt.Errorf("unsupported hash algorithm in ware hash %q", wareHash)
+	}
+	return a, nil
+}
+
+type algorithmCtxKey struct{}
+
+/*
+	Returns a context asking pack funcs (and scans, which likewise make new
+	WareIDs) to hash with the given algorithm.
+*/
+func WithAlgorithm(ctx context.Context, a Algorithm) context.Context {
+	return context.WithValue(ctx, algorithmCtxKey{}, a)
+}
+
+/*
+	Returns the algorithm carried by the context, or DefaultAlgorithm.
+*/
+func GetAlgorithm(ctx context.Context) Algorithm {
+	a, ok := ctx.Value(algorithmCtxKey{}).(Algorithm)
+	if !ok {
+		return DefaultAlgorithm
+	}
+	return a
+}
+
+/*
+	Returns the algorithm to check a ware with: the one its hash says,
+	if the hash is known; otherwise (when scanning), that of the context.
+*/
+func AlgorithmForWare(ctx context.Context, wareHash string) (Algorithm, error) {
+	if wareHash == "" || wareHash == "-" {
+		return GetAlgorithm(ctx), nil
+	}
+	return AlgorithmOfWareHash(wareHash)
+}
@@ -0,0 +1,54 @@
+package fshash
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAlgorithms(t *testing.T) {
+	Convey("Hash algorithms", t, func() {
+		sum := []byte{1, 2, 3}
+		Convey("the default encodes as bare base58, as WareIDs always have", func() {
+			So(Algorithm_SHA384.WareHash(sum), ShouldEqual, "Ldp")
+			alg, err := AlgorithmOfWareHash("Ldp")
+			So(err, ShouldBeNil)
+			So(alg, ShouldEqual, Algorithm_SHA384)
+		})
+		Convey("others are named in the hash, and detected from it", func() {
+			for _, alg := range []Algorithm{Algorithm_SHA256, Algorithm_BLAKE3} {
+				So(alg.WareHash(sum), ShouldEqual, string(alg)+"-Ldp")
+				detected, err := AlgorithmOfWareHash(alg.WareHash(sum))
+				So(err, ShouldBeNil)
+				So(detected, ShouldEqual, alg)
+			}
+		})
+		Convey("unknown or redundant names are rejected", func() {
+			_, err := AlgorithmOfWareHash("md5-Ldp")
+			So(err, ShouldNotBeNil)
+			_, err = AlgorithmOfWareHash("sha384-Ldp")
+			So(err, ShouldNotBeNil)
+			_, err = ParseAlgorithm("md5")
+			So(err, ShouldNotBeNil)
+		})
+		Convey("each has its own digest size", func() {
+			So(Algorithm_SHA384.New().Size(), ShouldEqual, 48)
+			So(Algorithm_SHA256.New().Size(), ShouldEqual, 32)
+			So(Algorithm_BLAKE3.New().Size(), ShouldEqual, 32)
+		})
+		Convey("the context picks the algorithm for new WareIDs, and a known hash overrules it", func() {
+			So(GetAlgorithm(context.Background()), ShouldEqual, DefaultAlgorithm)
+			ctx := WithAlgorithm(context.Background(), Algorithm_BLAKE3)
+			alg, err := AlgorithmForWare(ctx, "-")
+			So(err, ShouldBeNil)
+			So(alg, ShouldEqual, Algorithm_BLAKE3)
+			alg, err = AlgorithmForWare(ctx, "sha256-Ldp")
+			So(err, ShouldBeNil)
+			So(alg, ShouldEqual, Algorithm_SHA256)
+			alg, err = AlgorithmForWare(ctx, "Ldp")
+			So(err, ShouldBeNil)
+			So(alg, ShouldEqual, Algorithm_SHA384)
+		})
+	})
+}
@@ -17,6 +17,7 @@ type Bucket interface {
 	Iterator() (rootRecord RecordIterator)              // return a treewalk root that does a traversal ordered by path
 	Root() Record                                       // return the 0'th record; is the root if `Iterator` has already been invoked.
 	Length() int
+	Close() error // release anything held outside memory; the bucket mustn't be used after.
 }
 
 type Record struct {
@@ -0,0 +1,464 @@
+package fshash
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/cbor"
+	"github.com/polydawn/refmt/obj/atlas"
+
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/lib/treewalk"
+)
+
+// How many records a DiskBucket holds in memory before spilling, by default.
+const DefaultSpillThreshold = 1 << 17
+
+var _ Bucket = &DiskBucket{}
+
+/*
+	DiskBucket holds records in a MemoryBucket up to a threshold, then
+	spills them to temp files in sorted runs, which are merged while
+	iterating.  Below the threshold it's just a MemoryBucket; so it's fine
+	to use for any fileset, and only costs disk for very large ones.
+
+	Once spilling, dirs are still kept in memory, because HasRecord and
+	UpdateRecord (which unpackers use to reconcile dirs they inferred with
+	ones found later) are supported only for dirs.  Everything else may
+	be spilled.
+
+	The temp files are unlinked as soon as they're created, so nothing is
+	left behind even if the process dies; but they hold their space until
+	Close is called.  If spilling fails (e.g. for lack of temp space), the
+	bucket just keeps all further records in memory.
+
+	Records read back from disk have their mtimes in the local zone,
+	as from `time.Unix`.
+
+	The zero value is ready to use.
+*/
+type DiskBucket struct {
+	Threshold int    // Records to hold in memory before spilling.  If zero, DefaultSpillThreshold.
+	TempDir   string // Where to spill to.  If empty, os.TempDir.
+
+	mem      *MemoryBucket // every record, until the threshold is first reached.
+	spilling bool          // set once the threshold is reached; mem is nil after.
+	dirs     map[string]Record
+	repeated []string  // names of dirs added more than once
+	pending  []Record  // records other than dirs, not yet spilled
+	runs     []diskRun // spilled records, each run sorted
+	length   int
+	root     *Record // the lowest-sorting record added
+	noSpill  bool    // set if spilling failed once
+}
+
+type diskRun struct {
+	file *os.File
+	size int64
+}
+
+func (b *DiskBucket) AddRecord(metadata fs.Metadata, contentHash []byte) {
+	record := Record{recordName(metadata), metadata, contentHash}
+	if b.root == nil || record.Name < b.root.Name {
+		b.root = &record
+	}
+	b.length++
+	if !b.spilling {
+		if b.mem == nil {
+			b.mem = &MemoryBucket{}
+		}
+		b.mem.AddRecord(metadata, contentHash)
+		if b.length >= b.threshold() {
+			b.startSpilling()
+		}
+		return
+	}
+	b.add(record)
+}
+
+func (b *DiskBucket) threshold() int {
+	if b.Threshold == 0 {
+		return DefaultSpillThreshold
+	}
+	return b.Threshold
+}
+
+// Moves the records out of the MemoryBucket, so they can be spilled.
+//  Its names are in the order added, including any repeats, so the
+//  repeats are still caught while iterating.
+func (b *DiskBucket) startSpilling() {
+	b.spilling = true
+	for _, name := range b.mem.names {
+		b.add(b.mem.records[name])
+	}
+	b.mem = nil
+}
+
+func (b *DiskBucket) add(record Record) {
+	if record.Metadata.Type == fs.Type_Dir {
+		if b.dirs == nil {
+			b.dirs = map[string]Record{}
+		}
+		if _, exists := b.dirs[record.Name]; exists {
+			b.repeated = append(b.repeated, record.Name)
+		}
+		b.dirs[record.Name] = record
+		return
+	}
+	b.pending = append(b.pending, record)
+	if len(b.pending) >= b.threshold() && !b.noSpill {
+		b.spill()
+	}
+}
+
+/*
+	Reports whether a record of the same name exists.
+	Only supported for dirs; panics for anything else.
+*/
+func (b *DiskBucket) HasRecord(metadata fs.Metadata) bool {
+	if metadata.Type != fs.Type_Dir {
+		panic(fmt.Errorf("DiskBucket.HasRecord only supports dirs"))
+	}
+	if !b.spilling {
+		return b.mem != nil && b.mem.HasRecord(metadata)
+	}
+	_, hasRecord := b.dirs[recordName(metadata)]
+	return hasRecord
+}
+
+/*
+	Replaces the record of the same name.
+	Only supported for dirs; panics for anything else.
+*/
+func (b *DiskBucket) UpdateRecord(metadata fs.Metadata, contentHash []byte) {
+	if metadata.Type != fs.Type_Dir {
+		panic(fmt.Errorf("DiskBucket.UpdateRecord only supports dirs"))
+	}
+	record := Record{recordName(metadata), metadata, contentHash}
+	if b.spilling {
+		b.dirs[record.Name] = record
+	} else {
+		b.mem.UpdateRecord(metadata, contentHash)
+	}
+	if b.root != nil && b.root.Name == record.Name {
+		b.root = &record
+	}
+}
+
+/*
+	Get a `treewalk.Node` that starts at the root of the bucket.
+	The walk will be in deterministic, sorted order (and thus is appropriate
+	for hashing), exactly as for MemoryBucket.
+
+	This is only safe for non-concurrent use and depth-first traversal.
+	Iterating doesn't consume the bucket; it may be iterated again.
+*/
+func (b *DiskBucket) Iterator() RecordIterator {
+	if b.length == 0 {
+		return &diskBucketIterator{newMergeCursor(nil), Record{}}
+	}
+	if !b.spilling {
+		return b.mem.Iterator()
+	}
+	if len(b.repeated) > 0 {
+		panic(ErrInvalidFilesystem{fmt.Sprintf("repeated path: %q", b.repeated[0])})
+	}
+	dirs := make([]Record, 0, len(b.dirs))
+	for _, record := range b.dirs {
+		dirs = append(dirs, record)
+	}
+	sort.Sort(recordsByName(dirs))
+	sort.Sort(recordsByName(b.pending))
+	sources := []recordSource{&sliceSource{dirs}, &sliceSource{b.pending}}
+	for _, run := range b.runs {
+		sources = append(sources, &runSource{bufio.NewReader(io.NewSectionReader(run.file, 0, run.size)), nil})
+	}
+	cursor := newMergeCursor(sources)
+	root, _ := cursor.peek()
+	if root.Metadata.Name != (fs.RelPath{}) {
+		panic(ErrInvalidFilesystem{fmt.Sprintf("missing root (first entry: %q)", root.Metadata.Name)})
+	}
+	cursor.advance()
+	return &diskBucketIterator{cursor, root}
+}
+
+func (b *DiskBucket) Root() Record {
+	return *b.root
+}
+
+func (b *DiskBucket) Length() int {
+	return b.length
+}
+
+/*
+	Releases the temp files of any spilled runs.
+	The bucket mustn't be used after.
+*/
+func (b *DiskBucket) Close() error {
+	var firstErr error
+	for _, run := range b.runs {
+		if err := run.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	b.runs = nil
+	return firstErr
+}
+
+// Writes the pending records to a new run.  On failure, gives up on
+//  spilling, and leaves them (and all records to come) in memory.
+func (b *DiskBucket) spill() {
+	sort.Sort(recordsByName(b.pending))
+	f, err := ioutil.TempFile(b.TempDir, "rio-bucket-")
+	if err != nil {
+		b.noSpill = true
+		return
+	}
+	os.Remove(f.Name())
+	w := bufio.NewWriter(f)
+	var size int64
+	for _, record := range b.pending {
+		n, err := writeDiskRecord(w, record)
+		if err != nil {
+			f.Close()
+			b.noSpill = true
+			return
+		}
+		size += n
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		b.noSpill = true
+		return
+	}
+	b.runs = append(b.runs, diskRun{f, size})
+	b.pending = b.pending[:0]
+}
+
+func recordName(metadata fs.Metadata) string {
+	name := metadata.Name.String()
+	if metadata.Type == fs.Type_Dir {
+		name += "/"
+	}
+	return name
+}
+
+type diskBucketIterator struct {
+	cursor *mergeCursor
+	record Record
+}
+
+func (i *diskBucketIterator) NextChild() treewalk.Node {
+	// Records come off the cursor in sorted order, so all child nodes follow
+	// their parent, and a child is walked fully before the parent asks again.
+	// This checks exactly as memoryBucketIterator does.
+	next, ok := i.cursor.peek()
+	if !ok {
+		return nil
+	}
+	thisName := i.record.Name
+	// is the next one still a child?
+	if strings.HasPrefix(next.Name, thisName) {
+		// check for repeated names
+		if i.cursor.last == next.Name {
+			panic(ErrInvalidFilesystem{fmt.Sprintf("repeated path: %q", next.Name)})
+		}
+		// check for missing trees
+		if strings.ContainsRune(next.Name[len(thisName):len(next.Name)-1], '/') {
+			panic(ErrInvalidFilesystem{fmt.Sprintf("missing tree: %q followed %q", next.Name, thisName)})
+		}
+		// step forward
+		i.cursor.advance()
+		return &diskBucketIterator{i.cursor, next}
+	}
+	return nil
+}
+
+func (i *diskBucketIterator) Record() Record {
+	return i.record
+}
+
+type recordsByName []Record
+
+func (a recordsByName) Len() int           { return len(a) }
+func (a recordsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a recordsByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+// A sorted stream of records; one of the inputs to a mergeCursor.
+type recordSource interface {
+	next() (Record, bool)
+}
+
+type sliceSource struct {
+	records []Record
+}
+
+func (s *sliceSource) next() (Record, bool) {
+	if len(s.records) == 0 {
+		return Record{}, false
+	}
+	record := s.records[0]
+	s.records = s.records[1:]
+	return record, true
+}
+
+type runSource struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func (s *runSource) next() (Record, bool) {
+	record, err := readDiskRecord(s.r, &s.buf)
+	if err == io.EOF {
+		return Record{}, false
+	}
+	if err != nil {
+		panic(fmt.Errorf("cannot read back spilled bucket records: %s", err))
+	}
+	return record, true
+}
+
+// Merges sorted record sources into one sorted stream.
+type mergeCursor struct {
+	heads mergeHeap
+	last  string // name of the record last advanced past
+}
+
+type mergeHead struct {
+	record Record
+	source recordSource
+}
+
+func newMergeCursor(sources []recordSource) *mergeCursor {
+	c := &mergeCursor{}
+	for _, source := range sources {
+		if record, ok := source.next(); ok {
+			c.heads = append(c.heads, mergeHead{record, source})
+		}
+	}
+	heap.Init(&c.heads)
+	return c
+}
+
+func (c *mergeCursor) peek() (Record, bool) {
+	if len(c.heads) == 0 {
+		return Record{}, false
+	}
+	return c.heads[0].record, true
+}
+
+func (c *mergeCursor) advance() {
+	c.last = c.heads[0].record.Name
+	if record, ok := c.heads[0].source.next(); ok {
+		c.heads[0].record = record
+		heap.Fix(&c.heads, 0)
+	} else {
+		heap.Pop(&c.heads)
+	}
+}
+
+type mergeHeap []mergeHead
+
+func (h mergeHeap) Len() int            { return len(h) }
+func (h mergeHeap) Less(i, j int) bool  { return h[i].record.Name < h[j].record.Name }
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeHead)) }
+func (h *mergeHeap) Pop() interface{} {
+	x := (*h)[len(*h)-1]
+	*h = (*h)[:len(*h)-1]
+	return x
+}
+
+// diskRecord is the serial form of a Record in a spilled run.
+//  Each is written as a uvarint length, then that many bytes of cbor.
+type diskRecord struct {
+	Path        string            `refmt:"n"`
+	Type        int64             `refmt:"t"`
+	Perms       int64             `refmt:"p"`
+	Uid         int64             `refmt:"u"`
+	Gid         int64             `refmt:"g"`
+	Size        int64             `refmt:"s"`
+	Linkname    string            `refmt:"l"`
+	Devmajor    int64             `refmt:"dM"`
+	Devminor    int64             `refmt:"dm"`
+	Mtime       int64             `refmt:"m"`
+	MtimeNanos  int64             `refmt:"mn"`
+	Xattrs      map[string]string `refmt:"x"`
+	ContentHash []byte            `refmt:"h"`
+}
+
+var diskRecordAtlas = atlas.MustBuild(
+	atlas.BuildEntry(diskRecord{}).StructMap().Autogenerate().Complete(),
+)
+
+func writeDiskRecord(w io.Writer, record Record) (int64, error) {
+	m := record.Metadata
+	body, err := refmt.MarshalAtlased(cbor.EncodeOptions{}, diskRecord{
+		Path:        m.Name.String(),
+		Type:        int64(m.Type),
+		Perms:       int64(m.Perms),
+		Uid:         int64(m.Uid),
+		Gid:         int64(m.Gid),
+		Size:        m.Size,
+		Linkname:    m.Linkname,
+		Devmajor:    m.Devmajor,
+		Devminor:    m.Devminor,
+		Mtime:       m.Mtime.Unix(),
+		MtimeNanos:  int64(m.Mtime.Nanosecond()),
+		Xattrs:      m.Xattrs,
+		ContentHash: record.ContentHash,
+	}, diskRecordAtlas)
+	if err != nil {
+		return 0, err
+	}
+	var prefix [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(prefix[:], uint64(len(body)))
+	if _, err := w.Write(prefix[:n]); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return 0, err
+	}
+	return int64(n + len(body)), nil
+}
+
+func readDiskRecord(r *bufio.Reader, buf *[]byte) (Record, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return Record{}, err // including a clean io.EOF at the end of the run.
+	}
+	if uint64(cap(*buf)) < length {
+		*buf = make([]byte, length)
+	}
+	body := (*buf)[:length]
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Record{}, io.ErrUnexpectedEOF
+	}
+	var dr diskRecord
+	if err := refmt.UnmarshalAtlased(cbor.DecodeOptions{}, body, &dr, diskRecordAtlas); err != nil {
+		return Record{}, err
+	}
+	metadata := fs.Metadata{
+		Name:     fs.MustRelPath(dr.Path),
+		Type:     fs.Type(dr.Type),
+		Perms:    fs.Perms(dr.Perms),
+		Uid:      uint32(dr.Uid),
+		Gid:      uint32(dr.Gid),
+		Size:     dr.Size,
+		Linkname: dr.Linkname,
+		Devmajor: dr.Devmajor,
+		Devminor: dr.Devminor,
+		Mtime:    time.Unix(dr.Mtime, dr.MtimeNanos),
+		Xattrs:   dr.Xattrs,
+	}
+	return Record{recordName(metadata), metadata, dr.ContentHash}, nil
+}
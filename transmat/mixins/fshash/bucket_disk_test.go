@@ -0,0 +1,89 @@
+package fshash
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/lib/treewalk"
+)
+
+func TestDiskBucket(t *testing.T) {
+	Convey("DiskBucket", t, func() {
+		mtime := time.Unix(631628400, 12)
+		// A fileset of a few dirs of files, added in an order far from sorted.
+		var records []Record
+		records = append(records, Record{"", fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: mtime}, nil})
+		for i := 9; i >= 0; i-- {
+			dir := fs.MustRelPath(fmt.Sprintf("./d%d", i))
+			for j := 0; j < 7; j++ {
+				records = append(records, Record{"", fs.Metadata{Name: dir.Join(fs.MustRelPath(fmt.Sprintf("f%d", j))), Type: fs.Type_File, Perms: 0644, Uid: uint32(j), Size: int64(i), Mtime: mtime, Xattrs: map[string]string{"user.i": "x"}}, []byte{byte(i), byte(j)}})
+			}
+			records = append(records, Record{"", fs.Metadata{Name: dir.Join(fs.MustRelPath("l")), Type: fs.Type_Symlink, Perms: 0777, Linkname: "f0", Mtime: mtime}, nil})
+			records = append(records, Record{"", fs.Metadata{Name: dir, Type: fs.Type_Dir, Perms: 0750, Mtime: mtime}, nil})
+		}
+		memBucket := &MemoryBucket{}
+		for _, record := range records {
+			memBucket.AddRecord(record.Metadata, record.ContentHash)
+		}
+		walk := func(bucket Bucket) (walked []Record) {
+			treewalk.Walk(bucket.Iterator(), func(node treewalk.Node) error {
+				walked = append(walked, node.(RecordIterator).Record())
+				return nil
+			}, nil)
+			return
+		}
+
+		for _, threshold := range []int{0, 1, 4, 1000} {
+			Convey(fmt.Sprintf("with a threshold of %d", threshold), func() {
+				bucket := &DiskBucket{Threshold: threshold}
+				for _, record := range records {
+					bucket.AddRecord(record.Metadata, record.ContentHash)
+				}
+				So(bucket.Length(), ShouldEqual, memBucket.Length())
+				So(bucket.Root().Metadata.Name, ShouldResemble, fs.RelPath{})
+
+				Convey("iteration should be the same as for a MemoryBucket", func() {
+					So(walk(bucket), ShouldResemble, walk(memBucket))
+				})
+				Convey("the hash should be the same as for a MemoryBucket", func() {
+					So(HashBucket(bucket, sha512.New384), ShouldResemble, HashBucket(memBucket, sha512.New384))
+					Convey("and iterating again should work the same", func() {
+						So(HashBucket(bucket, sha512.New384), ShouldResemble, HashBucket(memBucket, sha512.New384))
+					})
+				})
+				Convey("dirs can be looked up and updated", func() {
+					dir := fs.Metadata{Name: fs.MustRelPath("./d3"), Type: fs.Type_Dir, Perms: 0700, Mtime: mtime}
+					So(bucket.HasRecord(dir), ShouldBeTrue)
+					So(bucket.HasRecord(fs.Metadata{Name: fs.MustRelPath("./nope"), Type: fs.Type_Dir}), ShouldBeFalse)
+					bucket.UpdateRecord(dir, nil)
+					memBucket.UpdateRecord(dir, nil)
+					So(walk(bucket), ShouldResemble, walk(memBucket))
+				})
+				Convey("a repeated path should be rejected", func() {
+					bucket.AddRecord(records[3].Metadata, records[3].ContentHash)
+					So(func() { HashBucket(bucket, sha512.New384) }, ShouldPanicWith, ErrInvalidFilesystem{fmt.Sprintf("repeated path: %q", records[3].Metadata.Name.String())})
+				})
+				Convey("it should spill only past the threshold, and Close should release what it spilled", func() {
+					if threshold == 0 || threshold > len(records) {
+						So(bucket.mem, ShouldNotBeNil)
+						So(bucket.runs, ShouldBeEmpty)
+					} else {
+						So(bucket.mem, ShouldBeNil)
+						So(bucket.runs, ShouldNotBeEmpty)
+					}
+					So(bucket.Close(), ShouldBeNil)
+					So(bucket.runs, ShouldBeEmpty)
+				})
+				Convey("a missing tree should be rejected", func() {
+					bucket.AddRecord(fs.Metadata{Name: fs.MustRelPath("./x/y"), Type: fs.Type_File, Mtime: mtime}, nil)
+					So(func() { HashBucket(bucket, sha512.New384) }, ShouldPanic)
+				})
+			})
+		}
+	})
+}
@@ -88,6 +88,10 @@ func (b *MemoryBucket) Length() int {
 	return len(b.records)
 }
 
+func (b *MemoryBucket) Close() error {
+	return nil
+}
+
 type memoryBucketIterator struct {
 	lines []Record
 	this  int  // pretending a linear structure is a tree is weird.
@@ -128,6 +132,6 @@ func (i memoryBucketIterator) Record() Record {
 
 type memoryBucketByFilename MemoryBucket
 
-func (a memoryBucketByFilename) Len() int           { return len(a.records) }
+func (a memoryBucketByFilename) Len() int           { return len(a.names) }
 func (a memoryBucketByFilename) Swap(i, j int)      { a.names[i], a.names[j] = a.names[j], a.names[i] }
 func (a memoryBucketByFilename) Less(i, j int) bool { return a.names[i] < a.names[j] }
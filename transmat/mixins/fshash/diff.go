@@ -0,0 +1,137 @@
+package fshash
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/lib/treewalk"
+)
+
+type ChangeKind string
+
+const (
+	Change_Added    ChangeKind = "added"
+	Change_Removed  ChangeKind = "removed"
+	Change_Modified ChangeKind = "modified"
+)
+
+/*
+	Change describes how one path differs between two buckets.
+
+	For modifications, Fields lists which properties differ, using the names:
+	"type", "perms", "uid", "gid", "linkname", "devmajor", "devminor",
+	"mtime", "xattrs", and "content".  Only properties which are part of the
+	fileset hash are considered; so for example, a difference in size alone
+	(or a symlink's "content", which some formats record) is no difference.
+	Old is nil for additions, and New is nil for removals.
+*/
+type Change struct {
+	Kind   ChangeKind
+	Fields []string
+	Old    *Record
+	New    *Record
+}
+
+/*
+	Diff compares the records of two buckets, and returns a Change for
+	every path which is not the same in both, sorted by path.
+
+	Paths are matched regardless of type, so a file replaced by a dir of the
+	same name is a modification of "type" (and whatever else), not a removal
+	and an addition.
+
+	May panic with ErrInvalidFilesystem, as iterating either bucket may.
+*/
+func Diff(a, b Bucket) []Change {
+	olds := recordsByPath(a)
+	news := recordsByPath(b)
+	var paths []string
+	for path := range olds {
+		paths = append(paths, path)
+	}
+	for path := range news {
+		if _, ok := olds[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	var changes []Change
+	for _, path := range paths {
+		prev, hasPrev := olds[path]
+		next, hasNext := news[path]
+		switch {
+		case !hasNext:
+			changes = append(changes, Change{Kind: Change_Removed, Old: &prev})
+		case !hasPrev:
+			changes = append(changes, Change{Kind: Change_Added, New: &next})
+		default:
+			if fields := diffRecord(prev, next); len(fields) > 0 {
+				changes = append(changes, Change{Change_Modified, fields, &prev, &next})
+			}
+		}
+	}
+	return changes
+}
+
+func recordsByPath(bucket Bucket) map[string]Record {
+	records := make(map[string]Record, bucket.Length())
+	if bucket.Length() == 0 {
+		return records
+	}
+	treewalk.Walk(bucket.Iterator(), func(node treewalk.Node) error {
+		record := node.(RecordIterator).Record()
+		records[record.Metadata.Name.String()] = record
+		return nil
+	}, nil)
+	return records
+}
+
+// Compares exactly what HashBucket does: e.g. not sizes (which are implied
+//  by content), and content hashes for files only.
+func diffRecord(prev, next Record) (fields []string) {
+	a, b := prev.Metadata, next.Metadata
+	if a.Type != b.Type {
+		fields = append(fields, "type")
+	}
+	if a.Perms != b.Perms {
+		fields = append(fields, "perms")
+	}
+	if a.Uid != b.Uid {
+		fields = append(fields, "uid")
+	}
+	if a.Gid != b.Gid {
+		fields = append(fields, "gid")
+	}
+	if a.Linkname != b.Linkname {
+		fields = append(fields, "linkname")
+	}
+	if isDevice(a) || isDevice(b) {
+		if a.Devmajor != b.Devmajor {
+			fields = append(fields, "devmajor")
+		}
+		if a.Devminor != b.Devminor {
+			fields = append(fields, "devminor")
+		}
+	}
+	if !a.Mtime.Equal(b.Mtime) {
+		fields = append(fields, "mtime")
+	}
+	if len(a.Xattrs) != 0 || len(b.Xattrs) != 0 {
+		if !reflect.DeepEqual(a.Xattrs, b.Xattrs) {
+			fields = append(fields, "xattrs")
+		}
+	}
+	if a.Type == fs.Type_File || b.Type == fs.Type_File {
+		if !bytes.Equal(prev.ContentHash, next.ContentHash) {
+			fields = append(fields, "content")
+		}
+	}
+	return fields
+}
+
+func isDevice(m fs.Metadata) bool {
+	return m.Type == fs.Type_Device || m.Type == fs.Type_CharDevice
+}
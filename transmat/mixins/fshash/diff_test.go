@@ -0,0 +1,73 @@
+package fshash
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/polydawn/rio/fs"
+)
+
+func TestDiff(t *testing.T) {
+	Convey("Diffing buckets", t, func() {
+		mtime := time.Date(1990, 1, 14, 12, 30, 0, 0, time.UTC)
+		root := fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: mtime}
+		file := fs.Metadata{Name: fs.MustRelPath("./a"), Type: fs.Type_File, Perms: 0644, Size: 3, Mtime: mtime}
+		bucketOf := func(fn func(b *MemoryBucket)) Bucket {
+			b := &MemoryBucket{}
+			b.AddRecord(root, nil)
+			fn(b)
+			return b
+		}
+
+		Convey("identical buckets should have no changes", func() {
+			a := bucketOf(func(b *MemoryBucket) { b.AddRecord(file, []byte("x")) })
+			b := bucketOf(func(b *MemoryBucket) { b.AddRecord(file, []byte("x")) })
+			So(Diff(a, b), ShouldBeEmpty)
+		})
+		Convey("additions and removals should be reported", func() {
+			a := bucketOf(func(b *MemoryBucket) {})
+			b := bucketOf(func(b *MemoryBucket) { b.AddRecord(file, []byte("x")) })
+			changes := Diff(a, b)
+			So(changes, ShouldHaveLength, 1)
+			So(changes[0].Kind, ShouldEqual, Change_Added)
+			So(changes[0].Old, ShouldBeNil)
+			So(changes[0].New.Metadata, ShouldResemble, file)
+
+			changes = Diff(b, a)
+			So(changes, ShouldHaveLength, 1)
+			So(changes[0].Kind, ShouldEqual, Change_Removed)
+			So(changes[0].Old.Metadata, ShouldResemble, file)
+			So(changes[0].New, ShouldBeNil)
+		})
+		Convey("modifications should name the fields that differ", func() {
+			file2 := file
+			file2.Perms = 0600
+			file2.Mtime = mtime.Add(time.Second)
+			a := bucketOf(func(b *MemoryBucket) { b.AddRecord(file, []byte("x")) })
+			b := bucketOf(func(b *MemoryBucket) { b.AddRecord(file2, []byte("y")) })
+			changes := Diff(a, b)
+			So(changes, ShouldHaveLength, 1)
+			So(changes[0].Kind, ShouldEqual, Change_Modified)
+			So(changes[0].Fields, ShouldResemble, []string{"perms", "mtime", "content"})
+		})
+		Convey("differences the fileset hash doesn't cover should be ignored", func() {
+			link := fs.Metadata{Name: fs.MustRelPath("./a"), Type: fs.Type_Symlink, Perms: 0777, Linkname: "b", Mtime: mtime}
+			link2 := link
+			link2.Size = 1
+			a := bucketOf(func(b *MemoryBucket) { b.AddRecord(link, nil) })
+			b := bucketOf(func(b *MemoryBucket) { b.AddRecord(link2, []byte("b")) })
+			So(Diff(a, b), ShouldBeEmpty)
+		})
+		Convey("a change of type at the same path should be a modification", func() {
+			dir := fs.Metadata{Name: fs.MustRelPath("./a"), Type: fs.Type_Dir, Perms: 0755, Mtime: mtime}
+			a := bucketOf(func(b *MemoryBucket) { b.AddRecord(file, []byte("x")) })
+			b := bucketOf(func(b *MemoryBucket) { b.AddRecord(dir, nil) })
+			changes := Diff(a, b)
+			So(changes, ShouldHaveLength, 1)
+			So(changes[0].Kind, ShouldEqual, Change_Modified)
+			So(changes[0].Fields, ShouldResemble, []string{"type", "perms", "content"})
+		})
+	})
+}
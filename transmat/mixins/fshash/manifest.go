@@ -0,0 +1,88 @@
+package fshash
+
+import (
+	"github.com/polydawn/refmt/misc"
+	"github.com/polydawn/refmt/obj/atlas"
+
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/lib/treewalk"
+)
+
+/*
+	Manifest lists every path in a fileset with exactly the properties
+	HashBucket covers, so that it says what a WareID commits to.
+
+	Properties which aren't hashed (e.g. size) are left out; so is the
+	content hash for anything other than a file.  The content hash is in
+	base58, as it is in a WareID.
+
+	Beware that HashBucket only feeds files and dirs into their parent's
+	hash; other entries (e.g. symlinks) are listed with the properties
+	they'd be hashed by, but the WareID doesn't actually commit to them.
+*/
+type Manifest struct {
+	WareID  string          `refmt:"wareID"`
+	Entries []ManifestEntry `refmt:"entries"`
+}
+
+type ManifestEntry struct {
+	Name        string            `refmt:"name"`
+	Type        string            `refmt:"type"`
+	Perms       int64             `refmt:"perms"`
+	Uid         int64             `refmt:"uid"`
+	Gid         int64             `refmt:"gid"`
+	Linkname    string            `refmt:"linkname,omitempty"`
+	Devmajor    *int64            `refmt:"devmajor,omitempty"`
+	Devminor    *int64            `refmt:"devminor,omitempty"`
+	Mtime       int64             `refmt:"mtime"`
+	MtimeNanos  int64             `refmt:"mtimeNanos"`
+	Xattrs      map[string]string `refmt:"xattrs,omitempty"`
+	ContentHash string            `refmt:"contentHash,omitempty"`
+}
+
+var ManifestAtlas = atlas.MustBuild(
+	atlas.BuildEntry(Manifest{}).StructMap().Autogenerate().Complete(),
+	atlas.BuildEntry(ManifestEntry{}).StructMap().Autogenerate().Complete(),
+)
+
+/*
+	Builds the manifest of a bucket, with entries in the same order
+	HashBucket visits them.
+
+	May panic with ErrInvalidFilesystem, as iterating the bucket may.
+*/
+func BuildManifest(wareID string, bucket Bucket) Manifest {
+	manifest := Manifest{WareID: wareID, Entries: []ManifestEntry{}}
+	if bucket.Length() == 0 {
+		return manifest
+	}
+	treewalk.Walk(bucket.Iterator(), func(node treewalk.Node) error {
+		record := node.(RecordIterator).Record()
+		manifest.Entries = append(manifest.Entries, toManifestEntry(record))
+		return nil
+	}, nil)
+	return manifest
+}
+
+func toManifestEntry(record Record) ManifestEntry {
+	m := record.Metadata
+	entry := ManifestEntry{
+		Name:       m.Name.String(),
+		Type:       string(m.Type),
+		Perms:      int64(m.Perms),
+		Uid:        int64(m.Uid),
+		Gid:        int64(m.Gid),
+		Linkname:   m.Linkname,
+		Mtime:      m.Mtime.Unix(),
+		MtimeNanos: int64(m.Mtime.Nanosecond()),
+		Xattrs:     m.Xattrs,
+	}
+	if isDevice(m) {
+		devmajor, devminor := m.Devmajor, m.Devminor
+		entry.Devmajor, entry.Devminor = &devmajor, &devminor
+	}
+	if m.Type == fs.Type_File {
+		entry.ContentHash = misc.Base58Encode(record.ContentHash)
+	}
+	return entry
+}
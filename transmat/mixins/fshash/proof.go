@@ -0,0 +1,257 @@
+package fshash
+
+import (
+	"fmt"
+	"hash"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/polydawn/refmt/cbor"
+	"github.com/polydawn/refmt/misc"
+	"github.com/polydawn/refmt/obj/atlas"
+	"github.com/polydawn/refmt/tok"
+
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/lib/treewalk"
+)
+
+/*
+	Proof shows that a path is included in a fileset, with only the hashes
+	of its siblings (and its ancestors' siblings) rather than the whole
+	fileset.
+
+	The proven entry is hashed as in HashBucket (a dir needs the hashes of
+	its children for that, given as Leaves); then each of Parents, from the
+	entry's own parent dir up to the root, is hashed with the hashes of its
+	other children placed before and after the one proven so far.
+	The result is the root of the tree hash, which is what a WareID is.
+
+	Entries are given as in a Manifest, and hashes in base58.
+
+	Only files and dirs can be proven: HashBucket doesn't feed any other
+	kind of entry (e.g. symlinks) into its parent's hash, so the WareID
+	doesn't commit to them.
+*/
+type Proof struct {
+	Entry   ManifestEntry `refmt:"entry"`
+	Leaves  []string      `refmt:"leaves,omitempty"`
+	Parents []ProofStep   `refmt:"parents"`
+}
+
+type ProofStep struct {
+	Entry  ManifestEntry `refmt:"entry"`
+	Before []string      `refmt:"before"`
+	After  []string      `refmt:"after"`
+}
+
+var ProofAtlas = atlas.MustBuild(
+	atlas.BuildEntry(Proof{}).StructMap().Autogenerate().Complete(),
+	atlas.BuildEntry(ProofStep{}).StructMap().Autogenerate().Complete(),
+	atlas.BuildEntry(ManifestEntry{}).StructMap().Autogenerate().Complete(),
+)
+
+/*
+	Builds a proof that the path is included in the bucket.
+	Errors if there's no such path in the bucket, or it's not a file or dir.
+
+	May panic with ErrInvalidFilesystem, as iterating the bucket may.
+*/
+func Prove(bucket Bucket, path fs.RelPath, hasherFactory func() hash.Hash) (Proof, error) {
+	if bucket.Length() == 0 {
+		return Proof{}, fmt.Errorf("%q not found", path)
+	}
+	// Hash every node, keeping the hashes of each dir's children in order,
+	//  and where among them each child is.
+	records := make(map[fs.RelPath]Record, bucket.Length())
+	leaves := make(map[fs.RelPath][][]byte)
+	indexes := make(map[fs.RelPath]int, bucket.Length())
+	preVisit := func(node treewalk.Node) error {
+		record := node.(RecordIterator).Record()
+		records[record.Metadata.Name] = record
+		if record.Metadata.Type == fs.Type_Dir {
+			leaves[record.Metadata.Name] = [][]byte{}
+		}
+		return nil
+	}
+	postVisit := func(node treewalk.Node) error {
+		record := node.(RecordIterator).Record()
+		name := record.Metadata.Name
+		if !isProvable(record.Metadata) {
+			return nil
+		}
+		hash := hashNode(hasherFactory, record.Metadata, record.ContentHash, leaves[name])
+		if name != (fs.RelPath{}) {
+			parent := name.Dir()
+			indexes[name] = len(leaves[parent])
+			leaves[parent] = append(leaves[parent], hash)
+		}
+		return nil
+	}
+	if err := treewalk.Walk(bucket.Iterator(), preVisit, postVisit); err != nil {
+		panic(err) // none of our code has known believable error returns.
+	}
+
+	// Pick out the path and its ancestors.
+	record, ok := records[path]
+	if !ok {
+		return Proof{}, fmt.Errorf("%q not found", path)
+	}
+	if !isProvable(record.Metadata) {
+		return Proof{}, fmt.Errorf("%q is a %s; only files and dirs are covered by the fileset hash", path, record.Metadata.Type)
+	}
+	proof := Proof{Entry: toManifestEntry(record), Parents: []ProofStep{}}
+	if record.Metadata.Type == fs.Type_Dir {
+		proof.Leaves = encodeHashes(leaves[path])
+	}
+	for at := path; at != (fs.RelPath{}); at = at.Dir() {
+		parent := at.Dir()
+		siblings, i := leaves[parent], indexes[at]
+		proof.Parents = append(proof.Parents, ProofStep{
+			Entry:  toManifestEntry(records[parent]),
+			Before: encodeHashes(siblings[:i]),
+			After:  encodeHashes(siblings[i+1:]),
+		})
+	}
+	return proof, nil
+}
+
+/*
+	Returns the root of the tree hash the proof leads to.
+	The proof holds if that's the hash of the WareID in question.
+
+	Errors if the proof is malformed: e.g. its entries aren't each the
+	parent dir of the last, or don't end at the root.
+*/
+func (p Proof) Root(hasherFactory func() hash.Hash) ([]byte, error) {
+	meta, contentHash, err := p.Entry.toRecord()
+	if err != nil {
+		return nil, err
+	}
+	if !isProvable(meta) {
+		return nil, fmt.Errorf("invalid proof: %q is a %s; only files and dirs are covered by the fileset hash", p.Entry.Name, meta.Type)
+	}
+	var leaves [][]byte
+	if meta.Type == fs.Type_Dir {
+		leaves = decodeHashes(p.Leaves)
+	} else if len(p.Leaves) > 0 {
+		return nil, fmt.Errorf("invalid proof: %q is not a dir, but has leaves", p.Entry.Name)
+	}
+	hash := hashNode(hasherFactory, meta, contentHash, leaves)
+	at := meta.Name
+	for _, step := range p.Parents {
+		parentMeta, _, err := step.Entry.toRecord()
+		if err != nil {
+			return nil, err
+		}
+		if at == (fs.RelPath{}) || parentMeta.Name != at.Dir() {
+			return nil, fmt.Errorf("invalid proof: %q is not the parent of %q", step.Entry.Name, at)
+		}
+		if parentMeta.Type != fs.Type_Dir {
+			return nil, fmt.Errorf("invalid proof: %q is not a dir", step.Entry.Name)
+		}
+		leaves := append(decodeHashes(step.Before), hash)
+		leaves = append(leaves, decodeHashes(step.After)...)
+		hash = hashNode(hasherFactory, parentMeta, nil, leaves)
+		at = parentMeta.Name
+	}
+	if at != (fs.RelPath{}) {
+		return nil, fmt.Errorf("invalid proof: ends at %q, not the root", at)
+	}
+	return hash, nil
+}
+
+/*
+	Hashes one node exactly as HashBucket does, given the hashes of its
+	children if it's a dir.  (HashBucket streams the children into the
+	dir's hasher instead of collecting them; the two must stay in step.)
+*/
+func hashNode(hasherFactory func() hash.Hash, m fs.Metadata, contentHash []byte, leaves [][]byte) []byte {
+	hasher := hasherFactory()
+	enc := cbor.NewEncoder(hasher)
+	switch m.Type {
+	case fs.Type_Dir, fs.Type_File:
+		enc.Step(&tok.Token{Type: tok.TMapOpen, Length: 2})
+	default:
+		enc.Step(&tok.Token{Type: tok.TMapOpen, Length: 1})
+	}
+	enc.Step(&tok.Token{Type: tok.TString, Str: "m"})
+	marshalMetadata(enc, m)
+	switch m.Type {
+	case fs.Type_Dir:
+		enc.Step(&tok.Token{Type: tok.TString, Str: "l"})
+		enc.Step(&tok.Token{Type: tok.TArrOpen, Length: -1})
+		for _, leaf := range leaves {
+			enc.Step(&tok.Token{Type: tok.TBytes, Bytes: leaf})
+		}
+		hasher.Write([]byte{0xff})
+	case fs.Type_File:
+		enc.Step(&tok.Token{Type: tok.TString, Str: "h"})
+		enc.Step(&tok.Token{Type: tok.TBytes, Bytes: contentHash})
+	}
+	return hasher.Sum(nil)
+}
+
+func isProvable(m fs.Metadata) bool {
+	return m.Type == fs.Type_File || m.Type == fs.Type_Dir
+}
+
+// Converts an entry back to the metadata it was made from, rejecting
+//  anything that couldn't have been.
+func (e ManifestEntry) toRecord() (fs.Metadata, []byte, error) {
+	if e.Name != "." && (!strings.HasPrefix(e.Name, "./") || fs.MustRelPath(e.Name).String() != e.Name) {
+		return fs.Metadata{}, nil, fmt.Errorf("invalid proof: %q is not a clean path within a fileset", e.Name)
+	}
+	name := fs.MustRelPath(e.Name)
+	if name.GoesUp() {
+		return fs.Metadata{}, nil, fmt.Errorf("invalid proof: %q is not a clean path within a fileset", e.Name)
+	}
+	if len(e.Type) != 1 {
+		return fs.Metadata{}, nil, fmt.Errorf("invalid proof: %q has invalid type %q", e.Name, e.Type)
+	}
+	if e.Perms < 0 || e.Perms > 07777 {
+		return fs.Metadata{}, nil, fmt.Errorf("invalid proof: %q has invalid perms %o", e.Name, e.Perms)
+	}
+	if e.Uid < 0 || e.Uid > math.MaxUint32 || e.Gid < 0 || e.Gid > math.MaxUint32 {
+		return fs.Metadata{}, nil, fmt.Errorf("invalid proof: %q has invalid uid or gid", e.Name)
+	}
+	if e.MtimeNanos < 0 || e.MtimeNanos >= int64(time.Second) {
+		return fs.Metadata{}, nil, fmt.Errorf("invalid proof: %q has invalid mtime", e.Name)
+	}
+	meta := fs.Metadata{
+		Name:     name,
+		Type:     fs.Type(e.Type[0]),
+		Perms:    fs.Perms(e.Perms),
+		Uid:      uint32(e.Uid),
+		Gid:      uint32(e.Gid),
+		Linkname: e.Linkname,
+		Mtime:    time.Unix(e.Mtime, e.MtimeNanos).UTC(),
+		Xattrs:   e.Xattrs,
+	}
+	if isDevice(meta) {
+		if e.Devmajor == nil || e.Devminor == nil {
+			return fs.Metadata{}, nil, fmt.Errorf("invalid proof: %q is a device, but lacks device numbers", e.Name)
+		}
+		meta.Devmajor, meta.Devminor = *e.Devmajor, *e.Devminor
+	}
+	if meta.Type != fs.Type_File && e.ContentHash != "" {
+		return fs.Metadata{}, nil, fmt.Errorf("invalid proof: %q is not a file, but has a content hash", e.Name)
+	}
+	return meta, misc.Base58Decode(e.ContentHash), nil
+}
+
+func encodeHashes(hashes [][]byte) []string {
+	strs := make([]string, len(hashes))
+	for i, hash := range hashes {
+		strs[i] = misc.Base58Encode(hash)
+	}
+	return strs
+}
+
+func decodeHashes(strs []string) [][]byte {
+	hashes := make([][]byte, len(strs))
+	for i, str := range strs {
+		hashes[i] = misc.Base58Decode(str)
+	}
+	return hashes
+}
@@ -0,0 +1,88 @@
+package fshash
+
+import (
+	"crypto/sha512"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/polydawn/rio/fs"
+)
+
+func TestProof(t *testing.T) {
+	Convey("Inclusion proofs", t, func() {
+		mtime := time.Date(1990, 1, 14, 12, 30, 0, 12, time.UTC)
+		bucket := &MemoryBucket{}
+		bucket.AddRecord(fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: mtime}, nil)
+		bucket.AddRecord(fs.Metadata{Name: fs.MustRelPath("./a"), Type: fs.Type_File, Perms: 0644, Mtime: mtime}, []byte("a"))
+		bucket.AddRecord(fs.Metadata{Name: fs.MustRelPath("./d"), Type: fs.Type_Dir, Perms: 0755, Uid: 7, Mtime: mtime}, nil)
+		bucket.AddRecord(fs.Metadata{Name: fs.MustRelPath("./d/b"), Type: fs.Type_File, Perms: 0600, Mtime: mtime, Xattrs: map[string]string{"user.x": "y"}}, []byte("b"))
+		bucket.AddRecord(fs.Metadata{Name: fs.MustRelPath("./d/c"), Type: fs.Type_Symlink, Perms: 0777, Linkname: "b", Mtime: mtime}, nil)
+		bucket.AddRecord(fs.Metadata{Name: fs.MustRelPath("./d/e"), Type: fs.Type_Dir, Perms: 0755, Mtime: mtime}, nil)
+		bucket.AddRecord(fs.Metadata{Name: fs.MustRelPath("./d/null"), Type: fs.Type_CharDevice, Perms: 0666, Devmajor: 1, Devminor: 3, Mtime: mtime}, nil)
+		bucket.AddRecord(fs.Metadata{Name: fs.MustRelPath("./z"), Type: fs.Type_File, Perms: 0644, Mtime: mtime}, []byte("z"))
+		root := HashBucket(bucket, sha512.New384)
+
+		Convey("every path's proof should lead to the root", func() {
+			for _, path := range []string{".", "./a", "./d", "./d/b", "./d/e", "./z"} {
+				proof, err := Prove(bucket, fs.MustRelPath(path), sha512.New384)
+				So(err, ShouldBeNil)
+				So(proof.Entry.Name, ShouldEqual, path)
+				proven, err := proof.Root(sha512.New384)
+				So(err, ShouldBeNil)
+				So(proven, ShouldResemble, root)
+			}
+		})
+		Convey("a proof should only carry its ancestors' sibling hashes", func() {
+			proof, _ := Prove(bucket, fs.MustRelPath("./d/e"), sha512.New384)
+			So(proof.Parents, ShouldHaveLength, 2)
+			So(proof.Parents[0].Entry.Name, ShouldEqual, "./d")
+			So(proof.Parents[0].Before, ShouldHaveLength, 1)
+			So(proof.Parents[0].After, ShouldHaveLength, 0)
+			So(proof.Parents[1].Entry.Name, ShouldEqual, ".")
+			So(proof.Parents[1].Before, ShouldHaveLength, 1)
+			So(proof.Parents[1].After, ShouldHaveLength, 1)
+		})
+		Convey("a path not in the bucket should have no proof", func() {
+			_, err := Prove(bucket, fs.MustRelPath("./d/nope"), sha512.New384)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("entries the hash doesn't cover should have no proof", func() {
+			// HashBucket doesn't feed anything but files and dirs into their parent's hash.
+			_, err := Prove(bucket, fs.MustRelPath("./d/c"), sha512.New384)
+			So(err, ShouldNotBeNil)
+			_, err = Prove(bucket, fs.MustRelPath("./d/null"), sha512.New384)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("a tampered proof should lead elsewhere", func() {
+			proof, _ := Prove(bucket, fs.MustRelPath("./d/b"), sha512.New384)
+			proof.Entry.Perms = 0644
+			proven, err := proof.Root(sha512.New384)
+			So(err, ShouldBeNil)
+			So(proven, ShouldNotResemble, root)
+
+			proof, _ = Prove(bucket, fs.MustRelPath("./d/b"), sha512.New384)
+			proof.Parents[0].Before, proof.Parents[0].After = proof.Parents[0].After, proof.Parents[0].Before
+			proven, err = proof.Root(sha512.New384)
+			So(err, ShouldBeNil)
+			So(proven, ShouldNotResemble, root)
+		})
+		Convey("a malformed proof should be rejected", func() {
+			proof, _ := Prove(bucket, fs.MustRelPath("./d/b"), sha512.New384)
+			proof.Entry.Name = "./b"
+			_, err := proof.Root(sha512.New384)
+			So(err, ShouldNotBeNil)
+
+			proof, _ = Prove(bucket, fs.MustRelPath("./d/b"), sha512.New384)
+			proof.Parents = proof.Parents[:1]
+			_, err = proof.Root(sha512.New384)
+			So(err, ShouldNotBeNil)
+
+			proof, _ = Prove(bucket, fs.MustRelPath("./d/b"), sha512.New384)
+			proof.Entry.Name = "../b"
+			_, err = proof.Root(sha512.New384)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
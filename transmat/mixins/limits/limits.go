@@ -0,0 +1,174 @@
+/*
+	The limits package bounds what an unpack will take from a ware: how many
+	entries, how deep, how big each file and all of them together, and how
+	much bigger than the ware itself -- so wares from untrusted sources
+	(decompression bombs included) can be scanned and unpacked without
+	filling the disk or running forever.
+
+	Limits are carried by the context; with none, there are none.  Exceeding
+	any of them fails the unpack with ErrLimitExceeded, with details saying
+	which limit ("total-size", "entries", "file-size", "depth", or "ratio",
+	as for the `--limit-*` flags) and what it was.  Sizes are counted as
+	file contents are actually read, not just as headers claim.
+*/
+package limits
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	. "github.com/warpfork/go-errcat"
+
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+)
+
+/*
+	ErrLimitExceeded is the category of errors from an unpack which
+	exceeded one of its Limits.  It's rio's own, not one of the API's:
+	so it's distinct from a filter's rejection, but has no exit code in
+	the API's table; the rio command gives it one of its own.
+*/
+const ErrLimitExceeded = rio.ErrorCategory("rio-limit-exceeded")
+
+/*
+	Limits on an unpack.  Zero means no limit.
+*/
+type Limits struct {
+	MaxTotalSize int64   // Total bytes of all file contents.
+	MaxEntries   int64   // Number of entries (of any type).
+	MaxFileSize  int64   // Bytes of any one file's contents.
+	MaxDepth     int     // Number of path segments in any entry's name.
+	MaxRatio     float64 // Total bytes of file contents per byte of the ware read (as packed, compression and all).
+}
+
+// The ratio is only enforced once this much has been unpacked:
+//  small wares of very compressible content are commonplace, and harmless.
+const ratioGrace = 1 << 20
+
+type limitsCtxKey struct{}
+
+// Returns a context carrying the given limits for unpacks.
+func WithLimits(ctx context.Context, l Limits) context.Context {
+	return context.WithValue(ctx, limitsCtxKey{}, l)
+}
+
+// Returns the limits carried by the context, or none.
+func GetLimits(ctx context.Context) Limits {
+	l, _ := ctx.Value(limitsCtxKey{}).(Limits)
+	return l
+}
+
+/*
+	Tracker counts an unpack against its limits.
+
+	An unpack should count the ware's bytes with Ware (or WareSize),
+	check each entry with Entry, and read each file's contents through
+	Body.  Reads of a Body fail once over a limit; since the unpack may
+	wrap that error in its own, Err returns the original.
+*/
+type Tracker struct {
+	Limits
+	wareSize int64 // bytes of the ware read so far.
+	entries  int64
+	total    int64 // bytes of file contents read so far.
+	err      error // the first limit exceeded, if any.
+}
+
+// Returns a tracker for the limits carried by the context.
+func NewTracker(ctx context.Context) *Tracker {
+	return &Tracker{Limits: GetLimits(ctx)}
+}
+
+// Returns the ware's reader, counting what's read from it.
+func (t *Tracker) Ware(r io.Reader) io.Reader {
+	if t.MaxRatio == 0 {
+		return r
+	}
+	return &wareReader{r, t}
+}
+
+// Counts the ware's bytes all at once, for unpacks which have all of it first.
+func (t *Tracker) WareSize(n int64) {
+	t.wareSize += n
+}
+
+// Checks an entry against the limits, before it's unpacked.
+func (t *Tracker) Entry(fmeta *fs.Metadata) error {
+	t.entries++
+	switch {
+	case t.MaxEntries > 0 && t.entries > t.MaxEntries:
+		return t.exceeded("entries", t.MaxEntries, "ware has more than %d entries", t.MaxEntries)
+	case t.MaxDepth > 0 && len(fmeta.Name.Split())-1 > t.MaxDepth:
+		return t.exceeded("depth", t.MaxDepth, "%q is more than %d dirs deep", fmeta.Name, t.MaxDepth)
+	case fmeta.Type != fs.Type_File:
+		return nil
+	case t.MaxFileSize > 0 && fmeta.Size > t.MaxFileSize:
+		return t.exceeded("file-size", t.MaxFileSize, "%q is %d bytes, over the limit of %d", fmeta.Name, fmeta.Size, t.MaxFileSize)
+	case t.MaxTotalSize > 0 && t.total+fmeta.Size > t.MaxTotalSize:
+		return t.exceeded("total-size", t.MaxTotalSize, "ware has more than %d bytes of content", t.MaxTotalSize)
+	}
+	return nil
+}
+
+// Returns the reader of a file's contents, counting what's read from it.
+func (t *Tracker) Body(fmeta *fs.Metadata, r io.Reader) io.Reader {
+	if t.Limits == (Limits{}) {
+		return r
+	}
+	return &bodyReader{r, fmeta.Name, 0, t}
+}
+
+// Returns the first limit exceeded, if any.
+func (t *Tracker) Err() error {
+	return t.err
+}
+
+func (t *Tracker) exceeded(limit string, max interface{}, format string, args ...interface{}) error {
+	if t.err == nil {
+		t.err = ErrorDetailed(
+			ErrLimitExceeded,
+			fmt.Sprintf("unpack limit exceeded: "+format, args...),
+			map[string]string{
+				"limit": limit,
+				"max":   fmt.Sprint(max),
+			},
+		)
+	}
+	return t.err
+}
+
+type wareReader struct {
+	r io.Reader
+	t *Tracker
+}
+
+func (wr *wareReader) Read(bs []byte) (int, error) {
+	n, err := wr.r.Read(bs)
+	wr.t.wareSize += int64(n)
+	return n, err
+}
+
+type bodyReader struct {
+	r    io.Reader
+	name fs.RelPath
+	n    int64 // bytes of this file read so far.
+	t    *Tracker
+}
+
+func (br *bodyReader) Read(bs []byte) (int, error) {
+	n, err := br.r.Read(bs)
+	br.n += int64(n)
+	t := br.t
+	t.total += int64(n)
+	switch {
+	case t.MaxFileSize > 0 && br.n > t.MaxFileSize:
+		return n, t.exceeded("file-size", t.MaxFileSize, "%q is over the limit of %d bytes", br.name, t.MaxFileSize)
+	case t.MaxTotalSize > 0 && t.total > t.MaxTotalSize:
+		return n, t.exceeded("total-size", t.MaxTotalSize, "ware has more than %d bytes of content", t.MaxTotalSize)
+	case t.MaxRatio > 0 && t.total > ratioGrace && float64(t.total) > t.MaxRatio*float64(t.wareSize):
+		return n, t.exceeded("ratio", t.MaxRatio, "ware unpacks to more than %g times its size", t.MaxRatio)
+	}
+	return n, err
+}
@@ -112,3 +112,17 @@ func DirectoryInferred(mon rio.Monitor, inferred, path fs.RelPath) {
 		},
 	})
 }
+
+// Log that cache content deduplication was skipped for a shelf.
+// The shelf is still committed; it just holds its own copy of every file.
+func CacheDedupSkipped(mon rio.Monitor, ware api.WareID, err error) {
+	mon.Send(rio.Event_Log{
+		Time:  time.Now(),
+		Level: rio.LogWarn,
+		Msg:   fmt.Sprintf("cache dedup skipped for ware %q: %s", ware, err),
+		Detail: [][2]string{
+			{"wareID", ware.String()},
+			{"error", err.Error()},
+		},
+	})
+}
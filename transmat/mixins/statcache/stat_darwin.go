@@ -0,0 +1,22 @@
+// +build darwin
+
+package statcache
+
+import (
+	"os"
+	"syscall"
+)
+
+func statOf(fi os.FileInfo) (Stat, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return Stat{}, false
+	}
+	return Stat{
+		Size:  st.Size,
+		Mtime: st.Mtimespec.Nano(),
+		Ctime: st.Ctimespec.Nano(),
+		Ino:   uint64(st.Ino),
+		Dev:   uint64(st.Dev),
+	}, true
+}
@@ -0,0 +1,262 @@
+/*
+	The statcache package remembers the content hashes of files in a local
+	fileset, keyed by their stat info, so that packing a mostly unchanged
+	tree again needn't read and hash every file again.  It's much like
+	git's index.
+
+	A cached hash is only trusted if everything we can cheaply observe
+	about the file is exactly as it was when it was hashed: its size,
+	mtime, ctime, inode, and device.  Anything else -- including files we
+	can't stat this way, and non-regular files -- is simply a miss.
+	Files which had been modified very shortly before they were stat'd
+	are never cached at all, since a later write within the same
+	timestamp granularity could go unnoticed (git calls these "racily
+	clean").
+
+	The cache is advisory: a missing, unreadable, or corrupt cache file is
+	treated as empty, and failing to save it loses nothing but time.
+	It does trust the clock: if the filesystem's timestamps come from a
+	clock far ahead of ours (e.g. some network filesystems), the racy
+	window may not cover them.
+*/
+package statcache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/cbor"
+	"github.com/polydawn/refmt/misc"
+	"github.com/polydawn/refmt/obj/atlas"
+
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+)
+
+// Files modified within this long before they're stat'd aren't cached.
+//  Two seconds covers the coarsest timestamps in common use (FAT).
+const racyWindow = 2 * time.Second
+
+// Bump this if the meaning of entries changes; old cache files are then ignored.
+const cacheFormat = "rio-statcache-v1"
+
+/*
+	Stat is what the cache observes of a file to decide if it's unchanged.
+*/
+type Stat struct {
+	Size  int64
+	Mtime int64 // unix nanos.
+	Ctime int64 // unix nanos.
+	Ino   uint64
+	Dev   uint64
+
+	at time.Time // when it was stat'd.
+}
+
+type cacheFile struct {
+	Format  string                `refmt:"format"`
+	Root    string                `refmt:"root"`
+	Alg     string                `refmt:"alg"`
+	Entries map[string]cacheEntry `refmt:"entries"`
+}
+
+type cacheEntry struct {
+	Size  int64  `refmt:"size"`
+	Mtime int64  `refmt:"mtime"`
+	Ctime int64  `refmt:"ctime"`
+	Ino   uint64 `refmt:"ino"`
+	Dev   uint64 `refmt:"dev"`
+	Hash  []byte `refmt:"hash"`
+}
+
+var cacheAtlas = atlas.MustBuild(
+	atlas.BuildEntry(cacheFile{}).StructMap().Autogenerate().Complete(),
+	atlas.BuildEntry(cacheEntry{}).StructMap().Autogenerate().Complete(),
+)
+
+/*
+	Cache holds the stat cache for one root path, and one hash algorithm.
+
+	Lookup and Record may be called concurrently.
+*/
+type Cache struct {
+	dir  fs.AbsolutePath
+	root fs.AbsolutePath
+	alg  fshash.Algorithm
+
+	mu   sync.Mutex
+	prev map[string]cacheEntry // as loaded.
+	seen map[string]cacheEntry // recorded this time; all that Save keeps.
+}
+
+/*
+	Opens the stat cache for the given root and hash algorithm, kept in the
+	given dir.  Never fails: if there's no usable cache yet, it starts empty.
+*/
+func Open(dir fs.AbsolutePath, root fs.AbsolutePath, alg fshash.Algorithm) *Cache {
+	c := &Cache{
+		dir:  dir,
+		root: root,
+		alg:  alg,
+		prev: map[string]cacheEntry{},
+		seen: map[string]cacheEntry{},
+	}
+	body, err := ioutil.ReadFile(c.filename())
+	if err != nil {
+		return c
+	}
+	var cf cacheFile
+	if err := refmt.UnmarshalAtlased(cbor.DecodeOptions{}, body, &cf, cacheAtlas); err != nil {
+		return c
+	}
+	if cf.Format != cacheFormat || cf.Root != root.String() || cf.Alg != string(alg) || cf.Entries == nil {
+		return c
+	}
+	c.prev = cf.Entries
+	return c
+}
+
+// Each root gets its own file (per algorithm), named for the hash of its path.
+func (c *Cache) filename() string {
+	hash := sha512.Sum384([]byte(c.root.String()))
+	return c.dir.Join(fs.MustRelPath(misc.Base58Encode(hash[:]) + "." + string(c.alg))).String()
+}
+
+/*
+	File is an open file which can be stat'd, as an *os.File can.
+*/
+type File interface {
+	Stat() (os.FileInfo, error)
+}
+
+/*
+	Stats the file, as it's open: so it's the very file that's read,
+	even if the path has since been replaced by another.
+	Returns false if it isn't a regular file, or can't be stat'd;
+	such files are never cached.
+
+	Stat the file before reading it, so that any change made while it's
+	being read shows up next time.
+*/
+func (c *Cache) Stat(f File) (Stat, bool) {
+	at := time.Now()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return Stat{}, false
+	}
+	st, ok := statOf(fi)
+	st.at = at
+	return st, ok
+}
+
+/*
+	Returns the cached content hash of the file, if it's unchanged since
+	it was recorded.
+*/
+func (c *Cache) Lookup(path fs.RelPath, st Stat) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ent, ok := c.prev[path.String()]
+	if !ok || !ent.matches(st) {
+		return nil, false
+	}
+	c.seen[path.String()] = ent
+	return ent.Hash, true
+}
+
+/*
+	Records the content hash of the file, as read after the given stat.
+	Files modified too recently to be sure of aren't recorded.
+*/
+func (c *Cache) Record(path fs.RelPath, st Stat, hash []byte) {
+	if st.racy() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen[path.String()] = cacheEntry{
+		Size:  st.Size,
+		Mtime: st.Mtime,
+		Ctime: st.Ctime,
+		Ino:   st.Ino,
+		Dev:   st.Dev,
+		Hash:  append([]byte(nil), hash...),
+	}
+}
+
+/*
+	Saves the cache, replacing the previous one.
+	Only entries looked up or recorded since Open are kept, so files
+	which have since gone away drop out.
+	Does nothing for a nil Cache.
+*/
+func (c *Cache) Save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var buf bytes.Buffer
+	cf := cacheFile{Format: cacheFormat, Root: c.root.String(), Alg: string(c.alg), Entries: c.seen}
+	if err := refmt.NewMarshallerAtlased(cbor.EncodeOptions{}, &buf, cacheAtlas).Marshal(cf); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir.String(), 0755); err != nil {
+		return err
+	}
+	// Write aside and rename into place, so a reader never sees half a cache.
+	tmp, err := ioutil.TempFile(c.dir.String(), ".tmp.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.filename())
+}
+
+func (ent cacheEntry) matches(st Stat) bool {
+	return ent.Size == st.Size &&
+		ent.Mtime == st.Mtime &&
+		ent.Ctime == st.Ctime &&
+		ent.Ino == st.Ino &&
+		ent.Dev == st.Dev
+}
+
+func (st Stat) racy() bool {
+	edge := st.at.Add(-racyWindow).UnixNano()
+	return st.Mtime >= edge || st.Ctime >= edge
+}
+
+type statCacheCtxKey struct{}
+
+/*
+	Returns a context asking pack funcs to use a stat cache kept in the
+	given dir (typically config.GetStatCachePath).
+*/
+func WithStatCache(ctx context.Context, dir fs.AbsolutePath) context.Context {
+	return context.WithValue(ctx, statCacheCtxKey{}, dir)
+}
+
+/*
+	Opens the stat cache for the given root, if the context asks for one;
+	or returns nil.  It's for the hash algorithm the context asks for.
+*/
+func FromContext(ctx context.Context, root fs.AbsolutePath) *Cache {
+	dir, ok := ctx.Value(statCacheCtxKey{}).(fs.AbsolutePath)
+	if !ok {
+		return nil
+	}
+	return Open(dir, root, fshash.GetAlgorithm(ctx))
+}
@@ -0,0 +1,177 @@
+// +build linux darwin
+
+package statcache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+	"github.com/polydawn/rio/testutil"
+)
+
+/*
+	These specs are the invalidation rules: when a cached hash may be
+	trusted, and (mostly) when it mustn't be.
+*/
+func TestStatCache(t *testing.T) {
+	Convey("Stat cache", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			cacheDir := tmpDir.Join(fs.MustRelPath("cache"))
+			root := tmpDir.Join(fs.MustRelPath("root"))
+			So(os.Mkdir(root.String(), 0755), ShouldBeNil)
+			pathA := fs.MustRelPath("./a")
+			fileA := root.Join(pathA).String()
+			So(ioutil.WriteFile(fileA, []byte("alpha"), 0644), ShouldBeNil)
+			hashA := []byte("hash-of-alpha")
+
+			// Stats a file as the pack walk would: once it's open.
+			statPath := func(c *Cache, path fs.RelPath) (Stat, bool) {
+				f, err := os.Open(root.Join(path).String())
+				So(err, ShouldBeNil)
+				defer f.Close()
+				return c.Stat(f)
+			}
+			// Files are all freshly written, so they'd all be racy;
+			//  this pretends the stat happened long enough afterwards.
+			settledStat := func(c *Cache, path fs.RelPath) Stat {
+				st, ok := statPath(c, path)
+				So(ok, ShouldBeTrue)
+				st.at = st.at.Add(time.Hour)
+				return st
+			}
+			// Record a, save, and reopen.
+			primed := func() *Cache {
+				c := Open(cacheDir, root, fshash.DefaultAlgorithm)
+				c.Record(pathA, settledStat(c, pathA), hashA)
+				So(c.Save(), ShouldBeNil)
+				return Open(cacheDir, root, fshash.DefaultAlgorithm)
+			}
+
+			Convey("an unchanged file is a hit", func() {
+				c := primed()
+				hash, ok := c.Lookup(pathA, settledStat(c, pathA))
+				So(ok, ShouldBeTrue)
+				So(hash, ShouldResemble, hashA)
+			})
+			Convey("a hit stays cached after saving again", func() {
+				c := primed()
+				_, ok := c.Lookup(pathA, settledStat(c, pathA))
+				So(ok, ShouldBeTrue)
+				So(c.Save(), ShouldBeNil)
+				c = Open(cacheDir, root, fshash.DefaultAlgorithm)
+				_, ok = c.Lookup(pathA, settledStat(c, pathA))
+				So(ok, ShouldBeTrue)
+			})
+			Convey("a file not looked up or recorded is dropped on save", func() {
+				c := primed()
+				So(c.Save(), ShouldBeNil)
+				c = Open(cacheDir, root, fshash.DefaultAlgorithm)
+				_, ok := c.Lookup(pathA, settledStat(c, pathA))
+				So(ok, ShouldBeFalse)
+			})
+			Convey("a different path is a miss", func() {
+				c := primed()
+				_, ok := c.Lookup(fs.MustRelPath("./b"), settledStat(c, pathA))
+				So(ok, ShouldBeFalse)
+			})
+			Convey("a change of size is a miss", func() {
+				c := primed()
+				So(ioutil.WriteFile(fileA, []byte("alphabet"), 0644), ShouldBeNil)
+				_, ok := c.Lookup(pathA, settledStat(c, pathA))
+				So(ok, ShouldBeFalse)
+			})
+			Convey("a change of mtime is a miss", func() {
+				c := primed()
+				st := settledStat(c, pathA)
+				mtime := time.Unix(0, st.Mtime).Add(-time.Minute)
+				So(os.Chtimes(fileA, mtime, mtime), ShouldBeNil)
+				_, ok := c.Lookup(pathA, settledStat(c, pathA))
+				So(ok, ShouldBeFalse)
+			})
+			Convey("a change of ctime alone is a miss, even with size and mtime put back", func() {
+				c := primed()
+				st := settledStat(c, pathA)
+				time.Sleep(20 * time.Millisecond) // the kernel's clock for ctime can be coarse.
+				So(ioutil.WriteFile(fileA, []byte("ALPHA"), 0644), ShouldBeNil)
+				mtime := time.Unix(0, st.Mtime)
+				So(os.Chtimes(fileA, mtime, mtime), ShouldBeNil)
+				st2 := settledStat(c, pathA)
+				So(st2.Size, ShouldEqual, st.Size)
+				So(st2.Mtime, ShouldEqual, st.Mtime)
+				_, ok := c.Lookup(pathA, st2)
+				So(ok, ShouldBeFalse)
+			})
+			Convey("a file replaced by another (new inode) is a miss", func() {
+				c := primed()
+				st := settledStat(c, pathA)
+				other := root.Join(fs.MustRelPath("./other")).String()
+				So(ioutil.WriteFile(other, []byte("alpha"), 0644), ShouldBeNil)
+				So(os.Rename(other, fileA), ShouldBeNil)
+				st2 := settledStat(c, pathA)
+				So(st2.Ino, ShouldNotEqual, st.Ino)
+				st2.Mtime, st2.Ctime = st.Mtime, st.Ctime
+				_, ok := c.Lookup(pathA, st2)
+				So(ok, ShouldBeFalse)
+			})
+			Convey("the file stat'd is the one open, even if another has since replaced it", func() {
+				c := primed()
+				before := settledStat(c, pathA)
+				f, err := os.Open(fileA)
+				So(err, ShouldBeNil)
+				defer f.Close()
+				other := root.Join(fs.MustRelPath("./other")).String()
+				So(ioutil.WriteFile(other, []byte("alpha"), 0644), ShouldBeNil)
+				So(os.Rename(other, fileA), ShouldBeNil)
+				st, ok := c.Stat(f)
+				So(ok, ShouldBeTrue)
+				So(st.Ino, ShouldEqual, before.Ino)
+				So(settledStat(c, pathA).Ino, ShouldNotEqual, before.Ino)
+			})
+			Convey("a file modified just before it was stat'd is not cached", func() {
+				c := Open(cacheDir, root, fshash.DefaultAlgorithm)
+				st, ok := statPath(c, pathA)
+				So(ok, ShouldBeTrue)
+				c.Record(pathA, st, hashA)
+				So(c.Save(), ShouldBeNil)
+				c = Open(cacheDir, root, fshash.DefaultAlgorithm)
+				_, ok = c.Lookup(pathA, settledStat(c, pathA))
+				So(ok, ShouldBeFalse)
+			})
+			Convey("non-regular files, and files that can't be stat'd, are never cached", func() {
+				c := Open(cacheDir, root, fshash.DefaultAlgorithm)
+				_, ok := statPath(c, fs.RelPath{})
+				So(ok, ShouldBeFalse)
+				f, err := os.Open(fileA)
+				So(err, ShouldBeNil)
+				f.Close()
+				_, ok = c.Stat(f)
+				So(ok, ShouldBeFalse)
+			})
+			Convey("another root's cache is not used", func() {
+				primed()
+				c := Open(cacheDir, tmpDir, fshash.DefaultAlgorithm)
+				_, ok := c.Lookup(pathA, settledStat(Open(cacheDir, root, fshash.DefaultAlgorithm), pathA))
+				So(ok, ShouldBeFalse)
+			})
+			Convey("another algorithm's cache is not used", func() {
+				primed()
+				c := Open(cacheDir, root, fshash.Algorithm_SHA256)
+				_, ok := c.Lookup(pathA, settledStat(c, pathA))
+				So(ok, ShouldBeFalse)
+			})
+			Convey("a corrupt cache file is treated as empty", func() {
+				c := primed()
+				So(ioutil.WriteFile(c.filename(), []byte("\xff\x00garbage"), 0644), ShouldBeNil)
+				c = Open(cacheDir, root, fshash.DefaultAlgorithm)
+				_, ok := c.Lookup(pathA, settledStat(c, pathA))
+				So(ok, ShouldBeFalse)
+			})
+		})
+	})
+}
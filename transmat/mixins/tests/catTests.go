@@ -0,0 +1,71 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/osfs"
+	"github.com/polydawn/rio/testutil"
+)
+
+// The cat func is a `util.CatFunc`; spelled out for the same reason as in CheckList.
+func CheckCat(packType api.PackType, pack rio.PackFunc, cat func(context.Context, api.WareID, fs.RelPath, bool, io.Writer, []api.WarehouseLocation, rio.Monitor) error, warehouseAddr api.WarehouseLocation) {
+	Convey("SPEC: Cat should write the body of a single file...", func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			fixturePath := tmpDir.Join(fs.MustRelPath("fixture"))
+			PlaceFixture(osfs.New(fixturePath), FixtureGamma)
+			wareID, err := pack(
+				context.Background(),
+				packType,
+				fixturePath.String(),
+				api.FilesetPackFilter_Lossless,
+				warehouseAddr,
+				rio.Monitor{},
+			)
+			So(err, ShouldBeNil)
+
+			catPath := func(wareID api.WareID, path string, verify bool) (string, error) {
+				var buf bytes.Buffer
+				err := cat(
+					context.Background(),
+					wareID,
+					fs.MustRelPath(path),
+					verify,
+					&buf,
+					[]api.WarehouseLocation{warehouseAddr},
+					rio.Monitor{},
+				)
+				return buf.String(), err
+			}
+
+			for _, verify := range []bool{true, false} {
+				Convey(map[bool]string{true: "with verification", false: "without verification"}[verify], FailureContinues, func() {
+					body, err := catPath(wareID, "etc/init/zed", verify)
+					So(err, ShouldBeNil)
+					So(body, ShouldEqual, "grue")
+
+					body, err = catPath(wareID, "var/fun", verify)
+					So(err, ShouldBeNil)
+					So(body, ShouldEqual, "zyx")
+
+					Convey("and reject paths that aren't files", func() {
+						body, err := catPath(wareID, "etc/init", verify)
+						So(Category(err), ShouldEqual, rio.ErrUsage)
+						So(body, ShouldEqual, "")
+
+						body, err = catPath(wareID, "etc/nope", verify)
+						So(Category(err), ShouldEqual, rio.ErrUsage)
+						So(body, ShouldEqual, "")
+					})
+				})
+			}
+		})
+	})
+}
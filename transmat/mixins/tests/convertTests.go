@@ -0,0 +1,138 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/osfs"
+	"github.com/polydawn/rio/testutil"
+)
+
+/*
+	Converting a ware into its own pack type should give back the same
+	ware, bytes and all: since packing is reproducible, this checks the
+	walk puts every entry of the ware, exactly as packing from disk would.
+
+	The convert func is a transmat's util.ConvertFunc with its own
+	util.WalkFunc already given.  (This package can't import util.)
+
+	The packInOrder func should write a ware of the pack type to the path,
+	with entries for the files given in just the order given: so wares no
+	pack from disk would make can be converted too.
+*/
+func CheckConvertRoundTrip(
+	packType api.PackType,
+	pack rio.PackFunc,
+	convert func(ctx context.Context, wareID api.WareID, warehouses []api.WarehouseLocation, target api.WarehouseLocation, mon rio.Monitor) (api.WareID, error),
+	packInOrder func(path string, files []FixtureFile) error,
+) {
+	Convey("SPEC: Converting a ware to its own pack type should give the same ware", func() {
+		for _, fixture := range AllFixtures {
+			Convey(fmt.Sprintf("- Fixture %q", fixture.Name), func() {
+				testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+					PlaceFixture(osfs.New(tmpDir.Join(fs.MustRelPath("src"))), fixture.Files)
+					blobPath := func(name string) string { return tmpDir.Join(fs.MustRelPath(name)).String() }
+					warehouse := func(name string) api.WarehouseLocation { return api.WarehouseLocation("file://" + blobPath(name)) }
+					wareID, err := pack(
+						context.Background(),
+						packType,
+						blobPath("src"),
+						api.FilesetPackFilter_Lossless,
+						warehouse("a"),
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+
+					convertedWareID, err := convert(
+						context.Background(),
+						wareID,
+						[]api.WarehouseLocation{warehouse("a")},
+						warehouse("b"),
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					So(convertedWareID, ShouldResemble, wareID)
+					blobA, err := ioutil.ReadFile(blobPath("a"))
+					So(err, ShouldBeNil)
+					blobB, err := ioutil.ReadFile(blobPath("b"))
+					So(err, ShouldBeNil)
+					So(bytes.Equal(blobA, blobB), ShouldBeTrue)
+				})
+			})
+		}
+	})
+	Convey("SPEC: Converting a ware with a dir's entry after its children's should give the same fileset", func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			files := []FixtureFile{
+				{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: defaultTime}, nil},
+				{fs.Metadata{Name: fs.MustRelPath("./d/f"), Type: fs.Type_File, Perms: 0644, Mtime: defaultTime, Size: 3}, []byte("zyx")},
+				{fs.Metadata{Name: fs.MustRelPath("./d"), Type: fs.Type_Dir, Perms: 0700, Mtime: defaultTime}, nil},
+			}
+			blobPath := func(name string) string { return tmpDir.Join(fs.MustRelPath(name)).String() }
+			warehouse := func(name string) api.WarehouseLocation { return api.WarehouseLocation("file://" + blobPath(name)) }
+			PlaceFixture(osfs.New(tmpDir.Join(fs.MustRelPath("src"))), []FixtureFile{files[0], files[2], files[1]})
+			wareID, err := pack(
+				context.Background(),
+				packType,
+				blobPath("src"),
+				api.FilesetPackFilter_Lossless,
+				warehouse("a"),
+				rio.Monitor{},
+			)
+			So(err, ShouldBeNil)
+			So(packInOrder(blobPath("a"), files), ShouldBeNil)
+
+			convertedWareID, err := convert(
+				context.Background(),
+				wareID,
+				[]api.WarehouseLocation{warehouse("a")},
+				warehouse("b"),
+				rio.Monitor{},
+			)
+			So(err, ShouldBeNil)
+			So(convertedWareID, ShouldResemble, wareID)
+		})
+	})
+	Convey("SPEC: Converting a ware that doesn't match its hash should fail, and save nothing", func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			blobPath := func(name string) string { return tmpDir.Join(fs.MustRelPath(name)).String() }
+			warehouse := func(name string) api.WarehouseLocation { return api.WarehouseLocation("file://" + blobPath(name)) }
+			packTo := func(fixture []FixtureFile, name string) api.WareID {
+				PlaceFixture(osfs.New(tmpDir.Join(fs.MustRelPath("src-"+name))), fixture)
+				wareID, err := pack(
+					context.Background(),
+					packType,
+					blobPath("src-"+name),
+					api.FilesetPackFilter_Lossless,
+					warehouse(name),
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+				return wareID
+			}
+			wareID := packTo(FixtureAlpha, "a")
+			packTo(FixtureAlphaDiffContent, "a2")
+			So(os.Rename(blobPath("a2"), blobPath("a")), ShouldBeNil)
+
+			_, err := convert(
+				context.Background(),
+				wareID,
+				[]api.WarehouseLocation{warehouse("a")},
+				warehouse("b"),
+				rio.Monitor{},
+			)
+			So(Category(err), ShouldEqual, rio.ErrWareHashMismatch)
+			_, err = os.Stat(blobPath("b"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,103 @@
+package tests
+
+import (
+	"context"
+	"strings"
+	"syscall"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	cacheapi "github.com/polydawn/rio/cache"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/faultfs"
+	"github.com/polydawn/rio/fs/osfs"
+	"github.com/polydawn/rio/testutil"
+)
+
+/*
+	The unpackWithFaults func should return an unpack func that unpacks
+	directly (no cache) into the path, through a faultfs with the faults.
+
+	The lrn2Cache func is `cache.Lrn2Cache`; it's passed in because that
+	package can't be imported from here without a cycle.
+*/
+func CheckUnpackFaults(packType api.PackType, pack rio.PackFunc, unpackWithFaults func(...faultfs.Fault) rio.UnpackFunc, lrn2Cache func(fs.FS, rio.UnpackFunc) rio.UnpackFunc, warehouseAddr api.WarehouseLocation) {
+	Convey("SPEC: Unpack failing to write should say so, and leave nothing in the cache...", func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			fixturePath := tmpDir.Join(fs.MustRelPath("fixture"))
+			PlaceFixture(osfs.New(fixturePath), FixtureGamma)
+			wareID, err := pack(
+				context.Background(),
+				packType,
+				fixturePath.String(),
+				api.FilesetPackFilter_Lossless,
+				warehouseAddr,
+				rio.Monitor{},
+			)
+			So(err, ShouldBeNil)
+
+			faults := []struct {
+				title string
+				fault faultfs.Fault
+			}{
+				{"a full disk", faultfs.Fault{Op: "Write", Path: "./etc/init/zed", Err: syscall.ENOSPC}},
+				{"a short write", faultfs.Fault{Op: "Write", AfterBytes: 5}},
+				{"a dir that may not be made", faultfs.Fault{Op: "Mkdir", Path: "./var", Err: syscall.EACCES}},
+				{"a path that may not be checked for symlinks", faultfs.Fault{Op: "Readlink", Nth: 3, Err: syscall.EACCES}},
+				{"dir times that may not be set", faultfs.Fault{Op: "SetTimesNano", Err: syscall.EPERM}},
+			}
+			cachePath := tmpDir.Join(fs.MustRelPath("cache"))
+			unpackWith := func(unpack rio.UnpackFunc, dst string, placementMode rio.PlacementMode) error {
+				_, err := unpack(
+					context.Background(),
+					wareID,
+					tmpDir.Join(fs.MustRelPath(dst)).String(),
+					api.FilesetUnpackFilter_Lossless,
+					placementMode,
+					[]api.WarehouseLocation{warehouseAddr},
+					rio.Monitor{},
+				)
+				return err
+			}
+			shouldLeaveCacheEmpty := func() {
+				_, err := osfs.New(cachePath).LStat(cacheapi.ShelfFor(wareID))
+				So(Category(err), ShouldEqual, fs.ErrNotExists)
+				names, err := osfs.New(cachePath).ReadDirNames(fs.RelPath{})
+				So(err, ShouldBeNil)
+				for _, name := range names {
+					So(strings.HasPrefix(name, ".tmp"), ShouldBeFalse)
+				}
+			}
+
+			for _, tr := range faults {
+				Convey("given "+tr.title+":", func() {
+					Convey("unpacking should fail as inoperable", func() {
+						err := unpackWith(unpackWithFaults(tr.fault), "unpack", rio.Placement_Direct)
+						So(Category(err), ShouldEqual, rio.ErrInoperablePath)
+					})
+					Convey("populating a cache should fail the same, and leave no shelf", func() {
+						err := unpackWith(lrn2Cache(osfs.New(cachePath), unpackWithFaults(tr.fault)), "placed", rio.Placement_Copy)
+						So(Category(err), ShouldEqual, rio.ErrInoperablePath)
+						shouldLeaveCacheEmpty()
+
+						Convey("and populating it again without faults should work", func() {
+							err := unpackWith(lrn2Cache(osfs.New(cachePath), unpackWithFaults()), "placed", rio.Placement_Copy)
+							So(err, ShouldBeNil)
+							_, err = osfs.New(cachePath).LStat(cacheapi.ShelfFor(wareID))
+							So(err, ShouldBeNil)
+						})
+					})
+				})
+			}
+			Convey("a cache failing to commit the shelf should fail as a cache problem, and leave no shelf", func() {
+				cacheFs := faultfs.New(osfs.New(cachePath), faultfs.Fault{Op: "Mkdir", Path: "./" + string(packType) + "/fileset/*", Err: syscall.EACCES})
+				err := unpackWith(lrn2Cache(cacheFs, unpackWithFaults()), "placed", rio.Placement_Copy)
+				So(Category(err), ShouldEqual, rio.ErrLocalCacheProblem)
+				shouldLeaveCacheEmpty()
+			})
+		})
+	})
+}
@@ -103,6 +103,15 @@ var FixtureGamma = []FixtureFile{
 	{fs.Metadata{Name: fs.MustRelPath("./var/fun"), Type: fs.Type_File, Perms: 0644, Mtime: defaultTime, Size: 3}, []byte("zyx")},
 }
 
+// large and small files mixed.
+// subtle: packing reads small files ahead (on other goroutines) but streams large ones, and they must still come out in order.
+var FixtureLarge = []FixtureFile{
+	{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: defaultTime}, nil},
+	{fs.Metadata{Name: fs.MustRelPath("./a"), Type: fs.Type_File, Perms: 0644, Mtime: defaultTime, Size: 3}, []byte("zyx")},
+	{fs.Metadata{Name: fs.MustRelPath("./b"), Type: fs.Type_File, Perms: 0644, Mtime: defaultTime, Size: 3 << 20}, bytes.Repeat([]byte("qwe"), 1<<20)},
+	{fs.Metadata{Name: fs.MustRelPath("./c"), Type: fs.Type_File, Perms: 0644, Mtime: defaultTime, Size: 4}, []byte("asdf")},
+}
+
 var AllFixtures = []struct {
 	Name  string
 	Files []FixtureFile
@@ -120,6 +129,7 @@ var AllFixtures = []struct {
 	{"Depth3", FixtureDepth3},
 	{"Symlinks", FixtureSymlinks},
 	{"Gamma", FixtureGamma},
+	{"Large", FixtureLarge},
 }
 
 /*
@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"context"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/osfs"
+	"github.com/polydawn/rio/testutil"
+	"github.com/polydawn/rio/transmat/mixins/limits"
+)
+
+// Four MiB of zeros compresses to nearly nothing: a (small) bomb.
+var fixtureBomb = []FixtureFile{
+	{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: fs.DefaultTime}, nil},
+	{fs.Metadata{Name: fs.MustRelPath("./a"), Type: fs.Type_Dir, Perms: 0755, Mtime: fs.DefaultTime}, nil},
+	{fs.Metadata{Name: fs.MustRelPath("./a/b"), Type: fs.Type_Dir, Perms: 0755, Mtime: fs.DefaultTime}, nil},
+	{fs.Metadata{Name: fs.MustRelPath("./a/b/c"), Type: fs.Type_File, Perms: 0644, Mtime: fs.DefaultTime, Size: 3}, []byte("abc")},
+	{fs.Metadata{Name: fs.MustRelPath("./zeros"), Type: fs.Type_File, Perms: 0644, Mtime: fs.DefaultTime, Size: 4 << 20}, make([]byte, 4<<20)},
+}
+
+func CheckUnpackLimits(packType api.PackType, pack rio.PackFunc, unpack rio.UnpackFunc, warehouseAddr api.WarehouseLocation) {
+	Convey("SPEC: Unpack with limits should reject wares which exceed them...", func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			fixturePath := tmpDir.Join(fs.MustRelPath("fixture"))
+			PlaceFixture(osfs.New(fixturePath), fixtureBomb)
+			wareID, err := pack(
+				context.Background(),
+				packType,
+				fixturePath.String(),
+				api.FilesetPackFilter_Lossless,
+				warehouseAddr,
+				rio.Monitor{},
+			)
+			So(err, ShouldBeNil)
+
+			unpackWith := func(l limits.Limits) (api.WareID, error) {
+				return unpack(
+					limits.WithLimits(context.Background(), l),
+					wareID,
+					tmpDir.Join(fs.MustRelPath("unpack")).String(),
+					api.FilesetUnpackFilter_Lossless,
+					rio.Placement_Direct,
+					[]api.WarehouseLocation{warehouseAddr},
+					rio.Monitor{},
+				)
+			}
+
+			Convey("limits the ware is within should pass", func() {
+				wareID2, err := unpackWith(limits.Limits{
+					MaxTotalSize: 4<<20 + 3,
+					MaxEntries:   5,
+					MaxFileSize:  4 << 20,
+					MaxDepth:     3,
+				})
+				So(err, ShouldBeNil)
+				So(wareID2, ShouldResemble, wareID)
+			})
+			Convey("too many entries should be rejected", func() {
+				_, err := unpackWith(limits.Limits{MaxEntries: 4})
+				So(Category(err), ShouldEqual, limits.ErrLimitExceeded)
+				So(Details(err)["limit"], ShouldEqual, "entries")
+			})
+			Convey("too deep a path should be rejected", func() {
+				_, err := unpackWith(limits.Limits{MaxDepth: 2})
+				So(Category(err), ShouldEqual, limits.ErrLimitExceeded)
+				So(Details(err)["limit"], ShouldEqual, "depth")
+			})
+			Convey("too big a file should be rejected", func() {
+				_, err := unpackWith(limits.Limits{MaxFileSize: 1 << 20})
+				So(Category(err), ShouldEqual, limits.ErrLimitExceeded)
+				So(Details(err)["limit"], ShouldEqual, "file-size")
+			})
+			Convey("too much content in total should be rejected", func() {
+				_, err := unpackWith(limits.Limits{MaxTotalSize: 4 << 20})
+				So(Category(err), ShouldEqual, limits.ErrLimitExceeded)
+				So(Details(err)["limit"], ShouldEqual, "total-size")
+			})
+			Convey("too compressed a ware should be rejected", func() {
+				_, err := unpackWith(limits.Limits{MaxRatio: 100})
+				So(Category(err), ShouldEqual, limits.ErrLimitExceeded)
+				So(Details(err)["limit"], ShouldEqual, "ratio")
+			})
+		})
+	})
+}
@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"context"
+	"crypto/sha512"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/osfs"
+	"github.com/polydawn/rio/lib/treewalk"
+	"github.com/polydawn/rio/testutil"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+)
+
+// The list func is a `util.ListFunc`; it's spelled out here because that
+//  package can't be imported from here without a cycle.
+func CheckList(packType api.PackType, pack rio.PackFunc, list func(context.Context, api.WareID, []api.WarehouseLocation, rio.Monitor) (fshash.Bucket, error), warehouseAddr api.WarehouseLocation) {
+	Convey("SPEC: Listing a ware should yield a record of each entry...", func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			fixture := FixtureGamma
+			fixturePath := tmpDir.Join(fs.MustRelPath("fixture"))
+			PlaceFixture(osfs.New(fixturePath), fixture)
+			wareID, err := pack(
+				context.Background(),
+				packType,
+				fixturePath.String(),
+				api.FilesetPackFilter_Lossless,
+				warehouseAddr,
+				rio.Monitor{},
+			)
+			So(err, ShouldBeNil)
+
+			bucket, err := list(
+				context.Background(),
+				wareID,
+				[]api.WarehouseLocation{warehouseAddr},
+				rio.Monitor{},
+			)
+			So(err, ShouldBeNil)
+			So(bucket.Length(), ShouldEqual, len(fixture))
+
+			Convey("in path order, with the fixture's metadata and content hashes", FailureContinues, func() {
+				var records []fshash.Record
+				So(treewalk.Walk(bucket.Iterator(), func(node treewalk.Node) error {
+					records = append(records, node.(fshash.RecordIterator).Record())
+					return nil
+				}, nil), ShouldBeNil)
+				So(records, ShouldHaveLength, len(fixture))
+				for i, record := range records {
+					fmeta := record.Metadata
+					fmeta.Mtime = fmeta.Mtime.UTC()
+					expectFmeta := fixture[i].Metadata
+					So(fmeta.Name, ShouldResemble, expectFmeta.Name)
+					So(fmeta.Type, ShouldEqual, expectFmeta.Type)
+					So(fmeta.Perms, ShouldEqual, expectFmeta.Perms)
+					So(fmeta.Size, ShouldEqual, expectFmeta.Size)
+					So(fmeta.Mtime, ShouldResemble, expectFmeta.Mtime)
+					if expectFmeta.Type == fs.Type_File {
+						hash := sha512.Sum384(fixture[i].Body)
+						So(record.ContentHash, ShouldResemble, hash[:])
+					} else {
+						So(record.ContentHash, ShouldBeNil)
+					}
+				}
+			})
+		})
+	})
+	Convey("SPEC: Listing a ware of another pack type should be rejected", func() {
+		_, err := list(
+			context.Background(),
+			api.WareID{"not" + packType, "hash"},
+			[]api.WarehouseLocation{warehouseAddr},
+			rio.Monitor{},
+		)
+		So(Category(err), ShouldEqual, rio.ErrUsage)
+	})
+}
@@ -0,0 +1,201 @@
+package tests
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/osfs"
+	"github.com/polydawn/rio/testutil"
+	"github.com/polydawn/rio/transmat/mixins/limits"
+	"github.com/polydawn/rio/transmat/mixins/warefs"
+)
+
+// The open func is a `util.OpenFSFunc`; spelled out for the same reason as in CheckList.
+func CheckOpenFS(packType api.PackType, pack rio.PackFunc, openFS func(context.Context, api.WareID, []api.WarehouseLocation, rio.Monitor) (*warefs.FS, error), warehouseAddr api.WarehouseLocation) {
+	Convey("SPEC: Opening a ware as a filesystem should show just what unpacking it would...", func() {
+		for _, fixture := range AllFixtures {
+			Convey("Fixture: "+fixture.Name, FailureContinues, func() {
+				testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+					fixturePath := tmpDir.Join(fs.MustRelPath("fixture"))
+					PlaceFixture(osfs.New(fixturePath), fixture.Files)
+					wareID, err := pack(
+						context.Background(),
+						packType,
+						fixturePath.String(),
+						api.FilesetPackFilter_Lossless,
+						warehouseAddr,
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+
+					wfs, err := openFS(context.Background(), wareID, []api.WarehouseLocation{warehouseAddr}, rio.Monitor{})
+					So(err, ShouldBeNil)
+					defer wfs.Close()
+
+					children := map[fs.RelPath][]string{}
+					for _, ff := range fixture.Files {
+						if ff.Metadata.Name != (fs.RelPath{}) {
+							children[ff.Metadata.Name.Dir()] = append(children[ff.Metadata.Name.Dir()], ff.Metadata.Name.Last())
+						}
+					}
+					for _, ff := range fixture.Files {
+						fmeta, err := wfs.LStat(ff.Metadata.Name)
+						So(err, ShouldBeNil)
+						So(fmeta.Type, ShouldEqual, ff.Metadata.Type)
+						So(fmeta.Perms, ShouldEqual, ff.Metadata.Perms)
+						So(fmeta.Uid, ShouldEqual, ff.Metadata.Uid)
+						So(fmeta.Gid, ShouldEqual, ff.Metadata.Gid)
+						So(fmeta.Linkname, ShouldEqual, ff.Metadata.Linkname)
+						So(fmeta.Mtime.Equal(ff.Metadata.Mtime), ShouldBeTrue)
+						switch ff.Metadata.Type {
+						case fs.Type_File:
+							So(fmeta.Size, ShouldEqual, ff.Metadata.Size)
+							f, err := wfs.OpenFile(ff.Metadata.Name, os.O_RDONLY, 0)
+							So(err, ShouldBeNil)
+							body, err := ioutil.ReadAll(f)
+							So(err, ShouldBeNil)
+							So(string(body), ShouldEqual, string(ff.Body))
+							So(f.Close(), ShouldBeNil)
+						case fs.Type_Dir:
+							names, err := wfs.ReadDirNames(ff.Metadata.Name)
+							So(err, ShouldBeNil)
+							want := children[ff.Metadata.Name]
+							sort.Strings(want)
+							if want == nil {
+								want = []string{}
+							}
+							So(names, ShouldResemble, want)
+						}
+					}
+				})
+			})
+		}
+
+		Convey("Reads should be random access, and writes refused", func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				fixturePath := tmpDir.Join(fs.MustRelPath("fixture"))
+				PlaceFixture(osfs.New(fixturePath), append(FixtureLarge, FixtureSymlinks[2]))
+				wareID, err := pack(
+					context.Background(),
+					packType,
+					fixturePath.String(),
+					api.FilesetPackFilter_Lossless,
+					warehouseAddr,
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+
+				wfs, err := openFS(context.Background(), wareID, []api.WarehouseLocation{warehouseAddr}, rio.Monitor{})
+				So(err, ShouldBeNil)
+				defer wfs.Close()
+
+				f, err := wfs.OpenFile(fs.MustRelPath("b"), os.O_RDONLY, 0)
+				So(err, ShouldBeNil)
+				defer f.Close()
+				buf := make([]byte, 6)
+				n, err := f.ReadAt(buf, 3<<19)
+				So(err, ShouldBeNil)
+				So(string(buf[:n]), ShouldEqual, "qweqwe")
+				n, err = f.ReadAt(buf, 1)
+				So(err, ShouldBeNil)
+				So(string(buf[:n]), ShouldEqual, "weqweq")
+				n, err = f.ReadAt(buf, 3<<20-2)
+				So(err, ShouldEqual, io.EOF)
+				So(string(buf[:n]), ShouldEqual, "we")
+				off, err := f.Seek(-4, io.SeekEnd)
+				So(err, ShouldBeNil)
+				So(off, ShouldEqual, 3<<20-4)
+				body, err := ioutil.ReadAll(f)
+				So(err, ShouldBeNil)
+				So(string(body), ShouldEqual, "eqwe")
+
+				// The symlink "ln" points to "./a": Stat and OpenFile follow it.
+				fmeta, err := wfs.Stat(fs.MustRelPath("ln"))
+				So(err, ShouldBeNil)
+				So(fmeta.Type, ShouldEqual, fs.Type_File)
+				So(fmeta.Size, ShouldEqual, 3)
+				f2, err := wfs.OpenFile(fs.MustRelPath("ln"), os.O_RDONLY, 0)
+				So(err, ShouldBeNil)
+				body, err = ioutil.ReadAll(f2)
+				So(err, ShouldBeNil)
+				So(string(body), ShouldEqual, "zyx")
+				So(f2.Close(), ShouldBeNil)
+
+				_, err = wfs.OpenFile(fs.MustRelPath("a"), os.O_RDWR, 0)
+				So(Category(err), ShouldEqual, fs.ErrPermission)
+				_, err = f.Write([]byte("x"))
+				So(err, ShouldNotBeNil)
+				So(Category(wfs.Mkdir(fs.MustRelPath("d"), 0755)), ShouldEqual, fs.ErrPermission)
+				So(Category(wfs.Chmod(fs.MustRelPath("a"), 0600)), ShouldEqual, fs.ErrPermission)
+				_, err = wfs.LStat(fs.MustRelPath("nope"))
+				So(Category(err), ShouldEqual, fs.ErrNotExists)
+			})
+		})
+
+		Convey("A ware other than the one asked for should be refused", func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				blobPath := func(name string) string { return tmpDir.Join(fs.MustRelPath(name)).String() }
+				warehouse := func(name string) api.WarehouseLocation { return api.WarehouseLocation("file://" + blobPath(name)) }
+				packTo := func(fixture []FixtureFile, name string) api.WareID {
+					PlaceFixture(osfs.New(tmpDir.Join(fs.MustRelPath("src-"+name))), fixture)
+					wareID, err := pack(
+						context.Background(),
+						packType,
+						blobPath("src-"+name),
+						api.FilesetPackFilter_Lossless,
+						warehouse(name),
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					return wareID
+				}
+				wareID := packTo(FixtureAlpha, "a")
+				packTo(FixtureAlphaDiffContent, "a2")
+				So(os.Rename(blobPath("a2"), blobPath("a")), ShouldBeNil)
+
+				_, err := openFS(context.Background(), wareID, []api.WarehouseLocation{warehouse("a")}, rio.Monitor{})
+				So(Category(err), ShouldEqual, rio.ErrWareHashMismatch)
+			})
+		})
+	})
+}
+
+// The ware packed must be compressed, for the ratio to be checked.
+func CheckOpenFSLimits(packType api.PackType, pack rio.PackFunc, openFS func(context.Context, api.WareID, []api.WarehouseLocation, rio.Monitor) (*warefs.FS, error), warehouseAddr api.WarehouseLocation) {
+	Convey("SPEC: Opening a ware as a filesystem should enforce limits while indexing, as unpacking would...", func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			fixturePath := tmpDir.Join(fs.MustRelPath("fixture"))
+			PlaceFixture(osfs.New(fixturePath), fixtureBomb)
+			wareID, err := pack(
+				context.Background(),
+				packType,
+				fixturePath.String(),
+				api.FilesetPackFilter_Lossless,
+				warehouseAddr,
+				rio.Monitor{},
+			)
+			So(err, ShouldBeNil)
+
+			openWith := func(l limits.Limits) error {
+				wfs, err := openFS(limits.WithLimits(context.Background(), l), wareID, []api.WarehouseLocation{warehouseAddr}, rio.Monitor{})
+				if err == nil {
+					wfs.Close()
+				}
+				return err
+			}
+			So(openWith(limits.Limits{MaxTotalSize: 4<<20 + 3, MaxFileSize: 4 << 20}), ShouldBeNil)
+			So(Category(openWith(limits.Limits{MaxEntries: 4})), ShouldEqual, limits.ErrLimitExceeded)
+			So(Category(openWith(limits.Limits{MaxTotalSize: 4 << 20})), ShouldEqual, limits.ErrLimitExceeded)
+			So(Category(openWith(limits.Limits{MaxRatio: 100})), ShouldEqual, limits.ErrLimitExceeded)
+		})
+	})
+}
@@ -1,8 +1,11 @@
 package tests
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
+	"sort"
 
 	. "github.com/smartystreets/goconvey/convey"
 
@@ -11,6 +14,8 @@ import (
 	"github.com/polydawn/rio/fs"
 	"github.com/polydawn/rio/fs/osfs"
 	"github.com/polydawn/rio/testutil"
+	"github.com/polydawn/rio/transmat/mixins/filters"
+	"github.com/polydawn/rio/transmat/mixins/statcache"
 )
 
 func CheckPackProducesConsistentHash(packType api.PackType, pack rio.PackFunc) {
@@ -122,3 +127,189 @@ func CheckPackErrorsGracefully(packType api.PackType, pack rio.PackFunc) {
 		})
 	})
 }
+
+func CheckPackPathFilters(packType api.PackType, pack rio.PackFunc) {
+	Convey("SPEC: path filters should leave paths out of the pack as if they were never there", func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			// Pack the clean fixture, for comparison.
+			cleanPath := tmpDir.Join(fs.MustRelPath("clean"))
+			PlaceFixture(osfs.New(cleanPath), FixtureMultifile)
+			wareIDClean, err := pack(
+				context.Background(),
+				packType,
+				cleanPath.String(),
+				api.FilesetPackFilter_Lossless,
+				"",
+				rio.Monitor{},
+			)
+			So(err, ShouldBeNil)
+
+			// Set up the same fixture again, with some junk mixed in.
+			//  Reset the root mtime after, since placing the junk bonks it.
+			dirtyPath := tmpDir.Join(fs.MustRelPath("dirty"))
+			dirtyFs := osfs.New(dirtyPath)
+			PlaceFixture(dirtyFs, FixtureMultifile)
+			PlaceFixture(dirtyFs, []FixtureFile{
+				{fs.Metadata{Name: fs.MustRelPath("./c.o"), Type: fs.Type_File, Perms: 0644, Mtime: defaultTime, Size: 3}, []byte("obj")},
+				{fs.Metadata{Name: fs.MustRelPath("./a~"), Type: fs.Type_File, Perms: 0644, Mtime: defaultTime, Size: 3}, []byte("zyx")},
+				{fs.Metadata{Name: fs.MustRelPath("./.git"), Type: fs.Type_Dir, Perms: 0755, Mtime: defaultTime}, nil},
+				{fs.Metadata{Name: fs.MustRelPath("./.git/config"), Type: fs.Type_File, Perms: 0644, Mtime: defaultTime, Size: 3}, []byte("cfg")},
+			})
+			resetRoot := func() {
+				So(dirtyFs.SetTimesNano(fs.RelPath{}, defaultTime, fs.DefaultTime), ShouldBeNil)
+			}
+			resetRoot()
+			packDirty := func(ctx context.Context) (api.WareID, error) {
+				return pack(
+					ctx,
+					packType,
+					dirtyPath.String(),
+					api.FilesetPackFilter_Lossless,
+					"",
+					rio.Monitor{},
+				)
+			}
+
+			Convey("without filters, the junk is packed", func() {
+				wareID, err := packDirty(context.Background())
+				So(err, ShouldBeNil)
+				So(wareID, ShouldNotResemble, wareIDClean)
+			})
+			Convey("excludes should leave out matching files and dirs", func() {
+				pathFilt, err := filters.NewPathFilter(nil, []string{"*.o", ".git/", "*~"})
+				So(err, ShouldBeNil)
+				wareID, err := packDirty(filters.WithPathFilter(context.Background(), pathFilt))
+				So(err, ShouldBeNil)
+				So(wareID, ShouldResemble, wareIDClean)
+			})
+			Convey("negated excludes should re-include matching paths", func() {
+				pathFilt, err := filters.NewPathFilter(nil, []string{"*", "!a", "!b"})
+				So(err, ShouldBeNil)
+				wareID, err := packDirty(filters.WithPathFilter(context.Background(), pathFilt))
+				So(err, ShouldBeNil)
+				So(wareID, ShouldResemble, wareIDClean)
+			})
+			Convey("includes should leave out all other files, and dirs with none of them in", func() {
+				pathFilt, err := filters.NewPathFilter([]string{"a", "b"}, nil)
+				So(err, ShouldBeNil)
+				wareID, err := packDirty(filters.WithPathFilter(context.Background(), pathFilt))
+				So(err, ShouldBeNil)
+				So(wareID, ShouldResemble, wareIDClean)
+			})
+			Convey("includes should keep the dirs the files they match are in", func() {
+				gitPath := tmpDir.Join(fs.MustRelPath("git"))
+				PlaceFixture(osfs.New(gitPath), []FixtureFile{
+					{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: defaultTime}, nil},
+					{fs.Metadata{Name: fs.MustRelPath("./.git"), Type: fs.Type_Dir, Perms: 0755, Mtime: defaultTime}, nil},
+					{fs.Metadata{Name: fs.MustRelPath("./.git/config"), Type: fs.Type_File, Perms: 0644, Mtime: defaultTime, Size: 3}, []byte("cfg")},
+				})
+				wareIDGit, err := pack(
+					context.Background(),
+					packType,
+					gitPath.String(),
+					api.FilesetPackFilter_Lossless,
+					"",
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+				for _, include := range []string{"config", ".git/"} {
+					pathFilt, err := filters.NewPathFilter([]string{include}, nil)
+					So(err, ShouldBeNil)
+					wareID, err := packDirty(filters.WithPathFilter(context.Background(), pathFilt))
+					So(err, ShouldBeNil)
+					So(wareID, ShouldResemble, wareIDGit)
+				}
+			})
+			Convey("an ignore file in the pack root should be honored", func() {
+				body := []byte("# build junk\n*.o\n.git/\n\n*~\n/" + filters.IgnoreFileName + "\n")
+				PlaceFixture(dirtyFs, []FixtureFile{
+					{fs.Metadata{Name: fs.MustRelPath(filters.IgnoreFileName), Type: fs.Type_File, Perms: 0644, Mtime: defaultTime, Size: int64(len(body))}, body},
+				})
+				resetRoot()
+				wareID, err := packDirty(context.Background())
+				So(err, ShouldBeNil)
+				So(wareID, ShouldResemble, wareIDClean)
+			})
+		})
+	})
+}
+
+func CheckPackStatCache(packType api.PackType, pack rio.PackFunc) {
+	Convey("SPEC: packing with a stat cache should produce the same hash as without", func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			cacheDir := tmpDir.Join(fs.MustRelPath("statcache"))
+			filesetPath := tmpDir.Join(fs.MustRelPath("fileset"))
+			afs := osfs.New(filesetPath)
+			PlaceFixture(afs, FixtureMultifile)
+			packIt := func(ctx context.Context, warehouseAddr api.WarehouseLocation) api.WareID {
+				wareID, err := pack(
+					ctx,
+					packType,
+					filesetPath.String(),
+					api.FilesetPackFilter_Lossless,
+					warehouseAddr,
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+				return wareID
+			}
+			cachingCtx := statcache.WithStatCache(context.Background(), cacheDir)
+			warehouseAddr := api.WarehouseLocation("file://" + tmpDir.Join(fs.MustRelPath("ware")).String())
+
+			wareIDPlain := packIt(context.Background(), "")
+			So(packIt(cachingCtx, ""), ShouldResemble, wareIDPlain)
+			So(packIt(cachingCtx, warehouseAddr), ShouldResemble, wareIDPlain)
+			So(packIt(cachingCtx, ""), ShouldResemble, wareIDPlain)
+
+			Convey("and follow changes to the files, even those which keep the size and mtime", func() {
+				So(ioutil.WriteFile(filesetPath.Join(fs.MustRelPath("./b")).String(), []byte("QWE"), 0644), ShouldBeNil)
+				So(afs.SetTimesNano(fs.MustRelPath("./b"), defaultTime, fs.DefaultTime), ShouldBeNil)
+				wareIDChanged := packIt(context.Background(), "")
+				So(wareIDChanged, ShouldNotResemble, wareIDPlain)
+				So(packIt(cachingCtx, ""), ShouldResemble, wareIDChanged)
+			})
+		})
+	})
+}
+
+func CheckPackReproducible(packType api.PackType, pack rio.PackFunc) {
+	Convey("SPEC: Packing the same fileset should produce the same bytes, however it was laid down", func() {
+		for _, fixture := range AllFixtures {
+			Convey(fmt.Sprintf("- Fixture %q", fixture.Name), func() {
+				testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+					// Place the fixture twice: once in order, and once with
+					//  siblings created in reverse order (parents still first),
+					//  so the dirs are likely to list differently.
+					PlaceFixture(osfs.New(tmpDir.Join(fs.MustRelPath("a"))), fixture.Files)
+					reordered := append([]FixtureFile(nil), fixture.Files...)
+					sort.SliceStable(reordered, func(i, j int) bool {
+						di, dj := len(reordered[i].Metadata.Name.Split()), len(reordered[j].Metadata.Name.Split())
+						if di != dj {
+							return di < dj
+						}
+						return reordered[i].Metadata.Name.String() > reordered[j].Metadata.Name.String()
+					})
+					PlaceFixture(osfs.New(tmpDir.Join(fs.MustRelPath("b"))), reordered)
+
+					packTo := func(dir, blob string) []byte {
+						_, err := pack(
+							context.Background(),
+							packType,
+							tmpDir.Join(fs.MustRelPath(dir)).String(),
+							api.FilesetPackFilter_Lossless,
+							api.WarehouseLocation("file://"+tmpDir.Join(fs.MustRelPath(blob)).String()),
+							rio.Monitor{},
+						)
+						So(err, ShouldBeNil)
+						body, err := ioutil.ReadFile(tmpDir.Join(fs.MustRelPath(blob)).String())
+						So(err, ShouldBeNil)
+						return body
+					}
+					blobA := packTo("a", "a1")
+					So(bytes.Equal(packTo("a", "a2"), blobA), ShouldBeTrue)
+					So(bytes.Equal(packTo("b", "b1"), blobA), ShouldBeTrue)
+				})
+			})
+		}
+	})
+}
@@ -5,8 +5,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
 
 	api "github.com/polydawn/go-timeless-api"
 	"github.com/polydawn/go-timeless-api/rio"
@@ -16,6 +20,8 @@ import (
 	"github.com/polydawn/rio/fs/osfs"
 	"github.com/polydawn/rio/fsOp"
 	"github.com/polydawn/rio/testutil"
+	"github.com/polydawn/rio/transmat/mixins/filters"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
 )
 
 func CheckRoundTrip(packType api.PackType, pack rio.PackFunc, unpack rio.UnpackFunc, warehouseAddr api.WarehouseLocation) {
@@ -128,3 +134,421 @@ func CheckCachePopulation(packType api.PackType, pack rio.PackFunc, unpack rio.U
 		})
 	})
 }
+
+func CheckCacheDedup(packType api.PackType, pack rio.PackFunc, unpack rio.UnpackFunc, warehouseAddr api.WarehouseLocation) {
+	Convey("SPEC: Caching: with hardlink dedup configured, shelves should share file content...", func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			// Bonk our own config env vars to isolate cache.
+			tmpBase := tmpDir.Join(fs.MustRelPath("rio-base"))
+			os.Setenv("RIO_BASE", tmpBase.String())
+			os.Setenv("RIO_CACHE_DEDUP", string(config.CacheDedup_Hardlink))
+			defer os.Unsetenv("RIO_CACHE_DEDUP")
+
+			// Pack and unpack several fixtures which have the same content in "./a",
+			//  with the same attributes in two of them and different mtime in the third.
+			fixtures := [][]FixtureFile{FixtureAlpha, FixtureMultifile, FixtureAlphaDiffTime}
+			shelves := make([]fs.AbsolutePath, len(fixtures))
+			for i, fixture := range fixtures {
+				fixturePath := tmpDir.Join(fs.MustRelPath(fmt.Sprintf("fixture%d", i)))
+				PlaceFixture(osfs.New(fixturePath), fixture)
+				wareID, err := pack(
+					context.Background(),
+					packType,
+					fixturePath.String(),
+					api.FilesetPackFilter_Lossless,
+					warehouseAddr,
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+				_, err = unpack(
+					context.Background(),
+					wareID,
+					tmpDir.Join(fs.MustRelPath("unpack")).String(),
+					api.FilesetUnpackFilter_Lossless,
+					rio.Placement_None,
+					[]api.WarehouseLocation{warehouseAddr},
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+				shelves[i] = config.GetCacheBasePath().Join(cache.ShelfFor(wareID))
+			}
+
+			Convey("shelves should still agree with their fixtures", FailureContinues, func() {
+				for i, fixture := range fixtures {
+					afs := osfs.New(shelves[i])
+					for _, file := range fixture {
+						fmeta, reader, err := fsOp.ScanFile(afs, file.Metadata.Name)
+						So(err, ShouldBeNil)
+						fmeta.Mtime = fmeta.Mtime.UTC()
+						So(*fmeta, ShouldResemble, file.Metadata)
+						if file.Metadata.Type == fs.Type_File {
+							body, _ := ioutil.ReadAll(reader)
+							So(string(body), ShouldResemble, string(file.Body))
+						}
+					}
+				}
+			})
+			Convey("files with identical content and attributes should share an inode", func() {
+				stat := func(shelf fs.AbsolutePath) os.FileInfo {
+					fi, err := os.Lstat(shelf.Join(fs.MustRelPath("a")).String())
+					So(err, ShouldBeNil)
+					return fi
+				}
+				So(os.SameFile(stat(shelves[0]), stat(shelves[1])), ShouldBeTrue)
+				So(os.SameFile(stat(shelves[0]), stat(shelves[2])), ShouldBeFalse)
+			})
+			Convey("content should be stored by its hash with the ware's own algorithm", func() {
+				contentFor := func(alg fshash.Algorithm, body string) string {
+					hasher := alg.New()
+					hasher.Write([]byte(body))
+					return config.GetCacheBasePath().Join(cache.ContentFor(alg.WareHash(hasher.Sum(nil)))).String()
+				}
+				fixturePath := tmpDir.Join(fs.MustRelPath("fixture0"))
+				ctx := fshash.WithAlgorithm(context.Background(), fshash.Algorithm_BLAKE3)
+				wareID, err := pack(
+					ctx,
+					packType,
+					fixturePath.String(),
+					api.FilesetPackFilter_Lossless,
+					warehouseAddr,
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+				_, err = unpack(
+					ctx,
+					wareID,
+					tmpDir.Join(fs.MustRelPath("unpack")).String(),
+					api.FilesetUnpackFilter_Lossless,
+					rio.Placement_None,
+					[]api.WarehouseLocation{warehouseAddr},
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+				_, err = os.Stat(contentFor(fshash.DefaultAlgorithm, "zyx"))
+				So(err, ShouldBeNil)
+				_, err = os.Stat(contentFor(fshash.Algorithm_BLAKE3, "zyx"))
+				So(err, ShouldBeNil)
+			})
+			Convey("cache stats should report the savings", func() {
+				stats, err := cache.GetStats(osfs.New(config.GetCacheBasePath()))
+				So(err, ShouldBeNil)
+				So(stats.Shelves, ShouldEqual, 3)
+				So(stats.Files, ShouldEqual, 4)
+				So(stats.LogicalBytes, ShouldEqual, 12)
+				So(stats.PhysicalBytes, ShouldEqual, 9)
+			})
+		})
+	})
+}
+
+func CheckUnpackMtimeNow(packType api.PackType, pack rio.PackFunc, unpack rio.UnpackFunc, warehouseAddr api.WarehouseLocation) {
+	Convey("SPEC: Unpack with 'mtime=now' filter should give everything the same fresh mtime...", func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			os.Setenv("RIO_BASE", tmpDir.Join(fs.MustRelPath("rio-base")).String())
+
+			fixture := FixtureDepth3
+			fixturePath := tmpDir.Join(fs.MustRelPath("fixture"))
+			PlaceFixture(osfs.New(fixturePath), fixture)
+			wareID, err := pack(
+				context.Background(),
+				packType,
+				fixturePath.String(),
+				api.FilesetPackFilter_Lossless,
+				warehouseAddr,
+				rio.Monitor{},
+			)
+			So(err, ShouldBeNil)
+
+			// Unpack with copy placement, so we'd notice if the cache got involved.
+			before := time.Now().Truncate(time.Second)
+			unpackPath := tmpDir.Join(fs.MustRelPath("unpack"))
+			wareID2, err := unpack(
+				context.Background(),
+				wareID,
+				unpackPath.String(),
+				api.MustParseFilesetUnpackFilter("mtime=now").Apply(api.FilesetUnpackFilter_Lossless),
+				rio.Placement_Copy,
+				[]api.WarehouseLocation{warehouseAddr},
+				rio.Monitor{},
+			)
+			So(err, ShouldBeNil)
+			after := time.Now()
+			So(wareID2, ShouldNotResemble, wareID)
+
+			Convey("every file and dir should have the same, current mtime", FailureContinues, func() {
+				afs := osfs.New(unpackPath)
+				var mtime time.Time
+				for _, file := range fixture {
+					fmeta, _, err := fsOp.ScanFile(afs, file.Metadata.Name)
+					So(err, ShouldBeNil)
+					if file.Metadata.Type == fs.Type_Symlink {
+						continue // Symlink mtimes are not reliably settable on all platforms.
+					}
+					if mtime.IsZero() {
+						mtime = fmeta.Mtime
+					}
+					So(fmeta.Mtime, ShouldHappenOnOrBetween, before, after)
+					So(fmeta.Mtime.UTC(), ShouldResemble, mtime.UTC())
+				}
+			})
+			Convey("the altered fileset should not be cached under the original ware's shelf", func() {
+				_, err := os.Stat(config.GetCacheBasePath().Join(cache.ShelfFor(wareID)).String())
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+			Convey("nothing should be cached at all, however it's placed", func() {
+				_, err := unpack(
+					context.Background(),
+					wareID,
+					tmpDir.Join(fs.MustRelPath("unpack2")).String(),
+					api.MustParseFilesetUnpackFilter("mtime=now").Apply(api.FilesetUnpackFilter_Lossless),
+					rio.Placement_None,
+					[]api.WarehouseLocation{warehouseAddr},
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+				_, err = os.Stat(config.GetCacheBasePath().Join(fs.MustRelPath(string(packType))).String())
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func CheckUnpackSubpath(packType api.PackType, pack rio.PackFunc, unpack rio.UnpackFunc, warehouseAddr api.WarehouseLocation) {
+	Convey("SPEC: Unpack with a subpath should place only that subtree...", func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			os.Setenv("RIO_BASE", tmpDir.Join(fs.MustRelPath("rio-base")).String())
+
+			fixture := FixtureGamma
+			fixturePath := tmpDir.Join(fs.MustRelPath("fixture"))
+			PlaceFixture(osfs.New(fixturePath), fixture)
+			wareID, err := pack(
+				context.Background(),
+				packType,
+				fixturePath.String(),
+				api.FilesetPackFilter_Lossless,
+				warehouseAddr,
+				rio.Monitor{},
+			)
+			So(err, ShouldBeNil)
+
+			unpackSubpath := func(subpath string, placementMode rio.PlacementMode, target string) (api.WareID, error) {
+				return unpack(
+					filters.WithUnpackSubpath(context.Background(), fs.MustRelPath(subpath)),
+					wareID,
+					tmpDir.Join(fs.MustRelPath(target)).String(),
+					api.FilesetUnpackFilter_Lossless,
+					placementMode,
+					[]api.WarehouseLocation{warehouseAddr},
+					rio.Monitor{},
+				)
+			}
+			// Each fixture entry within the subpath should be found at the target, rebased; nothing else should.
+			checkSubtree := func(subpath string, target string) {
+				afs := osfs.New(tmpDir.Join(fs.MustRelPath(target)))
+				var expect []fs.RelPath
+				for _, file := range fixture {
+					name, err := filepath.Rel(subpath, file.Metadata.Name.String())
+					if err != nil || strings.HasPrefix(name, "..") {
+						continue
+					}
+					expect = append(expect, fs.MustRelPath(name))
+					fmeta, reader, err := fsOp.ScanFile(afs, fs.MustRelPath(name))
+					So(err, ShouldBeNil)
+					fmeta.Mtime = fmeta.Mtime.UTC()
+					expectFmeta := file.Metadata
+					expectFmeta.Name = fs.MustRelPath(name)
+					So(*fmeta, ShouldResemble, expectFmeta)
+					if file.Metadata.Type == fs.Type_File {
+						body, _ := ioutil.ReadAll(reader)
+						So(string(body), ShouldResemble, string(file.Body))
+					}
+				}
+				var found []fs.RelPath
+				So(fs.Walk(afs, func(filenode *fs.FilewalkNode) error {
+					found = append(found, filenode.Info.Name)
+					return filenode.Err
+				}, nil), ShouldBeNil)
+				So(found, ShouldResemble, expect)
+			}
+
+			Convey("streaming straight to the target", FailureContinues, func() {
+				wareID2, err := unpackSubpath("etc/init", rio.Placement_Direct, "direct")
+				So(err, ShouldBeNil)
+				So(wareID2, ShouldResemble, wareID)
+				checkSubtree("etc/init", "direct")
+
+				_, err = unpackSubpath("etc/trick", rio.Placement_Direct, "direct-file")
+				So(err, ShouldBeNil)
+				checkSubtree("etc/trick", "direct-file")
+			})
+			Convey("placing from a populated cache", FailureContinues, func() {
+				_, err := unpackSubpath(".", rio.Placement_None, "none")
+				So(err, ShouldBeNil)
+				wareID2, err := unpackSubpath("etc/init", rio.Placement_Copy, "copy")
+				So(err, ShouldBeNil)
+				So(wareID2, ShouldResemble, wareID)
+				checkSubtree("etc/init", "copy")
+
+				_, err = unpackSubpath("etc/trick", rio.Placement_Copy, "copy-file")
+				So(err, ShouldBeNil)
+				checkSubtree("etc/trick", "copy-file")
+			})
+			Convey("a subpath not in the ware should be an error", func() {
+				_, err := unpackSubpath("etc/nope", rio.Placement_Direct, "direct")
+				So(err, ShouldNotBeNil)
+				So(errcat.Category(err), ShouldEqual, rio.ErrUsage)
+				_, err = unpackSubpath("etc/nope", rio.Placement_Copy, "copy")
+				So(err, ShouldNotBeNil)
+				So(errcat.Category(err), ShouldEqual, rio.ErrUsage)
+			})
+		})
+	})
+}
+
+func CheckIDMap(packType api.PackType, pack rio.PackFunc, unpack rio.UnpackFunc, warehouseAddr api.WarehouseLocation) {
+	Convey("SPEC: Unpack and pack with uid/gid remapping should round-trip...", func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			os.Setenv("RIO_BASE", tmpDir.Join(fs.MustRelPath("rio-base")).String())
+
+			fixture := FixtureAlphaDiffUidGid
+			fixturePath := tmpDir.Join(fs.MustRelPath("fixture"))
+			PlaceFixture(osfs.New(fixturePath), fixture)
+			wareID, err := pack(
+				context.Background(),
+				packType,
+				fixturePath.String(),
+				api.FilesetPackFilter_Lossless,
+				warehouseAddr,
+				rio.Monitor{},
+			)
+			So(err, ShouldBeNil)
+
+			idmap, err := filters.ParseIDMap([]string{"0:100000:65536"}, []string{"0:200000:1000"})
+			So(err, ShouldBeNil)
+			ctx := filters.WithIDMap(context.Background(), idmap)
+			unpackMapped := func(placementMode rio.PlacementMode, target string) (api.WareID, error) {
+				return unpack(
+					ctx,
+					wareID,
+					tmpDir.Join(fs.MustRelPath(target)).String(),
+					api.FilesetUnpackFilter_Lossless,
+					placementMode,
+					[]api.WarehouseLocation{warehouseAddr},
+					rio.Monitor{},
+				)
+			}
+			checkMapped := func(target string) {
+				afs := osfs.New(tmpDir.Join(fs.MustRelPath(target)))
+				fmeta, err := afs.LStat(fs.MustRelPath("."))
+				So(err, ShouldBeNil)
+				So(fmeta.Uid, ShouldEqual, 100000)
+				So(fmeta.Gid, ShouldEqual, 200000)
+				fmeta, err = afs.LStat(fs.MustRelPath("a"))
+				So(err, ShouldBeNil)
+				So(fmeta.Uid, ShouldEqual, 100444)
+				So(fmeta.Gid, ShouldEqual, 200444)
+			}
+
+			Convey("unpacking should map ware ids to host ids", func() {
+				wareID2, err := unpackMapped(rio.Placement_Direct, "unpack")
+				So(err, ShouldBeNil)
+				So(wareID2, ShouldNotResemble, wareID)
+				checkMapped("unpack")
+
+				Convey("and packing with the same map should reproduce the original ware", func() {
+					wareID3, err := pack(
+						ctx,
+						packType,
+						tmpDir.Join(fs.MustRelPath("unpack")).String(),
+						api.FilesetPackFilter_Lossless,
+						"",
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					So(wareID3, ShouldResemble, wareID)
+				})
+				Convey("but packing without the map should not", func() {
+					wareID3, err := pack(
+						context.Background(),
+						packType,
+						tmpDir.Join(fs.MustRelPath("unpack")).String(),
+						api.FilesetPackFilter_Lossless,
+						"",
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					So(wareID3, ShouldNotResemble, wareID)
+				})
+			})
+			Convey("unpacking should not be served an unmapped shelf from the cache", func() {
+				_, err := unpack(
+					context.Background(),
+					wareID,
+					tmpDir.Join(fs.MustRelPath("none")).String(),
+					api.FilesetUnpackFilter_Lossless,
+					rio.Placement_None,
+					[]api.WarehouseLocation{warehouseAddr},
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+				_, err = unpackMapped(rio.Placement_Copy, "copy")
+				So(err, ShouldBeNil)
+				checkMapped("copy")
+			})
+			Convey("ids not covered by the map should be rejected", func() {
+				idmap, err := filters.ParseIDMap([]string{"0:100000:100"}, nil)
+				So(err, ShouldBeNil)
+				_, err = unpack(
+					filters.WithIDMap(context.Background(), idmap),
+					wareID,
+					tmpDir.Join(fs.MustRelPath("rejected")).String(),
+					api.FilesetUnpackFilter_Lossless,
+					rio.Placement_Direct,
+					[]api.WarehouseLocation{warehouseAddr},
+					rio.Monitor{},
+				)
+				So(errcat.Category(err), ShouldEqual, rio.ErrFilterRejection)
+			})
+		})
+	})
+}
+
+func CheckHashAlgorithms(packType api.PackType, pack rio.PackFunc, unpack rio.UnpackFunc, warehouseAddr api.WarehouseLocation) {
+	Convey("SPEC: Each hash algorithm should round-trip, and be detected from the WareID", func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			fixturePath := tmpDir.Join(fs.MustRelPath("fixture"))
+			PlaceFixture(osfs.New(fixturePath), FixtureDepth1)
+			wareIDs := map[api.WareID]fshash.Algorithm{}
+			for _, alg := range fshash.Algorithms {
+				wareID, err := pack(
+					fshash.WithAlgorithm(context.Background(), alg),
+					packType,
+					fixturePath.String(),
+					api.FilesetPackFilter_Lossless,
+					warehouseAddr,
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+				detected, err := fshash.AlgorithmOfWareHash(wareID.Hash)
+				So(err, ShouldBeNil)
+				So(detected, ShouldEqual, alg)
+				wareIDs[wareID] = alg
+
+				// Unpack with no mention of the algorithm.
+				unpackPath := tmpDir.Join(fs.MustRelPath("unpack-" + string(alg)))
+				wareID2, err := unpack(
+					context.Background(),
+					wareID,
+					unpackPath.String(),
+					api.FilesetUnpackFilter_Lossless,
+					rio.Placement_Direct,
+					[]api.WarehouseLocation{warehouseAddr},
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+				So(wareID2, ShouldResemble, wareID)
+			}
+			So(wareIDs, ShouldHaveLength, len(fshash.Algorithms))
+		})
+	})
+}
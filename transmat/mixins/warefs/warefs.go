@@ -0,0 +1,320 @@
+/*
+	warefs is a read-only filesystem over the contents of a packed ware,
+	read in place rather than unpacked.
+
+	A transmat indexes the ware in one pass, calling Add for each entry.
+	After that, every file body is read straight out of the packed ware:
+	by offset where the format allows it (an uncompressed tar; a stored zip
+	entry), and by streaming from the start of the entry where it doesn't
+	(a deflated zip entry).
+
+	The tree itself -- and so all the metadata, and symlink resolution --
+	is kept in a memfs; warefs keeps only where each file's body lies.
+	It also keeps the records of the entries, as unpacking would hash them,
+	so the ware can be checked against its hash before it's handed out.
+*/
+package warefs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/memfs"
+	"github.com/polydawn/rio/fsOp"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+)
+
+/*
+	Body says where to read a file's contents from.
+
+	If ReaderAt is set, it's read from directly, and must hold exactly Size
+	bytes.  Otherwise, Open is called to stream the body from its start;
+	and called again whenever a read goes backwards.
+
+	Hash is the hash of the contents, as read while indexing.
+*/
+type Body struct {
+	Size     int64
+	ReaderAt io.ReaderAt
+	Open     func() (io.ReadCloser, error)
+	Hash     []byte
+}
+
+/*
+	Returns a new, empty FS: just a root dir, with defaulted metadata
+	until the ware says otherwise.
+
+	The closer is called by Close; it's for releasing whatever the bodies
+	are read from (e.g. the buffered ware).
+*/
+func New(closer io.Closer) *FS {
+	afs := &FS{
+		mem:     memfs.New(),
+		bodies:  map[fs.RelPath]Body{},
+		closer:  closer,
+		records: &fshash.DiskBucket{},
+		dirs:    map[fs.RelPath]struct{}{},
+	}
+	root := fshash.DefaultDirMetadata()
+	fsOp.PlaceFile(afs.mem, root, nil, false) // can't fail; it's all in memory.
+	return afs
+}
+
+type FS struct {
+	mem     *memfs.FS
+	bodies  map[fs.RelPath]Body // only written by Add; so only while indexing.
+	closer  io.Closer
+	records *fshash.DiskBucket      // every entry added, as unpack would record it.
+	handed  bool                    // set once Records has handed the records over; Close leaves them be.
+	dirs    map[fs.RelPath]struct{} // dirs recorded, added or inferred.
+}
+
+var _ fs.FS = &FS{}
+
+/*
+	Adds an entry of the ware to the FS, as an unpack would place it.
+	Missing parent dirs are inferred, with defaulted metadata, as unpack
+	does.  The body is required for files, and ignored for anything else.
+
+	Hardlinks become files sharing the body of their target, which must
+	have been added already.
+
+	Add isn't safe to call concurrently with anything, and the errors
+	it returns are all ErrWareCorrupt: the ware was unfit to unpack.
+*/
+func (afs *FS) Add(fmeta fs.Metadata, body *Body) error {
+	if fmeta.Type == fs.Type_File && body == nil {
+		panic("warefs: file added without a body")
+	}
+	afs.record(fmeta, body)
+	for _, parent := range fmeta.Name.SplitParent() {
+		if _, err := afs.mem.LStat(parent); err == nil {
+			continue
+		}
+		conjuredFmeta := fshash.DefaultDirMetadata()
+		conjuredFmeta.Name = parent
+		if err := afs.place(conjuredFmeta); err != nil {
+			return err
+		}
+	}
+	if fmeta.Type == fs.Type_Hardlink {
+		if strings.HasPrefix(fmeta.Linkname, "/") {
+			return Errorf(rio.ErrWareCorrupt, "corrupt ware: hardlink %q points outside the ware", fmeta.Name)
+		}
+		target, ok := afs.bodies[fs.MustRelPath(fmeta.Linkname)]
+		if !ok {
+			return Errorf(rio.ErrWareCorrupt, "corrupt ware: hardlink %q points to %q, which isn't a file before it", fmeta.Name, fmeta.Linkname)
+		}
+		fmeta.Type = fs.Type_File
+		fmeta.Linkname = ""
+		fmeta.Size = target.Size
+		body = &target
+	}
+	if err := afs.place(fmeta); err != nil {
+		return err
+	}
+	if fmeta.Type == fs.Type_File {
+		afs.bodies[fmeta.Name] = *body
+	}
+	return nil
+}
+
+/*
+	Records an entry just as unpack does: any parents not yet seen are
+	inferred first, and a dir which was inferred is updated, not repeated.
+*/
+func (afs *FS) record(fmeta fs.Metadata, body *Body) {
+	for _, parent := range fmeta.Name.SplitParent() {
+		if _, exists := afs.dirs[parent]; exists {
+			continue
+		}
+		conjuredFmeta := fshash.DefaultDirMetadata()
+		conjuredFmeta.Name = parent
+		afs.records.AddRecord(conjuredFmeta, nil)
+		afs.dirs[parent] = struct{}{}
+	}
+	var contentHash []byte
+	if fmeta.Type == fs.Type_File {
+		contentHash = body.Hash
+	}
+	switch {
+	case fmeta.Type == fs.Type_Dir && afs.records.HasRecord(fmeta):
+		afs.records.UpdateRecord(fmeta, nil)
+	default:
+		afs.records.AddRecord(fmeta, contentHash)
+	}
+	if fmeta.Type == fs.Type_Dir {
+		afs.dirs[fmeta.Name] = struct{}{}
+	}
+}
+
+/*
+	Returns the records of every entry added, as unpacking the ware would
+	record them: so, the records the ware's hash is the hash of.
+
+	The bucket is handed over: Close won't close it after this, so the
+	caller must, once done with it.
+*/
+func (afs *FS) Records() fshash.Bucket {
+	afs.handed = true
+	return afs.records
+}
+
+/*
+	Returns the hash of the records, in the form of a WareID's hash:
+	which is the ware's hash, if the ware was what it claimed to be.
+	Call only once done adding.
+*/
+func (afs *FS) WareHash(alg fshash.Algorithm) (_ string, err error) {
+	defer func() {
+		// Duplicate entries can't be hashed; the ware's no good.
+		if rec := recover(); rec != nil {
+			if e, ok := rec.(fshash.ErrInvalidFilesystem); ok {
+				err = Errorf(rio.ErrWareCorrupt, "corrupt ware: %s", e)
+				return
+			}
+			panic(rec)
+		}
+	}()
+	return alg.WareHash(fshash.HashBucket(afs.records, alg.New)), nil
+}
+
+func (afs *FS) place(fmeta fs.Metadata) error {
+	// Placing a node updates its parent's mtime; which we then put back.
+	parent, err := afs.mem.LStat(fmeta.Name.Dir())
+	if err != nil {
+		return Errorf(rio.ErrWareCorrupt, "corrupt ware: %s", err)
+	}
+	var body io.Reader
+	if fmeta.Type == fs.Type_File {
+		body = bytes.NewReader(nil)
+	}
+	if err := fsOp.PlaceFile(afs.mem, fmeta, body, false); err != nil {
+		return Errorf(rio.ErrWareCorrupt, "corrupt ware: %s", err)
+	}
+	if fmeta.Name != (fs.RelPath{}) {
+		afs.mem.SetTimesLNano(fmeta.Name.Dir(), parent.Mtime, fs.DefaultTime)
+	}
+	return nil
+}
+
+/*
+	Releases whatever the bodies are read from, and the records (unless
+	Records has handed them over).
+	Files still open will fail to read after this.
+*/
+func (afs *FS) Close() error {
+	if !afs.handed {
+		afs.records.Close()
+	}
+	if afs.closer == nil {
+		return nil
+	}
+	return afs.closer.Close()
+}
+
+func (afs *FS) BasePath() fs.AbsolutePath {
+	return afs.mem.BasePath()
+}
+
+func (afs *FS) OpenFile(path fs.RelPath, flag int, perms fs.Perms) (fs.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, readOnly("open", path)
+	}
+	rpath, err := afs.mem.Resolve(path, true)
+	if err != nil {
+		return nil, err
+	}
+	fmeta, err := afs.mem.LStat(rpath)
+	if err != nil {
+		return nil, err
+	}
+	if fmeta.Type != fs.Type_File {
+		return nil, Errorf(fs.ErrMisc, "open %s: not a regular file (a %s)", rpath, fmeta.Type)
+	}
+	return &file{name: rpath, body: afs.bodies[rpath]}, nil
+}
+
+func (afs *FS) Mkdir(path fs.RelPath, perms fs.Perms) error {
+	return readOnly("mkdir", path)
+}
+
+func (afs *FS) Mklink(path fs.RelPath, target string) error {
+	return readOnly("symlink", path)
+}
+
+func (afs *FS) Mkfifo(path fs.RelPath, perms fs.Perms) error {
+	return readOnly("mkfifo", path)
+}
+
+func (afs *FS) MkdevBlock(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
+	return readOnly("mknod", path)
+}
+
+func (afs *FS) MkdevChar(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
+	return readOnly("mknod", path)
+}
+
+func (afs *FS) Lchown(path fs.RelPath, uid uint32, gid uint32) error {
+	return readOnly("lchown", path)
+}
+
+func (afs *FS) Chmod(path fs.RelPath, perms fs.Perms) error {
+	return readOnly("chmod", path)
+}
+
+func (afs *FS) SetTimesLNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
+	return readOnly("utimes", path)
+}
+
+func (afs *FS) SetTimesNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
+	return readOnly("utimes", path)
+}
+
+func readOnly(op string, path fs.RelPath) error {
+	return Errorf(fs.ErrPermission, "%s %s: read-only file system", op, path)
+}
+
+func (afs *FS) Stat(path fs.RelPath) (*fs.Metadata, error) {
+	return afs.stat(path, true)
+}
+
+func (afs *FS) LStat(path fs.RelPath) (*fs.Metadata, error) {
+	return afs.stat(path, false)
+}
+
+// Stats in the memfs, which has the metadata right, except for the size of files.
+func (afs *FS) stat(path fs.RelPath, resolveLast bool) (*fs.Metadata, error) {
+	rpath, err := afs.mem.Resolve(path, resolveLast)
+	if err != nil {
+		return nil, err
+	}
+	fmeta, err := afs.mem.LStat(rpath)
+	if err != nil {
+		return nil, err
+	}
+	fmeta.Name = path
+	if fmeta.Type == fs.Type_File {
+		fmeta.Size = afs.bodies[rpath].Size
+	}
+	return fmeta, nil
+}
+
+func (afs *FS) ReadDirNames(path fs.RelPath) ([]string, error) {
+	return afs.mem.ReadDirNames(path)
+}
+
+func (afs *FS) Readlink(path fs.RelPath) (string, bool, error) {
+	return afs.mem.Readlink(path)
+}
+
+func (afs *FS) ResolveLink(symlink string, startingAt fs.RelPath) (fs.RelPath, error) {
+	return afs.mem.ResolveLink(symlink, startingAt)
+}
@@ -0,0 +1,138 @@
+package warefs
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	. "github.com/warpfork/go-errcat"
+
+	"github.com/polydawn/rio/fs"
+)
+
+var _ fs.File = &file{}
+
+// An open file.  Always read-only.  If its body can only be streamed,
+//  it keeps the stream open between reads, so reading along is cheap;
+//  but reading anywhere behind the stream means starting it over.
+type file struct {
+	mu     sync.Mutex
+	name   fs.RelPath
+	body   Body
+	off    int64         // where Read and Seek are at.
+	stream io.ReadCloser // if streaming: the open stream, if any...
+	sOff   int64         // ... and how far into it we are.
+	closed bool
+}
+
+func (f *file) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return Errorf(fs.ErrMisc, "close %s: %s", f.name, os.ErrClosed)
+	}
+	f.closed = true
+	if f.stream != nil {
+		return f.stream.Close()
+	}
+	return nil
+}
+
+func (f *file) Read(bs []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.readAt(bs, f.off)
+	f.off += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil // the next read can say so.
+	}
+	return n, err
+}
+
+func (f *file) ReadAt(bs []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.readAt(bs, off)
+}
+
+// Reads like ReadAt: if it returns short, it's with an error (io.EOF if at the end).
+func (f *file) readAt(bs []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, Errorf(fs.ErrMisc, "read %s: %s", f.name, os.ErrClosed)
+	}
+	if off < 0 {
+		return 0, Errorf(fs.ErrMisc, "read %s: negative offset", f.name)
+	}
+	if off >= f.body.Size {
+		return 0, io.EOF
+	}
+	want := bs
+	if remaining := f.body.Size - off; int64(len(want)) > remaining {
+		want = want[:remaining]
+	}
+	var n int
+	var err error
+	if f.body.ReaderAt != nil {
+		n, err = f.body.ReaderAt.ReadAt(want, off)
+	} else {
+		n, err = f.streamAt(want, off)
+	}
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return n, Errorf(fs.ErrUnexpectedEOF, "read %s: body shorter than its size of %d", f.name, f.body.Size)
+	case err != nil:
+		return n, err
+	case n < len(bs):
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *file) streamAt(bs []byte, off int64) (int, error) {
+	if f.stream == nil || off < f.sOff {
+		if f.stream != nil {
+			f.stream.Close()
+			f.stream = nil
+		}
+		stream, err := f.body.Open()
+		if err != nil {
+			return 0, err
+		}
+		f.stream, f.sOff = stream, 0
+	}
+	skipped, err := io.CopyN(io.Discard, f.stream, off-f.sOff)
+	f.sOff += skipped
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(f.stream, bs)
+	f.sOff += int64(n)
+	return n, err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, Errorf(fs.ErrMisc, "seek %s: %s", f.name, os.ErrClosed)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.body.Size
+	}
+	if offset < 0 {
+		return 0, Errorf(fs.ErrMisc, "seek %s: invalid argument", f.name)
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *file) Write(bs []byte) (int, error) {
+	return 0, Errorf(fs.ErrMisc, "write %s: bad file descriptor", f.name)
+}
+
+func (f *file) WriteAt(bs []byte, off int64) (int, error) {
+	return 0, Errorf(fs.ErrMisc, "write %s: bad file descriptor", f.name)
+}
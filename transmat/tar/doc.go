@@ -13,7 +13,12 @@ import (
 const PackType = api.PackType("tar")
 
 var (
-	Mirror rio.MirrorFunc = util.CreateMirror(unpackTar)
-	Scan   rio.ScanFunc   = util.CreateScanner(PackType, unpackTar)
-	Unpack rio.UnpackFunc = util.CreateUnpack(PackType, unpackTar)
+	Cat         util.CatFunc         = util.CreateCatter(PackType, unpackTar, OpenFS)
+	List        util.ListFunc        = util.CreateLister(OpenFS)
+	Mirror      rio.MirrorFunc       = util.CreateMirror(unpackTar)
+	OpenFS      util.OpenFSFunc      = util.CreateFSOpener(PackType, indexTar)
+	Scan        rio.ScanFunc         = util.CreateScanner(PackType, unpackTar)
+	ScanRecords util.ScanRecordsFunc = util.CreateRecordsScanner(PackType, unpackTar)
+	Unpack      rio.UnpackFunc       = util.CreateUnpack(PackType, unpackTar)
+	Walk        util.WalkFunc        = util.CreateWalker(PackType, unpackTar)
 )
@@ -0,0 +1,56 @@
+package tartrans
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/testutil"
+	"github.com/polydawn/rio/transmat/mixins/tests"
+)
+
+func TestTarConvert(t *testing.T) {
+	Convey("Spec compliance: Tar convert", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			tests.CheckConvertRoundTrip(PackType, Pack, func(ctx context.Context, wareID api.WareID, warehouses []api.WarehouseLocation, target api.WarehouseLocation, mon rio.Monitor) (api.WareID, error) {
+				return Convert(ctx, wareID, Walk, warehouses, target, mon)
+			}, packInOrder)
+		}),
+	)
+}
+
+// Packs the files given, in just the order given, to a tar at the path.
+func packInOrder(path string, files []tests.FixtureFile) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gzWriter, tarWriter := newTarWriter(f)
+	walk := func(ctx context.Context, put func(*fs.Metadata, io.ReadCloser) error) error {
+		for _, file := range files {
+			fmeta := file.Metadata
+			var body io.ReadCloser
+			if fmeta.Type == fs.Type_File {
+				body = ioutil.NopCloser(bytes.NewReader(file.Body))
+			}
+			if err := put(&fmeta, body); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if _, _, err := packTar(context.Background(), walk, nil, tarWriter); err != nil {
+		return err
+	}
+	tarWriter.Close()
+	return gzWriter.Close()
+}
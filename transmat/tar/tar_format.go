@@ -3,6 +3,7 @@ package tartrans
 import (
 	"archive/tar"
 	"fmt"
+	"math"
 
 	"github.com/polydawn/go-timeless-api/rio"
 	"github.com/polydawn/rio/fs"
@@ -10,7 +11,10 @@ import (
 )
 
 // Mutate tar.Header fields to match the given fmeta.
+// The header is reset first: nothing but the fmeta goes into it (no host
+// user names, no atimes, etc), so the same fmeta always yields the same bytes.
 func MetadataToTarHdr(fmeta *fs.Metadata, hdr *tar.Header) {
+	*hdr = tar.Header{}
 	hdr.Name = fmeta.Name.String()
 	if fmeta.Type == fs.Type_Dir {
 		hdr.Name += "/"
@@ -63,6 +67,12 @@ func TarHdrToMetadata(hdr *tar.Header, fmeta *fs.Metadata) (skipMe error, haltMe
 		return nil, Errorf(rio.ErrWareCorrupt, "corrupt tar: %q is not a known file type", hdr.Typeflag)
 	}
 	fmeta.Perms = fs.Perms(hdr.Mode & 07777)
+	if hdr.Uid < 0 || int64(hdr.Uid) > math.MaxUint32 {
+		return nil, Errorf(rio.ErrWareCorrupt, "corrupt tar: %q has uid %d, which is out of range", hdr.Name, hdr.Uid)
+	}
+	if hdr.Gid < 0 || int64(hdr.Gid) > math.MaxUint32 {
+		return nil, Errorf(rio.ErrWareCorrupt, "corrupt tar: %q has gid %d, which is out of range", hdr.Name, hdr.Gid)
+	}
 	fmeta.Uid = uint32(hdr.Uid)
 	fmeta.Gid = uint32(hdr.Gid)
 	fmeta.Size = hdr.Size
@@ -78,6 +88,8 @@ func tarTypeToFsType(tarType byte) (_ fs.Type, skipMe error) {
 	switch tarType {
 	case tar.TypeReg, tar.TypeRegA:
 		return fs.Type_File, nil
+	case tar.TypeGNUSparse: // archive/tar reads these as regular files; only the type is left.
+		return fs.Type_File, nil
 	case tar.TypeLink:
 		return fs.Type_Hardlink, nil
 	case tar.TypeSymlink:
@@ -0,0 +1,114 @@
+package tartrans
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/osfs"
+	"github.com/polydawn/rio/testutil"
+	"github.com/polydawn/rio/transmat/mixins/tests"
+)
+
+func TestTarFormats(t *testing.T) {
+	longName := "./" + strings.Repeat("d", 120) + "/" + strings.Repeat("e", 120) + "/" + strings.Repeat("f", 90)
+	mtime := time.Date(2004, 10, 14, 4, 3, 2, 0, time.UTC)
+	fixture := []tests.FixtureFile{
+		{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: mtime}, nil},
+		{fs.Metadata{Name: fs.MustRelPath("./" + strings.Repeat("d", 120)), Type: fs.Type_Dir, Perms: 0755, Mtime: mtime}, nil},
+		{fs.Metadata{Name: fs.MustRelPath("./" + strings.Repeat("d", 120) + "/" + strings.Repeat("e", 120)), Type: fs.Type_Dir, Perms: 0755, Mtime: mtime}, nil},
+		{fs.Metadata{Name: fs.MustRelPath(longName), Type: fs.Type_File, Perms: 0644, Mtime: mtime, Size: 3, Uid: 3000000, Gid: 4000000000}, []byte("zyx")},
+	}
+	Convey("Tar header formats", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				fixturePath := tmpDir.Join(fs.MustRelPath("fixture"))
+				tests.PlaceFixture(osfs.New(fixturePath), fixture)
+				packAs := func(format Format) (api.WareID, api.WarehouseLocation, error) {
+					warehouseAddr := api.WarehouseLocation("file://" + tmpDir.Join(fs.MustRelPath(string(format)+".tgz")).String())
+					wareID, err := Pack(
+						WithFormat(context.Background(), format),
+						PackType,
+						fixturePath.String(),
+						api.FilesetPackFilter_Lossless,
+						warehouseAddr,
+						rio.Monitor{},
+					)
+					return wareID, warehouseAddr, err
+				}
+				// Returns the format of the long-named entry, as archive/tar reads it.
+				formatOf := func(warehouseAddr api.WarehouseLocation) tar.Format {
+					f, err := os.Open(strings.TrimPrefix(string(warehouseAddr), "file://"))
+					So(err, ShouldBeNil)
+					defer f.Close()
+					gz, err := gzip.NewReader(f)
+					So(err, ShouldBeNil)
+					tr := tar.NewReader(gz)
+					for {
+						hdr, err := tr.Next()
+						if err == io.EOF {
+							return tar.FormatUnknown
+						}
+						So(err, ShouldBeNil)
+						if hdr.Name == longName {
+							So(hdr.Uid, ShouldEqual, 3000000)
+							So(hdr.Gid, ShouldEqual, 4000000000)
+							return hdr.Format
+						}
+					}
+				}
+
+				wareID, _, err := packAs(Format_Auto)
+				So(err, ShouldBeNil)
+				for _, tr := range []struct {
+					format Format
+					result tar.Format
+				}{
+					{Format_Auto, tar.FormatPAX},
+					{Format_PAX, tar.FormatPAX},
+					{Format_GNU, tar.FormatGNU},
+				} {
+					Convey("Format "+string(tr.format)+" holds long paths and large ids, with the same WareID", func() {
+						wareID2, warehouseAddr, err := packAs(tr.format)
+						So(err, ShouldBeNil)
+						So(wareID2, ShouldResemble, wareID)
+						So(formatOf(warehouseAddr), ShouldEqual, tr.result)
+
+						wareID3, err := Scan(
+							context.Background(),
+							PackType,
+							api.FilesetUnpackFilter_Lossless,
+							rio.Placement_Direct,
+							warehouseAddr,
+							rio.Monitor{},
+						)
+						So(err, ShouldBeNil)
+						So(wareID3, ShouldResemble, wareID)
+					})
+				}
+				Convey("Format ustar rejects what USTAR can't hold", func() {
+					_, _, err := packAs(Format_USTAR)
+					So(Category(err), ShouldEqual, rio.ErrPackInvalid)
+				})
+			})
+		}),
+	)
+
+	Convey("Tar headers with ids out of range are rejected", t, func() {
+		_, haltMe := TarHdrToMetadata(&tar.Header{Name: "./a", Typeflag: tar.TypeReg, Uid: -1}, &fs.Metadata{})
+		So(Category(haltMe), ShouldEqual, rio.ErrWareCorrupt)
+		_, haltMe = TarHdrToMetadata(&tar.Header{Name: "./a", Typeflag: tar.TypeReg, Gid: 1 << 40}, &fs.Metadata{})
+		So(Category(haltMe), ShouldEqual, rio.ErrWareCorrupt)
+	})
+}
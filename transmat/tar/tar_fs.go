@@ -0,0 +1,149 @@
+package tartrans
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/transmat/mixins/buffer"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+	"github.com/polydawn/rio/transmat/mixins/limits"
+	"github.com/polydawn/rio/transmat/mixins/warefs"
+	"github.com/polydawn/rio/transmat/util"
+)
+
+/*
+	Indexes a tar into a warefs.FS, in one pass over it; and returns the
+	WareID of what was indexed, as unpacking it would.
+
+	The tar is buffered *decompressed* as it's read, so that every body is
+	at a fixed offset in the buffer, and can be read from there directly.
+	(Except sparse files: only a tar reader knows where their holes go,
+	so those are read by finding their header again.)  Every body is read
+	through (and hashed) as it's buffered, so the limits are enforced as
+	they would be by unpacking it.
+*/
+func indexTar(
+	ctx context.Context,
+	wareID api.WareID,
+	reader io.Reader,
+	mon rio.Monitor,
+) (_ *warefs.FS, prefilterWareID api.WareID, err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Hash with the algorithm the ware's hash says it was made with.
+	alg, err := fshash.AlgorithmForWare(ctx, wareID.Hash)
+	if err != nil {
+		return nil, api.WareID{}, Errorf(rio.ErrUsage, "%s", err)
+	}
+
+	// Count everything against the limits, if any.
+	tracker := limits.NewTracker(ctx)
+
+	// Decompress (autodetecting how, as unpack does), and buffer that.
+	reader2, err := Decompress(tracker.Ware(reader))
+	if err != nil {
+		return nil, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar compression: %s", err)
+	}
+	spool, err := buffer.NewSpool(wareID, reader2)
+	if err != nil {
+		return nil, api.WareID{}, err
+	}
+	wfs := warefs.New(spool)
+	defer func() {
+		if err != nil {
+			wfs.Close()
+		}
+	}()
+	readErr := func(err error) error {
+		if err := tracker.Err(); err != nil {
+			return err
+		}
+		if err := spool.Err(); err != nil {
+			return err
+		}
+		return Errorf(rio.ErrWareCorrupt, "corrupt tar: %s", err)
+	}
+
+	// Read the tar.  The tar reader reads exactly up to each body before
+	//  returning its header; so that's where the body starts in the buffer.
+	tr := tar.NewReader(spool)
+	for i := 0; ; i++ {
+		thdr, err := tr.Next()
+		if err == io.EOF {
+			break // sucess!  end of archive.
+		}
+		if err != nil {
+			return nil, api.WareID{}, readErr(err)
+		}
+		if ctx.Err() != nil {
+			return nil, api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+		}
+
+		// Reshuffle metainfo to our default format.
+		fmeta := fs.Metadata{}
+		skipMe, haltMe := TarHdrToMetadata(thdr, &fmeta)
+		if skipMe != nil {
+			continue // unpack warns about these; but they're nothing we could show.
+		}
+		if haltMe != nil {
+			return nil, api.WareID{}, haltMe
+		}
+		if strings.HasPrefix(fmeta.Name.String(), "..") {
+			return nil, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar: paths that use '../' to leave the base dir are invalid")
+		}
+		if err := tracker.Entry(&fmeta); err != nil {
+			return nil, api.WareID{}, err
+		}
+
+		// Add it, noting where to find the body.
+		if fmeta.Type != fs.Type_File {
+			if err := wfs.Add(fmeta, nil); err != nil {
+				return nil, api.WareID{}, err
+			}
+			continue
+		}
+		body := warefs.Body{Size: fmeta.Size}
+		if isSparse(thdr) {
+			i := i
+			body.Open = func() (io.ReadCloser, error) {
+				return openTarEntry(io.NewSectionReader(spool, 0, spool.Offset()), i)
+			}
+		} else {
+			body.ReaderAt = io.NewSectionReader(spool, spool.Offset(), fmeta.Size)
+		}
+		reader := &util.HashingReader{tracker.Body(&fmeta, tr), alg.New()}
+		if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+			return nil, api.WareID{}, readErr(err)
+		}
+		body.Hash = reader.Hasher.Sum(nil)
+		if err := wfs.Add(fmeta, &body); err != nil {
+			return nil, api.WareID{}, err
+		}
+	}
+
+	// Hash the thing!
+	hash, err := wfs.WareHash(alg)
+	if err != nil {
+		return nil, api.WareID{}, err
+	}
+	return wfs, api.WareID{"tar", hash}, nil
+}
+
+// Reads the i'th entry's body, by reading headers (and skipping bodies) up to it.
+func openTarEntry(readerAt *io.SectionReader, i int) (io.ReadCloser, error) {
+	tr := tar.NewReader(io.NewSectionReader(readerAt, 0, readerAt.Size()))
+	for ; i >= 0; i-- {
+		if _, err := tr.Next(); err != nil {
+			return nil, Errorf(rio.ErrWareCorrupt, "corrupt tar: %s", err)
+		}
+	}
+	return io.NopCloser(tr), nil
+}
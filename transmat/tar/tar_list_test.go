@@ -0,0 +1,32 @@
+package tartrans
+
+import (
+	"fmt"
+	"testing"
+
+	api "github.com/polydawn/go-timeless-api"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/osfs"
+	"github.com/polydawn/rio/testutil"
+	"github.com/polydawn/rio/transmat/mixins/tests"
+)
+
+func TestTarList(t *testing.T) {
+	Convey("Spec compliance: Tar list", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			Convey("Using kvfs warehouse, in content-addressable mode:", func() {
+				testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+					osfs.New(tmpDir).Mkdir(fs.MustRelPath("bounce"), 0755)
+					tests.CheckList(PackType, Pack, List, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+				})
+			})
+			Convey("Using kvfs warehouse, in *non*-content-addressable mode:", func() {
+				testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+					tests.CheckList(PackType, Pack, List, api.WarehouseLocation(fmt.Sprintf("file://%s/bounce", tmpDir)))
+				})
+			})
+		}),
+	)
+}
@@ -0,0 +1,99 @@
+package tartrans
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+)
+
+/*
+	Format selects the tar header format to pack with.
+
+	The default, Format_Auto, lets each entry have the most conservative
+	format that can hold it: USTAR if possible, else PAX.  USTAR is strict
+	USTAR, for the oldest readers: entries it can't hold (long paths,
+	large uids and gids, xattrs...) are an error.  PAX and GNU hold
+	everything, with their own extensions.
+
+	The format only changes the bytes of the tar, never the WareID.
+*/
+type Format string
+
+const (
+	Format_Auto  Format = "auto"
+	Format_USTAR Format = "ustar"
+	Format_PAX   Format = "pax"
+	Format_GNU   Format = "gnu"
+)
+
+// All the formats supported, default first.
+var Formats = []Format{
+	Format_Auto,
+	Format_USTAR,
+	Format_PAX,
+	Format_GNU,
+}
+
+func ParseFormat(s string) (Format, error) {
+	for _, f := range Formats {
+		if string(f) == s {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported tar format %q", s)
+}
+
+func (f Format) tarFormat() tar.Format {
+	switch f {
+	case Format_USTAR:
+		return tar.FormatUSTAR
+	case Format_PAX:
+		return tar.FormatPAX
+	case Format_GNU:
+		return tar.FormatGNU
+	default:
+		return tar.FormatUnknown // lets archive/tar choose.
+	}
+}
+
+// Sparse entries are written in the PAX format; so, only where that's allowed.
+func (f Format) allowsSparse() bool {
+	return f == Format_Auto || f == Format_PAX
+}
+
+type formatCtxKey struct{}
+
+// Returns a context asking tar packs to use the given format.
+func WithFormat(ctx context.Context, f Format) context.Context {
+	return context.WithValue(ctx, formatCtxKey{}, f)
+}
+
+// Returns the format carried by the context, or Format_Auto.
+func GetFormat(ctx context.Context) Format {
+	f, ok := ctx.Value(formatCtxKey{}).(Format)
+	if !ok {
+		return Format_Auto
+	}
+	return f
+}
+
+type sparseCtxKey struct{}
+
+/*
+	Returns a context asking tar packs to look for holes in files (with
+	SEEK_HOLE, where the platform has it), and pack files that have any as
+	sparse entries.  Holes read as zeros, so the WareID is the same either
+	way; but the bytes of the tar then depend on how the filesystem happened
+	to lay the files out, so it's not the default.
+
+	Sparse entries are only written in the PAX and auto formats.
+*/
+func WithSparse(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sparseCtxKey{}, true)
+}
+
+// Returns whether the context asks for sparse entries.
+func GetSparse(ctx context.Context) bool {
+	sparse, _ := ctx.Value(sparseCtxKey{}).(bool)
+	return sparse
+}
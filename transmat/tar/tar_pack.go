@@ -4,25 +4,26 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"context"
-	"crypto/sha512"
 	"io"
+	"io/ioutil"
 	"time"
 
-	"github.com/polydawn/refmt/misc"
-
 	api "github.com/polydawn/go-timeless-api"
 	"github.com/polydawn/go-timeless-api/rio"
 	"github.com/polydawn/rio/fs"
 	"github.com/polydawn/rio/fs/osfs"
 	"github.com/polydawn/rio/fsOp"
+	"github.com/polydawn/rio/lib/treewalk"
 	"github.com/polydawn/rio/transmat/mixins/filters"
 	"github.com/polydawn/rio/transmat/mixins/fshash"
+	"github.com/polydawn/rio/transmat/mixins/statcache"
 	"github.com/polydawn/rio/transmat/util"
 	. "github.com/warpfork/go-errcat"
 )
 
 var (
-	_ rio.PackFunc = Pack
+	_ rio.PackFunc         = Pack
+	_ util.PackRecordsFunc = PackRecords
 )
 
 func Pack(
@@ -32,7 +33,23 @@ func Pack(
 	filt api.FilesetPackFilter, // Filters we should apply while packing.
 	warehouseAddr api.WarehouseLocation, // Warehouse to save into (or blank to just scan).
 	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
-) (_ api.WareID, err error) {
+) (api.WareID, error) {
+	wareID, records, err := PackRecords(ctx, packType, pathStr, filt, warehouseAddr, mon)
+	if records != nil {
+		records.Close()
+	}
+	return wareID, err
+}
+
+// PackRecords is Pack, also returning the records of every entry packed.
+func PackRecords(
+	ctx context.Context, // Long-running call.  Cancellable.
+	packType api.PackType, // The name of pack format.
+	pathStr string, // The fileset to scan and pack (absolute path).
+	filt api.FilesetPackFilter, // Filters we should apply while packing.
+	warehouseAddr api.WarehouseLocation, // Warehouse to save into (or blank to just scan).
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, _ fshash.Bucket, err error) {
 	if mon.Chan != nil {
 		defer close(mon.Chan)
 	}
@@ -40,14 +57,14 @@ func Pack(
 
 	// Sanitize arguments.
 	if packType != PackType {
-		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, packType)
+		return api.WareID{}, nil, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, packType)
 	}
 	if !filt.IsComplete() {
-		return api.WareID{}, Errorf(rio.ErrUsage, "filters must be completely specified")
+		return api.WareID{}, nil, Errorf(rio.ErrUsage, "filters must be completely specified")
 	}
 	path, err := fs.ParseAbsolutePath(pathStr)
 	if err != nil {
-		return api.WareID{}, Errorf(rio.ErrUsage, "pack must be called with absolute path: %s", err)
+		return api.WareID{}, nil, Errorf(rio.ErrUsage, "pack must be called with absolute path: %s", err)
 	}
 
 	// Short-circuit exit if the path does not exist.
@@ -59,112 +76,224 @@ func Pack(
 	case nil:
 		// pass
 	case fs.ErrNotExists:
-		return api.WareID{PackType, ""}, nil
+		return api.WareID{PackType, ""}, nil, nil
 	default:
-		return api.WareID{}, Errorf(rio.ErrPackInvalid, "cannot read path for packing: %s", err)
+		return api.WareID{}, nil, Errorf(rio.ErrPackInvalid, "cannot read path for packing: %s", err)
+	}
+
+	// Gather path filters: any given with the context, plus the fileset's own ignore file.
+	pathFilt, err := filters.GetPathFilter(ctx).WithIgnoreFile(afs)
+	if err != nil {
+		return api.WareID{}, nil, err
 	}
 
 	// Connect to warehouse, and get write controller opened.
-	wc, err := util.OpenWriteController(warehouseAddr, packType, mon)
+	wc, err := util.OpenWriteController(ctx, warehouseAddr, packType, mon)
 	if err != nil {
-		return api.WareID{}, err
+		return api.WareID{}, nil, err
 	}
 	defer wc.Close()
 
-	// Wrap writer stream to do compress on the way out.
-	//  Note on compression levels: The default is 6; and per http://tukaani.org/lzma/benchmarks.html
-	//  this appears quite reasonable: higher levels appear to have minimal size payoffs, but significantly rising compress time costs;
-	//  decompression time does not vary with compression level.
-	// Save a gzip reference just to close it; tar.Writer doesn't passthru its own close.
-	gzWriter := gzip.NewWriter(wc)
+	// Open the stat cache, if asked for.
+	statCache := statcache.FromContext(ctx, path)
+
+	// The entries are those of the fileset.
+	walk := walkFileset(afs, filt, pathFilt, filters.GetIDMap(ctx), GetSparse(ctx) && GetFormat(ctx).allowsSparse())
+
+	// With no warehouse, only the hash matters: skip building the tar at all.
+	if warehouseAddr == "" {
+		wareID, records, err := packTar(ctx, walk, statCache, nil)
+		if err != nil {
+			return wareID, nil, err
+		}
+		statCache.Save() // only an optimization; not worth failing the pack for.
+		if err := wc.Commit(wareID); err != nil {
+			records.Close()
+			return wareID, nil, err
+		}
+		return wareID, records, nil
+	}
 
 	// Construct tar writer.
-	tarWriter := tar.NewWriter(gzWriter)
+	gzWriter, tarWriter := newTarWriter(wc)
 
 	// Scan and tarify!
-	wareID, err := packTar(ctx, afs, filt, tarWriter)
+	wareID, records, err := packTar(ctx, walk, statCache, tarWriter)
 	if err != nil {
-		return wareID, err
+		return wareID, nil, err
 	}
 	// Close all the intermediate writer layers to ensure they've flushed.
 	tarWriter.Close()
 	gzWriter.Close()
+	statCache.Save() // only an optimization; not worth failing the pack for.
 
 	// If we made it all the way with no errors, commit.
 	//  (Otherwise, the write controller will be closed by default by our defers.)
-	return wareID, wc.Commit(wareID)
+	if err := wc.Commit(wareID); err != nil {
+		records.Close()
+		return wareID, nil, err
+	}
+	return wareID, records, nil
 }
 
-func packTar(
-	ctx context.Context,
+/*
+	Wraps the writer stream to do compression on the way out, and returns
+	both layers: save the gzip reference just to close it, because
+	tar.Writer doesn't passthru its own close.
+*/
+func newTarWriter(w io.Writer) (*gzip.Writer, *tarWriter) {
+	// Note on compression levels: The default is 6; and per http://tukaani.org/lzma/benchmarks.html
+	//  this appears quite reasonable: higher levels appear to have minimal size payoffs, but significantly rising compress time costs;
+	//  decompression time does not vary with compression level.
+	// The gzip header is pinned blank (no name, no mtime, OS "unknown"), so that the
+	//  archive bytes depend only on the entries: the same fileset always packs to
+	//  the same blob (given the same deflate implementation).
+	gzWriter, _ := gzip.NewWriterLevel(w, 6)
+	gzWriter.Header = gzip.Header{OS: 255}
+	return gzWriter, &tarWriter{tar.NewWriter(gzWriter), gzWriter}
+}
+
+// Returns the walk of a fileset on disk, for packTar.
+func walkFileset(
 	afs fs.FS,
 	filt api.FilesetPackFilter,
-	tw *tar.Writer,
-) (api.WareID, error) {
+	pathFilt filters.PathFilter,
+	idmap filters.IDMap,
+	sparse bool, // if true, files with holes are put as sparseFile.
+) func(ctx context.Context, put func(*fs.Metadata, io.ReadCloser) error) error {
+	return func(ctx context.Context, put func(*fs.Metadata, io.ReadCloser) error) error {
+		put = pathFilt.PruneDirs(put)
+		return fs.Walk(afs, func(filenode *fs.FilewalkNode) error {
+			if filenode.Err != nil {
+				return filenode.Err
+			}
+
+			// Consider cancellation.
+			if ctx.Err() != nil {
+				return Errorf(rio.ErrCancelled, "cancelled")
+			}
+
+			// Skip anything the path filters exclude (and everything in it, for dirs).
+			if isDir := filenode.Info.Type == fs.Type_Dir; pathFilt.Excluded(filenode.Info.Name, isDir) {
+				if isDir {
+					return treewalk.SkipNode
+				}
+				return nil
+			}
+
+			// Open file.
+			fmeta, file, err := fsOp.ScanFile(afs, filenode.Info.Name) // FIXME : we already have the full metadata loaded; give ScanFile option to accept it!
+			if err != nil {
+				return err
+			}
+
+			// Apply filters.
+			//  The filter may reject things by returning an error;
+			//   or, instruct us to ignore things by setting the type to invalid.
+			if err := filters.ApplyPackFilter(filt, idmap, fmeta); err != nil {
+				if file != nil {
+					file.Close()
+				}
+				return err
+			}
+			if fmeta.Type == fs.Type_Invalid {
+				return nil // skip it and continue the walk
+			}
+
+			// Flatten time to seconds.  The tar writer impl doesn't do subsecond precision.
+			//  The writer will always flatten it internally, but we need to do it here as well
+			//  so that the hash and the serial form are describing the same thing.
+			fmeta.Mtime = fmeta.Mtime.Truncate(time.Second)
+
+			// Look for holes in files, if we're to keep them.
+			if sparse && file != nil {
+				if extents := dataExtents(file.(io.Seeker), fmeta.Size); extents != nil {
+					return put(fmeta, &sparseFile{file, extents})
+				}
+			}
+			return put(fmeta, file)
+		}, nil)
+	}
+}
+
+func packTar(
+	ctx context.Context,
+	walk func(ctx context.Context, put func(*fs.Metadata, io.ReadCloser) error) error,
+	statCache *statcache.Cache, // may be nil.
+	tw *tarWriter, // may be nil, if only hashing.
+) (api.WareID, fshash.Bucket, error) {
 	// Allocate bucket for keeping each metadata entry and content hash;
 	// the full tree hash will be computed from this at the end.
-	bucket := &fshash.MemoryBucket{}
+	bucket := &fshash.DiskBucket{}
 
-	// Walk the filesystem, emitting tar entries and filling the bucket as we go.
-	tarHeader := &tar.Header{}
-	preVisit := func(filenode *fs.FilewalkNode) error {
-		if filenode.Err != nil {
-			return filenode.Err
-		}
+	// Hash with whichever algorithm was asked for.
+	alg := fshash.GetAlgorithm(ctx)
 
-		// Consider cancellation.
-		if ctx.Err() != nil {
-			return Errorf(rio.ErrCancelled, "cancelled")
-		}
+	// Headers in whichever format was asked for.
+	format := GetFormat(ctx)
 
-		// Open file.
-		fmeta, file, err := fsOp.ScanFile(afs, filenode.Info.Name) // FIXME : we already have the full metadata loaded; give ScanFile option to accept it!
-		if err != nil {
-			return err
+	// Run the walk, emitting tar entries and filling the bucket as we go.
+	//  The walk and the writing run in a pipeline, so files can be read and
+	//  hashed ahead on other cores; the entries are still written in order.
+	tarHeader := &tar.Header{}
+	write := func(entry *util.PackEntry) error {
+		// Flip our metadata to tar header format, and flush it.
+		fmeta := entry.Metadata
+		if tw == nil {
+			bucket.AddRecord(*fmeta, entry.ContentHash())
+			return nil
 		}
+		MetadataToTarHdr(fmeta, tarHeader)
+		tarHeader.Format = format.tarFormat()
 
-		// Apply filters.
-		//  The filter may reject things by returning an error;
-		//   or, instruct us to ignore things by setting the type to invalid.
-		if err := filters.ApplyPackFilter(filt, fmeta); err != nil {
-			return err
-		}
-		if fmeta.Type == fs.Type_Invalid {
-			return nil // skip it and continue the walk
+		// Sparse files are written by hand; archive/tar can't.
+		if sf, ok := entry.Source().(*sparseFile); ok {
+			if err := tw.writeSparse(tarHeader, sf.extents, entry.Body()); err != nil {
+				return err
+			}
+			bucket.AddRecord(*fmeta, entry.ContentHash())
+			return nil
 		}
 
-		// Flatten time to seconds.  The tar writer impl doesn't do subsecond precision.
-		//  The writer will always flatten it internally, but we need to do it here as well
-		//  so that the hash and the serial form are describing the same thing.
-		fmeta.Mtime = fmeta.Mtime.Truncate(time.Second)
-
-		// Flip our metadata to tar header format, and flush it.
-		MetadataToTarHdr(fmeta, tarHeader)
 		if err := tw.WriteHeader(tarHeader); err != nil {
-			return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+			return headerError(tarHeader, err)
 		}
 
-		// If it's a file, stream the body into the tar while hashing; for all,
-		//  record the metadata in the bucket for the total hash.
-		if file == nil {
+		// If it's a file, stream the body into the tar (hashing as we go, if not
+		//  already done); for all, record the metadata in the bucket for the total hash.
+		body := entry.Body()
+		if body == nil {
 			bucket.AddRecord(*fmeta, nil)
-		} else {
-			defer file.Close()
-			hasher := sha512.New384()
-			tee := io.MultiWriter(tw, hasher)
-			_, err := io.Copy(tee, file)
-			if err != nil {
-				return err
-			}
-			bucket.AddRecord(*fmeta, hasher.Sum(nil))
+			return nil
+		}
+		if _, err := io.Copy(tw, body); err != nil {
+			return err
 		}
+		bucket.AddRecord(*fmeta, entry.ContentHash())
 		return nil
 	}
-	if err := fs.Walk(afs, preVisit, nil); err != nil {
-		return api.WareID{}, err
+	pipeline := util.PackPipeline{Algorithm: alg, HashOnly: tw == nil, StatCache: statCache}
+	if err := pipeline.Run(ctx, walk, write); err != nil {
+		bucket.Close()
+		return api.WareID{}, nil, err
 	}
 
 	// Hash the thing!
-	hash := fshash.HashBucket(bucket, sha512.New384)
-	return api.WareID{"tar", misc.Base58Encode(hash)}, nil
+	hash := fshash.HashBucket(bucket, alg.New)
+	return api.WareID{"tar", alg.WareHash(hash)}, bucket, nil
+}
+
+/*
+	Categorizes an error from writing a tar header.  If the header can't be
+	encoded at all (say, a long path, with the format USTAR), it's the
+	fileset that can't be packed; otherwise, it's the write that failed.
+
+	archive/tar doesn't export its error for the former: so, we just try
+	again into nowhere, where only encoding can fail.
+*/
+func headerError(hdr *tar.Header, err error) error {
+	if err2 := tar.NewWriter(ioutil.Discard).WriteHeader(hdr); err2 != nil {
+		return Errorf(rio.ErrPackInvalid, "cannot pack %q in tar format %q: %s", hdr.Name, hdr.Format, err2)
+	}
+	return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
 }
@@ -15,6 +15,9 @@ func TestTarPack(t *testing.T) {
 			tests.CheckPackProducesConsistentHash(PackType, Pack)
 			tests.CheckPackHashVariesOnVariations(PackType, Pack)
 			tests.CheckPackErrorsGracefully(PackType, Pack)
+			tests.CheckPackPathFilters(PackType, Pack)
+			tests.CheckPackStatCache(PackType, Pack)
+			tests.CheckPackReproducible(PackType, Pack)
 		}),
 	)
 }
@@ -0,0 +1,338 @@
+package tartrans
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	. "github.com/warpfork/go-errcat"
+
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/transmat/mixins/statcache"
+)
+
+/*
+	Sparse files, on the way in and out.
+
+	archive/tar reads every flavor of sparse entry (handing us the holes
+	as zeros), but won't write any; and it won't tell us where the holes
+	were when reading.  So:
+
+	  - packing writes sparse entries itself, in the PAX 1.0 format that
+	    GNU tar writes: the file's data extents (as found by SEEK_DATA and
+	    SEEK_HOLE) go in a map at the start of the entry's body;
+	  - unpacking of any entry which was sparse in the tar skips over
+	    every block of zeros in it, leaving holes in the file.
+*/
+
+// An extent of data in a sparse file; everything else is holes.
+type extent struct {
+	Offset, Length int64
+}
+
+// A file put by the pack walk, along with its data extents.
+type sparseFile struct {
+	io.ReadCloser
+	extents []extent
+}
+
+// Stats the file underneath, so the stat cache can see it.
+func (sf *sparseFile) Stat() (os.FileInfo, error) {
+	f, ok := sf.ReadCloser.(statcache.File)
+	if !ok {
+		return nil, fmt.Errorf("sparse file cannot be stat'd")
+	}
+	return f.Stat()
+}
+
+/*
+	Returns the data extents of a file, by seeking from data to hole to
+	data again; or nil, if it has no holes (or it can't be told).
+	Leaves the file seeked back to the start.
+*/
+func seekExtents(f io.Seeker, size int64, seekData, seekHole int) []extent {
+	if size == 0 {
+		return nil
+	}
+	extents := []extent{}
+	for off := int64(0); off < size; {
+		start, err := f.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			break // no more data: it's holes to the end.
+		}
+		if err != nil {
+			extents = nil // can't be told.
+			break
+		}
+		if start >= size {
+			break // it's shrunk since stat; the hash will be the judge of that.
+		}
+		end, err := f.Seek(start, seekHole)
+		if err != nil {
+			extents = nil
+			break
+		}
+		if end > size {
+			end = size
+		}
+		extents = append(extents, extent{start, end - start})
+		off = end
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil
+	}
+	if len(extents) == 1 && extents[0] == (extent{0, size}) {
+		return nil // dense.
+	}
+	// If it ends in a hole, end with an empty extent, as GNU tar does:
+	//  otherwise, GNU tar doesn't make the file that long.
+	if extents != nil && (len(extents) == 0 || extents[len(extents)-1].Offset+extents[len(extents)-1].Length < size) {
+		extents = append(extents, extent{size, 0})
+	}
+	return extents
+}
+
+// Allows the tar.Writer's stream to be written to directly, between entries.
+type tarWriter struct {
+	*tar.Writer
+	raw io.Writer
+}
+
+/*
+	Writes an entry for a sparse file, in the PAX 1.0 format, and its body.
+	The body is read in full (holes are zeros, and are hashed as such);
+	only the extents are written.
+
+	The header is written by a scratch tar.Writer, so it's encoded just as
+	any other; we only add the sparse records to its PAX header (making one
+	if it had none).
+*/
+func (tw *tarWriter) writeSparse(hdr *tar.Header, extents []extent, body io.Reader) error {
+	// Encode the map, and work out the size of the entry's body: the map, then the extents.
+	var spb []byte
+	spb = append(strconv.AppendInt(spb, int64(len(extents)), 10), '\n')
+	physicalSize := int64(0)
+	for _, e := range extents {
+		spb = append(strconv.AppendInt(spb, e.Offset, 10), '\n')
+		spb = append(strconv.AppendInt(spb, e.Length, 10), '\n')
+		physicalSize += e.Length
+	}
+	spb = append(spb, make([]byte, blockPadding(int64(len(spb))))...)
+	physicalSize += int64(len(spb))
+
+	// Encode the header, as if it were a file of the physical size, under the name GNU tar would give it.
+	realName, realSize := hdr.Name, hdr.Size
+	shdr := *hdr
+	dir, file := path.Split(realName)
+	shdr.Name = path.Join(dir, "GNUSparseFile.0", file)
+	shdr.Size = physicalSize
+	var scratch bytes.Buffer
+	if err := tar.NewWriter(&scratch).WriteHeader(&shdr); err != nil {
+		return Errorf(rio.ErrPackInvalid, "cannot pack %q as a tar header: %s", realName, err)
+	}
+	blocks := scratch.Bytes()
+
+	// Take the PAX records it made, if any, and add the sparse ones.
+	records := map[string]string{}
+	if blocks[156] == tar.TypeXHeader {
+		size, err := strconv.ParseInt(strings.TrimRight(string(blocks[124:136]), " \x00"), 8, 64)
+		if err != nil {
+			panic(fmt.Errorf("unparsable size in our own PAX header: %s", err))
+		}
+		records = parsePAXRecords(blocks[512 : 512+size])
+		blocks = blocks[512+size+blockPadding(size):]
+	}
+	delete(records, "path") // superseded.
+	records["GNU.sparse.major"] = "1"
+	records["GNU.sparse.minor"] = "0"
+	records["GNU.sparse.name"] = realName
+	records["GNU.sparse.realsize"] = strconv.FormatInt(realSize, 10)
+	paxb := formatPAXRecords(records)
+
+	// Flush the last entry's padding; then it's all ours until the next.
+	if err := tw.Flush(); err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	for _, bs := range [][]byte{
+		paxHeaderBlock(int64(len(paxb))),
+		paxb,
+		make([]byte, blockPadding(int64(len(paxb)))),
+		blocks,
+		spb,
+	} {
+		if _, err := tw.raw.Write(bs); err != nil {
+			return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+		}
+	}
+
+	// Copy the extents of the body; skip over the holes.
+	pos := int64(0)
+	for _, e := range extents {
+		if _, err := io.CopyN(ioutil.Discard, body, e.Offset-pos); err != nil {
+			return Errorf(rio.ErrPackInvalid, "error while reading file for pack: %s", err)
+		}
+		if _, err := io.CopyN(tw.raw, body, e.Length); err != nil {
+			return Errorf(rio.ErrPackInvalid, "error while reading file for pack: %s", err)
+		}
+		pos = e.Offset + e.Length
+	}
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		return Errorf(rio.ErrPackInvalid, "error while reading file for pack: %s", err)
+	}
+	if _, err := tw.raw.Write(make([]byte, blockPadding(physicalSize))); err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	return nil
+}
+
+// Returns the number of bytes to pad n to a whole number of 512-byte blocks.
+func blockPadding(n int64) int64 {
+	return -n & 511
+}
+
+// Returns the header block for PAX records of the given length.
+//  Everything but the size is fixed, so it's as reproducible as the records.
+func paxHeaderBlock(size int64) []byte {
+	blk := make([]byte, 512)
+	copy(blk[0:100], "PaxHeaders.0/sparse")
+	copy(blk[100:108], "0000644\x00") // mode
+	copy(blk[108:116], "0000000\x00") // uid
+	copy(blk[116:124], "0000000\x00") // gid
+	copy(blk[124:136], fmt.Sprintf("%011o\x00", size))
+	copy(blk[136:148], "00000000000\x00") // mtime
+	blk[156] = tar.TypeXHeader
+	copy(blk[257:265], "ustar\x0000") // magic and version
+	copy(blk[148:156], "        ")    // the checksum counts itself as spaces.
+	sum := 0
+	for _, b := range blk {
+		sum += int(b)
+	}
+	copy(blk[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return blk
+}
+
+// Encodes PAX records, sorted: each is "<length> <key>=<value>\n", where the length includes itself.
+func formatPAXRecords(records map[string]string) []byte {
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		rec := " " + k + "=" + records[k] + "\n"
+		n := len(rec) + len(strconv.Itoa(len(rec)))
+		if len(strconv.Itoa(n)) > len(strconv.Itoa(len(rec))) {
+			n++
+		}
+		buf.WriteString(strconv.Itoa(n) + rec)
+	}
+	return buf.Bytes()
+}
+
+// Decodes PAX records, as archive/tar wrote them for us.
+func parsePAXRecords(bs []byte) map[string]string {
+	records := map[string]string{}
+	for len(bs) > 0 {
+		sp := bytes.IndexByte(bs, ' ')
+		if sp < 0 {
+			panic(fmt.Errorf("unparsable PAX records from archive/tar"))
+		}
+		n, err := strconv.Atoi(string(bs[:sp]))
+		if err != nil || n > len(bs) {
+			panic(fmt.Errorf("unparsable PAX records from archive/tar"))
+		}
+		rec := string(bs[sp+1 : n-1])
+		eq := strings.IndexByte(rec, '=')
+		records[rec[:eq]] = rec[eq+1:]
+		bs = bs[n:]
+	}
+	return records
+}
+
+// Returns whether the entry was sparse in the tar (in any of the formats archive/tar reads).
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Proxies the body of a file which was sparse in the tar.
+	Copied (with io.Copy) into a file which can seek, it leaves a hole
+	for every block of zeros, rather than writing them.
+*/
+type sparseBody struct {
+	io.Reader
+}
+
+const sparseBlockSize = 4096
+
+func (sb sparseBody) WriteTo(w io.Writer) (int64, error) {
+	ws, ok := w.(io.WriteSeeker)
+	if ok {
+		if _, err := ws.Seek(0, io.SeekCurrent); err != nil {
+			ok = false // Not everything that has Seek can really seek.
+		}
+	}
+	if !ok {
+		return io.Copy(w, sb.Reader)
+	}
+	var n int64
+	var holeAtEnd bool
+	buf := make([]byte, 32*sparseBlockSize)
+	zeros := make([]byte, sparseBlockSize)
+	for {
+		m, err := io.ReadFull(sb.Reader, buf)
+		for off := 0; off < m; off += sparseBlockSize {
+			end := off + sparseBlockSize
+			if end > m {
+				end = m
+			}
+			blk := buf[off:end]
+			if bytes.Equal(blk, zeros[:len(blk)]) {
+				if _, err := ws.Seek(int64(len(blk)), io.SeekCurrent); err != nil {
+					return n, err
+				}
+				holeAtEnd = true
+			} else {
+				if _, err := ws.Write(blk); err != nil {
+					return n, err
+				}
+				holeAtEnd = false
+			}
+			n += int64(len(blk))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	// If it ended in a hole, the file's not that long yet: rewrite its last zero.
+	if holeAtEnd {
+		if _, err := ws.Seek(-1, io.SeekCurrent); err != nil {
+			return n, err
+		}
+		if _, err := ws.Write([]byte{0}); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,17 @@
+// +build darwin
+
+package tartrans
+
+import (
+	"io"
+)
+
+// Not in the syscall package (nor our x/sys); see lseek(2).  The reverse of linux's.
+const (
+	seekHole = 3
+	seekData = 4
+)
+
+func dataExtents(f io.Seeker, size int64) []extent {
+	return seekExtents(f, size, seekData, seekHole)
+}
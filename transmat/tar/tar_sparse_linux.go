@@ -0,0 +1,17 @@
+// +build linux
+
+package tartrans
+
+import (
+	"io"
+)
+
+// Not in the syscall package (nor our x/sys); see lseek(2).
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+func dataExtents(f io.Seeker, size int64) []extent {
+	return seekExtents(f, size, seekData, seekHole)
+}
@@ -0,0 +1,125 @@
+// +build linux
+
+package tartrans
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/testutil"
+)
+
+func TestTarSparse(t *testing.T) {
+	Convey("Sparse files", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			// A file of 8MiB, with a little data in the middle, and holes all around.
+			fixturePath := tmpDir.Join(fs.MustRelPath("fixture"))
+			So(os.Mkdir(fixturePath.String(), 0755), ShouldBeNil)
+			filePath := fixturePath.Join(fs.MustRelPath("sparse")).String()
+			f, err := os.Create(filePath)
+			So(err, ShouldBeNil)
+			So(f.Truncate(8<<20), ShouldBeNil)
+			_, err = f.WriteAt([]byte("data"), 3<<20)
+			So(err, ShouldBeNil)
+			So(f.Close(), ShouldBeNil)
+			body, err := ioutil.ReadFile(filePath)
+			So(err, ShouldBeNil)
+
+			packTo := func(ctx context.Context, blob string) (api.WareID, api.WarehouseLocation) {
+				warehouseAddr := api.WarehouseLocation("file://" + tmpDir.Join(fs.MustRelPath(blob)).String())
+				wareID, err := Pack(
+					ctx,
+					PackType,
+					fixturePath.String(),
+					api.FilesetPackFilter_Lossless,
+					warehouseAddr,
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+				return wareID, warehouseAddr
+			}
+			denseWareID, _ := packTo(context.Background(), "dense.tgz")
+			wareID, warehouseAddr := packTo(WithSparse(context.Background()), "sparse.tgz")
+
+			Convey("pack as sparse entries, with the same WareID", func() {
+				So(wareID, ShouldResemble, denseWareID)
+
+				blob, err := os.Open(tmpDir.Join(fs.MustRelPath("sparse.tgz")).String())
+				So(err, ShouldBeNil)
+				defer blob.Close()
+				gz, err := gzip.NewReader(blob)
+				So(err, ShouldBeNil)
+				tr := tar.NewReader(gz)
+				var found bool
+				for {
+					hdr, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					So(err, ShouldBeNil)
+					if hdr.Name != "./sparse" {
+						continue
+					}
+					found = true
+					So(hdr.PAXRecords["GNU.sparse.major"], ShouldEqual, "1")
+					So(hdr.Size, ShouldEqual, 8<<20)
+					content, err := ioutil.ReadAll(tr)
+					So(err, ShouldBeNil)
+					So(bytes.Equal(content, body), ShouldBeTrue)
+				}
+				So(found, ShouldBeTrue)
+			})
+
+			Convey("unpack with the holes left as holes", func() {
+				unpackPath := tmpDir.Join(fs.MustRelPath("unpack"))
+				wareID2, err := Unpack(
+					context.Background(),
+					wareID,
+					unpackPath.String(),
+					api.FilesetUnpackFilter_Lossless,
+					rio.Placement_Direct,
+					[]api.WarehouseLocation{warehouseAddr},
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+				So(wareID2, ShouldResemble, wareID)
+
+				unpacked := unpackPath.Join(fs.MustRelPath("sparse")).String()
+				content, err := ioutil.ReadFile(unpacked)
+				So(err, ShouldBeNil)
+				So(bytes.Equal(content, body), ShouldBeTrue)
+				var st syscall.Stat_t
+				So(syscall.Stat(unpacked, &st), ShouldBeNil)
+				So(st.Blocks*512, ShouldBeLessThan, 1<<20)
+			})
+
+			Convey("read back whole when opened as a filesystem", func() {
+				wfs, err := OpenFS(context.Background(), wareID, []api.WarehouseLocation{warehouseAddr}, rio.Monitor{})
+				So(err, ShouldBeNil)
+				defer wfs.Close()
+				f, err := wfs.OpenFile(fs.MustRelPath("sparse"), os.O_RDONLY, 0)
+				So(err, ShouldBeNil)
+				defer f.Close()
+				content, err := ioutil.ReadAll(f)
+				So(err, ShouldBeNil)
+				So(bytes.Equal(content, body), ShouldBeTrue)
+				buf := make([]byte, 4)
+				_, err = f.ReadAt(buf, 3<<20)
+				So(err, ShouldBeNil)
+				So(string(buf), ShouldEqual, "data")
+			})
+		})
+	})
+}
@@ -3,13 +3,11 @@ package tartrans
 import (
 	"archive/tar"
 	"context"
-	"crypto/sha512"
 	"fmt"
 	"io"
 	"strings"
 	"time"
 
-	"github.com/polydawn/refmt/misc"
 	. "github.com/warpfork/go-errcat"
 
 	api "github.com/polydawn/go-timeless-api"
@@ -19,6 +17,7 @@ import (
 	"github.com/polydawn/rio/lib/treewalk"
 	"github.com/polydawn/rio/transmat/mixins/filters"
 	"github.com/polydawn/rio/transmat/mixins/fshash"
+	"github.com/polydawn/rio/transmat/mixins/limits"
 	"github.com/polydawn/rio/transmat/mixins/log"
 	"github.com/polydawn/rio/transmat/util"
 )
@@ -27,21 +26,31 @@ func unpackTar(
 	ctx context.Context,
 	afs fs.FS,
 	filt api.FilesetUnpackFilter,
-	_ api.WareID,
+	wareID api.WareID,
 	reader io.Reader,
 	mon rio.Monitor,
 ) (
 	prefilterWareID api.WareID,
 	actualWareID api.WareID,
+	records fshash.Bucket,
 	err error,
 ) {
 	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
 
+	// Hash with the algorithm the ware's hash says it was made with.
+	alg, err := fshash.AlgorithmForWare(ctx, wareID.Hash)
+	if err != nil {
+		return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrUsage, "%s", err)
+	}
+
+	// Count everything against the limits, if any.
+	tracker := limits.NewTracker(ctx)
+
 	// Wrap input stream with decompression as necessary.
 	//  Which kind of decompression to use can be autodetected by magic bytes.
-	reader2, err := Decompress(reader)
+	reader2, err := Decompress(tracker.Ware(reader))
 	if err != nil {
-		return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar compression: %s", err)
+		return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrWareCorrupt, "corrupt tar compression: %s", err)
 	}
 
 	// Convert the raw byte reader to a tar stream.
@@ -51,8 +60,18 @@ func unpackTar(
 	// the full tree hash will be computed from this at the end.
 	// We keep one for the raw ware data as we consume it, so we can verify no fuckery;
 	// we keep a second, separate one for the filtered data, which will compute a different hash.
-	prefilterBucket := &fshash.MemoryBucket{}
-	filteredBucket := &fshash.MemoryBucket{}
+	// Only the filtered one is returned; and that, only if all goes well.
+	prefilterBucket := &fshash.DiskBucket{}
+	filteredBucket := &fshash.DiskBucket{}
+	defer prefilterBucket.Close()
+	defer func() {
+		if err != nil {
+			filteredBucket.Close()
+		}
+	}()
+
+	// Any uid/gid remapping is applied along with the filters.
+	idmap := filters.GetIDMap(ctx)
 
 	// Also allocate a map for keeping records of which dirs we've created.
 	// This is necessary for correct bookkeepping in the face of the tar format's
@@ -69,10 +88,10 @@ func unpackTar(
 			break // sucess!  end of archive.
 		}
 		if err != nil {
-			return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar: %s", err)
+			return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrWareCorrupt, "corrupt tar: %s", err)
 		}
 		if ctx.Err() != nil {
-			return api.WareID{}, api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+			return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrCancelled, "cancelled")
 		}
 
 		// Reshuffle metainfo to our default format.
@@ -96,10 +115,13 @@ func unpackTar(
 			continue
 		}
 		if haltMe != nil {
-			return api.WareID{}, api.WareID{}, haltMe
+			return api.WareID{}, api.WareID{}, nil, haltMe
 		}
 		if strings.HasPrefix(fmeta.Name.String(), "..") {
-			return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar: paths that use '../' to leave the base dir are invalid")
+			return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrWareCorrupt, "corrupt tar: paths that use '../' to leave the base dir are invalid")
+		}
+		if err := tracker.Entry(&fmeta); err != nil {
+			return api.WareID{}, api.WareID{}, nil, err
 		}
 
 		// Infer parents, if necessary.  The tar format allows implicit parent dirs.
@@ -119,11 +141,13 @@ func unpackTar(
 			conjuredFmeta := fshash.DefaultDirMetadata()
 			conjuredFmeta.Name = parent
 			prefilterBucket.AddRecord(conjuredFmeta, nil)
-			filters.ApplyUnpackFilter(filt, &conjuredFmeta)
+			if err := filters.ApplyUnpackFilter(filt, idmap, &conjuredFmeta); err != nil {
+				return api.WareID{}, api.WareID{}, nil, err
+			}
 			filteredBucket.AddRecord(conjuredFmeta, nil)
 			dirs[conjuredFmeta.Name] = struct{}{}
 			if err := fsOp.PlaceFile(afs, conjuredFmeta, nil, false); err != nil {
-				return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+				return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 			}
 		}
 
@@ -133,8 +157,8 @@ func unpackTar(
 		filteredFmeta := fmeta
 		//  The filter may reject things by returning an error;
 		//   or, instruct us to ignore things by setting the type to invalid.
-		if err := filters.ApplyUnpackFilter(filt, &filteredFmeta); err != nil {
-			return api.WareID{}, api.WareID{}, err
+		if err := filters.ApplyUnpackFilter(filt, idmap, &filteredFmeta); err != nil {
+			return api.WareID{}, api.WareID{}, nil, err
 		}
 		if fmeta.Type == fs.Type_Invalid {
 			// skip placing that file and continue processing...
@@ -147,9 +171,16 @@ func unpackTar(
 		// Place the file.
 		switch fmeta.Type {
 		case fs.Type_File:
-			reader := &util.HashingReader{tr, sha512.New384()}
-			if err := fsOp.PlaceFile(afs, filteredFmeta, reader, false); err != nil {
-				return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+			reader := &util.HashingReader{tracker.Body(&fmeta, tr), alg.New()}
+			var body io.Reader = reader
+			if isSparse(thdr) {
+				body = sparseBody{reader} // leave its holes as holes.
+			}
+			if err := fsOp.PlaceFile(afs, filteredFmeta, body, false); err != nil {
+				if err := tracker.Err(); err != nil {
+					return api.WareID{}, api.WareID{}, nil, err
+				}
+				return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 			}
 			prefilterBucket.AddRecord(fmeta, reader.Hasher.Sum(nil))
 			filteredBucket.AddRecord(filteredFmeta, reader.Hasher.Sum(nil))
@@ -158,9 +189,9 @@ func unpackTar(
 			fallthrough
 		default:
 			if err := fsOp.PlaceFile(afs, filteredFmeta, nil, false); err != nil {
-				return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+				return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 			}
-			if prefilterBucket.HasRecord(fmeta) && fmeta.Type == fs.Type_Dir {
+			if fmeta.Type == fs.Type_Dir && prefilterBucket.HasRecord(fmeta) {
 				// It is possible that we have a duplicate entry for an inferred directory.
 				// In this case, adding a new record would cause a duplicate, which is not allowed,
 				// so we instead update the metadata to match the tar entry for the dir.
@@ -182,13 +213,13 @@ func unpackTar(
 		}
 		return afs.SetTimesNano(record.Metadata.Name, record.Metadata.Mtime, fs.DefaultTime)
 	}); err != nil {
-		return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+		return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 	}
 
 	// Hash the thing!
-	prefilterHash := misc.Base58Encode(fshash.HashBucket(prefilterBucket, sha512.New384))
-	filteredHash := misc.Base58Encode(fshash.HashBucket(filteredBucket, sha512.New384))
-	if !filt.Altering() {
+	prefilterHash := alg.WareHash(fshash.HashBucket(prefilterBucket, alg.New))
+	filteredHash := alg.WareHash(fshash.HashBucket(filteredBucket, alg.New))
+	if !filt.Altering() && idmap.IsIdentity() {
 		// Paranoia check for new feature.
 		//  When paranoia reduced, replace with skipping the double computation.
 		if prefilterHash != filteredHash {
@@ -196,5 +227,5 @@ func unpackTar(
 		}
 	}
 
-	return api.WareID{"tar", prefilterHash}, api.WareID{"tar", filteredHash}, nil
+	return api.WareID{"tar", prefilterHash}, api.WareID{"tar", filteredHash}, filteredBucket, nil
 }
@@ -12,10 +12,13 @@ import (
 	api "github.com/polydawn/go-timeless-api"
 	"github.com/polydawn/go-timeless-api/rio"
 	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/faultfs"
 	"github.com/polydawn/rio/fs/osfs"
 	"github.com/polydawn/rio/fsOp"
 	"github.com/polydawn/rio/testutil"
+	"github.com/polydawn/rio/transmat/mixins/cache"
 	"github.com/polydawn/rio/transmat/mixins/tests"
+	"github.com/polydawn/rio/transmat/util"
 )
 
 func TestTarUnpack(t *testing.T) {
@@ -27,6 +30,13 @@ func TestTarUnpack(t *testing.T) {
 					tests.CheckRoundTrip(PackType, Pack, Unpack, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
 					// Following tests could be done in all modes, but isn't about warehouses, so would be redundant to do so.
 					tests.CheckCachePopulation(PackType, Pack, Unpack, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+					tests.CheckCacheDedup(PackType, Pack, Unpack, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+					tests.CheckUnpackMtimeNow(PackType, Pack, Unpack, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+					tests.CheckUnpackSubpath(PackType, Pack, Unpack, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+					tests.CheckIDMap(PackType, Pack, Unpack, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+					tests.CheckHashAlgorithms(PackType, Pack, Unpack, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+					tests.CheckUnpackLimits(PackType, Pack, Unpack, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+					tests.CheckUnpackFaults(PackType, Pack, unpackWithFaults, cache.Lrn2Cache, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
 				})
 			})
 			Convey("Using kvfs warehouse, in *non*-content-addressable mode:", func() {
@@ -38,6 +48,28 @@ func TestTarUnpack(t *testing.T) {
 	)
 }
 
+// Unpacks straight into the path, through a faultfs with the faults given; no cache.
+func unpackWithFaults(faults ...faultfs.Fault) rio.UnpackFunc {
+	return func(
+		ctx context.Context,
+		wareID api.WareID,
+		path string,
+		filt api.FilesetUnpackFilter,
+		_ rio.PlacementMode,
+		warehouses []api.WarehouseLocation,
+		mon rio.Monitor,
+	) (api.WareID, error) {
+		reader, err := util.PickReader(ctx, wareID, warehouses, false, mon)
+		if err != nil {
+			return api.WareID{}, err
+		}
+		defer reader.Close()
+		afs := faultfs.New(osfs.New(fs.MustAbsolutePath(path)), faults...)
+		_, unpackWareID, _, err := unpackTar(ctx, afs, filt, wareID, reader, mon)
+		return unpackWareID, err
+	}
+}
+
 /*
 	Tests against pre-generated, known fixtures of tar binary blobs.
 
@@ -0,0 +1,143 @@
+package util
+
+import (
+	"context"
+	"io"
+	"os"
+
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/pickfs"
+	"github.com/polydawn/rio/transmat/mixins/filters"
+)
+
+/*
+	CatFunc reads a ware and copies the body of a single file in it to
+	the given writer, without placing anything on the local filesystem.
+
+	If `verify` is true, the whole ware is read and its hash verified
+	before anything is written; it's buffered locally until then.
+	If false, the body is written as it's read, and reading stops there:
+	this is faster, but nothing is known about the rest of the ware, and
+	a corrupt ware may yield a corrupt body.
+
+	(There's no cat func in the API; this is rio's own.)
+*/
+type CatFunc func(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to read.
+	path fs.RelPath, // The path within the ware of the file to cat.
+	verify bool, // Whether to verify the whole ware before writing anything.
+	w io.Writer, // Where to write the file body.
+	warehouses []api.WarehouseLocation, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) error
+
+// CreateCatter generates a CatFunc shared by both zip and tar transmat implementations.
+// Verifying, it opens the ware as a filesystem, which verifies it, and reads the one file;
+// otherwise, it's an unpack into a filesystem which discards everything but the one file.
+func CreateCatter(t api.PackType, unpacker unpackFn, open OpenFSFunc) CatFunc {
+	return func(
+		ctx context.Context,
+		wareID api.WareID,
+		path fs.RelPath,
+		verify bool,
+		w io.Writer,
+		warehouses []api.WarehouseLocation,
+		mon rio.Monitor,
+	) (err error) {
+		if verify {
+			return catVerified(ctx, open, wareID, path, w, warehouses, mon)
+		}
+		if mon.Chan != nil {
+			defer close(mon.Chan)
+		}
+		defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+		// Sanitize arguments.
+		if wareID.Type != t {
+			return Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", t, wareID.Type)
+		}
+
+		// Pick a warehouse and get a reader.
+		reader, err := PickReader(ctx, wareID, warehouses, false, mon)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		// Extract, to nowhere but the one file.
+		//  We cancel the unpack as soon as we have it.
+		unpackCtx, cancel := context.WithCancel(filters.WithIDMap(ctx, filters.IDMap{}))
+		defer cancel()
+		pfs := pickfs.New(path, w, cancel)
+		_, _, _, err = unpacker(unpackCtx, pfs, api.FilesetUnpackFilter_Lossless, wareID, reader, mon)
+		switch {
+		case err == nil:
+			// pass
+		case pfs.Found() != fs.Type_Invalid && Category(err) == rio.ErrCancelled && ctx.Err() == nil:
+			// We stopped it ourselves; that's fine.
+		default:
+			return err
+		}
+		return CheckPicked(pfs, path, wareID)
+	}
+}
+
+// Cats a file from a ware opened as a filesystem: so, only once the whole ware is verified.
+func catVerified(
+	ctx context.Context,
+	open OpenFSFunc,
+	wareID api.WareID,
+	path fs.RelPath,
+	w io.Writer,
+	warehouses []api.WarehouseLocation,
+	mon rio.Monitor,
+) (err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	wfs, err := open(ctx, wareID, warehouses, mon)
+	if err != nil {
+		return err
+	}
+	defer wfs.Close()
+
+	found := fs.Type_Invalid
+	if fmeta, err := wfs.LStat(path); err == nil {
+		found = fmeta.Type
+	}
+	if err := checkFound(found, path, wareID); err != nil {
+		return err
+	}
+	f, err := wfs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return Errorf(rio.ErrWareCorrupt, "error reading file body: %s", err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(w, f); err != nil {
+		return Errorf(rio.ErrInoperablePath, "error writing file body: %s", err)
+	}
+	return nil
+}
+
+/*
+	CheckPicked returns an error if what was found at the path in the
+	pickfs is not a file; it's shared with the git transmat.
+*/
+func CheckPicked(pfs *pickfs.FS, path fs.RelPath, wareID api.WareID) error {
+	return checkFound(pfs.Found(), path, wareID)
+}
+
+func checkFound(found fs.Type, path fs.RelPath, wareID api.WareID) error {
+	switch found {
+	case fs.Type_File:
+		return nil
+	case fs.Type_Invalid:
+		return Errorf(rio.ErrUsage, "path %q not found in ware %q", path, wareID)
+	default:
+		return Errorf(rio.ErrUsage, "path %q in ware %q is a %s, not a file", path, wareID, found)
+	}
+}
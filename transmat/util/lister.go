@@ -0,0 +1,41 @@
+package util
+
+import (
+	"context"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+)
+
+/*
+	ListFunc reads a ware and returns the records of every entry in it,
+	without placing anything on the local filesystem.
+	The whole ware is read and its hash verified before anything is returned.
+
+	(There's no list func in the API; this is rio's own.)
+*/
+type ListFunc func(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to list.
+	warehouses []api.WarehouseLocation, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (fshash.Bucket, error)
+
+// CreateLister generates a ListFunc shared by both zip and tar transmat implementations.
+// It opens the ware as a filesystem, which verifies it, and keeps the records.
+func CreateLister(open OpenFSFunc) ListFunc {
+	return func(
+		ctx context.Context,
+		wareID api.WareID,
+		warehouses []api.WarehouseLocation,
+		mon rio.Monitor,
+	) (fshash.Bucket, error) {
+		wfs, err := open(ctx, wareID, warehouses, mon)
+		if err != nil {
+			return nil, err
+		}
+		defer wfs.Close()
+		return wfs.Records(), nil
+	}
+}
@@ -0,0 +1,96 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/transmat/mixins/warefs"
+)
+
+/*
+	OpenFSFunc opens a ware as a read-only filesystem, without unpacking
+	it: the ware is fetched and indexed, and then each file is read from
+	the packed ware only as it's read from the filesystem.  The FS must
+	be closed when done with; the ware is kept locally until then.
+
+	The whole ware is read while indexing, and its hash verified, before
+	the FS is returned.  Limits are enforced while indexing, as by unpacking.
+
+	(There's no such func in the API; this is rio's own.)
+*/
+type OpenFSFunc func(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to open.
+	warehouses []api.WarehouseLocation, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (*warefs.FS, error)
+
+/*
+	Indexes a ware, read from the reader, into a new warefs.FS; and returns
+	the WareID of what it read, as an unpack would.
+	The reader is only good until it returns; so whatever the FS will read
+	bodies from later has to be buffered.
+*/
+type indexFn func(
+	ctx context.Context,
+	wareID api.WareID,
+	reader io.Reader,
+	mon rio.Monitor,
+) (
+	wfs *warefs.FS,
+	prefilterWareID api.WareID,
+	err error,
+)
+
+// CreateFSOpener generates an OpenFSFunc shared by both zip and tar transmat implementations.
+func CreateFSOpener(t api.PackType, indexer indexFn) OpenFSFunc {
+	return func(
+		ctx context.Context,
+		wareID api.WareID,
+		warehouses []api.WarehouseLocation,
+		mon rio.Monitor,
+	) (_ *warefs.FS, err error) {
+		if mon.Chan != nil {
+			defer close(mon.Chan)
+		}
+		defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+		// Sanitize arguments.
+		if wareID.Type != t {
+			return nil, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", t, wareID.Type)
+		}
+
+		// Pick a warehouse and get a reader.
+		reader, err := PickReader(ctx, wareID, warehouses, false, mon)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		// Index it.
+		wfs, prefilterWareID, err := indexer(ctx, wareID, reader, mon)
+		if err != nil {
+			return nil, err
+		}
+
+		// Check for hash mismatch: nothing may be read from a ware that
+		//  isn't the one asked for.
+		if prefilterWareID != wareID {
+			wfs.Close()
+			return nil, ErrorDetailed(
+				rio.ErrWareHashMismatch,
+				fmt.Sprintf("hash mismatch: expected %q, got %q", wareID, prefilterWareID),
+				map[string]string{
+					"expected": wareID.String(),
+					"actual":   prefilterWareID.String(),
+				},
+			)
+		}
+		return wfs, nil
+	}
+}
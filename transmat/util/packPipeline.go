@@ -0,0 +1,229 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"runtime"
+
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+	"github.com/polydawn/rio/transmat/mixins/statcache"
+	. "github.com/warpfork/go-errcat"
+)
+
+// Files up to this size are read (and hashed) ahead of the writer, whole;
+//  larger ones are streamed by the writer itself, so memory stays bounded.
+const packPrefetchLimit = 1 << 20
+
+/*
+	PackEntry is one entry found by a pack's walk, as handed to the writer.
+*/
+type PackEntry struct {
+	Metadata *fs.Metadata
+
+	isFile   bool
+	hashOnly bool
+	alg      fshash.Algorithm
+	source   io.ReadCloser   // the file just as the walk put it (see Source).
+	file     io.ReadCloser   // the body, until it's been read (nil if the hash was cached).
+	stat     *statcache.Stat // if the stat cache is in use, and the file can be cached.
+	body     []byte          // if prefetched: the whole content.
+	hash     []byte          // if prefetched, hashed, or cached: its hash.
+	reader   *HashingReader  // if not prefetched: the stream to write.
+	err      error           // if prefetching failed.
+	done     chan struct{}   // closed when the entry is ready for the writer.
+}
+
+/*
+	Returns the content to write, if the entry is a file; or nil.
+	Always nil if the pipeline is only hashing.
+*/
+func (e *PackEntry) Body() io.Reader {
+	switch {
+	case !e.isFile || e.hashOnly:
+		return nil
+	case e.reader != nil:
+		return e.reader
+	default:
+		return bytes.NewReader(e.body)
+	}
+}
+
+/*
+	Returns the file just as the walk put it (or nil, if not a file), so the
+	writer can see anything more the walk attached to it.
+	It's for looking at, only: read the Body.
+*/
+func (e *PackEntry) Source() io.ReadCloser {
+	return e.source
+}
+
+/*
+	Returns the hash of the content, if the entry is a file; or nil.
+	Must only be called once the body (if any) has been read to the end.
+*/
+func (e *PackEntry) ContentHash() []byte {
+	switch {
+	case !e.isFile:
+		return nil
+	case e.reader != nil:
+		return e.reader.Hasher.Sum(nil)
+	default:
+		return e.hash
+	}
+}
+
+/*
+	PackPipeline runs a pack's walk and its archive writer concurrently,
+	with a pool of workers reading and hashing the contents of files ahead
+	of the writer.  The writer still sees every entry in the order the walk
+	put it, so the archive comes out exactly as if written in one pass;
+	but packing many files can keep many cores busy.
+*/
+type PackPipeline struct {
+	// The algorithm to hash file contents with.
+	Algorithm fshash.Algorithm
+
+	// If true, the writer is never handed file bodies: only their hashes.
+	//  This is for packing with no warehouse, when only the WareID matters.
+	HashOnly bool
+
+	// Optionally, a stat cache.  It's always updated with the hashes of the
+	//  files packed; but cached hashes are only used in HashOnly mode.
+	//  When writing a ware, every file is read and hashed as it's written,
+	//  so the ware can never disagree with its hash.
+	StatCache *statcache.Cache
+}
+
+/*
+	Runs the pipeline.
+
+	The walk func is called on its own goroutine, and should `put` each
+	entry (and the file's body, if it is one; put takes care of closing it).
+	The write func is called with each entry in turn, on the calling
+	goroutine; it should write the entry, and read its body (if any) to
+	the end, after which its ContentHash is available.
+
+	If either func errors, the other is cancelled, and the error returned.
+*/
+func (pp PackPipeline) Run(
+	ctx context.Context,
+	walk func(ctx context.Context, put func(fmeta *fs.Metadata, file io.ReadCloser) error) error,
+	write func(entry *PackEntry) error,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Start the workers.  They only ever see files small enough to prefetch,
+	//  or, when only hashing, any file whose hash wasn't cached.
+	workers := runtime.GOMAXPROCS(0)
+	work := make(chan *PackEntry, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for entry := range work {
+				prefetch(entry)
+			}
+		}()
+	}
+
+	// Start the walk.  The queue of entries between it and the writer is the
+	//  window of work in flight; the walk blocks while it's full.
+	queue := make(chan *PackEntry, 4*workers)
+	var walkErr error
+	go func() {
+		defer close(queue)
+		defer close(work)
+		walkErr = walk(ctx, func(fmeta *fs.Metadata, file io.ReadCloser) error {
+			entry := &PackEntry{
+				Metadata: fmeta,
+				isFile:   file != nil,
+				source:   file,
+				hashOnly: pp.HashOnly,
+				alg:      pp.Algorithm,
+				file:     file,
+				done:     make(chan struct{}),
+			}
+			// Stat for the cache before anything reads the file.
+			//  It's the open file that's stat'd, not the path, which may
+			//  have been replaced since the walk opened it.
+			if f, ok := file.(statcache.File); ok && pp.StatCache != nil {
+				if st, ok := pp.StatCache.Stat(f); ok {
+					entry.stat = &st
+					if pp.HashOnly {
+						if hash, ok := pp.StatCache.Lookup(fmeta.Name, st); ok {
+							file.Close()
+							entry.file, entry.hash = nil, hash
+						}
+					}
+				}
+			}
+			select {
+			case queue <- entry:
+			case <-ctx.Done():
+				if entry.file != nil {
+					entry.file.Close()
+				}
+				return Errorf(rio.ErrCancelled, "cancelled")
+			}
+			switch {
+			case entry.file != nil && (pp.HashOnly || fmeta.Size <= packPrefetchLimit):
+				work <- entry
+			case entry.file != nil:
+				entry.reader = &HashingReader{entry.file, pp.Algorithm.New()}
+				close(entry.done)
+			default:
+				close(entry.done)
+			}
+			return nil
+		})
+	}()
+
+	// Write everything, in order.
+	//  Whatever happens, drain the queue so every file gets closed.
+	var writeErr error
+	for entry := range queue {
+		<-entry.done
+		if writeErr == nil {
+			if entry.err != nil {
+				writeErr = entry.err
+			} else {
+				writeErr = write(entry)
+			}
+			if writeErr != nil {
+				cancel()
+			} else if entry.stat != nil {
+				pp.StatCache.Record(entry.Metadata.Name, *entry.stat, entry.ContentHash())
+			}
+		}
+		if entry.file != nil {
+			entry.file.Close()
+		}
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	return walkErr
+}
+
+func prefetch(entry *PackEntry) {
+	defer close(entry.done)
+	hasher := entry.alg.New()
+	if entry.hashOnly {
+		if _, err := io.Copy(hasher, entry.file); err != nil {
+			entry.err = Errorf(rio.ErrPackInvalid, "error while reading file for pack: %s", err)
+			return
+		}
+		entry.hash = hasher.Sum(nil)
+		return
+	}
+	body, err := ioutil.ReadAll(entry.file)
+	if err != nil {
+		entry.err = Errorf(rio.ErrPackInvalid, "error while reading file for pack: %s", err)
+		return
+	}
+	hasher.Write(body)
+	entry.body, entry.hash = body, hasher.Sum(nil)
+}
@@ -0,0 +1,41 @@
+package util
+
+import (
+	"context"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+)
+
+/*
+	PackRecordsFunc is a rio.PackFunc which also returns the records of
+	every entry packed: the bucket the WareID is the hash of.
+	With no warehouse, that's the records of a local path as they would
+	be in a ware.
+
+	(There's no such func in the API; this is rio's own.)
+*/
+type PackRecordsFunc func(
+	ctx context.Context, // Long-running call.  Cancellable.
+	packType api.PackType, // The name of pack format.
+	path string, // The fileset to scan and pack (absolute path).
+	filt api.FilesetPackFilter, // Filters we should apply while packing.
+	warehouseAddr api.WarehouseLocation, // Warehouse to save into (or blank to just scan).
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (api.WareID, fshash.Bucket, error)
+
+/*
+	ScanRecordsFunc is a rio.ScanFunc which also returns the records of
+	every entry scanned, after filters: the bucket the WareID is the hash of.
+
+	(There's no such func in the API; this is rio's own.)
+*/
+type ScanRecordsFunc func(
+	ctx context.Context, // Long-running call.  Cancellable.
+	packType api.PackType, // The name of pack format.
+	filt api.FilesetUnpackFilter, // Optionally: filters we should apply while unpacking.
+	placementMode rio.PlacementMode, // For scanning only "None" (cache; the default) and "Direct" (don't cache) are valid.
+	addr api.WarehouseLocation, // The *one* warehouse to fetch from.  Must be a monowarehouse (not a CA-mode).
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (api.WareID, fshash.Bucket, error)
@@ -12,7 +12,10 @@ import (
 	"github.com/polydawn/rio/config"
 	"github.com/polydawn/rio/fs"
 	"github.com/polydawn/rio/fs/osfs"
+	"github.com/polydawn/rio/fs/subtreefs"
 	"github.com/polydawn/rio/transmat/mixins/cache"
+	"github.com/polydawn/rio/transmat/mixins/filters"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
 )
 
 type unpackFn func(
@@ -25,6 +28,7 @@ type unpackFn func(
 ) (
 	prefilterWareID api.WareID,
 	actualWareID api.WareID,
+	records fshash.Bucket, // The filtered records; actualWareID is their hash.
 	err error,
 )
 
@@ -79,17 +83,30 @@ func wrapUnpacker(unpacker unpackFn) rio.UnpackFunc {
 		path2 := fs.MustAbsolutePath(path)
 
 		// Pick a warehouse and get a reader.
-		reader, err := PickReader(wareID, warehouses, false, mon)
+		reader, err := PickReader(ctx, wareID, warehouses, false, mon)
 		if err != nil {
 			return api.WareID{}, err
 		}
 		defer reader.Close()
 
 		// Construct filesystem wrapper to use for all our ops.
-		afs := osfs.New(path2)
+		//  It's confined, since others may be writing in the target path too.
+		//  If only a subtree is wanted, the rest is discarded as it streams by.
+		confinedFs := osfs.NewConfined(path2)
+		defer confinedFs.Close()
+		var afs fs.FS = confinedFs
+		var sfs *subtreefs.FS
+		if subpath := filters.GetUnpackSubpath(ctx); subpath != (fs.RelPath{}) {
+			sfs = subtreefs.New(afs, subpath)
+			afs = sfs
+		}
 
 		// Extract.
-		prefilterWareID, unpackWareID, err := unpacker(ctx, afs, filt, wareID, reader, mon)
+		filt = filters.PinUnpackNow(filt)
+		prefilterWareID, unpackWareID, records, err := unpacker(ctx, afs, filt, wareID, reader, mon)
+		if records != nil {
+			records.Close() // the placed files are the product; the records aren't needed.
+		}
 		if err != nil {
 			return unpackWareID, err
 		}
@@ -107,6 +124,9 @@ func wrapUnpacker(unpacker unpackFn) rio.UnpackFunc {
 				},
 			)
 		}
+		if sfs != nil && !sfs.Reached() {
+			return unpackWareID, Errorf(rio.ErrUsage, "subpath %q not found in ware %q", filters.GetUnpackSubpath(ctx), wareID)
+		}
 		return unpackWareID, nil
 	}
 }
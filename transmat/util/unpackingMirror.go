@@ -31,7 +31,7 @@ func CreateMirror(unpacker unpackFn) rio.MirrorFunc {
 		// Try to read the ware from the target first; if successfull, no-op out.
 		//  We don't fully re-verify the content, because that requires a time
 		//  committment, and we want this command to be fast when run repeatedly.
-		reader, err := PickReader(wareID, []api.WarehouseLocation{target}, false, mon)
+		reader, err := PickReader(ctx, wareID, []api.WarehouseLocation{target}, false, mon)
 		if err == nil {
 			log.MirrorNoop(mon, target, wareID)
 			reader.Close()
@@ -42,14 +42,14 @@ func CreateMirror(unpacker unpackFn) rio.MirrorFunc {
 		//  During mirroring, unlike unpacking, we actually *do* know the hash
 		//  of what we'll be uploading... but there's nothing dramatically better
 		//  we can do with that knowledge.
-		wc, err := OpenWriteController(target, wareID.Type, mon)
+		wc, err := OpenWriteController(ctx, target, wareID.Type, mon)
 		if err != nil {
 			return api.WareID{}, err
 		}
 		defer wc.Close()
 
 		// Pick a source warehouse and get a reader.
-		reader, err = PickReader(wareID, sources, false, mon)
+		reader, err = PickReader(ctx, wareID, sources, false, mon)
 		if err != nil {
 			return api.WareID{}, err
 		}
@@ -62,7 +62,10 @@ func CreateMirror(unpacker unpackFn) rio.MirrorFunc {
 		afs := nilFS.New()
 
 		// We can ignore the pre/post filter wareIDs, since we know its a no-mutation filter.
-		gotWare, _, err := unpacker(ctx, afs, api.FilesetUnpackFilter_Lossless, wareID, reader, mon)
+		gotWare, _, records, err := unpacker(ctx, afs, api.FilesetUnpackFilter_Lossless, wareID, reader, mon)
+		if records != nil {
+			records.Close()
+		}
 		if err != nil {
 			// If errors at this stage: still return a blank wareID, because
 			//  we haven't finished *uploading* it.
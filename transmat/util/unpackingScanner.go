@@ -8,6 +8,8 @@ import (
 	"github.com/polydawn/rio/fs"
 	nilFS "github.com/polydawn/rio/fs/nilfs"
 	"github.com/polydawn/rio/fs/osfs"
+	"github.com/polydawn/rio/transmat/mixins/filters"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
 	. "github.com/warpfork/go-errcat"
 )
 
@@ -24,6 +26,25 @@ import (
 // well-defined even in the case of untrusted networks.
 
 func CreateScanner(t api.PackType, unpacker unpackFn) rio.ScanFunc {
+	scan := CreateRecordsScanner(t, unpacker)
+	return func(
+		ctx context.Context,
+		packType api.PackType,
+		filt api.FilesetUnpackFilter,
+		placementMode rio.PlacementMode,
+		addr api.WarehouseLocation,
+		mon rio.Monitor,
+	) (api.WareID, error) {
+		wareID, records, err := scan(ctx, packType, filt, placementMode, addr, mon)
+		if records != nil {
+			records.Close()
+		}
+		return wareID, err
+	}
+}
+
+// CreateRecordsScanner is CreateScanner, for a func also returning the records scanned.
+func CreateRecordsScanner(t api.PackType, unpacker unpackFn) ScanRecordsFunc {
 	return func(
 		ctx context.Context, // Long-running call.  Cancellable.
 		packType api.PackType, // The name of pack format.
@@ -31,7 +52,7 @@ func CreateScanner(t api.PackType, unpacker unpackFn) rio.ScanFunc {
 		placementMode rio.PlacementMode, // For scanning only "None" (cache; the default) and "Direct" (don't cache) are valid.
 		addr api.WarehouseLocation, // The *one* warehouse to fetch from.  Must be a monowarehouse (not a CA-mode).
 		mon rio.Monitor, // Optionally: callbacks for progress monitoring.
-	) (_ api.WareID, err error) {
+	) (_ api.WareID, _ fshash.Bucket, err error) {
 		if mon.Chan != nil {
 			defer close(mon.Chan)
 		}
@@ -39,10 +60,10 @@ func CreateScanner(t api.PackType, unpacker unpackFn) rio.ScanFunc {
 
 		// Sanitize arguments.
 		if packType != t {
-			return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", t, packType)
+			return api.WareID{}, nil, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", t, packType)
 		}
 		if !filt.IsComplete() {
-			return api.WareID{}, Errorf(rio.ErrUsage, "filters must be completely specified")
+			return api.WareID{}, nil, Errorf(rio.ErrUsage, "filters must be completely specified")
 		}
 		if placementMode == "" {
 			placementMode = rio.Placement_None
@@ -53,9 +74,9 @@ func CreateScanner(t api.PackType, unpacker unpackFn) rio.ScanFunc {
 		// Dial warehouse.
 		//  Note how this is a subset of the usual accepted warehouses;
 		//  it must be a monowarehouse, not a legit CA storage bucket.
-		reader, err := PickReader(api.WareID{t, "-"}, []api.WarehouseLocation{addr}, true, mon)
+		reader, err := PickReader(ctx, api.WareID{t, "-"}, []api.WarehouseLocation{addr}, true, mon)
 		if err != nil {
-			return api.WareID{}, err
+			return api.WareID{}, nil, err
 		}
 		defer reader.Close()
 
@@ -78,7 +99,8 @@ func CreateScanner(t api.PackType, unpacker unpackFn) rio.ScanFunc {
 		//  an expected one to assert against.
 		//  TODO: the ware used by the buffer internally will need to be derived from addr
 		//  once caching is supported.
-		_, unpackedWareID, err := unpacker(ctx, afs, filt, api.WareID{t, "-"}, reader, mon)
-		return unpackedWareID, err
+		filt = filters.PinUnpackNow(filt)
+		_, unpackedWareID, records, err := unpacker(ctx, afs, filt, api.WareID{t, "-"}, reader, mon)
+		return unpackedWareID, records, err
 	}
 }
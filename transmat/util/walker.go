@@ -0,0 +1,224 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	nilFS "github.com/polydawn/rio/fs/nilfs"
+	"github.com/polydawn/rio/fsOp"
+	"github.com/polydawn/rio/transmat/mixins/filters"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+)
+
+/*
+	WalkFunc reads a ware and puts each entry in it, just as the walk of a
+	PackPipeline puts each entry of a fileset on disk -- so a ware can be
+	packed straight into another format, without placing anything on the
+	local filesystem.
+
+	Each put must have read the body (if any) to the end, or closed it,
+	before it returns.  The whole ware is read and its hash verified
+	before the walk returns; if it doesn't match, the walk errors, and
+	anything made from the entries put should be thrown away.
+
+	(There's no walk func in the API; this is rio's own.)
+*/
+type WalkFunc func(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to walk.
+	warehouses []api.WarehouseLocation, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.  Not closed.
+	put func(fmeta *fs.Metadata, body io.ReadCloser) error, // Called with each entry.
+) error
+
+/*
+	ConvertFunc packs the entries of a ware (as read by a WalkFunc of its
+	pack type) into another pack type, saving it in the target warehouse.
+	The fileset is the same, so the WareID returned has the same hash; if
+	the new pack type can't hold the fileset exactly, it's an error.
+
+	(There's no convert func in the API; this is rio's own.)
+*/
+type ConvertFunc func(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to convert.
+	walk WalkFunc, // The WalkFunc for the ware's pack type.
+	warehouses []api.WarehouseLocation, // Warehouses we can try to fetch from.
+	target api.WarehouseLocation, // Warehouse to save into.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (api.WareID, error)
+
+// CreateWalker generates a WalkFunc shared by both zip and tar transmat implementations.
+// It's an unpack into a filesystem which puts each file it's given.
+func CreateWalker(t api.PackType, unpacker unpackFn) WalkFunc {
+	return func(
+		ctx context.Context,
+		wareID api.WareID,
+		warehouses []api.WarehouseLocation,
+		mon rio.Monitor,
+		put func(fmeta *fs.Metadata, body io.ReadCloser) error,
+	) (err error) {
+		defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+		// Sanitize arguments.
+		if wareID.Type != t {
+			return Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", t, wareID.Type)
+		}
+
+		// Pick a warehouse and get a reader.
+		reader, err := PickReader(ctx, wareID, warehouses, false, mon)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		// Extract, into the puts.
+		//  As with listing, the entries must be the ware's own: so, lossless
+		//  filters, and no id remapping.
+		ctx = filters.WithIDMap(ctx, filters.IDMap{})
+		efs := &entryFS{FS: nilFS.New(), put: put, dirs: map[fs.RelPath]struct{}{}, inferred: map[fs.RelPath]fs.Metadata{}}
+		prefilterWareID, _, records, err := unpacker(ctx, efs, api.FilesetUnpackFilter_Lossless, wareID, reader, mon)
+		if records != nil {
+			records.Close()
+		}
+		if efs.err != nil {
+			return efs.err // the unpack would've wrapped it; but it's the put's own.
+		}
+		if err != nil {
+			return err
+		}
+		if err := efs.flush(); err != nil {
+			return err
+		}
+
+		// Check for hash mismatch.
+		if prefilterWareID != wareID {
+			return ErrorDetailed(
+				rio.ErrWareHashMismatch,
+				fmt.Sprintf("hash mismatch: expected %q, got %q", wareID, prefilterWareID),
+				map[string]string{
+					"expected": wareID.String(),
+					"actual":   prefilterWareID.String(),
+				},
+			)
+		}
+		return nil
+	}
+}
+
+/*
+	Returns an error if a ware converted from another doesn't have the
+	same hash: which means the new pack type couldn't hold the fileset
+	exactly.
+*/
+func CheckConverted(wareID, converted api.WareID) error {
+	if converted.Hash == wareID.Hash {
+		return nil
+	}
+	return ErrorDetailed(
+		rio.ErrPackInvalid,
+		fmt.Sprintf("ware %q can't be converted to %s exactly: it would become %q", wareID, converted.Type, converted),
+		map[string]string{
+			"expected": wareID.String(),
+			"actual":   converted.String(),
+		},
+	)
+}
+
+// entryFS takes each file placed in it whole, and puts it; everything
+//  else an unpack does (like fixing up dir times at the end) is discarded.
+type entryFS struct {
+	fs.FS
+	put      func(fmeta *fs.Metadata, body io.ReadCloser) error
+	dirs     map[fs.RelPath]struct{}
+	inferred map[fs.RelPath]fs.Metadata // dirs held back until seen, or the end.
+	err      error                      // the first error from put, if any.
+}
+
+var _ fsOp.Placer = &entryFS{}
+
+func (efs *entryFS) PlaceFile(fmeta fs.Metadata, body io.Reader) error {
+	// A dir may be placed again, if it was inferred before it was seen.
+	//  So a dir that could have been inferred isn't put until either it's
+	//  placed again (with its own metadata), or the walk ends; it may come
+	//  after its children in the new ware, as it did in the old one.
+	if fmeta.Type == fs.Type_Dir {
+		_, seen := efs.dirs[fmeta.Name]
+		_, held := efs.inferred[fmeta.Name]
+		efs.dirs[fmeta.Name] = struct{}{}
+		switch {
+		case held:
+			delete(efs.inferred, fmeta.Name)
+		case seen:
+			return nil
+		case isInferredDir(fmeta):
+			efs.inferred[fmeta.Name] = fmeta
+			return nil
+		}
+	}
+	if fmeta.Type != fs.Type_File {
+		efs.err = efs.put(&fmeta, nil)
+		return efs.err
+	}
+
+	// Files must be read before we return: the unpack moves on after.
+	eb := &entryBody{r: body, done: make(chan struct{})}
+	if efs.err = efs.put(&fmeta, eb); efs.err != nil {
+		return efs.err
+	}
+	<-eb.done
+	return nil
+}
+
+// Puts the dirs still held back, which were never seen but inferred.
+func (efs *entryFS) flush() error {
+	names := make([]string, 0, len(efs.inferred))
+	for name := range efs.inferred {
+		names = append(names, name.String())
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmeta := efs.inferred[fs.MustRelPath(name)]
+		if efs.err = efs.put(&fmeta, nil); efs.err != nil {
+			return efs.err
+		}
+	}
+	return nil
+}
+
+// Whether a dir has just the metadata an unpack gives the dirs it infers.
+func isInferredDir(fmeta fs.Metadata) bool {
+	conjured := fshash.DefaultDirMetadata()
+	conjured.Name = fmeta.Name
+	return reflect.DeepEqual(fmeta, conjured)
+}
+
+// entryBody is the body of a file being put; closing it lets the unpack go on.
+type entryBody struct {
+	r    io.Reader
+	once sync.Once
+	done chan struct{}
+}
+
+func (eb *entryBody) Read(bs []byte) (int, error) {
+	n, err := eb.r.Read(bs)
+	// Errors already categorized (e.g. limits exceeded) are left as they are.
+	if err != nil && err != io.EOF && Category(err) == nil {
+		return n, Errorf(rio.ErrWareCorrupt, "error while reading ware: %s", err)
+	}
+	return n, err
+}
+
+func (eb *entryBody) Close() error {
+	eb.once.Do(func() { close(eb.done) })
+	return nil
+}
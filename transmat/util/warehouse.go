@@ -1,7 +1,9 @@
 package util
 
 import (
+	"context"
 	"io"
+	"io/ioutil"
 	"net/url"
 
 	. "github.com/warpfork/go-errcat"
@@ -16,9 +18,44 @@ import (
 
 // The shared bits of warehouseAddr parse and dial code.
 
+// StdioWarehouse is the warehouse address meaning stdin, when reading a ware,
+//  or stdout, when writing one.  It only works if the context carries them
+//  (see WithStdio); so, really, only from the CLI.
+const StdioWarehouse api.WarehouseLocation = "-"
+
+type stdioCtxKey struct{}
+
+type stdio struct {
+	in  io.Reader
+	out io.Writer
+}
+
+// Returns a context in which the StdioWarehouse reads from in and writes to out.
+//  Either may be nil, if it's not to be used.
+func WithStdio(ctx context.Context, in io.Reader, out io.Writer) context.Context {
+	return context.WithValue(ctx, stdioCtxKey{}, stdio{in, out})
+}
+
+func getStdin(ctx context.Context) (io.Reader, error) {
+	streams, _ := ctx.Value(stdioCtxKey{}).(stdio)
+	if streams.in == nil {
+		return nil, Errorf(rio.ErrUsage, "warehouse %q (stdin) is not available here", StdioWarehouse)
+	}
+	return streams.in, nil
+}
+
+func getStdout(ctx context.Context) (io.Writer, error) {
+	streams, _ := ctx.Value(stdioCtxKey{}).(stdio)
+	if streams.out == nil {
+		return nil, Errorf(rio.ErrUsage, "warehouse %q (stdout) is not available here", StdioWarehouse)
+	}
+	return streams.out, nil
+}
+
 // Pick a warehouse.
 //  With K/V warehouses, this takes the form of "pick the first one that answers".
 func PickReader(
+	ctx context.Context,
 	wareID api.WareID,
 	warehouses []api.WarehouseLocation,
 	requireMono bool,
@@ -28,6 +65,15 @@ func PickReader(
 
 	var anyWarehouses bool // for clarity in final error messages
 	for _, addr := range warehouses {
+		// Stdin is taken to be the ware, whatever it is; it'll be verified like any other.
+		if addr == StdioWarehouse {
+			stdin, err := getStdin(ctx)
+			if err != nil {
+				return nil, err
+			}
+			log.WareReaderOpened(mon, addr, wareID)
+			return ioutil.NopCloser(stdin), nil
+		}
 		// REVIEW ... Do I really have to parse this again?  is this sanely encapsulated?
 		u, err := url.Parse(string(addr))
 		if err != nil {
@@ -84,6 +130,7 @@ func PickReader(
 }
 
 func OpenWriteController(
+	ctx context.Context,
 	warehouseAddr api.WarehouseLocation,
 	packType api.PackType,
 	mon rio.Monitor,
@@ -95,6 +142,13 @@ func OpenWriteController(
 		wc = warehouse.NullBlobstoreWriteController{}
 		return wc, nil
 	}
+	if warehouseAddr == StdioWarehouse {
+		stdout, err := getStdout(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return stdoutWriteController{stdout}, nil
+	}
 	u, err := url.Parse(string(warehouseAddr))
 	if err != nil {
 		return nil, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
@@ -127,3 +181,17 @@ func OpenWriteController(
 		return nil, Errorf(rio.ErrUsage, "this save operation doesn't support %q scheme (valid options are 'file' or 'ca+file')", u.Scheme)
 	}
 }
+
+/*
+	Writes the ware straight through to stdout.
+
+	There's no taking it back: if the pack fails partway, whatever was
+	written is already gone down the pipe.  (The exit code says so.)
+*/
+type stdoutWriteController struct {
+	w io.Writer
+}
+
+func (wc stdoutWriteController) Write(bs []byte) (int, error) { return wc.w.Write(bs) }
+func (stdoutWriteController) Close() error                    { return nil }
+func (stdoutWriteController) Commit(wareID api.WareID) error  { return nil }
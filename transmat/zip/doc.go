@@ -13,7 +13,12 @@ import (
 const PackType = api.PackType("zip")
 
 var (
-	Mirror rio.MirrorFunc = util.CreateMirror(unpackZip)
-	Scan   rio.ScanFunc   = util.CreateScanner(PackType, unpackZip)
-	Unpack rio.UnpackFunc = util.CreateUnpack(PackType, unpackZip)
+	Cat         util.CatFunc         = util.CreateCatter(PackType, unpackZip, OpenFS)
+	List        util.ListFunc        = util.CreateLister(OpenFS)
+	Mirror      rio.MirrorFunc       = util.CreateMirror(unpackZip)
+	OpenFS      util.OpenFSFunc      = util.CreateFSOpener(PackType, indexZip)
+	Scan        rio.ScanFunc         = util.CreateScanner(PackType, unpackZip)
+	ScanRecords util.ScanRecordsFunc = util.CreateRecordsScanner(PackType, unpackZip)
+	Unpack      rio.UnpackFunc       = util.CreateUnpack(PackType, unpackZip)
+	Walk        util.WalkFunc        = util.CreateWalker(PackType, unpackZip)
 )
@@ -0,0 +1,85 @@
+package ziptrans
+
+import (
+	"context"
+	"io"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+	"github.com/polydawn/rio/transmat/util"
+)
+
+var (
+	_ util.ConvertFunc = Convert
+)
+
+// Convert packs the entries of a ware of any pack type into a zip.
+func Convert(
+	ctx context.Context,
+	wareID api.WareID,
+	walk util.WalkFunc,
+	warehouses []api.WarehouseLocation,
+	warehouseAddr api.WarehouseLocation,
+	mon rio.Monitor,
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Hash with the algorithm the ware was made with: the hash mustn't change.
+	alg, err := fshash.AlgorithmForWare(ctx, wareID.Hash)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "%s", err)
+	}
+	ctx = fshash.WithAlgorithm(ctx, alg)
+
+	// Connect to warehouse, and get write controller opened.
+	wc, err := util.OpenWriteController(ctx, warehouseAddr, PackType, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer wc.Close()
+
+	// Walk the ware, and zip!
+	//  Zip only has files, dirs, and symlinks; for the rest of the metadata,
+	//  it keeps times to the second, and no xattrs.  Anything else is lost
+	//  on the way in; if that changes anything, the hash check will say so.
+	//  (Only files have a size, as for a fileset on disk.)
+	zipWriter := newZipWriter(wc)
+	resultWareID, records, err := packZip(ctx, func(ctx context.Context, put func(*fs.Metadata, io.ReadCloser) error) error {
+		return walk(ctx, wareID, warehouses, mon, func(fmeta *fs.Metadata, body io.ReadCloser) error {
+			switch fmeta.Type {
+			case fs.Type_File, fs.Type_Dir, fs.Type_Symlink:
+				// pass
+			default:
+				return Errorf(rio.ErrPackInvalid, "ware %q can't be converted to zip: %q is a %s", wareID, fmeta.Name, fmeta.Type)
+			}
+			if fmeta.Type != fs.Type_File {
+				fmeta.Size = 0
+			}
+			fmeta.Mtime = fmeta.Mtime.Truncate(time.Second)
+			fmeta.Xattrs = nil
+			return put(fmeta, body)
+		})
+	}, nil, zipWriter)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	records.Close()
+	// Close all the intermediate writer layers to ensure they've flushed.
+	if err := zipWriter.Close(); err != nil {
+		return api.WareID{}, Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+
+	// If we made it all the way with no errors, and the fileset is unchanged, commit.
+	if err := util.CheckConverted(wareID, resultWareID); err != nil {
+		return api.WareID{}, err
+	}
+	return resultWareID, wc.Commit(resultWareID)
+}
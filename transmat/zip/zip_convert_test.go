@@ -0,0 +1,55 @@
+package ziptrans
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/testutil"
+	"github.com/polydawn/rio/transmat/mixins/tests"
+)
+
+func TestZipConvert(t *testing.T) {
+	Convey("Spec compliance: zip convert", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			tests.CheckConvertRoundTrip(PackType, Pack, func(ctx context.Context, wareID api.WareID, warehouses []api.WarehouseLocation, target api.WarehouseLocation, mon rio.Monitor) (api.WareID, error) {
+				return Convert(ctx, wareID, Walk, warehouses, target, mon)
+			}, packInOrder)
+		}),
+	)
+}
+
+// Packs the files given, in just the order given, to a zip at the path.
+func packInOrder(path string, files []tests.FixtureFile) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zipWriter := newZipWriter(f)
+	walk := func(ctx context.Context, put func(*fs.Metadata, io.ReadCloser) error) error {
+		for _, file := range files {
+			fmeta := file.Metadata
+			var body io.ReadCloser
+			if fmeta.Type == fs.Type_File {
+				body = ioutil.NopCloser(bytes.NewReader(file.Body))
+			}
+			if err := put(&fmeta, body); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if _, _, err := packZip(context.Background(), walk, nil, zipWriter); err != nil {
+		return err
+	}
+	return zipWriter.Close()
+}
@@ -3,6 +3,10 @@ package ziptrans
 import (
 	"archive/zip"
 	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
 
 	"github.com/polydawn/go-timeless-api/rio"
 	"github.com/polydawn/rio/fs"
@@ -11,6 +15,8 @@ import (
 )
 
 // MetadataToZipHdr mutates zip.FileHeader fields to match the given fmeta.
+// Nothing but the fmeta goes into it, and times are in UTC whatever the local
+// zone, so the same fmeta always yields the same bytes.
 func MetadataToZipHdr(fmeta *fs.Metadata, hdr *zip.FileHeader) {
 	hdr.Name = fmeta.Name.String()
 	if fmeta.Type == fs.Type_Dir {
@@ -23,7 +29,7 @@ func MetadataToZipHdr(fmeta *fs.Metadata, hdr *zip.FileHeader) {
 	hdr.UncompressedSize64 = uint64(fmeta.Size)
 	hdr.Extra = append(zipUnix2ExtraHeader(fmeta), zipUnix3ExtraHeader(fmeta)...)
 	hdr.SetMode(osfs.ModeToOs(fmeta))
-	hdr.SetModTime(fmeta.Mtime)
+	hdr.SetModTime(fmeta.Mtime) // n.b. converts to UTC.
 }
 
 type zipExtraHeaderID uint16
@@ -159,3 +165,15 @@ func ZipHdrToMetadata(hdr *zip.FileHeader, fmeta *fs.Metadata) error {
 	//TODO: xattrs
 	return nil
 }
+
+// Zstd, as APPNOTE 6.3.7 numbers it.  archive/zip doesn't know it; we register it to read.
+const zipMethodZstd = 93
+
+func decompressZstd(r io.Reader) io.ReadCloser {
+	// One goroutine: files are unpacked one at a time anyway.
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		panic(fmt.Errorf("invalid zstd decoder options: %s", err))
+	}
+	return d.IOReadCloser()
+}
@@ -0,0 +1,153 @@
+package ziptrans
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/transmat/mixins/buffer"
+	"github.com/polydawn/rio/transmat/mixins/fshash"
+	"github.com/polydawn/rio/transmat/mixins/limits"
+	"github.com/polydawn/rio/transmat/mixins/warefs"
+	"github.com/polydawn/rio/transmat/util"
+)
+
+/*
+	Indexes a zip into a warefs.FS, straight from the central directory;
+	and returns the WareID of what was indexed, as unpacking it would.
+
+	Stored entries are read from the buffered zip by offset; compressed
+	ones are decompressed from their start whenever read.  Every body is
+	read through (and hashed) once while indexing, so the limits are
+	enforced as they would be by unpacking it.
+*/
+func indexZip(
+	ctx context.Context,
+	wareID api.WareID,
+	reader io.Reader,
+	mon rio.Monitor,
+) (_ *warefs.FS, prefilterWareID api.WareID, err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Hash with the algorithm the ware's hash says it was made with.
+	alg, err := fshash.AlgorithmForWare(ctx, wareID.Hash)
+	if err != nil {
+		return nil, api.WareID{}, Errorf(rio.ErrUsage, "%s", err)
+	}
+
+	readerAt, closer, err := buffer.SectionReader(ctx, wareID, reader, mon)
+	if err != nil {
+		return nil, api.WareID{}, err
+	}
+	wfs := warefs.New(closer)
+	defer func() {
+		if err != nil {
+			wfs.Close()
+		}
+	}()
+
+	// Count everything against the limits, if any.
+	tracker := limits.NewTracker(ctx)
+	tracker.WareSize(readerAt.Size())
+
+	// Read the zip's index.
+	zr, err := zip.NewReader(readerAt, readerAt.Size())
+	if err != nil {
+		return nil, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt zip: %s", err)
+	}
+	zr.RegisterDecompressor(zipMethodZstd, decompressZstd)
+
+	for _, zf := range zr.File {
+		if ctx.Err() != nil {
+			return nil, api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+		}
+
+		// Reshuffle metainfo to our default format.
+		fmeta := fs.Metadata{}
+		if err := ZipHdrToMetadata(&zf.FileHeader, &fmeta); err != nil {
+			return nil, api.WareID{}, err
+		}
+		if strings.HasPrefix(fmeta.Name.String(), "..") {
+			return nil, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt zip: paths that use '../' to leave the base dir are invalid")
+		}
+		if err := tracker.Entry(&fmeta); err != nil {
+			return nil, api.WareID{}, err
+		}
+
+		// Add it, noting where to find the body.
+		switch fmeta.Type {
+		case fs.Type_File:
+			body := warefs.Body{Size: fmeta.Size}
+			if zf.Method == zip.Store {
+				offset, err := zf.DataOffset()
+				if err != nil {
+					return nil, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt zip: %s", err)
+				}
+				body.ReaderAt = io.NewSectionReader(readerAt, offset, int64(zf.CompressedSize64))
+			} else {
+				zf := zf
+				body.Open = func() (io.ReadCloser, error) { return openZipFile(zf) }
+			}
+			body.Hash, err = readZipBody(zf, &fmeta, tracker, alg)
+			if err != nil {
+				return nil, api.WareID{}, err
+			}
+			if err := wfs.Add(fmeta, &body); err != nil {
+				return nil, api.WareID{}, err
+			}
+		case fs.Type_Symlink:
+			buf := new(bytes.Buffer)
+			r, err := openZipFile(zf)
+			if err != nil {
+				return nil, api.WareID{}, err
+			}
+			_, err = buf.ReadFrom(r)
+			r.Close()
+			if err != nil {
+				return nil, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt zip: %s", err)
+			}
+			fmeta.Linkname = buf.String()
+			if err := wfs.Add(fmeta, nil); err != nil {
+				return nil, api.WareID{}, err
+			}
+		case fs.Type_Dir:
+			if err := wfs.Add(fmeta, nil); err != nil {
+				return nil, api.WareID{}, err
+			}
+		default:
+			return nil, api.WareID{}, Errorf(rio.ErrPackInvalid, "zip pack does not support files of type %v", fmeta.Type)
+		}
+	}
+
+	// Hash the thing!
+	hash, err := wfs.WareHash(alg)
+	if err != nil {
+		return nil, api.WareID{}, err
+	}
+	return wfs, api.WareID{"zip", hash}, nil
+}
+
+// Reads through a file's body, counting it against the limits; returns its hash.
+func readZipBody(zf *zip.File, fmeta *fs.Metadata, tracker *limits.Tracker, alg fshash.Algorithm) ([]byte, error) {
+	r, err := openZipFile(zf)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	reader := &util.HashingReader{R: tracker.Body(fmeta, r), Hasher: alg.New()}
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		if err := tracker.Err(); err != nil {
+			return nil, err
+		}
+		return nil, Errorf(rio.ErrWareCorrupt, "corrupt zip: %s", err)
+	}
+	return reader.Hasher.Sum(nil), nil
+}
@@ -0,0 +1,39 @@
+package ziptrans
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/osfs"
+	"github.com/polydawn/rio/testutil"
+	"github.com/polydawn/rio/transmat/mixins/tests"
+)
+
+func TestZipOpenFS(t *testing.T) {
+	Convey("Spec compliance: Zip opened as a filesystem", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			Convey("Using kvfs warehouse, in content-addressable mode:", func() {
+				testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+					osfs.New(tmpDir).Mkdir(fs.MustRelPath("bounce"), 0755)
+					tests.CheckOpenFS(PackType, Pack, OpenFS, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+					tests.CheckOpenFSLimits(PackType, Pack, OpenFS, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+				})
+			})
+			Convey("With files stored uncompressed (so read by offset):", func() {
+				testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+					osfs.New(tmpDir).Mkdir(fs.MustRelPath("bounce"), 0755)
+					packStored := func(ctx context.Context, packType api.PackType, path string, filt api.FilesetPackFilter, warehouse api.WarehouseLocation, mon rio.Monitor) (api.WareID, error) {
+						return Pack(WithMethod(ctx, Method_Store), packType, path, filt, warehouse, mon)
+					}
+					tests.CheckOpenFS(PackType, packStored, OpenFS, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+				})
+			})
+		}),
+	)
+}
@@ -0,0 +1,127 @@
+package ziptrans
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+
+	api "github.com/polydawn/go-timeless-api"
+	"github.com/polydawn/go-timeless-api/rio"
+	"github.com/polydawn/rio/fs"
+	nilFS "github.com/polydawn/rio/fs/nilfs"
+	"github.com/polydawn/rio/transmat/mixins/tests"
+)
+
+// Returns a walk putting the fixture's files, just as a walk of them on disk would.
+func walkFixture(files []tests.FixtureFile) func(ctx context.Context, put func(*fs.Metadata, io.ReadCloser) error) error {
+	return func(ctx context.Context, put func(*fs.Metadata, io.ReadCloser) error) error {
+		for _, ff := range files {
+			fmeta := ff.Metadata
+			var body io.ReadCloser
+			if fmeta.Type == fs.Type_File {
+				body = ioutil.NopCloser(bytes.NewReader(ff.Body))
+			}
+			if err := put(&fmeta, body); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Packs the fixture into a zip in memory, using the method asked for; returns the zip and its WareID.
+func packFixture(ctx context.Context, files []tests.FixtureFile) ([]byte, api.WareID) {
+	var buf bytes.Buffer
+	zw := newZipWriter(&buf)
+	wareID, _, err := packZip(ctx, walkFixture(files), nil, zw)
+	So(err, ShouldBeNil)
+	So(zw.Close(), ShouldBeNil)
+	return buf.Bytes(), wareID
+}
+
+// Writes the fixture into a zip in memory, with every file compressed by the given method (and compressor).
+func writeFixtureWithMethod(files []tests.FixtureFile, method uint16, comp zip.Compressor) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zw.RegisterCompressor(method, comp)
+	for _, ff := range files {
+		fmeta := ff.Metadata
+		hdr := &zip.FileHeader{}
+		MetadataToZipHdr(&fmeta, hdr)
+		hdr.Method = method
+		w, err := zw.CreateHeader(hdr)
+		So(err, ShouldBeNil)
+		switch fmeta.Type {
+		case fs.Type_File:
+			_, err = w.Write(ff.Body)
+		case fs.Type_Symlink:
+			_, err = w.Write([]byte(fmeta.Linkname))
+		}
+		So(err, ShouldBeNil)
+	}
+	So(zw.Close(), ShouldBeNil)
+	return buf.Bytes()
+}
+
+func scanZip(wareID api.WareID, blob []byte) (api.WareID, error) {
+	prefilterWareID, _, _, err := unpackZip(context.Background(), nilFS.New(), api.FilesetUnpackFilter_Lossless, wareID, bytes.NewReader(blob), rio.Monitor{})
+	return prefilterWareID, err
+}
+
+func TestZipMethods(t *testing.T) {
+	Convey("Zip compression methods", t, func() {
+		for _, fixture := range tests.AllFixtures {
+			Convey(fmt.Sprintf("- Fixture %q", fixture.Name), func() {
+				_, wareID := packFixture(context.Background(), fixture.Files)
+
+				Convey("packing with any method gives the same WareID, and unpacks to it", func() {
+					for _, method := range Methods {
+						blob, wareID2 := packFixture(WithMethod(context.Background(), method), fixture.Files)
+						So(wareID2, ShouldResemble, wareID)
+						zr, err := zip.NewReader(bytes.NewReader(blob), int64(len(blob)))
+						So(err, ShouldBeNil)
+						for _, zf := range zr.File {
+							if zf.Mode().IsRegular() {
+								So(zf.Method, ShouldEqual, method.zipMethod())
+							}
+						}
+						wareID3, err := scanZip(wareID, blob)
+						So(err, ShouldBeNil)
+						So(wareID3, ShouldResemble, wareID)
+					}
+				})
+
+				Convey("zips compressed with zstd unpack to the same WareID", func() {
+					blob := writeFixtureWithMethod(fixture.Files, zipMethodZstd, func(w io.Writer) (io.WriteCloser, error) {
+						return zstd.NewWriter(w)
+					})
+					wareID2, err := scanZip(wareID, blob)
+					So(err, ShouldBeNil)
+					So(wareID2, ShouldResemble, wareID)
+				})
+			})
+		}
+
+		Convey("Zips compressed with an unknown method are rejected", func() {
+			blob := writeFixtureWithMethod(tests.FixtureAlpha, 99, func(w io.Writer) (io.WriteCloser, error) {
+				return nopWriteCloser{w}, nil
+			})
+			_, err := scanZip(api.WareID{PackType, "-"}, blob)
+			So(Category(err), ShouldEqual, rio.ErrWareCorrupt)
+		})
+	})
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,66 @@
+package ziptrans
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+)
+
+/*
+	Method selects the compression method files are packed with.
+
+	The default, Method_Deflate, is what every zip reader understands.
+	Method_Store doesn't compress at all: it's the fastest to pack and
+	unpack, and the right choice for contents that are already compressed
+	(jars of jars, model weights, and so on).
+
+	The method only changes the bytes of the zip, never the WareID.
+	(Zstd, method 93, can be unpacked; but it's not packed, since few
+	zip readers understand it.)
+*/
+type Method string
+
+const (
+	Method_Deflate Method = "deflate"
+	Method_Store   Method = "store"
+)
+
+// All the methods supported for packing, default first.
+var Methods = []Method{
+	Method_Deflate,
+	Method_Store,
+}
+
+func ParseMethod(s string) (Method, error) {
+	for _, m := range Methods {
+		if string(m) == s {
+			return m, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported zip compression method %q", s)
+}
+
+func (m Method) zipMethod() uint16 {
+	switch m {
+	case Method_Store:
+		return zip.Store
+	default:
+		return zip.Deflate
+	}
+}
+
+type methodCtxKey struct{}
+
+// Returns a context asking zip packs to use the given compression method.
+func WithMethod(ctx context.Context, m Method) context.Context {
+	return context.WithValue(ctx, methodCtxKey{}, m)
+}
+
+// Returns the compression method carried by the context, or Method_Deflate.
+func GetMethod(ctx context.Context) Method {
+	m, ok := ctx.Value(methodCtxKey{}).(Method)
+	if !ok {
+		return Method_Deflate
+	}
+	return m
+}
@@ -2,25 +2,27 @@ package ziptrans
 
 import (
 	"archive/zip"
+	"compress/flate"
 	"context"
-	"crypto/sha512"
 	"io"
-
-	"github.com/polydawn/refmt/misc"
+	"io/ioutil"
 
 	api "github.com/polydawn/go-timeless-api"
 	"github.com/polydawn/go-timeless-api/rio"
 	"github.com/polydawn/rio/fs"
 	"github.com/polydawn/rio/fs/osfs"
 	"github.com/polydawn/rio/fsOp"
+	"github.com/polydawn/rio/lib/treewalk"
 	"github.com/polydawn/rio/transmat/mixins/filters"
 	"github.com/polydawn/rio/transmat/mixins/fshash"
+	"github.com/polydawn/rio/transmat/mixins/statcache"
 	"github.com/polydawn/rio/transmat/util"
 	. "github.com/warpfork/go-errcat"
 )
 
 var (
-	_ rio.PackFunc = Pack
+	_ rio.PackFunc         = Pack
+	_ util.PackRecordsFunc = PackRecords
 )
 
 // Pack transmutes a defined fileset into a given warehouse.
@@ -31,7 +33,23 @@ func Pack(
 	filt api.FilesetPackFilter, // Filters we should apply while packing.
 	warehouseAddr api.WarehouseLocation, // Warehouse to save into (or blank to just scan).
 	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
-) (_ api.WareID, err error) {
+) (api.WareID, error) {
+	wareID, records, err := PackRecords(ctx, packType, pathStr, filt, warehouseAddr, mon)
+	if records != nil {
+		records.Close()
+	}
+	return wareID, err
+}
+
+// PackRecords is Pack, also returning the records of every entry packed.
+func PackRecords(
+	ctx context.Context, // Long-running call.  Cancellable.
+	packType api.PackType, // The name of pack format.
+	pathStr string, // The fileset to scan and pack (absolute path).
+	filt api.FilesetPackFilter, // Filters we should apply while packing.
+	warehouseAddr api.WarehouseLocation, // Warehouse to save into (or blank to just scan).
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, _ fshash.Bucket, err error) {
 	if mon.Chan != nil {
 		defer close(mon.Chan)
 	}
@@ -39,14 +57,14 @@ func Pack(
 
 	// Sanitize arguments.
 	if packType != PackType {
-		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, packType)
+		return api.WareID{}, nil, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, packType)
 	}
 	if !filt.IsComplete() {
-		return api.WareID{}, Errorf(rio.ErrUsage, "filters must be completely specified")
+		return api.WareID{}, nil, Errorf(rio.ErrUsage, "filters must be completely specified")
 	}
 	path, err := fs.ParseAbsolutePath(pathStr)
 	if err != nil {
-		return api.WareID{}, Errorf(rio.ErrUsage, "pack must be called with absolute path: %s", err)
+		return api.WareID{}, nil, Errorf(rio.ErrUsage, "pack must be called with absolute path: %s", err)
 	}
 
 	// Short-circuit exit if the path does not exist.
@@ -58,115 +76,199 @@ func Pack(
 	case nil:
 		// pass
 	case fs.ErrNotExists:
-		return api.WareID{PackType, ""}, nil
+		return api.WareID{PackType, ""}, nil, nil
 	default:
-		return api.WareID{}, Errorf(rio.ErrPackInvalid, "cannot read path for packing: %s", err)
+		return api.WareID{}, nil, Errorf(rio.ErrPackInvalid, "cannot read path for packing: %s", err)
+	}
+
+	// Gather path filters: any given with the context, plus the fileset's own ignore file.
+	pathFilt, err := filters.GetPathFilter(ctx).WithIgnoreFile(afs)
+	if err != nil {
+		return api.WareID{}, nil, err
 	}
 
 	// Connect to warehouse, and get write controller opened.
-	wc, err := util.OpenWriteController(warehouseAddr, packType, mon)
+	wc, err := util.OpenWriteController(ctx, warehouseAddr, packType, mon)
 	if err != nil {
-		return api.WareID{}, err
+		return api.WareID{}, nil, err
 	}
 	defer wc.Close()
 
+	// Open the stat cache, if asked for.
+	statCache := statcache.FromContext(ctx, path)
+
+	// The entries are those of the fileset.
+	walk := walkFileset(afs, filt, pathFilt, filters.GetIDMap(ctx))
+
+	// With no warehouse, only the hash matters: skip building the zip at all.
+	if warehouseAddr == "" {
+		wareID, records, err := packZip(ctx, walk, statCache, nil)
+		if err != nil {
+			return wareID, nil, err
+		}
+		statCache.Save() // only an optimization; not worth failing the pack for.
+		if err := wc.Commit(wareID); err != nil {
+			records.Close()
+			return wareID, nil, err
+		}
+		return wareID, records, nil
+	}
+
 	// Construct zip writer.
-	zipWriter := zip.NewWriter(wc)
+	zipWriter := newZipWriter(wc)
 
 	// Scan and zip!
-	wareID, err := packZip(ctx, afs, filt, zipWriter)
+	wareID, records, err := packZip(ctx, walk, statCache, zipWriter)
 	if err != nil {
-		return wareID, err
+		return wareID, nil, err
 	}
 	// Close all the intermediate writer layers to ensure they've flushed.
 	err = zipWriter.Close()
 	if err != nil {
-		return wareID, err
+		return wareID, nil, err
 	}
+	statCache.Save() // only an optimization; not worth failing the pack for.
 
 	// If we made it all the way with no errors, commit.
 	//  (Otherwise, the write controller will be closed by default by our defers.)
-	return wareID, wc.Commit(wareID)
+	if err := wc.Commit(wareID); err != nil {
+		records.Close()
+		return wareID, nil, err
+	}
+	return wareID, records, nil
 }
 
-func packZip(
-	ctx context.Context,
+/*
+	Returns a zip writer.
+	The deflate level is pinned, as is everything in the entry headers (see
+	MetadataToZipHdr), so the same fileset always packs to the same blob.
+*/
+func newZipWriter(w io.Writer) *zip.Writer {
+	zipWriter := zip.NewWriter(w)
+	zipWriter.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, 5) // archive/zip's default level; pinned so it can't drift.
+	})
+	return zipWriter
+}
+
+// Returns the walk of a fileset on disk, for packZip.
+func walkFileset(
 	afs fs.FS,
 	filt api.FilesetPackFilter,
-	zw *zip.Writer,
-) (api.WareID, error) {
-	// Allocate bucket for keeping each metadata entry and content hash;
-	// the full tree hash will be computed from this at the end.
-	bucket := &fshash.MemoryBucket{}
+	pathFilt filters.PathFilter,
+	idmap filters.IDMap,
+) func(ctx context.Context, put func(*fs.Metadata, io.ReadCloser) error) error {
+	return func(ctx context.Context, put func(*fs.Metadata, io.ReadCloser) error) error {
+		put = pathFilt.PruneDirs(put)
+		return fs.Walk(afs, func(filenode *fs.FilewalkNode) error {
+			if filenode.Err != nil {
+				return filenode.Err
+			}
 
-	// Walk the filesystem, emitting entries and filling the bucket as we go.
-	zipHeader := &zip.FileHeader{}
-	preVisit := func(filenode *fs.FilewalkNode) error {
-		if filenode.Err != nil {
-			return filenode.Err
-		}
+			// Consider cancellation.
+			if ctx.Err() != nil {
+				return Errorf(rio.ErrCancelled, "cancelled")
+			}
 
-		// Consider cancellation.
-		if ctx.Err() != nil {
-			return Errorf(rio.ErrCancelled, "cancelled")
-		}
+			// Skip anything the path filters exclude (and everything in it, for dirs).
+			if isDir := filenode.Info.Type == fs.Type_Dir; pathFilt.Excluded(filenode.Info.Name, isDir) {
+				if isDir {
+					return treewalk.SkipNode
+				}
+				return nil
+			}
 
-		// Open file.
-		fmeta, file, err := fsOp.ScanFile(afs, filenode.Info.Name) // FIXME : we already have the full metadata loaded; give ScanFile option to accept it!
-		if err != nil {
-			return err
-		}
+			// Open file.
+			fmeta, file, err := fsOp.ScanFile(afs, filenode.Info.Name) // FIXME : we already have the full metadata loaded; give ScanFile option to accept it!
+			if err != nil {
+				return err
+			}
 
-		// Apply filters.
-		//  The filter may reject things by returning an error;
-		//   or, instruct us to ignore things by setting the type to invalid.
-		if err := filters.ApplyPackFilter(filt, fmeta); err != nil {
-			return err
-		}
-		if fmeta.Type == fs.Type_Invalid {
-			return nil // skip it and continue the walk
-		}
+			// Apply filters.
+			//  The filter may reject things by returning an error;
+			//   or, instruct us to ignore things by setting the type to invalid.
+			if err := filters.ApplyPackFilter(filt, idmap, fmeta); err != nil {
+				if file != nil {
+					file.Close()
+				}
+				return err
+			}
+			if fmeta.Type == fs.Type_Invalid {
+				return nil // skip it and continue the walk
+			}
 
+			return put(fmeta, file)
+		}, nil)
+	}
+}
+
+func packZip(
+	ctx context.Context,
+	walk func(ctx context.Context, put func(*fs.Metadata, io.ReadCloser) error) error,
+	statCache *statcache.Cache, // may be nil.
+	zw *zip.Writer, // may be nil, if only hashing.
+) (api.WareID, fshash.Bucket, error) {
+	// Allocate bucket for keeping each metadata entry and content hash;
+	// the full tree hash will be computed from this at the end.
+	bucket := &fshash.DiskBucket{}
+
+	// Hash with whichever algorithm was asked for.
+	alg := fshash.GetAlgorithm(ctx)
+
+	// Compress with whichever method was asked for.
+	method := GetMethod(ctx)
+
+	// Run the walk, emitting entries and filling the bucket as we go.
+	//  The walk and the writing run in a pipeline, so files can be read and
+	//  hashed ahead on other cores; the entries are still written in order.
+	write := func(entry *util.PackEntry) error {
 		// Flip our metadata to zip header format, and flush it.
-		zipHeader = new(zip.FileHeader)
-		MetadataToZipHdr(fmeta, zipHeader)
+		fmeta := entry.Metadata
+		var fw io.Writer = ioutil.Discard
+		if zw != nil {
+			zipHeader := new(zip.FileHeader)
+			MetadataToZipHdr(fmeta, zipHeader)
+			zipHeader.Method = method.zipMethod()
 
-		fw, err := zw.CreateHeader(zipHeader)
-		if err != nil {
-			return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+			var err error
+			fw, err = zw.CreateHeader(zipHeader)
+			if err != nil {
+				return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+			}
 		}
 
-		// If it's a file, stream the body into the file while hashing; for all,
-		//  record the metadata in the bucket for the total hash.
-		if file == nil && fmeta.Type == fs.Type_Symlink {
-			hasher := sha512.New384()
+		// If it's a file, stream the body into the file (hashing as we go, if not
+		//  already done); for all, record the metadata in the bucket for the total hash.
+		//  (If only hashing, there's no body, but files still have their hash.)
+		body := entry.Body()
+		if body == nil && fmeta.Type == fs.Type_Symlink {
+			hasher := alg.New()
 			tee := io.MultiWriter(fw, hasher)
 			_, err := tee.Write([]byte(fmeta.Linkname))
 			if err != nil {
 				return err
 			}
 			bucket.AddRecord(*fmeta, hasher.Sum(nil))
-		} else if file == nil {
+		} else if body == nil {
 			fw.Write([]byte{})
-			bucket.AddRecord(*fmeta, nil)
+			bucket.AddRecord(*fmeta, entry.ContentHash())
 		} else {
-			defer file.Close()
-			hasher := sha512.New384()
-			tee := io.MultiWriter(fw, hasher)
-			_, err := io.Copy(tee, file)
+			_, err := io.Copy(fw, body)
 			if err != nil {
 				return err
 			}
-			bucket.AddRecord(*fmeta, hasher.Sum(nil))
+			bucket.AddRecord(*fmeta, entry.ContentHash())
 		}
 
 		return nil
 	}
-	if err := fs.Walk(afs, preVisit, nil); err != nil {
-		return api.WareID{}, err
+	pipeline := util.PackPipeline{Algorithm: alg, HashOnly: zw == nil, StatCache: statCache}
+	if err := pipeline.Run(ctx, walk, write); err != nil {
+		bucket.Close()
+		return api.WareID{}, nil, err
 	}
 
 	// Hash the thing!
-	hash := fshash.HashBucket(bucket, sha512.New384)
-	return api.WareID{"zip", misc.Base58Encode(hash)}, nil
+	hash := fshash.HashBucket(bucket, alg.New)
+	return api.WareID{"zip", alg.WareHash(hash)}, bucket, nil
 }
@@ -4,12 +4,10 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
-	"crypto/sha512"
 	"fmt"
 	"io"
 	"strings"
 
-	"github.com/polydawn/refmt/misc"
 	. "github.com/warpfork/go-errcat"
 
 	api "github.com/polydawn/go-timeless-api"
@@ -20,6 +18,7 @@ import (
 	"github.com/polydawn/rio/transmat/mixins/buffer"
 	"github.com/polydawn/rio/transmat/mixins/filters"
 	"github.com/polydawn/rio/transmat/mixins/fshash"
+	"github.com/polydawn/rio/transmat/mixins/limits"
 	"github.com/polydawn/rio/transmat/mixins/log"
 	"github.com/polydawn/rio/transmat/util"
 )
@@ -34,28 +33,50 @@ func unpackZip(
 ) (
 	prefilterWareID api.WareID,
 	actualWareID api.WareID,
+	records fshash.Bucket,
 	err error,
 ) {
 	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
 
+	// Hash with the algorithm the ware's hash says it was made with.
+	alg, err := fshash.AlgorithmForWare(ctx, archiveWareID.Hash)
+	if err != nil {
+		return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrUsage, "%s", err)
+	}
+
 	readerAt, closer, err := buffer.SectionReader(ctx, archiveWareID, reader, mon)
 	if err != nil {
-		return api.WareID{}, api.WareID{}, err
+		return api.WareID{}, api.WareID{}, nil, err
 	}
 	defer closer.Close()
 
+	// Count everything against the limits, if any.
+	tracker := limits.NewTracker(ctx)
+	tracker.WareSize(readerAt.Size())
+
 	// Convert the raw byte reader to a zip stream.
 	zr, err := zip.NewReader(readerAt, readerAt.Size())
 	if err != nil {
-		return api.WareID{}, api.WareID{}, err
+		return api.WareID{}, api.WareID{}, nil, err
 	}
+	zr.RegisterDecompressor(zipMethodZstd, decompressZstd)
 
 	// Allocate bucket for keeping each metadata entry and content hash;
 	// the full tree hash will be computed from this at the end.
 	// We keep one for the raw ware data as we consume it, so we can verify no fuckery;
 	// we keep a second, separate one for the filtered data, which will compute a different hash.
-	prefilterBucket := &fshash.MemoryBucket{}
-	filteredBucket := &fshash.MemoryBucket{}
+	// Only the filtered one is returned; and that, only if all goes well.
+	prefilterBucket := &fshash.DiskBucket{}
+	filteredBucket := &fshash.DiskBucket{}
+	defer prefilterBucket.Close()
+	defer func() {
+		if err != nil {
+			filteredBucket.Close()
+		}
+	}()
+
+	// Any uid/gid remapping is applied along with the filters.
+	idmap := filters.GetIDMap(ctx)
 
 	// Also allocate a map for keeping records of which dirs we've created.
 	dirs := map[fs.RelPath]struct{}{}
@@ -69,19 +90,22 @@ func unpackZip(
 			break // sucess!  end of archive.
 		}
 		if err != nil {
-			return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt zip: %s", err)
+			return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrWareCorrupt, "corrupt zip: %s", err)
 		}
 		if ctx.Err() != nil {
-			return api.WareID{}, api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+			return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrCancelled, "cancelled")
 		}
 
 		// Reshuffle metainfo to our default format.
 		err := ZipHdrToMetadata(&zf.FileHeader, &fmeta)
 		if err != nil {
-			return api.WareID{}, api.WareID{}, err
+			return api.WareID{}, api.WareID{}, nil, err
 		}
 		if strings.HasPrefix(fmeta.Name.String(), "..") {
-			return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt zip: paths that use '../' to leave the base dir are invalid")
+			return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrWareCorrupt, "corrupt zip: paths that use '../' to leave the base dir are invalid")
+		}
+		if err := tracker.Entry(&fmeta); err != nil {
+			return api.WareID{}, api.WareID{}, nil, err
 		}
 
 		// Infer parents, if necessary.  The zip format should not allow implicit dirs, but we allow
@@ -96,11 +120,13 @@ func unpackZip(
 			conjuredFmeta := fshash.DefaultDirMetadata()
 			conjuredFmeta.Name = parent
 			prefilterBucket.AddRecord(conjuredFmeta, nil)
-			filters.ApplyUnpackFilter(filt, &conjuredFmeta)
+			if err := filters.ApplyUnpackFilter(filt, idmap, &conjuredFmeta); err != nil {
+				return api.WareID{}, api.WareID{}, nil, err
+			}
 			filteredBucket.AddRecord(conjuredFmeta, nil)
 			dirs[conjuredFmeta.Name] = struct{}{}
 			if err := fsOp.PlaceFile(afs, conjuredFmeta, nil, false); err != nil {
-				return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+				return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 			}
 		}
 
@@ -110,8 +136,8 @@ func unpackZip(
 		filteredFmeta := fmeta
 		//  The filter may reject things by returning an error;
 		//   or, instruct us to ignore things by setting the type to invalid.
-		if err := filters.ApplyUnpackFilter(filt, &filteredFmeta); err != nil {
-			return api.WareID{}, api.WareID{}, err
+		if err := filters.ApplyUnpackFilter(filt, idmap, &filteredFmeta); err != nil {
+			return api.WareID{}, api.WareID{}, nil, err
 		}
 		if fmeta.Type == fs.Type_Invalid {
 			// skip placing that file and continue processing...
@@ -124,42 +150,51 @@ func unpackZip(
 		// Place the file.
 		switch fmeta.Type {
 		case fs.Type_File:
-			r, err := zf.Open()
+			r, err := openZipFile(zf)
 			if err != nil {
-				return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "error while unpacking: %s", err)
+				return api.WareID{}, api.WareID{}, nil, err
 			}
-			reader := &util.HashingReader{R: r, Hasher: sha512.New384()}
+			reader := &util.HashingReader{R: tracker.Body(&fmeta, r), Hasher: alg.New()}
 			if err = fsOp.PlaceFile(afs, filteredFmeta, reader, false); err != nil {
-				return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+				if err := tracker.Err(); err != nil {
+					return api.WareID{}, api.WareID{}, nil, err
+				}
+				return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 			}
 			prefilterBucket.AddRecord(fmeta, reader.Hasher.Sum(nil))
 			filteredBucket.AddRecord(filteredFmeta, reader.Hasher.Sum(nil))
 		case fs.Type_Symlink:
 			buf := new(bytes.Buffer)
-			r, err := zf.Open()
+			r, err := openZipFile(zf)
 			if err != nil {
-				return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "error while unpacking: %s", err)
+				return api.WareID{}, api.WareID{}, nil, err
 			}
 			_, err = buf.ReadFrom(r)
 			if err != nil {
-				return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "error while unpacking: %s", err)
+				return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrWareCorrupt, "error while unpacking: %s", err)
 			}
 			fmeta.Linkname = buf.String()
 			filteredFmeta.Linkname = fmeta.Linkname
 			if err := fsOp.PlaceFile(afs, filteredFmeta, nil, false); err != nil {
-				return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+				return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 			}
 			prefilterBucket.AddRecord(fmeta, nil)
 			filteredBucket.AddRecord(filteredFmeta, nil)
 		case fs.Type_Dir:
 			dirs[fmeta.Name] = struct{}{}
 			if err := fsOp.PlaceFile(afs, filteredFmeta, nil, false); err != nil {
-				return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+				return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+			}
+			if prefilterBucket.HasRecord(fmeta) {
+				// A dir inferred earlier, now seen: as for tars, update it.
+				prefilterBucket.UpdateRecord(fmeta, nil)
+				filteredBucket.UpdateRecord(filteredFmeta, nil)
+			} else {
+				prefilterBucket.AddRecord(fmeta, nil)
+				filteredBucket.AddRecord(filteredFmeta, nil)
 			}
-			prefilterBucket.AddRecord(fmeta, nil)
-			filteredBucket.AddRecord(filteredFmeta, nil)
 		default:
-			return api.WareID{}, api.WareID{}, Errorf(rio.ErrPackInvalid, "zip pack does not support files of type %v", fmeta.Type)
+			return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrPackInvalid, "zip pack does not support files of type %v", fmeta.Type)
 		}
 	}
 
@@ -172,13 +207,13 @@ func unpackZip(
 		}
 		return afs.SetTimesNano(record.Metadata.Name, record.Metadata.Mtime, fs.DefaultTime)
 	}); err != nil {
-		return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+		return api.WareID{}, api.WareID{}, nil, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 	}
 
 	// Hash the thing!
-	prefilterHash := misc.Base58Encode(fshash.HashBucket(prefilterBucket, sha512.New384))
-	filteredHash := misc.Base58Encode(fshash.HashBucket(filteredBucket, sha512.New384))
-	if !filt.Altering() {
+	prefilterHash := alg.WareHash(fshash.HashBucket(prefilterBucket, alg.New))
+	filteredHash := alg.WareHash(fshash.HashBucket(filteredBucket, alg.New))
+	if !filt.Altering() && idmap.IsIdentity() {
 		// Paranoia check for new feature.
 		//  When paranoia reduced, replace with skipping the double computation.
 		if prefilterHash != filteredHash {
@@ -186,5 +221,17 @@ func unpackZip(
 		}
 	}
 
-	return api.WareID{"zip", prefilterHash}, api.WareID{"zip", filteredHash}, nil
+	return api.WareID{"zip", prefilterHash}, api.WareID{"zip", filteredHash}, filteredBucket, nil
+}
+
+// Opens a file in the zip, with a clear error if it's compressed with a method we can't read.
+func openZipFile(zf *zip.File) (io.ReadCloser, error) {
+	r, err := zf.Open()
+	switch {
+	case err == zip.ErrAlgorithm:
+		return nil, Errorf(rio.ErrWareCorrupt, "cannot unpack %q: unsupported zip compression method %d", zf.Name, zf.Method)
+	case err != nil:
+		return nil, Errorf(rio.ErrWareCorrupt, "error while unpacking: %s", err)
+	}
+	return r, nil
 }
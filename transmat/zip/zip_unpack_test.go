@@ -1,6 +1,7 @@
 package ziptrans
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
@@ -12,10 +13,14 @@ import (
 	api "github.com/polydawn/go-timeless-api"
 	"github.com/polydawn/go-timeless-api/rio"
 	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/fs/faultfs"
+	"github.com/polydawn/rio/fs/memfs"
 	"github.com/polydawn/rio/fs/osfs"
 	"github.com/polydawn/rio/fsOp"
 	"github.com/polydawn/rio/testutil"
+	"github.com/polydawn/rio/transmat/mixins/cache"
 	"github.com/polydawn/rio/transmat/mixins/tests"
+	"github.com/polydawn/rio/transmat/util"
 )
 
 func TestZipUnpack(t *testing.T) {
@@ -27,6 +32,13 @@ func TestZipUnpack(t *testing.T) {
 					tests.CheckRoundTrip(PackType, Pack, Unpack, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
 					// Following tests could be done in all modes, but isn't about warehouses, so would be redundant to do so.
 					tests.CheckCachePopulation(PackType, Pack, Unpack, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+					tests.CheckCacheDedup(PackType, Pack, Unpack, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+					tests.CheckUnpackMtimeNow(PackType, Pack, Unpack, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+					tests.CheckUnpackSubpath(PackType, Pack, Unpack, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+					tests.CheckIDMap(PackType, Pack, Unpack, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+					tests.CheckHashAlgorithms(PackType, Pack, Unpack, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+					tests.CheckUnpackLimits(PackType, Pack, Unpack, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+					tests.CheckUnpackFaults(PackType, Pack, unpackWithFaults, cache.Lrn2Cache, api.WarehouseLocation(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
 				})
 			})
 			Convey("Using kvfs warehouse, in *non*-content-addressable mode:", func() {
@@ -38,6 +50,28 @@ func TestZipUnpack(t *testing.T) {
 	)
 }
 
+// Unpacks straight into the path, through a faultfs with the faults given; no cache.
+func unpackWithFaults(faults ...faultfs.Fault) rio.UnpackFunc {
+	return func(
+		ctx context.Context,
+		wareID api.WareID,
+		path string,
+		filt api.FilesetUnpackFilter,
+		_ rio.PlacementMode,
+		warehouses []api.WarehouseLocation,
+		mon rio.Monitor,
+	) (api.WareID, error) {
+		reader, err := util.PickReader(ctx, wareID, warehouses, false, mon)
+		if err != nil {
+			return api.WareID{}, err
+		}
+		defer reader.Close()
+		afs := faultfs.New(osfs.New(fs.MustAbsolutePath(path)), faults...)
+		_, unpackWareID, _, err := unpackZip(ctx, afs, filt, wareID, reader, mon)
+		return unpackWareID, err
+	}
+}
+
 /*
 	Tests against pre-generated, known fixtures of zip binary blobs.
 
@@ -122,3 +156,30 @@ func TestZipFixtureUnpack(t *testing.T) {
 		}),
 	)
 }
+
+func TestZipUnpackInMemory(t *testing.T) {
+	Convey("Zip unpack into an in-memory filesystem (no root, no tmpdir)", t, func() {
+		for _, fixture := range tests.AllFixtures {
+			Convey(fmt.Sprintf("- Fixture %q", fixture.Name), FailureContinues, func() {
+				blob, wareID := packFixture(context.Background(), fixture.Files)
+				afs := memfs.New()
+				prefilterWareID, _, _, err := unpackZip(context.Background(), afs, api.FilesetUnpackFilter_Lossless, wareID, bytes.NewReader(blob), rio.Monitor{})
+				So(err, ShouldBeNil)
+				So(prefilterWareID, ShouldResemble, wareID)
+
+				for _, file := range fixture.Files {
+					fmeta, reader, err := fsOp.ScanFile(afs, file.Metadata.Name)
+					So(err, ShouldBeNil)
+					fmeta.Mtime = fmeta.Mtime.UTC()
+					So(*fmeta, ShouldResemble, file.Metadata)
+					if file.Metadata.Type == fs.Type_File {
+						body, err := ioutil.ReadAll(reader)
+						So(err, ShouldBeNil)
+						So(string(body), ShouldResemble, string(file.Body))
+						So(reader.Close(), ShouldBeNil)
+					}
+				}
+			})
+		}
+	})
+}
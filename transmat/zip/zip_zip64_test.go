@@ -0,0 +1,142 @@
+package ziptrans
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/polydawn/rio/fs"
+	"github.com/polydawn/rio/testutil"
+	"github.com/polydawn/rio/transmat/mixins/tests"
+)
+
+func TestZip64(t *testing.T) {
+	Convey("Zip64", t, func() {
+		Convey("Zips of more than 65535 entries round-trip", func() {
+			const n = 70000
+			files := []tests.FixtureFile{
+				{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: fs.DefaultTime}, nil},
+			}
+			for i := 0; i < n; i++ {
+				files = append(files, tests.FixtureFile{fs.Metadata{Name: fs.MustRelPath(fmt.Sprintf("./f%05d", i)), Type: fs.Type_File, Perms: 0644, Mtime: fs.DefaultTime, Size: 1}, []byte{byte(i)}})
+			}
+			blob, wareID := packFixture(WithMethod(context.Background(), Method_Store), files)
+
+			So(bytes.Contains(blob, []byte("PK\x06\x06")), ShouldBeTrue) // the zip64 end of central directory.
+			zr, err := zip.NewReader(bytes.NewReader(blob), int64(len(blob)))
+			So(err, ShouldBeNil)
+			So(zr.File, ShouldHaveLength, n+1)
+
+			wareID2, err := scanZip(wareID, blob)
+			So(err, ShouldBeNil)
+			So(wareID2, ShouldResemble, wareID)
+		})
+
+		Convey("Zips of files over 4GiB round-trip", testutil.Requires(testutil.RequiresLongRun, func() {
+			// A file of zeros, but for its end; stored, into a buffer that doesn't keep the zeros.
+			const size = 1<<32 + 1<<20
+			files := []tests.FixtureFile{
+				{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: fs.DefaultTime}, nil},
+				{fs.Metadata{Name: fs.MustRelPath("./big"), Type: fs.Type_File, Perms: 0644, Mtime: fs.DefaultTime, Size: size}, nil},
+			}
+			walk := func(ctx context.Context, put func(*fs.Metadata, io.ReadCloser) error) error {
+				if err := put(&files[0].Metadata, nil); err != nil {
+					return err
+				}
+				body := io.MultiReader(io.LimitReader(zeros{}, size-3), bytes.NewReader([]byte("end")))
+				return put(&files[1].Metadata, ioutil.NopCloser(body))
+			}
+			buf := &sparseBuffer{chunks: map[int64][]byte{}}
+			zw := newZipWriter(buf)
+			_, _, err := packZip(WithMethod(context.Background(), Method_Store), walk, nil, zw)
+			So(err, ShouldBeNil)
+			So(zw.Close(), ShouldBeNil)
+
+			// The zip reader checks sizes and CRC when the file's read to the end.
+			zr, err := zip.NewReader(buf, buf.size)
+			So(err, ShouldBeNil)
+			So(zr.File, ShouldHaveLength, 2)
+			zf := zr.File[1]
+			So(zf.UncompressedSize64, ShouldEqual, uint64(size))
+			var fmeta fs.Metadata
+			So(ZipHdrToMetadata(&zf.FileHeader, &fmeta), ShouldBeNil)
+			So(fmeta.Size, ShouldEqual, int64(size))
+			r, err := openZipFile(zf)
+			So(err, ShouldBeNil)
+			n, err := io.Copy(ioutil.Discard, r)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, int64(size))
+		}))
+	})
+}
+
+type zeros struct{}
+
+func (zeros) Read(bs []byte) (int, error) {
+	for i := range bs {
+		bs[i] = 0
+	}
+	return len(bs), nil
+}
+
+// Holds the bytes written to it in chunks, except for chunks of only zeros:
+//  so, it can hold a stored zip of a huge file of zeros, in little memory.
+type sparseBuffer struct {
+	chunks map[int64][]byte
+	size   int64
+}
+
+const sparseChunkSize = 1 << 16
+
+func (b *sparseBuffer) Write(bs []byte) (int, error) {
+	n := len(bs)
+	for len(bs) > 0 {
+		idx, off := b.size/sparseChunkSize, int(b.size%sparseChunkSize)
+		k := sparseChunkSize - off
+		if k > len(bs) {
+			k = len(bs)
+		}
+		chunk := b.chunks[idx]
+		if chunk == nil && !bytes.Equal(bs[:k], make([]byte, k)) {
+			chunk = make([]byte, sparseChunkSize)
+			b.chunks[idx] = chunk
+		}
+		if chunk != nil {
+			copy(chunk[off:], bs[:k])
+		}
+		b.size += int64(k)
+		bs = bs[k:]
+	}
+	return n, nil
+}
+
+func (b *sparseBuffer) ReadAt(bs []byte, off int64) (int, error) {
+	n := 0
+	for n < len(bs) && off < b.size {
+		idx, o := off/sparseChunkSize, int(off%sparseChunkSize)
+		k := sparseChunkSize - o
+		if k > len(bs)-n {
+			k = len(bs) - n
+		}
+		if int64(k) > b.size-off {
+			k = int(b.size - off)
+		}
+		if chunk := b.chunks[idx]; chunk != nil {
+			copy(bs[n:n+k], chunk[o:o+k])
+		} else {
+			copy(bs[n:n+k], make([]byte, k))
+		}
+		n += k
+		off += int64(k)
+	}
+	if n < len(bs) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -1,6 +1,8 @@
 package util
 
 import (
+	"strings"
+
 	api "github.com/polydawn/go-timeless-api"
 )
 
@@ -15,9 +17,16 @@ import (
 	invalid semantically anyway, but we're not going to error about that here.)
 	A hash of empty string will result in a return of `"---", "---", "-"` (in other
 	words, as if the hash had been padded to a min of 7 characts, all dashes).
+
+	If the hash names its algorithm (as "<algorithm>-<base58>"), the chunks
+	are taken from the base58 part after the last dash, so that wares of
+	every algorithm are spread out the same.
 */
 func ChunkifyHash(wareID api.WareID) (string, string, string) {
 	hash := wareID.Hash
+	if i := strings.LastIndexByte(hash, '-'); i >= 0 {
+		hash = hash[i+1:]
+	}
 	if len(hash) < 7 {
 		hash = hash + "-------"[:7-len(hash)]
 	}